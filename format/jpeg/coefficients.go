@@ -0,0 +1,609 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"io"
+)
+
+// Block is an 8x8 block of quantized DCT coefficients, in natural (not
+// zig-zag) order.
+type Block [blockSize]int32
+
+// Component is a color component of an image decoded to DCT
+// coefficients.
+type Component struct {
+	// ID is the component identifier from the frame header.
+	ID uint8
+
+	// H and V are the horizontal and vertical sampling factors.
+	H, V int
+
+	// Quant is the index of the component's quantization table.
+	Quant int
+
+	// BlocksWide and BlocksHigh are the dimensions of the component in
+	// blocks, which always cover a whole number of MCUs.
+	BlocksWide, BlocksHigh int
+
+	// Blocks contains the component's blocks, from left to right and top
+	// to bottom.
+	Blocks []Block
+}
+
+// Coefficients is a JPEG image decoded to quantized DCT coefficients.
+// Unlike decoding and re-encoding the pixels, encoding the coefficients
+// doesn't lose any quality.
+type Coefficients struct {
+	// Width and Height are the dimensions of the image in pixels.
+	Width, Height int
+
+	// Components contains the image's color components.
+	Components []Component
+
+	// QuantTables contains the quantization tables, in natural order.
+	QuantTables [maxTq + 1]Block
+
+	// AdobeTransform is the color transform from the Adobe APP14 segment,
+	// or -1 if there is no such segment.
+	AdobeTransform int
+}
+
+// DecodeCoefficients reads a JPEG image from r and returns its quantized
+// DCT coefficients. Both sequential and progressive images are supported.
+func DecodeCoefficients(r io.Reader) (*Coefficients, error) {
+	d := &decoder{coeffsOnly: true}
+	if _, err := d.decode(r, false); err != nil {
+		return nil, err
+	}
+
+	c := &Coefficients{
+		Width:          d.width,
+		Height:         d.height,
+		Components:     make([]Component, d.nComp),
+		AdobeTransform: -1,
+	}
+	if d.adobeTransformValid {
+		c.AdobeTransform = int(d.adobeTransform)
+	}
+	for i := range c.QuantTables {
+		for zig, q := range d.quant[i] {
+			c.QuantTables[i][unzig[zig]] = q
+		}
+	}
+
+	for i := range c.Components {
+		comp := &d.comp[i]
+		c.Components[i] = Component{
+			ID:    comp.c,
+			H:     comp.h,
+			V:     comp.v,
+			Quant: int(comp.tq),
+		}
+	}
+
+	mxx, myy := c.mcus()
+	for i := range c.Components {
+		cc := &c.Components[i]
+		cc.BlocksWide, cc.BlocksHigh = mxx*cc.H, myy*cc.V
+
+		// Components without any scans are left empty.
+		cc.Blocks = make([]Block, cc.BlocksWide*cc.BlocksHigh)
+		for j, b := range d.progCoeffs[i] {
+			cc.Blocks[j] = Block(b)
+		}
+	}
+	return c, nil
+}
+
+// imageCoefficients converts m to quantized DCT coefficients using the
+// encoder's quantization tables. Color images are converted to YCbCr and
+// the chroma components are subsampled as specified.
+func (e *encoder) imageCoefficients(m image.Image, s Subsampling) *Coefficients {
+	bounds := m.Bounds()
+	c := &Coefficients{
+		Width:          bounds.Dx(),
+		Height:         bounds.Dy(),
+		AdobeTransform: -1,
+	}
+	for i := range e.quant {
+		for zig, q := range e.quant[i] {
+			c.QuantTables[i][unzig[zig]] = int32(q)
+		}
+	}
+
+	gray, _ := m.(*image.Gray)
+	if gray != nil {
+		c.Components = []Component{{ID: 1, H: 1, V: 1}}
+	} else {
+		h, v := s.lumaSampling()
+		c.Components = []Component{
+			{ID: 1, H: h, V: v, Quant: 0},
+			{ID: 2, H: 1, V: 1, Quant: 1},
+			{ID: 3, H: 1, V: 1, Quant: 1},
+		}
+	}
+	mxx, myy := c.mcus()
+	for i := range c.Components {
+		comp := &c.Components[i]
+		comp.BlocksWide, comp.BlocksHigh = mxx*comp.H, myy*comp.V
+		comp.Blocks = make([]Block, comp.BlocksWide*comp.BlocksHigh)
+	}
+
+	// quantize transforms b and stores it in component i at the given
+	// block coordinates.
+	quantize := func(b *block, i, bx, by int) {
+		comp := &c.Components[i]
+		q := &e.quant[comp.Quant]
+		fdct(b)
+		dst := &comp.Blocks[by*comp.BlocksWide+bx]
+		for zig := 0; zig < blockSize; zig++ {
+			dst[unzig[zig]] = div(b[unzig[zig]], 8*int32(q[zig]))
+		}
+	}
+
+	var (
+		b      block
+		cb, cr [4]block
+	)
+	rgba, _ := m.(*image.RGBA)
+	ycbcr, _ := m.(*image.YCbCr)
+	luma := &c.Components[0]
+	for my := 0; my < myy; my++ {
+		for mx := 0; mx < mxx; mx++ {
+			for y := 0; y < luma.V; y++ {
+				for x := 0; x < luma.H; x++ {
+					bx, by := mx*luma.H+x, my*luma.V+y
+					p := bounds.Min.Add(image.Pt(8*bx, 8*by))
+					i := y*luma.H + x
+					switch {
+					case gray != nil:
+						grayToY(gray, p, &b)
+					case rgba != nil:
+						rgbaToYCbCr(rgba, p, &b, &cb[i], &cr[i])
+					case ycbcr != nil:
+						yCbCrToYCbCr(ycbcr, p, &b, &cb[i], &cr[i])
+					default:
+						toYCbCr(m, p, &b, &cb[i], &cr[i])
+					}
+					quantize(&b, 0, bx, by)
+				}
+			}
+			if gray == nil {
+				downsample(&b, &cb, luma.H, luma.V)
+				quantize(&b, 1, mx, my)
+				downsample(&b, &cr, luma.H, luma.V)
+				quantize(&b, 2, mx, my)
+			}
+		}
+	}
+	return c
+}
+
+// downsample averages the h by v blocks in src, from left to right and top
+// to bottom, into dst.
+func downsample(dst *block, src *[4]block, h, v int) {
+	n := int32(h * v)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			sum := int32(0)
+			for dy := 0; dy < v; dy++ {
+				for dx := 0; dx < h; dx++ {
+					sx, sy := x*h+dx, y*v+dy
+					sum += src[(sy/8)*h+sx/8][(sy%8)*8+sx%8]
+				}
+			}
+			dst[8*y+x] = (sum + n/2) / n
+		}
+	}
+}
+
+// maxSampling returns the maximum sampling factors of the components.
+func (c *Coefficients) maxSampling() (maxH, maxV int) {
+	for _, comp := range c.Components {
+		if comp.H > maxH {
+			maxH = comp.H
+		}
+		if comp.V > maxV {
+			maxV = comp.V
+		}
+	}
+	return
+}
+
+// mcus returns the number of MCUs across and down the image.
+func (c *Coefficients) mcus() (mxx, myy int) {
+	maxH, maxV := c.maxSampling()
+	return (c.Width + 8*maxH - 1) / (8 * maxH), (c.Height + 8*maxV - 1) / (8 * maxV)
+}
+
+// MCUSize returns the size of an MCU in pixels. Lossless crops must
+// start at a multiple of the MCU size.
+func (c *Coefficients) MCUSize() image.Point {
+	maxH, maxV := c.maxSampling()
+	return image.Pt(8*maxH, 8*maxV)
+}
+
+// Clone returns a deep copy of c.
+func (c *Coefficients) Clone() *Coefficients {
+	c2 := *c
+	c2.Components = make([]Component, len(c.Components))
+	for i, comp := range c.Components {
+		comp.Blocks = append([]Block(nil), comp.Blocks...)
+		c2.Components[i] = comp
+	}
+	return &c2
+}
+
+// clampCoefficient limits v to the range of AC coefficients that can be
+// encoded in an 8-bit JPEG image.
+func clampCoefficient(v int32) int32 {
+	if v < -1023 {
+		return -1023
+	}
+	if v > 1023 {
+		return 1023
+	}
+	return v
+}
+
+// clampDC limits v to the range of DC coefficients that can be encoded
+// in an 8-bit JPEG image.
+func clampDC(v int32) int32 {
+	if v < -1024 {
+		return -1024
+	}
+	if v > 1023 {
+		return 1023
+	}
+	return v
+}
+
+// writeCoefficients writes a block of quantized DCT coefficients using
+// the given Huffman tables, returning the DC value.
+func (e *encoder) writeCoefficients(b *Block, q quantIndex, prevDC int32) int32 {
+	// Emit the DC delta.
+	dc := clampDC(b[0])
+	e.emitHuffRLE(huffIndex(2*q+0), 0, dc-prevDC)
+	// Emit the AC components.
+	h, runLength := huffIndex(2*q+1), int32(0)
+	for zig := 1; zig < blockSize; zig++ {
+		ac := clampCoefficient(b[unzig[zig]])
+		if ac == 0 {
+			runLength++
+		} else {
+			for runLength > 15 {
+				e.emitHuff(h, 0xf0)
+				runLength -= 16
+			}
+			e.emitHuffRLE(h, runLength, ac)
+			runLength = 0
+		}
+	}
+	if runLength > 0 {
+		e.emitHuff(h, 0x00)
+	}
+	return dc
+}
+
+// emitEOBRun emits a run of blocks whose remaining coefficients in a
+// progressive scan are all zero.
+func (e *encoder) emitEOBRun(h huffIndex, eobRun *int32) {
+	if *eobRun == 0 {
+		return
+	}
+	var nBits uint32
+	if *eobRun < 0x100 {
+		nBits = uint32(bitCount[*eobRun]) - 1
+	} else {
+		nBits = 8 + uint32(bitCount[*eobRun>>8]) - 1
+	}
+	e.emitHuff(h, int32(nBits<<4))
+	if nBits > 0 {
+		e.emit(uint32(*eobRun)&(1<<nBits-1), nBits)
+	}
+	*eobRun = 0
+}
+
+// writeACBand writes the AC coefficients zs through ze, in zig-zag order,
+// of a block in a progressive scan.
+func (e *encoder) writeACBand(b *Block, h huffIndex, zs, ze int, eobRun *int32) {
+	runLength := int32(0)
+	for zig := zs; zig <= ze; zig++ {
+		ac := clampCoefficient(b[unzig[zig]])
+		if ac == 0 {
+			runLength++
+			continue
+		}
+		e.emitEOBRun(h, eobRun)
+		for runLength > 15 {
+			e.emitHuff(h, 0xf0)
+			runLength -= 16
+		}
+		e.emitHuffRLE(h, runLength, ac)
+		runLength = 0
+	}
+	if runLength > 0 {
+		*eobRun++
+		if *eobRun == 0x7fff {
+			e.emitEOBRun(h, eobRun)
+		}
+	}
+}
+
+// coefficientScan is a scan of some of the coefficients of some of the
+// components of an image.
+type coefficientScan struct {
+	// comps contains the indexes of the components in the scan.
+	comps []int
+	// zs and ze are the first and last coefficients in the scan, in
+	// zig-zag order.
+	zs, ze int
+}
+
+// tables returns the index of the Huffman tables for component i. The
+// first component uses the luminance tables.
+func coefficientTables(i int) quantIndex {
+	if i == 0 {
+		return quantIndexLuminance
+	}
+	return quantIndexChrominance
+}
+
+// writeCoefficientScan writes a scan of c. Scans of a single component
+// contain only the blocks inside the image, as specified in section
+// A.2.2. The scan is progressive unless it contains every coefficient.
+func (e *encoder) writeCoefficientScan(c *Coefficients, scan coefficientScan, restartInterval int) {
+	markerlen := 6 + 2*len(scan.comps)
+	e.writeMarkerHeader(sosMarker, markerlen)
+	e.writeByte(uint8(len(scan.comps)))
+	for _, i := range scan.comps {
+		e.writeByte(c.Components[i].ID)
+		if coefficientTables(i) == quantIndexLuminance {
+			e.writeByte(0x00)
+		} else {
+			e.writeByte(0x11)
+		}
+	}
+	e.write([]byte{uint8(scan.zs), uint8(scan.ze), 0x00})
+
+	var (
+		prevDC   [maxComponents]int32
+		eobRun   int32
+		units    int
+		restarts int
+	)
+	sequential := scan.zs == 0 && scan.ze == blockSize-1
+	acTable := huffIndex(2*coefficientTables(scan.comps[0]) + 1)
+
+	// writeUnit writes the blocks of component i at the given block
+	// coordinates, after a restart marker if one is due.
+	writeUnit := func(i, bx, by, w, h int) {
+		comp := &c.Components[i]
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				b := &comp.Blocks[(by+y)*comp.BlocksWide+bx+x]
+				switch {
+				case sequential:
+					prevDC[i] = e.writeCoefficients(b, coefficientTables(i), prevDC[i])
+				case scan.zs == 0:
+					dc := clampDC(b[0])
+					e.emitHuffRLE(huffIndex(2*coefficientTables(i)), 0, dc-prevDC[i])
+					prevDC[i] = dc
+				default:
+					e.writeACBand(b, acTable, scan.zs, scan.ze, &eobRun)
+				}
+			}
+		}
+	}
+	// restart writes a restart marker before every restartInterval units.
+	restart := func() {
+		if restartInterval > 0 && units > 0 && units%restartInterval == 0 {
+			e.emitEOBRun(acTable, &eobRun)
+			e.emit(0x7f, 7)
+			e.bits, e.nBits = 0, 0
+			e.write([]byte{0xff, rst0Marker + uint8(restarts%8)})
+			restarts++
+			prevDC = [maxComponents]int32{}
+		}
+		units++
+	}
+
+	if len(scan.comps) == 1 {
+		i := scan.comps[0]
+		comp := &c.Components[i]
+		maxH, maxV := c.maxSampling()
+		compW := (c.Width*comp.H + maxH - 1) / maxH
+		compH := (c.Height*comp.V + maxV - 1) / maxV
+		for by := 0; by < (compH+7)/8; by++ {
+			for bx := 0; bx < (compW+7)/8; bx++ {
+				restart()
+				writeUnit(i, bx, by, 1, 1)
+			}
+		}
+	} else {
+		mxx, myy := c.mcus()
+		for my := 0; my < myy; my++ {
+			for mx := 0; mx < mxx; mx++ {
+				restart()
+				for _, i := range scan.comps {
+					comp := &c.Components[i]
+					writeUnit(i, mx*comp.H, my*comp.V, comp.H, comp.V)
+				}
+			}
+		}
+	}
+	e.emitEOBRun(acTable, &eobRun)
+	// Pad the last byte with 1's.
+	e.emit(0x7f, 7)
+	e.bits, e.nBits = 0, 0
+}
+
+// coefficientScans returns the scans to write c with. Progressive images
+// send the DC coefficients first, then the low frequencies of the luma
+// component, the chroma components and finally the remaining luma
+// frequencies.
+func coefficientScans(c *Coefficients, progressive bool) (scans []coefficientScan) {
+	// Interleaved scans are limited to 10 blocks per MCU.
+	totalHV := 0
+	for _, comp := range c.Components {
+		totalHV += comp.H * comp.V
+	}
+	interleave := func(zs, ze int) {
+		if len(c.Components) > 1 && totalHV <= 10 {
+			scan := coefficientScan{comps: make([]int, len(c.Components)), zs: zs, ze: ze}
+			for i := range scan.comps {
+				scan.comps[i] = i
+			}
+			scans = append(scans, scan)
+		} else {
+			for i := range c.Components {
+				scans = append(scans, coefficientScan{comps: []int{i}, zs: zs, ze: ze})
+			}
+		}
+	}
+
+	if !progressive {
+		interleave(0, blockSize-1)
+		return
+	}
+
+	interleave(0, 0)
+	scans = append(scans, coefficientScan{comps: []int{0}, zs: 1, ze: 5})
+	for i := 1; i < len(c.Components); i++ {
+		scans = append(scans, coefficientScan{comps: []int{i}, zs: 1, ze: blockSize - 1})
+	}
+	scans = append(scans, coefficientScan{comps: []int{0}, zs: 6, ze: blockSize - 1})
+	return
+}
+
+// EncodeCoefficients writes the quantized DCT coefficients c to w. The
+// Quality and Subsampling options are ignored; a nil *[Options] writes a
+// baseline image with standard Huffman tables.
+func EncodeCoefficients(w io.Writer, c *Coefficients, o *Options) error {
+	if c.Width < 1 || c.Height < 1 || c.Width >= 1<<16 || c.Height >= 1<<16 {
+		return errors.New("jpeg: invalid image size")
+	}
+	switch len(c.Components) {
+	case 1, 3, 4:
+	default:
+		return errors.New("jpeg: invalid number of components")
+	}
+	if o == nil {
+		o = &Options{}
+	}
+	if o.RestartInterval < 0 || o.RestartInterval > 0xffff {
+		return errors.New("jpeg: invalid restart interval")
+	}
+
+	mxx, myy := c.mcus()
+	for _, comp := range c.Components {
+		if comp.H < 1 || comp.H > 4 || comp.V < 1 || comp.V > 4 {
+			return errors.New("jpeg: invalid sampling factors")
+		}
+		if comp.Quant < 0 || comp.Quant > maxTq {
+			return errors.New("jpeg: invalid quantization table")
+		}
+		if comp.BlocksWide != mxx*comp.H || comp.BlocksHigh != myy*comp.V || len(comp.Blocks) != comp.BlocksWide*comp.BlocksHigh {
+			return errors.New("jpeg: invalid number of blocks")
+		}
+	}
+
+	var e encoder
+	if ww, ok := w.(writer); ok {
+		e.w = ww
+	} else {
+		e.w = bufio.NewWriter(w)
+	}
+
+	// Build the Huffman tables by counting the values each scan emits.
+	scans := coefficientScans(c, o.Progressive)
+	specs := theHuffmanSpec
+	e.lut = theHuffmanLUT
+	if o.Progressive || o.OptimizeHuffman {
+		counter := encoder{w: bufio.NewWriter(io.Discard), counts: new([nHuffIndex][256]int)}
+		for _, scan := range scans {
+			counter.writeCoefficientScan(c, scan, o.RestartInterval)
+		}
+		for i := range specs {
+			specs[i] = optimalHuffmanSpec(counter.counts[i])
+			e.lut[i].init(specs[i])
+		}
+	}
+
+	// Write the Start Of Image marker.
+	e.write([]byte{0xff, soiMarker})
+
+	if c.AdobeTransform >= 0 {
+		e.writeMarkerHeader(app14Marker, 2+12)
+		e.write([]byte("Adobe\x00\x64\x00\x00\x00\x00"))
+		e.writeByte(uint8(c.AdobeTransform))
+	}
+
+	// Write the quantization tables used by the components. Tables with
+	// values that don't fit in a byte require an extended sequential
+	// frame.
+	extended := false
+	var used [maxTq + 1]bool
+	for _, comp := range c.Components {
+		used[comp.Quant] = true
+	}
+	for i, q := range c.QuantTables {
+		if !used[i] {
+			continue
+		}
+		precision := 0
+		for _, v := range q {
+			if v < 1 || v > 0xffff {
+				return errors.New("jpeg: invalid quantization table")
+			}
+			if v > 0xff {
+				precision = 1
+			}
+		}
+		e.writeMarkerHeader(dqtMarker, 2+1+blockSize*(precision+1))
+		e.writeByte(uint8(precision<<4 | i))
+		for zig := 0; zig < blockSize; zig++ {
+			v := q[unzig[zig]]
+			if precision == 1 {
+				e.writeByte(uint8(v >> 8))
+				extended = true
+			}
+			e.writeByte(uint8(v))
+		}
+	}
+
+	// Write the frame header.
+	marker := uint8(sof0Marker)
+	if o.Progressive {
+		marker = sof2Marker
+	} else if extended {
+		marker = sof1Marker
+	}
+	e.writeMarkerHeader(marker, 8+3*len(c.Components))
+	e.write([]byte{8, uint8(c.Height >> 8), uint8(c.Height), uint8(c.Width >> 8), uint8(c.Width), uint8(len(c.Components))})
+	for _, comp := range c.Components {
+		e.write([]byte{comp.ID, uint8(comp.H<<4 | comp.V), uint8(comp.Quant)})
+	}
+
+	e.writeHuffmanTables(&specs, len(c.Components))
+
+	if o.RestartInterval > 0 {
+		e.writeMarkerHeader(driMarker, 4)
+		e.write([]byte{uint8(o.RestartInterval >> 8), uint8(o.RestartInterval)})
+	}
+
+	for _, scan := range scans {
+		e.writeCoefficientScan(c, scan, o.RestartInterval)
+	}
+
+	// Write the End Of Image marker.
+	e.write([]byte{0xff, eoiMarker})
+	e.flush()
+	return e.err
+}
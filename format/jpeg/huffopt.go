@@ -0,0 +1,104 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+// optimalHuffmanSpec returns a Huffman encoding for values with the
+// given frequencies, following the procedure in section K.2 of the spec.
+// Codes are limited to 16 bits, and no code consists of only 1 bits.
+func optimalHuffmanSpec(freq [256]int) huffmanSpec {
+	const maxCodeLength = 32
+
+	var (
+		f        [257]int
+		codeSize [257]int
+		others   [257]int
+		bits     [maxCodeLength + 1]int
+	)
+	copy(f[:], freq[:])
+	// Every table needs at least one code.
+	if f == [257]int{} {
+		f[0] = 1
+	}
+	// Reserve one code point, so that no real code is all 1 bits.
+	f[256] = 1
+	for i := range others {
+		others[i] = -1
+	}
+
+	// Repeatedly merge the two least frequent trees.
+	for {
+		c1, c2 := -1, -1
+		for i, v := range f {
+			if v == 0 {
+				continue
+			}
+			if c1 < 0 || v <= f[c1] {
+				c1, c2 = i, c1
+			} else if c2 < 0 || v <= f[c2] {
+				c2 = i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+
+		f[c1] += f[c2]
+		f[c2] = 0
+
+		codeSize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codeSize[c1]++
+		}
+		others[c1] = c2
+
+		codeSize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codeSize[c2]++
+		}
+	}
+
+	for _, size := range codeSize {
+		if size > 0 {
+			bits[size]++
+		}
+	}
+
+	// Limit the code lengths to 16 bits, as in section K.2 of the spec.
+	for i := maxCodeLength; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+
+	// Remove the reserved code point, which has the longest code.
+	i := 16
+	for bits[i] == 0 {
+		i--
+	}
+	bits[i]--
+
+	var s huffmanSpec
+	for i := range s.count {
+		s.count[i] = byte(bits[i+1])
+	}
+	// List the values in order of increasing code length.
+	for size := 1; size <= maxCodeLength; size++ {
+		for v := 0; v < 256; v++ {
+			if codeSize[v] == size {
+				s.value = append(s.value, byte(v))
+			}
+		}
+	}
+	return s
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"testing"
+)
+
+func TestEncodeOptions(t *testing.T) {
+	m0, err := readPng("testdata/video-001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray := image.NewGray(m0.Bounds())
+	for y := gray.Rect.Min.Y; y < gray.Rect.Max.Y; y++ {
+		for x := gray.Rect.Min.X; x < gray.Rect.Max.X; x++ {
+			gray.Set(x, y, m0.At(x, y))
+		}
+	}
+
+	var baseline bytes.Buffer
+	if err := Encode(&baseline, m0, &Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []image.Image{m0, gray} {
+		for _, subsampling := range []Subsampling{Subsampling420, Subsampling422, Subsampling444, Subsampling440} {
+			for _, restart := range []int{0, 3} {
+				for _, progressive := range []bool{false, true} {
+					for _, optimize := range []bool{false, true} {
+						o := &Options{
+							Quality:         90,
+							Subsampling:     subsampling,
+							Progressive:     progressive,
+							OptimizeHuffman: optimize,
+							RestartInterval: restart,
+						}
+						name := fmt.Sprintf("%T %+v", m, *o)
+
+						var buf bytes.Buffer
+						if err := Encode(&buf, m, o); err != nil {
+							t.Fatalf("%s: %v", name, err)
+						}
+						if optimize && !progressive && restart == 0 && subsampling == Subsampling420 && m == m0 && buf.Len() >= baseline.Len() {
+							t.Errorf("%s: optimized image is %d bytes, baseline is %d bytes", name, buf.Len(), baseline.Len())
+						}
+
+						m1, err := Decode(&buf)
+						if err != nil {
+							t.Fatalf("%s: %v", name, err)
+						}
+						if m1.Bounds() != m.Bounds() {
+							t.Fatalf("%s: bounds differ: %v and %v", name, m.Bounds(), m1.Bounds())
+						}
+						if got := averageDelta(m, m1); got > 4<<8 {
+							t.Errorf("%s: average delta is %d, want <= %d", name, got, 4<<8)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeCoefficientsOptions(t *testing.T) {
+	for _, filename := range []string{
+		"testdata/video-001.q50.420.progressive.jpeg",
+		"testdata/video-005.gray.q50.jpeg",
+	} {
+		c := decodeCoefficientsFile(t, filename)
+		want := encodeCoefficientsToImage(t, c)
+
+		for _, o := range []*Options{
+			{Progressive: true},
+			{OptimizeHuffman: true, RestartInterval: 2},
+			{Progressive: true, RestartInterval: 5},
+		} {
+			var buf bytes.Buffer
+			if err := EncodeCoefficients(&buf, c, o); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Decode(&buf)
+			if err != nil {
+				t.Fatalf("%s %+v: %v", filename, *o, err)
+			}
+			if err := checkImages(want, got); err != nil {
+				t.Errorf("%s %+v: %v", filename, *o, err)
+			}
+		}
+	}
+}
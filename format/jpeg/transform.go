@@ -0,0 +1,139 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"errors"
+	"image"
+)
+
+// ErrTooSmall is returned when a lossless transformation would leave no
+// complete MCUs in the image.
+var ErrTooSmall = errors.New("jpeg: image too small to transform losslessly")
+
+// Transpose mirrors the image along the diagonal from the top left to the
+// bottom right corner.
+func (c *Coefficients) Transpose() {
+	c.Width, c.Height = c.Height, c.Width
+
+	for i := range c.QuantTables {
+		c.QuantTables[i] = transposeBlock(c.QuantTables[i])
+	}
+
+	for i := range c.Components {
+		comp := &c.Components[i]
+		blocks := make([]Block, len(comp.Blocks))
+		for by := 0; by < comp.BlocksHigh; by++ {
+			for bx := 0; bx < comp.BlocksWide; bx++ {
+				blocks[bx*comp.BlocksHigh+by] = transposeBlock(comp.Blocks[by*comp.BlocksWide+bx])
+			}
+		}
+		comp.H, comp.V = comp.V, comp.H
+		comp.BlocksWide, comp.BlocksHigh = comp.BlocksHigh, comp.BlocksWide
+		comp.Blocks = blocks
+	}
+}
+
+func transposeBlock(b Block) (t Block) {
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			t[u*8+v] = b[v*8+u]
+		}
+	}
+	return
+}
+
+// FlipHorizontal mirrors the image horizontally. A partial MCU at the
+// right edge of the image would end up at the left edge, where it can't
+// be represented, so it is removed.
+func (c *Coefficients) FlipHorizontal() error {
+	mcu := c.MCUSize()
+	width := c.Width - c.Width%mcu.X
+	if width == 0 {
+		return ErrTooSmall
+	}
+	c.Crop(image.Rect(0, 0, width, c.Height))
+
+	for i := range c.Components {
+		comp := &c.Components[i]
+		for by := 0; by < comp.BlocksHigh; by++ {
+			row := comp.Blocks[by*comp.BlocksWide:][:comp.BlocksWide]
+			for l, r := 0, len(row)-1; l <= r; l, r = l+1, r-1 {
+				row[l], row[r] = negateOdd(row[r], 1), negateOdd(row[l], 1)
+			}
+		}
+	}
+	return nil
+}
+
+// FlipVertical mirrors the image vertically. A partial MCU at the bottom
+// edge of the image would end up at the top edge, where it can't be
+// represented, so it is removed.
+func (c *Coefficients) FlipVertical() error {
+	mcu := c.MCUSize()
+	height := c.Height - c.Height%mcu.Y
+	if height == 0 {
+		return ErrTooSmall
+	}
+	c.Crop(image.Rect(0, 0, c.Width, height))
+
+	for i := range c.Components {
+		comp := &c.Components[i]
+		for t, b := 0, comp.BlocksHigh-1; t <= b; t, b = t+1, b-1 {
+			top := comp.Blocks[t*comp.BlocksWide:][:comp.BlocksWide]
+			bottom := comp.Blocks[b*comp.BlocksWide:][:comp.BlocksWide]
+			for x := range top {
+				top[x], bottom[x] = negateOdd(bottom[x], 8), negateOdd(top[x], 8)
+			}
+		}
+	}
+	return nil
+}
+
+// negateOdd returns b with the coefficients of odd horizontal (stride 1)
+// or vertical (stride 8) frequencies negated, which mirrors the block.
+func negateOdd(b Block, stride int) Block {
+	for i := range b {
+		if (i/stride)&1 != 0 {
+			b[i] = -b[i]
+		}
+	}
+	return b
+}
+
+// Crop crops the image to r, which is first intersected with the image
+// bounds. The top left corner is moved up and to the left to the nearest
+// multiple of the MCU size, and the resulting bounds are returned. Crop
+// returns an empty rectangle and leaves the image unchanged if r doesn't
+// overlap the image.
+func (c *Coefficients) Crop(r image.Rectangle) image.Rectangle {
+	r = r.Intersect(image.Rect(0, 0, c.Width, c.Height))
+	if r.Empty() {
+		return image.Rectangle{}
+	}
+
+	mcu := c.MCUSize()
+	r.Min.X -= r.Min.X % mcu.X
+	r.Min.Y -= r.Min.Y % mcu.Y
+	if r == image.Rect(0, 0, c.Width, c.Height) {
+		return r
+	}
+
+	c.Width, c.Height = r.Dx(), r.Dy()
+	mxx, myy := c.mcus()
+	for i := range c.Components {
+		comp := &c.Components[i]
+		x0, y0 := r.Min.X/mcu.X*comp.H, r.Min.Y/mcu.Y*comp.V
+		w, h := mxx*comp.H, myy*comp.V
+
+		blocks := make([]Block, w*h)
+		for by := 0; by < h; by++ {
+			copy(blocks[by*w:][:w], comp.Blocks[(y0+by)*comp.BlocksWide+x0:])
+		}
+		comp.BlocksWide, comp.BlocksHigh = w, h
+		comp.Blocks = blocks
+	}
+	return r
+}
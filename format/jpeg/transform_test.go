@@ -0,0 +1,165 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"os"
+	"testing"
+)
+
+func decodeCoefficientsFile(t *testing.T, filename string) *Coefficients {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	c, err := DecodeCoefficients(f)
+	if err != nil {
+		t.Fatalf("%s: %v", filename, err)
+	}
+	return c
+}
+
+func encodeCoefficientsToImage(t *testing.T, c *Coefficients) image.Image {
+	var buf bytes.Buffer
+	if err := EncodeCoefficients(&buf, c, nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// checkImages returns an error if m0 and m1 have different bounds or
+// pixels.
+func checkImages(m0, m1 image.Image) error {
+	b := m0.Bounds()
+	if b != m1.Bounds() {
+		return fmt.Errorf("wrong bounds: got %v, want %v", m1.Bounds(), b)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r0, g0, b0, a0 := m0.At(x, y).RGBA()
+			r1, g1, b1, a1 := m1.At(x, y).RGBA()
+			if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+				return fmt.Errorf("pixel (%d, %d) differs", x, y)
+			}
+		}
+	}
+	return nil
+}
+
+func TestCoefficientsRoundTrip(t *testing.T) {
+	for _, filename := range []string{
+		"testdata/video-001.jpeg",
+		"testdata/video-001.progressive.jpeg",
+		"testdata/video-001.q50.422.progressive.jpeg",
+		"testdata/video-001.q50.221122.jpeg",
+		"testdata/video-001.restart2.jpeg",
+		"testdata/video-001.rgb.jpeg",
+		"testdata/video-001.cmyk.jpeg",
+		"testdata/video-005.gray.q50.2x2.progressive.jpeg",
+	} {
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := encodeCoefficientsToImage(t, decodeCoefficientsFile(t, filename))
+		if err := checkImages(want, got); err != nil {
+			t.Errorf("%s: %v", filename, err)
+		}
+	}
+}
+
+func TestCoefficientsTransform(t *testing.T) {
+	const filename = "testdata/video-001.q50.420.jpeg"
+
+	src := encodeCoefficientsToImage(t, decodeCoefficientsFile(t, filename))
+
+	at := func(m image.Image, x, y int) [3]uint32 {
+		r, g, b, _ := m.At(x, y).RGBA()
+		return [3]uint32{r >> 8, g >> 8, b >> 8}
+	}
+	// The integer inverse DCT and color conversion don't round exactly
+	// symmetrically, so mirrored pixels may differ slightly.
+	near := func(a, b [3]uint32) bool {
+		for i := range a {
+			d := int(a[i]) - int(b[i])
+			if d < -4 || d > 4 {
+				return false
+			}
+		}
+		return true
+	}
+
+	tests := []struct {
+		name string
+		fn   func(c *Coefficients) error
+		// srcPt maps a point of the result to the source image, whose
+		// width and height are w and h after trimming.
+		srcPt func(x, y, w, h int) (int, int)
+	}{
+		{"transpose", func(c *Coefficients) error { c.Transpose(); return nil },
+			func(x, y, w, h int) (int, int) { return y, x }},
+		{"flip horizontal", (*Coefficients).FlipHorizontal,
+			func(x, y, w, h int) (int, int) { return w - 1 - x, y }},
+		{"flip vertical", (*Coefficients).FlipVertical,
+			func(x, y, w, h int) (int, int) { return x, h - 1 - y }},
+	}
+
+	for _, tt := range tests {
+		c := decodeCoefficientsFile(t, filename)
+		if err := tt.fn(c); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		dst := encodeCoefficientsToImage(t, c)
+
+		w, h := c.Width, c.Height
+		if tt.name == "transpose" {
+			w, h = h, w
+		}
+		bad := 0
+		db := dst.Bounds()
+		for y := db.Min.Y; y < db.Max.Y; y++ {
+			for x := db.Min.X; x < db.Max.X; x++ {
+				sx, sy := tt.srcPt(x, y, w, h)
+				if !near(at(dst, x, y), at(src, sx, sy)) {
+					bad++
+				}
+			}
+		}
+		if bad > 0 {
+			t.Errorf("%s: %d of %d pixels differ", tt.name, bad, db.Dx()*db.Dy())
+		}
+	}
+
+	c := decodeCoefficientsFile(t, filename)
+	r := c.Crop(image.Rect(20, 20, 100, 90))
+	if want := image.Rect(16, 16, 100, 90); r != want {
+		t.Fatalf("crop: expected %v, got %v", want, r)
+	}
+	dst := encodeCoefficientsToImage(t, c)
+	if dst.Bounds() != image.Rect(0, 0, 84, 74) {
+		t.Fatalf("crop: expected 84x74 image, got %v", dst.Bounds())
+	}
+	for y := 0; y < 74; y++ {
+		for x := 0; x < 84; x++ {
+			if at(dst, x, y) != at(src, x+16, y+16) {
+				t.Fatalf("crop: pixel (%d, %d) differs", x, y)
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package png
+
+import (
+	"encoding/binary"
+	"image/color"
+	"io"
+)
+
+// Metadata contains information from ancillary chunks whose encoding
+// depends on the color type and bit depth of the image. Other ancillary
+// chunks are available through ParseUnknownChunk and CustomChunks.
+type Metadata struct {
+	// Background is the background color from the bKGD chunk, if any.
+	Background color.Color
+
+	// SignificantBits is the number of significant bits in the red,
+	// green, blue and alpha channels, from the sBIT chunk. The red, green
+	// and blue values are equal for grayscale images. A value of zero
+	// means that the number of significant bits is unknown.
+	SignificantBits [4]uint8
+}
+
+// cbDepth returns the bit depth of samples for the color type and bit
+// depth combination cb. Palette entries always have 8-bit samples.
+func cbDepth(cb int) int {
+	switch cb {
+	case cbG1:
+		return 1
+	case cbG2:
+		return 2
+	case cbG4:
+		return 4
+	case cbG16, cbGA16, cbTC16, cbTCA16:
+		return 16
+	}
+	return 8
+}
+
+func cbGray(cb int) bool {
+	return cb >= cbG1 && cb <= cbGA8 || cb == cbG16 || cb == cbGA16
+}
+
+func cbAlpha(cb int) bool {
+	return cb == cbGA8 || cb == cbGA16 || cb == cbTCA8 || cb == cbTCA16
+}
+
+// readAncillary reads the data of a chunk of the specified length,
+// which must be at most max bytes.
+func (d *decoder) readAncillary(name string, length uint32, max int) ([]byte, error) {
+	if length > uint32(max) {
+		return nil, FormatError("bad " + name + " length")
+	}
+	data := d.tmp[:length]
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return nil, err
+	}
+	d.crc.Write(data)
+	return data, nil
+}
+
+func (d *decoder) parsebKGD(length uint32) error {
+	data, err := d.readAncillary("bKGD", length, 6)
+	if err != nil {
+		return err
+	}
+
+	scale := func(v uint16) uint16 {
+		return uint16(uint32(v) * 0xffff / (1<<cbDepth(d.cb) - 1))
+	}
+	switch {
+	case cbPaletted(d.cb):
+		if len(data) != 1 {
+			return FormatError("bad bKGD length")
+		}
+		if int(data[0]) < len(d.palette) {
+			d.md.Background = d.palette[data[0]]
+		}
+	case cbGray(d.cb):
+		if len(data) != 2 {
+			return FormatError("bad bKGD length")
+		}
+		d.md.Background = color.Gray16{scale(binary.BigEndian.Uint16(data))}
+	default:
+		if len(data) != 6 {
+			return FormatError("bad bKGD length")
+		}
+		d.md.Background = color.RGBA64{
+			scale(binary.BigEndian.Uint16(data[0:])),
+			scale(binary.BigEndian.Uint16(data[2:])),
+			scale(binary.BigEndian.Uint16(data[4:])),
+			0xffff,
+		}
+	}
+	return d.verifyChecksum()
+}
+
+func (d *decoder) parsesBIT(length uint32) error {
+	data, err := d.readAncillary("sBIT", length, 4)
+	if err != nil {
+		return err
+	}
+
+	n := 3
+	if cbGray(d.cb) {
+		n = 1
+	}
+	if cbAlpha(d.cb) {
+		n++
+	}
+	if len(data) != n {
+		return FormatError("bad sBIT length")
+	}
+
+	sb := &d.md.SignificantBits
+	if cbGray(d.cb) {
+		sb[0], sb[1], sb[2] = data[0], data[0], data[0]
+	} else {
+		copy(sb[:3], data)
+	}
+	if cbAlpha(d.cb) {
+		sb[3] = data[n-1]
+	}
+	return d.verifyChecksum()
+}
+
+// writesBIT writes the sBIT chunk, if the number of significant bits is
+// known.
+func (e *encoder) writesBIT(md *Metadata) {
+	if md == nil || md.SignificantBits == [4]uint8{} {
+		return
+	}
+
+	depth := uint8(cbDepth(e.cb))
+	sample := func(v uint8) byte {
+		if v == 0 || v > depth {
+			return depth
+		}
+		return v
+	}
+
+	sb := md.SignificantBits
+	var data []byte
+	if cbGray(e.cb) {
+		gray := sb[0]
+		if sb[1] > gray {
+			gray = sb[1]
+		}
+		if sb[2] > gray {
+			gray = sb[2]
+		}
+		data = append(data, sample(gray))
+	} else {
+		data = append(data, sample(sb[0]), sample(sb[1]), sample(sb[2]))
+	}
+	if cbAlpha(e.cb) {
+		data = append(data, sample(sb[3]))
+	}
+	e.writeChunk(data, "sBIT")
+}
+
+// writebKGD writes the bKGD chunk, if there is a background color.
+func (e *encoder) writebKGD(md *Metadata, pal color.Palette) {
+	if md == nil || md.Background == nil {
+		return
+	}
+
+	shift := 16 - cbDepth(e.cb)
+	c := color.NRGBA64Model.Convert(md.Background).(color.NRGBA64)
+	var data []byte
+	switch {
+	case pal != nil:
+		data = []byte{byte(pal.Index(md.Background))}
+	case cbGray(e.cb):
+		gray := color.Gray16Model.Convert(color.NRGBA64{c.R, c.G, c.B, 0xffff}).(color.Gray16)
+		data = binary.BigEndian.AppendUint16(data, gray.Y>>shift)
+	default:
+		data = binary.BigEndian.AppendUint16(data, c.R>>shift)
+		data = binary.BigEndian.AppendUint16(data, c.G>>shift)
+		data = binary.BigEndian.AppendUint16(data, c.B>>shift)
+	}
+	e.writeChunk(data, "bKGD")
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestAncillaryRoundTrip(t *testing.T) {
+	gray16 := image.NewGray16(image.Rect(0, 0, 4, 4))
+	paletted := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White, color.Gray{0x80}})
+	rgba := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+
+	tests := []struct {
+		m    image.Image
+		md   Metadata
+		want Metadata
+	}{
+		{
+			gray16,
+			Metadata{color.Gray16{0x1234}, [4]uint8{12, 12, 12, 0}},
+			Metadata{color.Gray16{0x1234}, [4]uint8{12, 12, 12, 0}},
+		},
+		{
+			paletted,
+			Metadata{color.Gray{0x80}, [4]uint8{5, 6, 5, 0}},
+			Metadata{color.RGBA{0x80, 0x80, 0x80, 0xff}, [4]uint8{5, 6, 5, 0}},
+		},
+		{
+			rgba,
+			Metadata{color.RGBA{0x10, 0x20, 0x30, 0xff}, [4]uint8{5, 6, 5, 1}},
+			Metadata{color.RGBA64{0x1010, 0x2020, 0x3030, 0xffff}, [4]uint8{5, 6, 5, 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		md := tt.md
+		if err := (&Encoder{}).EncodeWithOptions(&buf, tt.m, &EncodeOptions{Metadata: &md}); err != nil {
+			t.Fatal(err)
+		}
+
+		var got Metadata
+		if _, err := DecodeWithOptions(&buf, &DecodeOptions{Metadata: &got}); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%T: got %v, want %v", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeConfigWithOptions(t *testing.T) {
+	for _, fn := range append(filenames, "ftbbn2c16", "ftbrn2c08", "ftbwn0g16", "ftbyn3p08") {
+		data, err := os.ReadFile("testdata/pngsuite/" + fn + ".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wantMd, gotMd Metadata
+		var wantChunks, gotChunks []string
+		m, err := DecodeWithOptions(bytes.NewReader(data), &DecodeOptions{
+			Metadata: &wantMd,
+			ParseUnknownChunk: func(c Chunk) error {
+				wantChunks = append(wantChunks, c.Name)
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := DecodeConfigWithOptions(bytes.NewReader(data), &DecodeOptions{
+			Metadata: &gotMd,
+			ParseUnknownChunk: func(c Chunk) error {
+				gotChunks = append(gotChunks, c.Name)
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", fn, err)
+		}
+
+		if cfg.Width != m.Bounds().Dx() || cfg.Height != m.Bounds().Dy() {
+			t.Errorf("%s: got %dx%d, want %v", fn, cfg.Width, cfg.Height, m.Bounds())
+		}
+		if !reflect.DeepEqual(cfg.ColorModel, m.ColorModel()) {
+			t.Errorf("%s: color model differs from the decoded image", fn)
+		}
+		if gotMd != wantMd {
+			t.Errorf("%s: got metadata %v, want %v", fn, gotMd, wantMd)
+		}
+		if !reflect.DeepEqual(gotChunks, wantChunks) {
+			t.Errorf("%s: got chunks %v, want %v", fn, gotChunks, wantChunks)
+		}
+
+		// Without metadata, nothing after the first IDAT chunk header
+		// needs to be read.
+		header := data[:bytes.Index(data, []byte("IDAT"))+4]
+		if _, err := DecodeConfigWithOptions(bytes.NewReader(header), &DecodeOptions{}); err != nil {
+			t.Errorf("%s: %v", fn, err)
+		}
+	}
+}
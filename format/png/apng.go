@@ -0,0 +1,381 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package png
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Frame disposal operations, as per the APNG spec.
+const (
+	DisposeOpNone       = 0
+	DisposeOpBackground = 1
+	DisposeOpPrevious   = 2
+)
+
+// Frame blend operations, as per the APNG spec.
+const (
+	BlendOpSource = 0
+	BlendOpOver   = 1
+)
+
+// Frame is a single frame of an animated PNG.
+type Frame struct {
+	// Image is the frame's image data. Its bounds specify the
+	// position of the frame on the canvas.
+	Image image.Image
+
+	// DelayNum and DelayDen specify the frame delay as a fraction of
+	// a second. A DelayDen of zero is treated as 100.
+	DelayNum, DelayDen uint16
+
+	// DisposeOp and BlendOp specify how the frame is disposed of and
+	// blended onto the canvas.
+	DisposeOp, BlendOp uint8
+}
+
+// Animation is an animated PNG.
+type Animation struct {
+	// Default is the default image, if it is not part of the
+	// animation. Decoders without APNG support display this image.
+	Default image.Image
+
+	// Frames contains each frame of the animation. If Default is nil,
+	// the first frame is used as the default image and must cover the
+	// entire canvas.
+	Frames []*Frame
+
+	// Width and Height are the dimensions of the canvas.
+	Width, Height int
+
+	// NumPlays is the number of times to play the animation. A value
+	// of 0 means the animation loops forever.
+	NumPlays int
+}
+
+// fcTL is the decoded contents of a frame control chunk.
+type fcTL struct {
+	width, height, xOffset, yOffset int
+	delayNum, delayDen              uint16
+	disposeOp, blendOp              uint8
+}
+
+// translateImage moves the bounds of an image returned by readImagePass
+// by the given offset.
+func translateImage(img image.Image, x, y int) image.Image {
+	p := image.Pt(x, y)
+	switch img := img.(type) {
+	case *image.Gray:
+		img.Rect = img.Rect.Add(p)
+	case *image.Gray16:
+		img.Rect = img.Rect.Add(p)
+	case *image.RGBA:
+		img.Rect = img.Rect.Add(p)
+	case *image.RGBA64:
+		img.Rect = img.Rect.Add(p)
+	case *image.NRGBA:
+		img.Rect = img.Rect.Add(p)
+	case *image.NRGBA64:
+		img.Rect = img.Rect.Add(p)
+	case *image.Paletted:
+		img.Rect = img.Rect.Add(p)
+	}
+	return img
+}
+
+// readSequence reads and verifies an APNG sequence number from the
+// current chunk, whose remaining length is pointed to by length.
+func (d *decoder) readSequence(length *uint32) error {
+	if *length < 4 {
+		return FormatError("bad APNG chunk length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:4]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:4])
+	*length -= 4
+	if binary.BigEndian.Uint32(d.tmp[:4]) != d.seq {
+		return FormatError("APNG sequence number out of order")
+	}
+	d.seq++
+	return nil
+}
+
+func (d *decoder) parseacTL(length uint32) error {
+	if length != 8 {
+		return FormatError("bad acTL length")
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:8]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:8])
+	if binary.BigEndian.Uint32(d.tmp[0:4]) == 0 {
+		return FormatError("acTL with zero frames")
+	}
+	d.anim.NumPlays = int(binary.BigEndian.Uint32(d.tmp[4:8]))
+	d.animated = true
+	return d.verifyChecksum()
+}
+
+func (d *decoder) parsefcTL(length uint32) error {
+	if length != 26 {
+		return FormatError("bad fcTL length")
+	}
+	if err := d.readSequence(&length); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(d.r, d.tmp[:22]); err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:22])
+
+	f := &fcTL{
+		width:     int(binary.BigEndian.Uint32(d.tmp[0:4])),
+		height:    int(binary.BigEndian.Uint32(d.tmp[4:8])),
+		xOffset:   int(binary.BigEndian.Uint32(d.tmp[8:12])),
+		yOffset:   int(binary.BigEndian.Uint32(d.tmp[12:16])),
+		delayNum:  binary.BigEndian.Uint16(d.tmp[16:18]),
+		delayDen:  binary.BigEndian.Uint16(d.tmp[18:20]),
+		disposeOp: d.tmp[20],
+		blendOp:   d.tmp[21],
+	}
+	if f.width <= 0 || f.height <= 0 || f.xOffset < 0 || f.yOffset < 0 ||
+		f.xOffset+f.width > d.width || f.yOffset+f.height > d.height {
+		return FormatError("bad fcTL frame region")
+	}
+	if f.disposeOp > DisposeOpPrevious || f.blendOp > BlendOpOver {
+		return FormatError("bad fcTL dispose or blend operation")
+	}
+	if d.stage < dsSeenIDAT && (f.xOffset != 0 || f.yOffset != 0 || f.width != d.width || f.height != d.height) {
+		return FormatError("fcTL for default image does not cover the canvas")
+	}
+	if d.fctl != nil {
+		return FormatError("fcTL without frame data")
+	}
+	d.fctl = f
+	return d.verifyChecksum()
+}
+
+// addFrame appends an image to the animation using the pending frame
+// control chunk.
+func (d *decoder) addFrame(img image.Image) {
+	f := d.fctl
+	d.anim.Frames = append(d.anim.Frames, &Frame{
+		Image:     translateImage(img, f.xOffset, f.yOffset),
+		DelayNum:  f.delayNum,
+		DelayDen:  f.delayDen,
+		DisposeOp: f.disposeOp,
+		BlendOp:   f.blendOp,
+	})
+	d.fctl = nil
+}
+
+// parseDefaultImage records the image decoded from the IDAT chunks,
+// either as the first frame or as a separate default image.
+func (d *decoder) parseDefaultImage() {
+	if !d.animated {
+		return
+	}
+	if d.fctl != nil {
+		d.addFrame(d.img)
+	} else {
+		d.anim.Default = d.img
+	}
+}
+
+func (d *decoder) parsefdAT(length uint32) (err error) {
+	if d.fctl == nil {
+		// Ignore trailing fdAT chunks, as with IDAT chunks.
+		return d.skipChunk(length)
+	}
+	if err := d.readSequence(&length); err != nil {
+		return err
+	}
+
+	width, height := d.width, d.height
+	d.width, d.height = d.fctl.width, d.fctl.height
+	d.inFdAT = true
+	d.idatLength = length
+	img, err := d.decode()
+	d.width, d.height = width, height
+	d.inFdAT = false
+	if err != nil {
+		return err
+	}
+	d.addFrame(img)
+	return d.verifyChecksum()
+}
+
+// skipChunk ignores the remaining data of the current chunk.
+func (d *decoder) skipChunk(length uint32) error {
+	var ignored [4096]byte
+	for length > 0 {
+		n, err := io.ReadFull(d.r, ignored[:min(len(ignored), int(length))])
+		if err != nil {
+			return err
+		}
+		d.crc.Write(ignored[:n])
+		length -= uint32(n)
+	}
+	return d.verifyChecksum()
+}
+
+// DecodeAll reads an animated PNG from r and returns every frame.
+// Non-animated PNG images are returned as a single frame.
+func DecodeAll(r io.Reader) (*Animation, error) {
+	return DecodeAllWithOptions(r, &DecodeOptions{})
+}
+
+// DecodeAllWithOptions reads an animated PNG from r and returns every
+// frame, taking into account the extra options specified.
+func DecodeAllWithOptions(r io.Reader, o *DecodeOptions) (*Animation, error) {
+	d := &decoder{
+		r:              r,
+		crc:            crc32.NewIEEE(),
+		unknownChunkCb: o.ParseUnknownChunk,
+		md:             o.Metadata,
+		anim:           &Animation{},
+	}
+	if err := d.checkHeader(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	for d.stage != dsSeenIEND {
+		if err := d.parseChunk(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	if len(d.anim.Frames) == 0 {
+		d.anim.Default = nil
+		d.anim.Frames = []*Frame{&Frame{Image: d.img}}
+	}
+	d.anim.Width, d.anim.Height = d.width, d.height
+	return d.anim, nil
+}
+
+func (e *encoder) writeacTL(numFrames, numPlays int) {
+	binary.BigEndian.PutUint32(e.tmp[0:4], uint32(numFrames))
+	binary.BigEndian.PutUint32(e.tmp[4:8], uint32(numPlays))
+	e.writeChunk(e.tmp[:8], "acTL")
+}
+
+func (e *encoder) writefcTL(f *Frame) {
+	b := f.Image.Bounds()
+	binary.BigEndian.PutUint32(e.tmp[0:4], e.seq)
+	binary.BigEndian.PutUint32(e.tmp[4:8], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(e.tmp[8:12], uint32(b.Dy()))
+	binary.BigEndian.PutUint32(e.tmp[12:16], uint32(b.Min.X))
+	binary.BigEndian.PutUint32(e.tmp[16:20], uint32(b.Min.Y))
+	binary.BigEndian.PutUint16(e.tmp[20:22], f.DelayNum)
+	binary.BigEndian.PutUint16(e.tmp[22:24], f.DelayDen)
+	e.tmp[24] = f.DisposeOp
+	e.tmp[25] = f.BlendOp
+	e.writeChunk(e.tmp[:26], "fcTL")
+	e.seq++
+}
+
+// samePalette returns whether or not two palettes are identical.
+func samePalette(a, b color.Palette) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		r1, g1, b1, a1 := a[i].RGBA()
+		r2, g2, b2, a2 := b[i].RGBA()
+		if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+			return false
+		}
+	}
+	return true
+}
+
+// EncodeAll writes the Animation a to w in APNG format.
+func EncodeAll(w io.Writer, a *Animation) error {
+	var e Encoder
+	return e.EncodeAll(w, a)
+}
+
+// EncodeAll writes the Animation a to w in APNG format.
+func (enc *Encoder) EncodeAll(w io.Writer, a *Animation) error {
+	return enc.EncodeAllWithOptions(w, a, &EncodeOptions{})
+}
+
+// EncodeAllWithOptions writes the Animation a to w in APNG format,
+// taking into account the extra options specified.
+func (enc *Encoder) EncodeAllWithOptions(w io.Writer, a *Animation, o *EncodeOptions) error {
+	if len(a.Frames) == 0 {
+		return FormatError("animation has no frames")
+	}
+	if enc.UseZstd {
+		return UnsupportedError("Zstd compression of animated images")
+	}
+
+	def := a.Default
+	if def == nil {
+		def = a.Frames[0].Image
+	}
+	canvas := image.Rect(0, 0, a.Width, a.Height)
+	if a.Width == 0 && a.Height == 0 {
+		canvas = image.Rect(0, 0, def.Bounds().Dx(), def.Bounds().Dy())
+	}
+	if def.Bounds() != canvas {
+		return FormatError("default image does not cover the canvas")
+	}
+
+	ims := []image.Image{def}
+	for _, f := range a.Frames {
+		if !f.Image.Bounds().In(canvas) || f.Image.Bounds().Empty() {
+			return FormatError("frame outside of canvas: " + f.Image.Bounds().String())
+		}
+		ims = append(ims, f.Image)
+	}
+
+	e := &encoder{enc: enc, w: w, m: def}
+	pal := e.chooseColorType(ims)
+
+	_, e.err = io.WriteString(w, pngHeader)
+	e.writeIHDR()
+	for _, c := range o.CustomChunks {
+		if !c.AfterIDAT {
+			e.writeChunk(c.Data, c.Name)
+		}
+	}
+	e.writesBIT(o.Metadata)
+	e.writeacTL(len(a.Frames), a.NumPlays)
+	if pal != nil {
+		e.writePLTEAndTRNS(pal)
+	}
+	e.writebKGD(o.Metadata, pal)
+	if a.Default != nil {
+		e.writeIDATorZDATs()
+	}
+	for i, f := range a.Frames {
+		e.writefcTL(f)
+		e.m = f.Image
+		if i == 0 && a.Default == nil {
+			e.writeIDATorZDATs()
+		} else {
+			e.inFdAT = true
+			e.writeIDATorZDATs()
+			e.inFdAT = false
+		}
+	}
+	for _, c := range o.CustomChunks {
+		if c.AfterIDAT {
+			e.writeChunk(c.Data, c.Name)
+		}
+	}
+	e.writeIEND()
+	return e.err
+}
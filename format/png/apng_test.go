@@ -0,0 +1,145 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package png
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func apngTestFrame(r image.Rectangle, c color.NRGBA) *image.NRGBA {
+	m := image.NewNRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			m.SetNRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+func TestAPNGRoundTrip(t *testing.T) {
+	for _, withDefault := range []bool{false, true} {
+		a := &Animation{
+			Width:    16,
+			Height:   16,
+			NumPlays: 3,
+			Frames: []*Frame{
+				{
+					Image:    apngTestFrame(image.Rect(0, 0, 16, 16), color.NRGBA{0xff, 0, 0, 0xff}),
+					DelayNum: 1, DelayDen: 10,
+				},
+				{
+					Image:    apngTestFrame(image.Rect(4, 4, 12, 12), color.NRGBA{0, 0xff, 0, 0x80}),
+					DelayNum: 2, DelayDen: 10,
+					DisposeOp: DisposeOpBackground, BlendOp: BlendOpOver,
+				},
+				{
+					Image:    apngTestFrame(image.Rect(8, 0, 16, 8), color.NRGBA{0, 0, 0xff, 0xff}),
+					DelayNum: 3, DelayDen: 100,
+					DisposeOp: DisposeOpPrevious,
+				},
+			},
+		}
+		if withDefault {
+			a.Default = apngTestFrame(image.Rect(0, 0, 16, 16), color.NRGBA{0x10, 0x20, 0x30, 0xff})
+		}
+
+		var buf bytes.Buffer
+		if err := EncodeAll(&buf, a); err != nil {
+			t.Fatal(err)
+		}
+
+		// Decoders without APNG support see the default image.
+		m, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := a.Frames[0].Image
+		if withDefault {
+			want = a.Default
+		}
+		if err := diff(want, m); err != nil {
+			t.Fatalf("default image: %v", err)
+		}
+
+		b, err := DecodeAll(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Width != a.Width || b.Height != a.Height || b.NumPlays != a.NumPlays {
+			t.Fatalf("got %dx%d (%d plays), want %dx%d (%d plays)",
+				b.Width, b.Height, b.NumPlays, a.Width, a.Height, a.NumPlays)
+		}
+		if (b.Default != nil) != withDefault {
+			t.Fatalf("default image presence: got %v, want %v", b.Default != nil, withDefault)
+		}
+		if len(b.Frames) != len(a.Frames) {
+			t.Fatalf("got %d frames, want %d", len(b.Frames), len(a.Frames))
+		}
+		for i, f := range b.Frames {
+			g := a.Frames[i]
+			if f.DelayNum != g.DelayNum || f.DelayDen != g.DelayDen ||
+				f.DisposeOp != g.DisposeOp || f.BlendOp != g.BlendOp {
+				t.Fatalf("frame %d: got %+v, want %+v", i, f, g)
+			}
+			if f.Image.Bounds() != g.Image.Bounds() {
+				t.Fatalf("frame %d: got bounds %v, want %v", i, f.Image.Bounds(), g.Image.Bounds())
+			}
+			if err := diff(g.Image, f.Image); err != nil {
+				t.Fatalf("frame %d: %v", i, err)
+			}
+		}
+	}
+}
+
+func TestAPNGChunksUnknownToDecode(t *testing.T) {
+	a := &Animation{
+		Frames: []*Frame{
+			{Image: apngTestFrame(image.Rect(0, 0, 4, 4), color.NRGBA{0xff, 0, 0, 0xff})},
+			{Image: apngTestFrame(image.Rect(0, 0, 2, 2), color.NRGBA{0, 0xff, 0, 0xff})},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeAll(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]int{}
+	_, err := DecodeWithOptions(&buf, &DecodeOptions{
+		ParseUnknownChunk: func(c Chunk) error {
+			seen[c.Name]++
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen["acTL"] != 1 || seen["fcTL"] != 2 || seen["fdAT"] != 1 {
+		t.Fatalf("unexpected unknown chunks: %v", seen)
+	}
+}
+
+func TestAPNGNotAnimated(t *testing.T) {
+	m := apngTestFrame(image.Rect(0, 0, 4, 4), color.NRGBA{0xff, 0, 0, 0xff})
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Default != nil || len(a.Frames) != 1 {
+		t.Fatalf("expected a single frame, got %d", len(a.Frames))
+	}
+	if err := diff(m, a.Frames[0].Image); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -123,6 +123,22 @@ type decoder struct {
 
 	// unknownChunkCb is called when an unrecognized chunk is read
 	unknownChunkCb func (Chunk) error
+
+	// md receives the contents of bKGD and sBIT chunks. They are treated
+	// as unknown chunks when md is nil.
+	md *Metadata
+
+	// configOnly is set by DecodeConfigWithOptions, which skips the image
+	// data instead of decoding it.
+	configOnly bool
+
+	// APNG state, only used by DecodeAll. anim is nil when APNG chunks
+	// should be treated as unknown chunks.
+	anim     *Animation
+	animated bool
+	seq      uint32
+	fctl     *fcTL
+	inFdAT   bool
 }
 
 // A FormatError reports that the input is not a valid PNG.
@@ -352,6 +368,17 @@ func (d *decoder) Read(p []byte) (int, error) {
 			return 0, err
 		}
 		d.idatLength = binary.BigEndian.Uint32(d.tmp[:4])
+		if d.inFdAT {
+			if string(d.tmp[4:8]) != "fdAT" {
+				return 0, FormatError("not enough frame data")
+			}
+			d.crc.Reset()
+			d.crc.Write(d.tmp[4:8])
+			if err := d.readSequence(&d.idatLength); err != nil {
+				return 0, err
+			}
+			continue
+		}
 		if string(d.tmp[4:8]) != "IDAT" {
 			return 0, FormatError("not enough pixel data")
 		}
@@ -913,6 +940,9 @@ func (d *decoder) parseIDAT(length uint32) (err error) {
 	if err != nil {
 		return err
 	}
+	if d.anim != nil {
+		d.parseDefaultImage()
+	}
 	return d.verifyChecksum()
 }
 
@@ -968,6 +998,14 @@ func (d *decoder) parseChunk() error {
 	case "IDAT":
 		if d.stage < dsSeenIHDR || d.stage > dsSeenIDAT || (d.stage == dsSeenIHDR && cbPaletted(d.cb)) {
 			return chunkOrderError
+		} else if d.configOnly {
+			// The image data is skipped without being decompressed, or
+			// not read at all if no chunks after it are needed.
+			d.stage = dsSeenIDAT
+			if !d.readsTrailingChunks() {
+				return nil
+			}
+			return d.skipChunk(length)
 		} else if d.stage == dsSeenIDAT {
 			// Ignore trailing zero-length or garbage IDAT chunks.
 			//
@@ -981,6 +1019,14 @@ func (d *decoder) parseChunk() error {
 	case "ZDAT":
 		if d.stage < dsSeenIHDR || d.stage > dsSeenIDAT || (d.stage == dsSeenIHDR && cbPaletted(d.cb)) {
 			return chunkOrderError
+		} else if d.configOnly {
+			// The image data is skipped without being decompressed, or
+			// not read at all if no chunks after it are needed.
+			d.stage = dsSeenIDAT
+			if !d.readsTrailingChunks() {
+				return nil
+			}
+			return d.skipChunk(length)
 		} else if d.stage == dsSeenIDAT {
 			// Ignore trailing zero-length or garbage IDAT chunks.
 			//
@@ -997,6 +1043,41 @@ func (d *decoder) parseChunk() error {
 		}
 		d.stage = dsSeenIEND
 		return d.parseIEND(length)
+	case "bKGD":
+		if d.md != nil {
+			if d.stage < dsSeenIHDR || d.stage >= dsSeenIDAT || (d.stage == dsSeenIHDR && cbPaletted(d.cb)) {
+				return chunkOrderError
+			}
+			return d.parsebKGD(length)
+		}
+	case "sBIT":
+		if d.md != nil {
+			if d.stage != dsSeenIHDR {
+				return chunkOrderError
+			}
+			return d.parsesBIT(length)
+		}
+	case "acTL":
+		if d.anim != nil {
+			if d.stage < dsSeenIHDR || d.stage >= dsSeenIDAT || d.animated {
+				return chunkOrderError
+			}
+			return d.parseacTL(length)
+		}
+	case "fcTL":
+		if d.anim != nil && d.animated {
+			if d.stage < dsSeenIHDR || d.stage == dsSeenIEND {
+				return chunkOrderError
+			}
+			return d.parsefcTL(length)
+		}
+	case "fdAT":
+		if d.anim != nil && d.animated {
+			if d.stage != dsSeenIDAT {
+				return chunkOrderError
+			}
+			return d.parsefdAT(length)
+		}
 	}
 	if length > 0x7fffffff {
 		return FormatError(fmt.Sprintf("Bad chunk length: %d", length))
@@ -1004,30 +1085,22 @@ func (d *decoder) parseChunk() error {
 
 	if d.unknownChunkCb == nil {
 		// Ignore this chunk (of a known length).
-		var ignored [4096]byte
-		for length > 0 {
-			n, err := io.ReadFull(d.r, ignored[:min(len(ignored), int(length))])
-			if err != nil {
-				return err
-			}
-			d.crc.Write(ignored[:n])
-			length -= uint32(n)
-		}
-	} else {
-		data := make([]byte, length)
-		_, err := io.ReadFull(d.r, data)
-		if err != nil {
-			return err
-		}
-		d.crc.Write(data)
-		err = d.unknownChunkCb(Chunk{
-			Name: string(d.tmp[4:8]),
-			Data: data,
-			AfterIDAT: d.stage > dsSeenIDAT,
-		})
-		if err != nil {
-			return err
-		}
+		return d.skipChunk(length)
+	}
+
+	data := make([]byte, length)
+	_, err := io.ReadFull(d.r, data)
+	if err != nil {
+		return err
+	}
+	d.crc.Write(data)
+	err = d.unknownChunkCb(Chunk{
+		Name: string(d.tmp[4:8]),
+		Data: data,
+		AfterIDAT: d.stage > dsSeenIDAT,
+	})
+	if err != nil {
+		return err
 	}
 	return d.verifyChecksum()
 }
@@ -1059,6 +1132,10 @@ type DecodeOptions struct {
 	// ParseUnknownChunk specifies a function to call when an
 	// unrecognized PNG chunk is encountered.
 	ParseUnknownChunk func (Chunk) error
+
+	// Metadata, if not nil, receives the contents of ancillary chunks
+	// that depend on the color type of the image.
+	Metadata *Metadata
 }
 
 // Decode reads a PNG image from r and returns it as an image.Image.
@@ -1075,6 +1152,7 @@ func DecodeWithOptions(r io.Reader, o *DecodeOptions) (image.Image, error) {
 		r:   r,
 		crc: crc32.NewIEEE(),
 		unknownChunkCb: o.ParseUnknownChunk,
+		md: o.Metadata,
 	}
 	if err := d.checkHeader(); err != nil {
 		if err == io.EOF {
@@ -1121,24 +1199,85 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 			break
 		}
 	}
+	return d.config(), nil
+}
+
+// DecodeConfigWithOptions returns the color model and dimensions of a PNG
+// image without decoding the image data. Unlike DecodeConfig, it reads
+// the ancillary chunks, so that they are passed to the options as they
+// would be by DecodeWithOptions, and the color model takes transparency
+// into account. Reading stops at the image data if the options take
+// neither metadata nor unknown chunks, and continues up to IEND,
+// skipping the image data, otherwise.
+func DecodeConfigWithOptions(r io.Reader, o *DecodeOptions) (image.Config, error) {
+	d := &decoder{
+		r:   r,
+		crc: crc32.NewIEEE(),
+		unknownChunkCb: o.ParseUnknownChunk,
+		md: o.Metadata,
+		configOnly: true,
+	}
+	if err := d.checkHeader(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return image.Config{}, err
+	}
+	end := dsSeenIEND
+	if !d.readsTrailingChunks() {
+		end = dsSeenIDAT
+	}
+	for d.stage != end {
+		if err := d.parseChunk(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return image.Config{}, err
+		}
+	}
+	return d.config(), nil
+}
+
+// readsTrailingChunks reports whether DecodeConfigWithOptions reads the
+// chunks after the image data, which it only does if they are passed to
+// the options.
+func (d *decoder) readsTrailingChunks() bool {
+	return d.md != nil || d.unknownChunkCb != nil
+}
+
+// config returns the configuration of the image described by the chunks
+// read so far. The color model is that of the image returned by Decode.
+func (d *decoder) config() image.Config {
 	var cm color.Model
 	switch d.cb {
 	case cbG1, cbG2, cbG4, cbG8:
 		cm = color.GrayModel
+		if d.useTransparent {
+			cm = color.NRGBAModel
+		}
 	case cbGA8:
 		cm = color.NRGBAModel
 	case cbTC8:
 		cm = color.RGBAModel
+		if d.useTransparent {
+			cm = color.NRGBAModel
+		}
 	case cbP1, cbP2, cbP4, cbP8:
 		cm = d.palette
 	case cbTCA8:
 		cm = color.NRGBAModel
 	case cbG16:
 		cm = color.Gray16Model
+		if d.useTransparent {
+			cm = color.NRGBA64Model
+		}
 	case cbGA16:
 		cm = color.NRGBA64Model
 	case cbTC16:
 		cm = color.RGBA64Model
+		if d.useTransparent {
+			cm = color.NRGBA64Model
+		}
 	case cbTCA16:
 		cm = color.NRGBA64Model
 	}
@@ -1146,7 +1285,7 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 		ColorModel: cm,
 		Width:      d.width,
 		Height:     d.height,
-	}, nil
+	}
 }
 
 func init() {
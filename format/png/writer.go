@@ -58,6 +58,12 @@ type encoder struct {
 	zsLevel zstd.EncoderLevel
 	bw      *bufio.Writer
 	useZstd bool
+
+	// APNG state. When inFdAT is set, image data is written as fdAT
+	// chunks prefixed by the sequence number seq.
+	inFdAT bool
+	seq    uint32
+	fdat   []byte
 }
 
 // CompressionLevel indicates the compression level.
@@ -69,8 +75,9 @@ const (
 	BestSpeed          CompressionLevel = -2
 	BestCompression    CompressionLevel = -3
 
-	// Positive CompressionLevel values are reserved to mean a numeric zlib
-	// compression level, although that is not implemented yet.
+	// Positive CompressionLevel values are a numeric zlib compression
+	// level from 1 to 9 or, if UseZstd is set, a zstd compression level
+	// from 1 to 22. Larger values are treated as the maximum level.
 )
 
 type opaquer interface {
@@ -204,7 +211,13 @@ func (e *encoder) writePLTEAndTRNS(p color.Palette) {
 // This method should only be called from writeIDATs (via writeImage).
 // No other code should treat an encoder as an io.Writer.
 func (e *encoder) Write(b []byte) (int, error) {
-	if e.useZstd {
+	if e.inFdAT {
+		e.fdat = append(e.fdat[:0], 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(e.fdat[:4], e.seq)
+		e.fdat = append(e.fdat, b...)
+		e.writeChunk(e.fdat, "fdAT")
+		e.seq++
+	} else if e.useZstd {
 		e.writeChunk(b, "ZDAT")
 	} else {
 		e.writeChunk(b, "IDAT")
@@ -586,6 +599,11 @@ func levelToZlib(l CompressionLevel) int {
 	case BestCompression:
 		return zlib.BestCompression
 	default:
+		if l > zlib.BestCompression {
+			return zlib.BestCompression
+		} else if l > 0 {
+			return int(l)
+		}
 		return zlib.DefaultCompression
 	}
 }
@@ -603,6 +621,9 @@ func levelToZstd(l CompressionLevel) int {
 	case BestCompression:
 		return int(zstd.SpeedBestCompression)
 	default:
+		if l > 0 {
+			return int(zstd.EncoderLevelFromZstd(int(l)))
+		}
 		return int(zstd.SpeedDefault)
 	}
 }
@@ -628,6 +649,10 @@ type EncodeOptions struct {
 	// FallbackImage specifies a fallback image when Zstd compression is
 	// used.
 	FallbackImage image.Image
+
+	// Metadata specifies the contents of ancillary chunks that depend on
+	// the color type of the image, if any.
+	Metadata *Metadata
 }
 
 // Encode writes the Image m to w in PNG format. Any Image may be
@@ -670,12 +695,78 @@ func (enc *Encoder) EncodeWithOptions(w io.Writer, m image.Image, o *EncodeOptio
 	e.useZstd = enc.UseZstd
 	e.w = w
 	e.m = m
+	e.inFdAT = false
+	e.seq = 0
+
+	pal := e.chooseColorType([]image.Image{m})
+
+	_, e.err = io.WriteString(w, pngHeader)
+	e.writeIHDR()
+	for _, c := range o.CustomChunks {
+		if !c.AfterIDAT {
+			e.writeChunk(c.Data, c.Name)
+		}
+	}
+	e.writesBIT(o.Metadata)
+	if pal != nil {
+		e.writePLTEAndTRNS(pal)
+	}
+	e.writebKGD(o.Metadata, pal)
+	e.writeIDATorZDATs()
+	if o.FallbackImage != nil && enc.UseZstd {
+		e.useZstd = false
+		e.m = o.FallbackImage
+		e.writeIDATorZDATs()
+	}
+	for _, c := range o.CustomChunks {
+		if c.AfterIDAT {
+			e.writeChunk(c.Data, c.Name)
+		}
+	}
+	e.writeIEND()
+	return e.err
+}
+
+// chooseColorType sets the color type and bit depth that can represent
+// every image in ms, returning the palette to use, if any.
+func (e *encoder) chooseColorType(ms []image.Image) color.Palette {
+	m := ms[0]
 
 	var pal color.Palette
 	// cbP8 encoding needs PalettedImage's ColorIndexAt method.
 	if _, ok := m.(image.PalettedImage); ok {
 		pal, _ = m.ColorModel().(color.Palette)
 	}
+	for _, m1 := range ms[1:] {
+		if pal == nil {
+			break
+		}
+		pal1, _ := m1.ColorModel().(color.Palette)
+		if _, ok := m1.(image.PalettedImage); !ok || !samePalette(pal, pal1) {
+			pal = nil
+		}
+	}
+
+	// allOpaque reports whether every image is fully opaque.
+	allOpaque := func() bool {
+		for _, m1 := range ms {
+			if !opaque(m1) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// model returns the color model shared by every image, or nil.
+	model := func() color.Model {
+		for _, m1 := range ms[1:] {
+			if m1.ColorModel() != m.ColorModel() {
+				return nil
+			}
+		}
+		return m.ColorModel()
+	}
+
 	if pal != nil {
 		if len(pal) <= 2 {
 			e.cb = cbP1
@@ -687,48 +778,25 @@ func (enc *Encoder) EncodeWithOptions(w io.Writer, m image.Image, o *EncodeOptio
 			e.cb = cbP8
 		}
 	} else {
-		switch m.ColorModel() {
+		switch model() {
 		case color.GrayModel:
 			e.cb = cbG8
 		case color.Gray16Model:
 			e.cb = cbG16
 		case color.RGBAModel, color.NRGBAModel, color.AlphaModel:
-			if opaque(m) {
+			if allOpaque() {
 				e.cb = cbTC8
 			} else {
 				e.cb = cbTCA8
 			}
 		default:
-			if opaque(m) {
+			if allOpaque() {
 				e.cb = cbTC16
 			} else {
 				e.cb = cbTCA16
 			}
 		}
 	}
-
-	_, e.err = io.WriteString(w, pngHeader)
-	e.writeIHDR()
-	for _, c := range o.CustomChunks {
-		if !c.AfterIDAT {
-			e.writeChunk(c.Data, c.Name)
-		}
-	}
-	if pal != nil {
-		e.writePLTEAndTRNS(pal)
-	}
-	e.writeIDATorZDATs()
-	if o.FallbackImage != nil && enc.UseZstd {
-		e.useZstd = false
-		e.m = o.FallbackImage
-		e.writeIDATorZDATs()
-	}
-	for _, c := range o.CustomChunks {
-		if c.AfterIDAT {
-			e.writeChunk(c.Data, c.Name)
-		}
-	}
-	e.writeIEND()
-	return e.err
+	return pal
 }
 
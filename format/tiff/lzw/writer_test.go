@@ -0,0 +1,56 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lzw
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestWriterRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	rnd.Read(random)
+	// Low-entropy data fills the code table slowly, and exercises long
+	// codes.
+	smooth := make([]byte, 100000)
+	for i := range smooth {
+		smooth[i] = byte(i/97) ^ byte(rnd.Intn(2))
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte{42}},
+		{"repeated", bytes.Repeat([]byte("abcabcab"), 10000)},
+		{"random", random},
+		{"smooth", smooth},
+	} {
+		for _, order := range []Order{LSB, MSB} {
+			var buf bytes.Buffer
+			w := NewWriter(&buf, order, 8)
+			if _, err := w.Write(tc.data); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+
+			r := NewReader(&buf, order, 8)
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			if !bytes.Equal(got, tc.data) {
+				t.Errorf("%s, order %d: data differs after round trip", tc.name, order)
+			}
+		}
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package webp
+
+import (
+	"sort"
+)
+
+// bitWriter writes a little-endian, least-significant-bit-first bit
+// stream, as used by VP8L.
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	nAcc uint
+}
+
+// writeBits writes the n least significant bits of v.
+func (b *bitWriter) writeBits(v uint32, n uint) {
+	b.acc |= uint64(v&(1<<n-1)) << b.nAcc
+	b.nAcc += n
+	for b.nAcc >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.nAcc -= 8
+	}
+}
+
+// bytes flushes any partial byte and returns the written data.
+func (b *bitWriter) bytes() []byte {
+	if b.nAcc > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.nAcc = 0, 0
+	}
+	return b.buf
+}
+
+// huffmanCode is a canonical Huffman code, ready for writing symbols.
+type huffmanCode struct {
+	// lengths contains the code length of each symbol.
+	lengths []uint8
+	// codes contains the bit-reversed code of each symbol.
+	codes []uint16
+	// trivial is set if only one symbol is used, in which case
+	// symbols take up no bits in the bit stream.
+	trivial bool
+}
+
+// writeSymbol writes a symbol using the code.
+func (h *huffmanCode) writeSymbol(b *bitWriter, sym int) {
+	if h.trivial {
+		return
+	}
+	b.writeBits(uint32(h.codes[sym]), uint(h.lengths[sym]))
+}
+
+// huffmanNode is a node used when building a Huffman tree.
+type huffmanNode struct {
+	count       uint32
+	symbol      int
+	left, right int
+}
+
+// buildCodeLengths returns Huffman code lengths for the symbols in
+// hist, none of which exceeds maxLength.
+func buildCodeLengths(hist []uint32, maxLength int) []uint8 {
+	lengths := make([]uint8, len(hist))
+
+	var used []int
+	for sym, c := range hist {
+		if c != 0 {
+			used = append(used, sym)
+		}
+	}
+	if len(used) == 0 {
+		return lengths
+	} else if len(used) == 1 {
+		lengths[used[0]] = 1
+		return lengths
+	}
+
+	counts := make([]uint32, len(used))
+	for i, sym := range used {
+		counts[i] = hist[sym]
+	}
+
+	// If the tree is too deep, flatten the distribution and try again.
+	for countMin := uint32(1); ; countMin *= 2 {
+		for i := range counts {
+			if counts[i] < countMin {
+				counts[i] = countMin
+			}
+		}
+		if buildTree(used, counts, lengths, maxLength) {
+			return lengths
+		}
+	}
+}
+
+// buildTree computes code lengths with a two-queue Huffman tree
+// construction, returning false if any length exceeds maxLength.
+func buildTree(used []int, counts []uint32, lengths []uint8, maxLength int) bool {
+	nodes := make([]huffmanNode, 0, 2*len(used))
+	for i, sym := range used {
+		nodes = append(nodes, huffmanNode{count: counts[i], symbol: sym, left: -1, right: -1})
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].count < nodes[j].count })
+
+	leaf, internal := 0, len(nodes)
+	nLeaves := len(nodes)
+	pick := func() int {
+		if leaf < nLeaves && (internal >= len(nodes) || nodes[leaf].count <= nodes[internal].count) {
+			leaf++
+			return leaf - 1
+		}
+		internal++
+		return internal - 1
+	}
+	for i := 0; i < nLeaves-1; i++ {
+		a := pick()
+		b := pick()
+		nodes = append(nodes, huffmanNode{count: nodes[a].count + nodes[b].count, symbol: -1, left: a, right: b})
+	}
+
+	ok := true
+	var walk func(n, depth int)
+	walk = func(n, depth int) {
+		if nodes[n].symbol >= 0 {
+			if depth > maxLength {
+				ok = false
+			}
+			lengths[nodes[n].symbol] = uint8(depth)
+			return
+		}
+		walk(nodes[n].left, depth+1)
+		walk(nodes[n].right, depth+1)
+	}
+	walk(len(nodes)-1, 0)
+	return ok
+}
+
+// newHuffmanCode returns the canonical Huffman code with the given code
+// lengths.
+func newHuffmanCode(lengths []uint8) *huffmanCode {
+	h := &huffmanCode{lengths: lengths, codes: make([]uint16, len(lengths))}
+
+	var count [16]int
+	nUsed := 0
+	for _, l := range lengths {
+		if l != 0 {
+			count[l]++
+			nUsed++
+		}
+	}
+	h.trivial = nUsed <= 1
+
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		// Reverse the code, since VP8L reads codes bit by bit.
+		r := 0
+		for i := 0; i < int(l); i++ {
+			r = r<<1 | (c>>i)&1
+		}
+		h.codes[sym] = uint16(r)
+	}
+	return h
+}
+
+// codeLengthCodeOrder is the order in which code length code lengths
+// are written, specified in section 5.2.2.
+var codeLengthCodeOrder = [19]uint8{
+	17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// lengthToken is a run-length encoded code length.
+type lengthToken struct {
+	code  uint8
+	extra uint8
+}
+
+// tokenizeLengths run-length encodes a list of code lengths.
+func tokenizeLengths(lengths []uint8) (tokens []lengthToken) {
+	prev := uint8(8)
+	for i := 0; i < len(lengths); {
+		v := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == v {
+			run++
+		}
+		i += run
+
+		if v == 0 {
+			for run >= 11 {
+				n := run
+				if n > 138 {
+					n = 138
+				}
+				tokens = append(tokens, lengthToken{18, uint8(n - 11)})
+				run -= n
+			}
+			if run >= 3 {
+				tokens = append(tokens, lengthToken{17, uint8(run - 3)})
+				run = 0
+			}
+		} else {
+			if v != prev {
+				tokens = append(tokens, lengthToken{v, 0})
+				prev = v
+				run--
+			}
+			for run >= 3 {
+				n := run
+				if n > 6 {
+					n = 6
+				}
+				tokens = append(tokens, lengthToken{16, uint8(n - 3)})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, lengthToken{v, 0})
+		}
+	}
+	return
+}
+
+// writeHuffmanCode builds a Huffman code for the symbol histogram hist
+// and writes it to the bit stream.
+func writeHuffmanCode(b *bitWriter, hist []uint32) *huffmanCode {
+	var symbols [2]int
+	nSymbols := 0
+	for sym, c := range hist {
+		if c == 0 {
+			continue
+		}
+		if nSymbols < 2 {
+			symbols[nSymbols] = sym
+		}
+		nSymbols++
+	}
+
+	// Use a simple code when possible.
+	if nSymbols <= 2 && symbols[0] < 256 && symbols[1] < 256 {
+		lengths := make([]uint8, len(hist))
+		b.writeBits(1, 1)
+		if nSymbols <= 1 {
+			b.writeBits(0, 1)
+			lengths[symbols[0]] = 1
+		} else {
+			b.writeBits(1, 1)
+			lengths[symbols[0]] = 1
+			lengths[symbols[1]] = 1
+		}
+		if symbols[0] < 2 {
+			b.writeBits(0, 1)
+			b.writeBits(uint32(symbols[0]), 1)
+		} else {
+			b.writeBits(1, 1)
+			b.writeBits(uint32(symbols[0]), 8)
+		}
+		if nSymbols == 2 {
+			b.writeBits(uint32(symbols[1]), 8)
+		}
+		return newHuffmanCode(lengths)
+	}
+
+	lengths := buildCodeLengths(hist, 15)
+	tokens := tokenizeLengths(lengths)
+
+	var tokenHist [19]uint32
+	for _, t := range tokens {
+		tokenHist[t.code]++
+	}
+	tokenLengths := buildCodeLengths(tokenHist[:], 7)
+	tokenCode := newHuffmanCode(tokenLengths)
+
+	nCodes := 4
+	for i := len(codeLengthCodeOrder) - 1; i >= 4; i-- {
+		if tokenLengths[codeLengthCodeOrder[i]] != 0 {
+			nCodes = i + 1
+			break
+		}
+	}
+
+	b.writeBits(0, 1)
+	b.writeBits(uint32(nCodes-4), 4)
+	for i := 0; i < nCodes; i++ {
+		b.writeBits(uint32(tokenLengths[codeLengthCodeOrder[i]]), 3)
+	}
+
+	// Write every code length, rather than a maximum symbol.
+	b.writeBits(0, 1)
+	for _, t := range tokens {
+		tokenCode.writeSymbol(b, int(t.code))
+		switch t.code {
+		case 16:
+			b.writeBits(uint32(t.extra), 2)
+		case 17:
+			b.writeBits(uint32(t.extra), 3)
+		case 18:
+			b.writeBits(uint32(t.extra), 7)
+		}
+	}
+
+	return newHuffmanCode(lengths)
+}
@@ -0,0 +1,595 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package webp
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// This file implements the VP8L lossless bitstream, as described in
+// "WebP Lossless Bitstream Specification". Pixels are handled as ARGB
+// values packed into a uint32.
+
+const (
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+	transformColorIndexing = 3
+
+	nLiteralCodes  = 256
+	nLengthCodes   = 24
+	nDistanceCodes = 40
+
+	colorCacheMultiplier = 0x1e35a7bd
+
+	// maxLength is the longest possible backward reference.
+	maxLength = 4096
+	// maxDistance is the furthest possible backward reference.
+	maxDistance = 1<<20 - 120
+	// minLength is the shortest backward reference worth emitting.
+	minLength = 3
+
+	hashBits = 16
+)
+
+// losslessOptions controls the VP8L encoder's trade-off between speed
+// and size.
+type losslessOptions struct {
+	predictor     bool
+	predictorBits uint
+	chainDepth    int
+	cacheBits     []uint
+}
+
+// losslessOptionsForEffort returns encoder settings for an effort level
+// from 1 to 9.
+func losslessOptionsForEffort(effort int) losslessOptions {
+	o := losslessOptions{predictorBits: 4, cacheBits: []uint{0}}
+	if effort >= 2 {
+		o.chainDepth = 1 << effort
+	}
+	if effort >= 3 {
+		o.predictor = true
+	}
+	if effort >= 4 {
+		o.cacheBits = []uint{10}
+	}
+	if effort >= 6 {
+		o.cacheBits = []uint{0, 6, 10}
+	}
+	if effort >= 8 {
+		o.predictorBits = 3
+	}
+	return o
+}
+
+// encodeLossless encodes ARGB pixels as a VP8L bitstream, not including
+// the RIFF container.
+func encodeLossless(pix []uint32, w, h int, hasAlpha bool, o losslessOptions) []byte {
+	b := &bitWriter{}
+	b.writeBits(0x2f, 8)
+	b.writeBits(uint32(w-1), 14)
+	b.writeBits(uint32(h-1), 14)
+	if hasAlpha {
+		b.writeBits(1, 1)
+	} else {
+		b.writeBits(0, 1)
+	}
+	b.writeBits(0, 3)
+
+	if palette := findPalette(pix); palette != nil {
+		pix, w = applyColorIndexing(b, pix, w, h, palette, o)
+	} else {
+		applySubtractGreen(b, pix)
+		if o.predictor {
+			applyPredictor(b, pix, w, h, o)
+		}
+	}
+	b.writeBits(0, 1)
+
+	// Try each color cache size, keeping whichever gives the smallest
+	// output.
+	var best []byte
+	for _, cacheBits := range o.cacheBits {
+		img := &bitWriter{buf: append([]byte(nil), b.buf...), acc: b.acc, nAcc: b.nAcc}
+		writeEntropyImage(img, pix, w, true, cacheBits, o.chainDepth)
+		if data := img.bytes(); best == nil || len(data) < len(best) {
+			best = data
+		}
+	}
+	return best
+}
+
+// findPalette returns the distinct colors in pix, sorted, if there are
+// no more than 256 of them. Otherwise, it returns nil.
+func findPalette(pix []uint32) []uint32 {
+	seen := make(map[uint32]struct{})
+	for _, c := range pix {
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		if len(seen) == 256 {
+			return nil
+		}
+		seen[c] = struct{}{}
+	}
+
+	palette := make([]uint32, 0, len(seen))
+	for c := range seen {
+		palette = append(palette, c)
+	}
+	sort.Slice(palette, func(i, j int) bool { return palette[i] < palette[j] })
+	return palette
+}
+
+// applyColorIndexing writes a color indexing transform, returning the
+// packed index image and its width.
+func applyColorIndexing(b *bitWriter, pix []uint32, w, h int, palette []uint32, o losslessOptions) ([]uint32, int) {
+	b.writeBits(1, 1)
+	b.writeBits(transformColorIndexing, 2)
+	b.writeBits(uint32(len(palette)-1), 8)
+
+	// The palette is delta-coded.
+	deltas := make([]uint32, len(palette))
+	for i := range palette {
+		if i == 0 {
+			deltas[i] = palette[i]
+		} else {
+			deltas[i] = subPixels(palette[i], palette[i-1])
+		}
+	}
+	writeEntropyImage(b, deltas, len(palette), false, 0, o.chainDepth)
+
+	// Bundle multiple indices into each pixel for small palettes.
+	xBits := uint(0)
+	switch {
+	case len(palette) <= 2:
+		xBits = 3
+	case len(palette) <= 4:
+		xBits = 2
+	case len(palette) <= 16:
+		xBits = 1
+	}
+	bitsPerIndex := 8 >> xBits
+	packedW := (w + 1<<xBits - 1) >> xBits
+
+	index := make(map[uint32]uint32, len(palette))
+	for i, c := range palette {
+		index[c] = uint32(i)
+	}
+
+	packed := make([]uint32, packedW*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			shift := uint(bitsPerIndex * (x & (1<<xBits - 1)))
+			packed[y*packedW+x>>xBits] |= index[pix[y*w+x]] << (8 + shift)
+		}
+	}
+	for i := range packed {
+		packed[i] |= 0xff000000
+	}
+	return packed, packedW
+}
+
+// applySubtractGreen writes a subtract green transform, applying it to
+// pix in place.
+func applySubtractGreen(b *bitWriter, pix []uint32) {
+	b.writeBits(1, 1)
+	b.writeBits(transformSubtractGreen, 2)
+
+	for i, c := range pix {
+		g := (c >> 8) & 0xff
+		pix[i] = subPixels(c, g<<16|g)
+	}
+}
+
+// nTiles returns the number of tiles of 1<<bits pixels needed to
+// cover size pixels.
+func nTiles(size int, bits uint) int {
+	return (size + 1<<bits - 1) >> bits
+}
+
+// applyPredictor writes a predictor transform, choosing the predictor
+// that gives the smallest residuals for each tile, and replaces pix
+// with the residuals.
+func applyPredictor(b *bitWriter, pix []uint32, w, h int, o losslessOptions) {
+	tileBits := o.predictorBits
+	tilesW, tilesH := nTiles(w, tileBits), nTiles(h, tileBits)
+	modes := make([]uint32, tilesW*tilesH)
+
+	for ty := 0; ty < tilesH; ty++ {
+		for tx := 0; tx < tilesW; tx++ {
+			x0, y0 := tx<<tileBits, ty<<tileBits
+			x1, y1 := min(x0+1<<tileBits, w), min(y0+1<<tileBits, h)
+
+			bestMode, bestCost := 0, -1
+			for mode := 0; mode < 14; mode++ {
+				cost := 0
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						cost += residualCost(subPixels(pix[y*w+x], predict(pix, w, x, y, mode)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					bestMode, bestCost = mode, cost
+				}
+			}
+			modes[ty*tilesW+tx] = 0xff000000 | uint32(bestMode)<<8
+		}
+	}
+
+	b.writeBits(1, 1)
+	b.writeBits(transformPredictor, 2)
+	b.writeBits(uint32(tileBits-2), 3)
+	writeEntropyImage(b, modes, tilesW, false, 0, o.chainDepth)
+
+	// Residuals depend on the original neighbors, so work backwards.
+	for y := h - 1; y >= 0; y-- {
+		for x := w - 1; x >= 0; x-- {
+			mode := int(modes[(y>>tileBits)*tilesW+x>>tileBits]>>8) & 0xf
+			pix[y*w+x] = subPixels(pix[y*w+x], predict(pix, w, x, y, mode))
+		}
+	}
+}
+
+// residualCost estimates the cost of encoding a residual.
+func residualCost(c uint32) int {
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		v := int((c >> shift) & 0xff)
+		if v >= 128 {
+			v = 256 - v
+		}
+		cost += v
+	}
+	return cost
+}
+
+// predict returns the predicted value of the pixel at (x, y) using the
+// given predictor mode. The first row and column always use the left
+// and top pixel respectively.
+func predict(pix []uint32, w, x, y, mode int) uint32 {
+	p := y*w + x
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return pix[p-1]
+	case x == 0:
+		return pix[p-w]
+	}
+
+	// The top-right pixel of the last column is the first pixel of the
+	// current row, which is what p-w+1 refers to.
+	L, T, TR, TL := pix[p-1], pix[p-w], pix[p-w+1], pix[p-w-1]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return L
+	case 2:
+		return T
+	case 3:
+		return TR
+	case 4:
+		return TL
+	case 5:
+		return average2(average2(L, TR), T)
+	case 6:
+		return average2(L, TL)
+	case 7:
+		return average2(L, T)
+	case 8:
+		return average2(TL, T)
+	case 9:
+		return average2(T, TR)
+	case 10:
+		return average2(average2(L, TL), average2(T, TR))
+	case 11:
+		return selectPixel(L, T, TL)
+	case 12:
+		return clampAddSubtractFull(L, T, TL)
+	case 13:
+		return clampAddSubtractHalf(average2(L, T), TL)
+	}
+	panic("webp: invalid predictor mode")
+}
+
+// subPixels subtracts b from a, channel by channel.
+func subPixels(a, b uint32) uint32 {
+	ag := 0x00ff00ff + (a & 0xff00ff00) - (b & 0xff00ff00)
+	rb := 0xff00ff00 + (a & 0x00ff00ff) - (b & 0x00ff00ff)
+	return (ag & 0xff00ff00) | (rb & 0x00ff00ff)
+}
+
+// average2 returns the average of a and b, channel by channel.
+func average2(a, b uint32) uint32 {
+	return (((a ^ b) & 0xfefefefe) >> 1) + (a & b)
+}
+
+// selectPixel implements the Select predictor.
+func selectPixel(L, T, TL uint32) uint32 {
+	pL, pT := 0, 0
+	for shift := 0; shift < 32; shift += 8 {
+		l, t, tl := int((L>>shift)&0xff), int((T>>shift)&0xff), int((TL>>shift)&0xff)
+		pL += abs(t - tl)
+		pT += abs(l - tl)
+	}
+	if pL < pT {
+		return L
+	}
+	return T
+}
+
+// clampAddSubtractFull implements the ClampAddSubtractFull predictor.
+func clampAddSubtractFull(a, b, c uint32) (r uint32) {
+	for shift := 0; shift < 32; shift += 8 {
+		v := int((a>>shift)&0xff) + int((b>>shift)&0xff) - int((c>>shift)&0xff)
+		r |= uint32(clamp255(v)) << shift
+	}
+	return
+}
+
+// clampAddSubtractHalf implements the ClampAddSubtractHalf predictor.
+func clampAddSubtractHalf(a, b uint32) (r uint32) {
+	for shift := 0; shift < 32; shift += 8 {
+		av, bv := int((a>>shift)&0xff), int((b>>shift)&0xff)
+		r |= uint32(clamp255(av+(av-bv)/2)) << shift
+	}
+	return
+}
+
+func clamp255(v int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return v
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Symbol kinds in an entropy-coded image.
+const (
+	symbolLiteral = iota
+	symbolCache
+	symbolCopy
+)
+
+// symbol is a literal pixel, color cache reference, or backward
+// reference.
+type symbol struct {
+	kind uint8
+	// value is the pixel, cache index, or length.
+	value uint32
+	// dist is the distance code of a backward reference.
+	dist uint32
+}
+
+// prefixEncode returns the prefix code and extra bits for a length or
+// distance value.
+func prefixEncode(v uint32) (code int, nExtra uint, extra uint32) {
+	d := v - 1
+	if d < 4 {
+		return int(d), 0, 0
+	}
+	hi := uint(bits.Len32(d) - 1)
+	second := (d >> (hi - 1)) & 1
+	nExtra = hi - 1
+	return int(2*hi + uint(second)), nExtra, d & (1<<nExtra - 1)
+}
+
+// distanceCodes returns the short distance codes for an image of the
+// given width, indexed by distance.
+func distanceCodes(w int) map[int]uint32 {
+	codes := make(map[int]uint32, len(distanceMapTable))
+	for i, off := range distanceMapTable {
+		d := off[0] + off[1]*w
+		if _, ok := codes[d]; d >= 1 && !ok {
+			codes[d] = uint32(i + 1)
+		}
+	}
+	return codes
+}
+
+// distanceMapTable is the (xi, yi) offset of each of the 120 short
+// distance codes, specified in section 4.2.2.
+var distanceMapTable = [120][2]int{
+	{0, 1}, {1, 0}, {1, 1}, {-1, 1}, {0, 2}, {2, 0}, {1, 2}, {-1, 2},
+	{2, 1}, {-2, 1}, {2, 2}, {-2, 2}, {0, 3}, {3, 0}, {1, 3}, {-1, 3},
+	{3, 1}, {-3, 1}, {2, 3}, {-2, 3}, {3, 2}, {-3, 2}, {0, 4}, {4, 0},
+	{1, 4}, {-1, 4}, {4, 1}, {-4, 1}, {3, 3}, {-3, 3}, {2, 4}, {-2, 4},
+	{4, 2}, {-4, 2}, {0, 5}, {3, 4}, {-3, 4}, {4, 3}, {-4, 3}, {5, 0},
+	{1, 5}, {-1, 5}, {5, 1}, {-5, 1}, {2, 5}, {-2, 5}, {5, 2}, {-5, 2},
+	{4, 4}, {-4, 4}, {3, 5}, {-3, 5}, {5, 3}, {-5, 3}, {0, 6}, {6, 0},
+	{1, 6}, {-1, 6}, {6, 1}, {-6, 1}, {2, 6}, {-2, 6}, {6, 2}, {-6, 2},
+	{4, 5}, {-4, 5}, {5, 4}, {-5, 4}, {3, 6}, {-3, 6}, {6, 3}, {-6, 3},
+	{0, 7}, {7, 0}, {1, 7}, {-1, 7}, {5, 5}, {-5, 5}, {7, 1}, {-7, 1},
+	{4, 6}, {-4, 6}, {6, 4}, {-6, 4}, {2, 7}, {-2, 7}, {7, 2}, {-7, 2},
+	{3, 7}, {-3, 7}, {7, 3}, {-7, 3}, {5, 6}, {-5, 6}, {6, 5}, {-6, 5},
+	{8, 0}, {4, 7}, {-4, 7}, {7, 4}, {-7, 4}, {8, 1}, {8, 2}, {6, 6},
+	{-6, 6}, {8, 3}, {5, 7}, {-5, 7}, {7, 5}, {-7, 5}, {8, 4}, {6, 7},
+	{-6, 7}, {7, 6}, {-7, 6}, {8, 5}, {7, 7}, {-7, 7}, {8, 6}, {8, 7},
+}
+
+// findSymbols converts pixels into literals, color cache references
+// and backward references found by following up to chainDepth hash
+// chain entries.
+func findSymbols(pix []uint32, w int, cacheBits uint, chainDepth int) []symbol {
+	syms := make([]symbol, 0, len(pix))
+
+	var cache []uint32
+	if cacheBits > 0 {
+		cache = make([]uint32, 1<<cacheBits)
+	}
+	insert := func(c uint32) {
+		if cache != nil {
+			cache[(c*colorCacheMultiplier)>>(32-cacheBits)] = c
+		}
+	}
+
+	var head []int32
+	var prev []int32
+	if chainDepth > 0 {
+		head = make([]int32, 1<<hashBits)
+		for i := range head {
+			head[i] = -1
+		}
+		prev = make([]int32, len(pix))
+	}
+	hash := func(i int) uint32 {
+		return ((pix[i] * colorCacheMultiplier) ^ (pix[i+1] * 0x9e3779b1)) >> (32 - hashBits)
+	}
+	addHash := func(i int) {
+		if i+1 < len(pix) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+	matchLen := func(i, j int) int {
+		n := 0
+		for i+n < len(pix) && n < maxLength && pix[i+n] == pix[j+n] {
+			n++
+		}
+		return n
+	}
+	codes := distanceCodes(w)
+
+	for i := 0; i < len(pix); {
+		bestLen, bestDist := 0, 0
+		if chainDepth > 0 && i+minLength <= len(pix) {
+			// Always consider the pixels to the left and above.
+			for _, d := range [2]int{1, w} {
+				if d <= i {
+					if n := matchLen(i, i-d); n > bestLen {
+						bestLen, bestDist = n, d
+					}
+				}
+			}
+			for j, depth := head[hash(i)], 0; j >= 0 && depth < chainDepth && bestLen < maxLength; j, depth = prev[j], depth+1 {
+				d := i - int(j)
+				if d > maxDistance {
+					break
+				}
+				if n := matchLen(i, int(j)); n > bestLen {
+					bestLen, bestDist = n, d
+				}
+			}
+		}
+
+		if bestLen >= minLength {
+			dist, ok := codes[bestDist]
+			if !ok {
+				dist = uint32(bestDist + len(distanceMapTable))
+			}
+			syms = append(syms, symbol{kind: symbolCopy, value: uint32(bestLen), dist: dist})
+			for k := 0; k < bestLen; k++ {
+				insert(pix[i+k])
+				addHash(i + k)
+			}
+			i += bestLen
+			continue
+		}
+
+		c := pix[i]
+		if cache != nil {
+			if key := (c * colorCacheMultiplier) >> (32 - cacheBits); cache[key] == c {
+				syms = append(syms, symbol{kind: symbolCache, value: key})
+				if head != nil {
+					addHash(i)
+				}
+				i++
+				continue
+			}
+		}
+		syms = append(syms, symbol{kind: symbolLiteral, value: c})
+		insert(c)
+		if head != nil {
+			addHash(i)
+		}
+		i++
+	}
+	return syms
+}
+
+// writeEntropyImage writes an entropy-coded image of the given width.
+// The top-level image includes the (unused) meta prefix code flag.
+func writeEntropyImage(b *bitWriter, pix []uint32, w int, topLevel bool, cacheBits uint, chainDepth int) {
+	syms := findSymbols(pix, w, cacheBits, chainDepth)
+
+	cacheSize := 0
+	if cacheBits > 0 {
+		cacheSize = 1 << cacheBits
+		b.writeBits(1, 1)
+		b.writeBits(uint32(cacheBits), 4)
+	} else {
+		b.writeBits(0, 1)
+	}
+	if topLevel {
+		b.writeBits(0, 1)
+	}
+
+	var (
+		green = make([]uint32, nLiteralCodes+nLengthCodes+cacheSize)
+		red   = make([]uint32, nLiteralCodes)
+		blue  = make([]uint32, nLiteralCodes)
+		alpha = make([]uint32, nLiteralCodes)
+		dist  = make([]uint32, nDistanceCodes)
+	)
+	for _, s := range syms {
+		switch s.kind {
+		case symbolLiteral:
+			alpha[s.value>>24]++
+			red[(s.value>>16)&0xff]++
+			green[(s.value>>8)&0xff]++
+			blue[s.value&0xff]++
+		case symbolCache:
+			green[nLiteralCodes+nLengthCodes+int(s.value)]++
+		case symbolCopy:
+			code, _, _ := prefixEncode(s.value)
+			green[nLiteralCodes+code]++
+			code, _, _ = prefixEncode(s.dist)
+			dist[code]++
+		}
+	}
+
+	greenCode := writeHuffmanCode(b, green)
+	redCode := writeHuffmanCode(b, red)
+	blueCode := writeHuffmanCode(b, blue)
+	alphaCode := writeHuffmanCode(b, alpha)
+	distCode := writeHuffmanCode(b, dist)
+
+	for _, s := range syms {
+		switch s.kind {
+		case symbolLiteral:
+			greenCode.writeSymbol(b, int((s.value>>8)&0xff))
+			redCode.writeSymbol(b, int((s.value>>16)&0xff))
+			blueCode.writeSymbol(b, int(s.value&0xff))
+			alphaCode.writeSymbol(b, int(s.value>>24))
+		case symbolCache:
+			greenCode.writeSymbol(b, nLiteralCodes+nLengthCodes+int(s.value))
+		case symbolCopy:
+			code, nExtra, extra := prefixEncode(s.value)
+			greenCode.writeSymbol(b, nLiteralCodes+code)
+			b.writeBits(extra, nExtra)
+			code, nExtra, extra = prefixEncode(s.dist)
+			distCode.writeSymbol(b, code)
+			b.writeBits(extra, nExtra)
+		}
+	}
+}
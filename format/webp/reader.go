@@ -0,0 +1,595 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+
+	"golang.org/x/image/webp"
+)
+
+// VP8X feature flags.
+const (
+	flagAnimation = 1 << 1
+	flagXMP       = 1 << 2
+	flagEXIF      = 1 << 3
+	flagAlpha     = 1 << 4
+	flagICCP      = 1 << 5
+)
+
+// ANMF flags.
+const (
+	anmfDispose = 1 << 0
+	anmfNoBlend = 1 << 1
+)
+
+// A FormatError reports that the input is not a valid WebP image.
+type FormatError string
+
+func (e FormatError) Error() string { return "webp: invalid format: " + string(e) }
+
+// Metadata contains the metadata of an extended format WebP image.
+type Metadata struct {
+	// ICCProfile is the ICC color profile.
+	ICCProfile []byte
+
+	// EXIF is the EXIF data, in TIFF format.
+	EXIF []byte
+
+	// XMP is the XMP packet.
+	XMP []byte
+}
+
+// IsEmpty returns true if there is no metadata.
+func (md *Metadata) IsEmpty() bool {
+	return md == nil || (md.ICCProfile == nil && md.EXIF == nil && md.XMP == nil)
+}
+
+// Frame is a single frame of an animated WebP image.
+type Frame struct {
+	// Image is the frame's image data. Its bounds specify the
+	// position of the frame on the canvas.
+	Image image.Image
+
+	// Duration is how long the frame is displayed, in milliseconds.
+	Duration int
+
+	// Dispose specifies that the frame's area is cleared to the
+	// background color before the next frame is rendered.
+	Dispose bool
+
+	// Blend specifies that the frame is alpha-blended onto the
+	// canvas, rather than replacing its area.
+	Blend bool
+}
+
+// Animation is a WebP image, which may contain multiple frames.
+type Animation struct {
+	// Frames contains each frame of the animation. A still image has
+	// only one frame.
+	Frames []*Frame
+
+	// Width and Height are the dimensions of the canvas.
+	Width, Height int
+
+	// LoopCount is the number of times to play the animation. A value
+	// of 0 means the animation loops forever.
+	LoopCount int
+
+	// Background is the suggested background color of the canvas.
+	Background color.NRGBA
+}
+
+// DecodeOptions specifies options for decoding.
+type DecodeOptions struct {
+	// Metadata, if not nil, is filled in with the image's metadata.
+	Metadata *Metadata
+}
+
+// chunk is a RIFF chunk.
+type chunk struct {
+	fourCC string
+	data   []byte
+}
+
+// parseChunks splits data into a list of RIFF chunks.
+func parseChunks(data []byte) ([]chunk, error) {
+	var chunks []chunk
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, FormatError("truncated chunk header")
+		}
+		n := binary.LittleEndian.Uint32(data[4:8])
+		if uint64(n) > uint64(len(data)-8) {
+			return nil, FormatError("truncated chunk")
+		}
+		chunks = append(chunks, chunk{string(data[:4]), data[8 : 8+n]})
+
+		// The padding byte may be missing at the end of the file.
+		next := 8 + int(n) + int(n&1)
+		if next > len(data) {
+			next = len(data)
+		}
+		data = data[next:]
+	}
+	return chunks, nil
+}
+
+// readChunks reads a WebP file, returning its chunks.
+func readChunks(r io.Reader) ([]chunk, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, FormatError("not a WebP file")
+	}
+	if n := binary.LittleEndian.Uint32(data[4:8]); uint64(n) < uint64(len(data)-8) {
+		data = data[:8+n]
+	}
+
+	chunks, err := parseChunks(data[12:])
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 {
+		return nil, FormatError("no image data")
+	}
+	return chunks, nil
+}
+
+// readChunk stores the contents of an ICCP, EXIF or XMP chunk.
+func (md *Metadata) readChunk(c chunk) {
+	switch c.fourCC {
+	case "ICCP":
+		md.ICCProfile = c.data
+	case "EXIF":
+		// Some encoders include the JPEG APP1 header.
+		md.EXIF = bytes.TrimPrefix(c.data, []byte("Exif\x00\x00"))
+	case "XMP ":
+		md.XMP = c.data
+	}
+}
+
+// readUint24 reads a little-endian 24-bit integer.
+func readUint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+// vp8xChunk returns a VP8X chunk with the given flags and canvas size.
+func vp8xChunk(flags byte, width, height int) chunk {
+	data := make([]byte, 10)
+	data[0] = flags
+	putUint24(data[4:], width-1)
+	putUint24(data[7:], height-1)
+	return chunk{"VP8X", data}
+}
+
+// decodeBitstream decodes a VP8 or VP8L bitstream, along with any ALPH
+// chunk.
+func decodeBitstream(alph *chunk, bitstream chunk) (image.Image, error) {
+	var buf bytes.Buffer
+	if alph != nil && bitstream.fourCC == "VP8 " {
+		// Alpha requires the extended format, which in turn requires
+		// the image dimensions.
+		var cfgBuf bytes.Buffer
+		if err := writeRIFF(&cfgBuf, bitstream); err != nil {
+			return nil, err
+		}
+		cfg, err := webp.DecodeConfig(&cfgBuf)
+		if err != nil {
+			return nil, err
+		}
+		err = writeRIFF(&buf, vp8xChunk(flagAlpha, cfg.Width, cfg.Height), *alph, bitstream)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := writeRIFF(&buf, bitstream); err != nil {
+		return nil, err
+	}
+	m, err := webp.Decode(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lossless images without alpha are returned as NRGBA images too,
+	// but they are opaque. The header only hints at whether alpha is
+	// used, so the pixels are checked as well.
+	if m, ok := m.(*image.NRGBA); ok && bitstream.fourCC == "VP8L" && !vp8lHasAlpha(bitstream.data) && m.Opaque() {
+		return &image.RGBA{Pix: m.Pix, Stride: m.Stride, Rect: m.Rect}, nil
+	}
+	return m, nil
+}
+
+// vp8lHasAlpha reports whether the header of a VP8L bitstream says that
+// the image uses its alpha channel.
+func vp8lHasAlpha(data []byte) bool {
+	return len(data) < 5 || data[4]&0x10 != 0
+}
+
+// vp8lColorModel returns the color model of the image in a VP8L bitstream
+// with the given header.
+func vp8lColorModel(data []byte) color.Model {
+	if vp8lHasAlpha(data) {
+		return color.NRGBAModel
+	}
+	return color.RGBAModel
+}
+
+// decodeFrameData decodes the image data of a still image or a frame,
+// ignoring any unknown chunks.
+func decodeFrameData(chunks []chunk) (image.Image, error) {
+	var alph *chunk
+	for i, c := range chunks {
+		switch c.fourCC {
+		case "ALPH":
+			alph = &chunks[i]
+		case "VP8 ", "VP8L":
+			return decodeBitstream(alph, c)
+		}
+	}
+	return nil, FormatError("missing image data")
+}
+
+// translateImage moves the bounds of an image returned by
+// decodeBitstream by the given offset.
+func translateImage(img image.Image, x, y int) image.Image {
+	p := image.Pt(x, y)
+	switch img := img.(type) {
+	case *image.NRGBA:
+		img.Rect = img.Rect.Add(p)
+	case *image.RGBA:
+		img.Rect = img.Rect.Add(p)
+	case *image.YCbCr:
+		img.Rect = img.Rect.Add(p)
+	case *image.NYCbCrA:
+		img.Rect = img.Rect.Add(p)
+	default:
+		b := img.Bounds()
+		dst := image.NewNRGBA(b.Add(p))
+		draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+		return dst
+	}
+	return img
+}
+
+// decodeANMF decodes an animation frame.
+func decodeANMF(data []byte) (*Frame, error) {
+	if len(data) < 16 {
+		return nil, FormatError("truncated ANMF chunk")
+	}
+	x, y := 2*readUint24(data[0:]), 2*readUint24(data[3:])
+	w, h := readUint24(data[6:])+1, readUint24(data[9:])+1
+
+	chunks, err := parseChunks(data[16:])
+	if err != nil {
+		return nil, err
+	}
+	m, err := decodeFrameData(chunks)
+	if err != nil {
+		return nil, err
+	}
+	if b := m.Bounds(); b.Dx() != w || b.Dy() != h {
+		return nil, FormatError("frame size mismatch")
+	}
+
+	return &Frame{
+		Image:    translateImage(m, x, y),
+		Duration: readUint24(data[12:]),
+		Dispose:  data[15]&anmfDispose != 0,
+		Blend:    data[15]&anmfNoBlend == 0,
+	}, nil
+}
+
+// DecodeAll reads a WebP image from r and returns all of its frames.
+func DecodeAll(r io.Reader) (*Animation, error) {
+	return DecodeAllWithOptions(r, nil)
+}
+
+// DecodeAllWithOptions reads a WebP image from r and returns all of its
+// frames, according to the options specified.
+func DecodeAllWithOptions(r io.Reader, o *DecodeOptions) (*Animation, error) {
+	if o == nil {
+		o = &DecodeOptions{}
+	}
+
+	chunks, err := readChunks(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch chunks[0].fourCC {
+	case "VP8 ", "VP8L":
+		m, err := decodeBitstream(nil, chunks[0])
+		if err != nil {
+			return nil, err
+		}
+		b := m.Bounds()
+		return &Animation{Frames: []*Frame{{Image: m}}, Width: b.Dx(), Height: b.Dy()}, nil
+	case "VP8X":
+	default:
+		return nil, FormatError("unexpected " + chunks[0].fourCC + " chunk")
+	}
+
+	vp8x := chunks[0].data
+	if len(vp8x) < 10 {
+		return nil, FormatError("truncated VP8X chunk")
+	}
+	flags := vp8x[0]
+	a := &Animation{Width: readUint24(vp8x[4:]) + 1, Height: readUint24(vp8x[7:]) + 1}
+
+	for _, c := range chunks[1:] {
+		switch c.fourCC {
+		case "ICCP", "EXIF", "XMP ":
+			if o.Metadata != nil {
+				o.Metadata.readChunk(c)
+			}
+		case "ANIM":
+			if len(c.data) < 6 {
+				return nil, FormatError("truncated ANIM chunk")
+			}
+			a.Background = color.NRGBA{R: c.data[2], G: c.data[1], B: c.data[0], A: c.data[3]}
+			a.LoopCount = int(binary.LittleEndian.Uint16(c.data[4:]))
+		case "ANMF":
+			if flags&flagAnimation == 0 {
+				continue
+			}
+			f, err := decodeANMF(c.data)
+			if err != nil {
+				return nil, err
+			}
+			if !f.Image.Bounds().In(a.Bounds()) {
+				return nil, FormatError("frame outside of canvas")
+			}
+			a.Frames = append(a.Frames, f)
+		}
+	}
+
+	if flags&flagAnimation == 0 {
+		m, err := decodeFrameData(chunks[1:])
+		if err != nil {
+			return nil, err
+		}
+		if m.Bounds() != a.Bounds() {
+			return nil, FormatError("image size mismatch")
+		}
+		a.Frames = []*Frame{{Image: m}}
+	} else if len(a.Frames) == 0 {
+		return nil, FormatError("no frames")
+	}
+
+	return a, nil
+}
+
+// Bounds returns the bounds of the canvas.
+func (a *Animation) Bounds() image.Rectangle {
+	return image.Rect(0, 0, a.Width, a.Height)
+}
+
+// Decode reads a WebP image from r and returns it as an image.Image. For
+// animated images, the first frame is returned.
+func Decode(r io.Reader) (image.Image, error) {
+	return DecodeWithOptions(r, nil)
+}
+
+// DecodeWithOptions reads a WebP image from r and returns it as an
+// image.Image, according to the options specified. For animated
+// images, the first frame is returned.
+func DecodeWithOptions(r io.Reader, o *DecodeOptions) (image.Image, error) {
+	a, err := DecodeAllWithOptions(r, o)
+	if err != nil {
+		return nil, err
+	}
+
+	m := a.Frames[0].Image
+	if m.Bounds() == a.Bounds() {
+		return m, nil
+	}
+	canvas := image.NewNRGBA(a.Bounds())
+	draw.Draw(canvas, m.Bounds(), m, m.Bounds().Min, draw.Src)
+	return canvas, nil
+}
+
+// DecodeConfig returns the color model and dimensions of a WebP image
+// without decoding the entire image.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	return DecodeConfigWithOptions(r, nil)
+}
+
+// readChunkHeader reads the header of the next RIFF chunk from r,
+// returning its FourCC and the size of its data. It returns io.EOF if
+// there are no more chunks.
+func readChunkHeader(r io.Reader) (string, uint32, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = FormatError("truncated chunk header")
+		}
+		return "", 0, err
+	}
+	return string(hdr[:4]), binary.LittleEndian.Uint32(hdr[4:]), nil
+}
+
+// readChunkData reads n bytes of chunk data from r, followed by any
+// padding.
+func readChunkData(r io.Reader, n uint32) ([]byte, error) {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, FormatError("truncated chunk")
+	}
+	return data, skipChunkData(r, n, n)
+}
+
+// skipChunkData skips the rest of the data of a chunk of n bytes, of
+// which read bytes have already been read, followed by any padding. The
+// padding byte may be missing at the end of the file.
+func skipChunkData(r io.Reader, n, read uint32) error {
+	rest := int64(n) - int64(read)
+	if m, _ := io.CopyN(io.Discard, r, rest+int64(n&1)); m < rest {
+		return FormatError("truncated chunk")
+	}
+	return nil
+}
+
+// DecodeConfigWithOptions returns the color model and dimensions of a
+// WebP image without decoding the entire image, according to the options
+// specified. Only the chunks needed for the configuration and metadata
+// are read. The image data is skipped over if metadata follows it.
+func DecodeConfigWithOptions(r io.Reader, o *DecodeOptions) (image.Config, error) {
+	cfg, _, err := decodeConfig(r, o, false)
+	return cfg, err
+}
+
+// DecodeFrameCount returns the color model and dimensions of a WebP image
+// and the number of frames that DecodeAllWithOptions would return, without
+// decoding any of them, according to the options specified.
+func DecodeFrameCount(r io.Reader, o *DecodeOptions) (image.Config, int, error) {
+	return decodeConfig(r, o, true)
+}
+
+// decodeConfig implements DecodeConfigWithOptions and DecodeFrameCount.
+// The frames are only counted if countFrames is set.
+func decodeConfig(r io.Reader, o *DecodeOptions, countFrames bool) (image.Config, int, error) {
+	var md *Metadata
+	if o != nil {
+		md = o.Metadata
+	}
+
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil || string(riff[:4]) != "RIFF" || string(riff[8:12]) != "WEBP" {
+		return image.Config{}, 0, FormatError("not a WebP file")
+	}
+	r = io.LimitReader(r, int64(binary.LittleEndian.Uint32(riff[4:]))-4)
+
+	fourCC, n, err := readChunkHeader(r)
+	if err == io.EOF {
+		return image.Config{}, 0, FormatError("no image data")
+	} else if err != nil {
+		return image.Config{}, 0, err
+	}
+
+	switch fourCC {
+	case "VP8 ", "VP8L":
+		// The dimensions are at the start of the bitstream.
+		if n > 32 {
+			n = 32
+		}
+		head := make([]byte, n)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return image.Config{}, 0, FormatError("truncated chunk")
+		}
+		var buf bytes.Buffer
+		if err := writeRIFF(&buf, chunk{fourCC, head}); err != nil {
+			return image.Config{}, 0, err
+		}
+		cfg, err := webp.DecodeConfig(&buf)
+		if err != nil {
+			return image.Config{}, 0, err
+		}
+		if fourCC == "VP8L" {
+			cfg.ColorModel = vp8lColorModel(head)
+		}
+		return cfg, 1, nil
+	case "VP8X":
+	default:
+		return image.Config{}, 0, FormatError("unexpected " + fourCC + " chunk")
+	}
+
+	if n < 10 {
+		return image.Config{}, 0, FormatError("truncated VP8X chunk")
+	}
+	var vp8x [10]byte
+	if _, err := io.ReadFull(r, vp8x[:]); err != nil {
+		return image.Config{}, 0, FormatError("truncated VP8X chunk")
+	}
+	if err := skipChunkData(r, n, 10); err != nil {
+		return image.Config{}, 0, err
+	}
+	flags := vp8x[0]
+	cfg := image.Config{
+		ColorModel: color.NRGBAModel,
+		Width:      readUint24(vp8x[4:]) + 1,
+		Height:     readUint24(vp8x[7:]) + 1,
+	}
+	if flags&flagAlpha == 0 {
+		cfg.ColorModel = color.RGBAModel
+	}
+	animated := flags&flagAnimation != 0
+	if animated && md == nil && !countFrames {
+		return cfg, 0, nil
+	}
+
+	// The ICC profile precedes the image data, but EXIF and XMP metadata
+	// follow it.
+	// Counting the frames of an animation needs every chunk.
+	trailing := md != nil && flags&(flagEXIF|flagXMP) != 0 || animated && countFrames
+	found := false
+	frames := 0
+	for {
+		fourCC, n, err := readChunkHeader(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return image.Config{}, 0, err
+		}
+
+		var read uint32
+		switch fourCC {
+		case "ICCP", "EXIF", "XMP ":
+			if md != nil {
+				data, err := readChunkData(r, n)
+				if err != nil {
+					return image.Config{}, 0, err
+				}
+				md.readChunk(chunk{fourCC, data})
+				continue
+			}
+		case "ALPH":
+			if !found {
+				cfg.ColorModel = color.NYCbCrAModel
+			}
+			found = true
+		case "VP8 ":
+			if !found {
+				cfg.ColorModel = color.YCbCrModel
+			}
+			found = true
+		case "VP8L":
+			if !found {
+				var head [5]byte
+				if n < 5 {
+					return image.Config{}, 0, FormatError("truncated VP8L chunk")
+				}
+				if _, err := io.ReadFull(r, head[:]); err != nil {
+					return image.Config{}, 0, FormatError("truncated VP8L chunk")
+				}
+				read = 5
+				cfg.ColorModel = vp8lColorModel(head[:])
+			}
+			found = true
+		case "ANMF":
+			found = true
+			frames++
+		}
+
+		if found && !trailing {
+			return cfg, 1, nil
+		}
+		if err := skipChunkData(r, n, read); err != nil {
+			return image.Config{}, 0, err
+		}
+	}
+
+	if !animated {
+		if !found {
+			return image.Config{}, 0, FormatError("missing image data")
+		}
+		frames = 1
+	}
+	return cfg, frames, nil
+}
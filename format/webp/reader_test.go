@@ -0,0 +1,262 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"os"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func testFrame(r image.Rectangle, c color.NRGBA) *image.NRGBA {
+	m := image.NewNRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			m.SetNRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+func sameImage(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	r := a.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if color.NRGBAModel.Convert(a.At(x, y)) != color.NRGBAModel.Convert(b.At(x, y)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestAnimationRoundTrip(t *testing.T) {
+	a := &Animation{
+		Width:      16,
+		Height:     12,
+		LoopCount:  4,
+		Background: color.NRGBA{1, 2, 3, 4},
+		Frames: []*Frame{
+			{Image: testFrame(image.Rect(0, 0, 16, 12), color.NRGBA{0xff, 0, 0, 0xff}), Duration: 100},
+			{Image: testFrame(image.Rect(2, 4, 9, 7), color.NRGBA{0, 0xff, 0, 0x80}), Duration: 250, Blend: true},
+			{Image: testFrame(image.Rect(10, 0, 16, 2), color.NRGBA{0, 0, 0xff, 0xff}), Duration: 0, Dispose: true},
+		},
+	}
+	md := &Metadata{
+		ICCProfile: []byte("not really an ICC profile"),
+		EXIF:       []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x00"),
+		XMP:        []byte("<x:xmpmeta xmlns:x='adobe:ns:meta/'/>"),
+	}
+
+	var buf bytes.Buffer
+	if err := (&Encoder{}).EncodeAllWithOptions(&buf, a, &EncodeOptions{Metadata: md}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != a.Width || cfg.Height != a.Height {
+		t.Fatalf("DecodeConfig: got %dx%d, want %dx%d", cfg.Width, cfg.Height, a.Width, a.Height)
+	}
+	for _, o := range []*DecodeOptions{nil, {Metadata: &Metadata{}}} {
+		_, n, err := DecodeFrameCount(bytes.NewReader(buf.Bytes()), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(a.Frames) {
+			t.Fatalf("DecodeFrameCount: got %d frames, want %d", n, len(a.Frames))
+		}
+	}
+
+	md2 := &Metadata{}
+	b, err := DecodeAllWithOptions(&buf, &DecodeOptions{Metadata: md2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(md.ICCProfile, md2.ICCProfile) || !bytes.Equal(md.EXIF, md2.EXIF) || !bytes.Equal(md.XMP, md2.XMP) {
+		t.Fatalf("got metadata %q, want %q", md2, md)
+	}
+	if b.Width != a.Width || b.Height != a.Height || b.LoopCount != a.LoopCount || b.Background != a.Background {
+		t.Fatalf("got %dx%d (loop %d, background %v), want %dx%d (loop %d, background %v)",
+			b.Width, b.Height, b.LoopCount, b.Background, a.Width, a.Height, a.LoopCount, a.Background)
+	}
+	if len(b.Frames) != len(a.Frames) {
+		t.Fatalf("got %d frames, want %d", len(b.Frames), len(a.Frames))
+	}
+	for i, f := range b.Frames {
+		g := a.Frames[i]
+		if f.Duration != g.Duration || f.Blend != g.Blend || f.Dispose != g.Dispose {
+			t.Fatalf("frame %d: got %+v, want %+v", i, f, g)
+		}
+		if !sameImage(f.Image, g.Image) {
+			t.Fatalf("frame %d: image mismatch", i)
+		}
+	}
+}
+
+func TestStillImageWithMetadata(t *testing.T) {
+	m := testFrame(image.Rect(0, 0, 5, 5), color.NRGBA{0x10, 0x20, 0x30, 0x40})
+
+	var buf bytes.Buffer
+	md := &Metadata{EXIF: []byte("II\x2a\x00\x08\x00\x00\x00\x00\x00")}
+	if err := (&Encoder{}).EncodeWithOptions(&buf, m, &EncodeOptions{Metadata: md}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("VP8X")) {
+		t.Fatal("expected extended file format")
+	}
+
+	md2 := &Metadata{}
+	got, err := DecodeWithOptions(bytes.NewReader(buf.Bytes()), &DecodeOptions{Metadata: md2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameImage(m, got) {
+		t.Fatal("image mismatch")
+	}
+	if !bytes.Equal(md.EXIF, md2.EXIF) || md2.ICCProfile != nil || md2.XMP != nil {
+		t.Fatalf("got metadata %q, want %q", md2, md)
+	}
+
+	md3 := &Metadata{}
+	cfg, err := DecodeConfigWithOptions(&buf, &DecodeOptions{Metadata: md3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 5 || cfg.Height != 5 {
+		t.Fatalf("got %dx%d, want 5x5", cfg.Width, cfg.Height)
+	}
+	if !bytes.Equal(md.EXIF, md3.EXIF) || md3.ICCProfile != nil || md3.XMP != nil {
+		t.Fatalf("got config metadata %q, want %q", md3, md)
+	}
+}
+
+func TestLossyAlphaFrame(t *testing.T) {
+	data, err := os.ReadFile("testdata/yellow_rose.lossy-with-alpha.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameImage(want, got) {
+		t.Fatal("still image mismatch")
+	}
+
+	// Move the image data into an animation frame.
+	chunks, err := readChunks(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := want.Bounds()
+	var anmf bytes.Buffer
+	hdr := make([]byte, 16)
+	putUint24(hdr[0:], 1)
+	putUint24(hdr[3:], 2)
+	putUint24(hdr[6:], b.Dx()-1)
+	putUint24(hdr[9:], b.Dy()-1)
+	anmf.Write(hdr)
+	for _, c := range chunks[1:] {
+		writeChunk(&anmf, c)
+	}
+
+	var buf bytes.Buffer
+	err = writeRIFF(&buf,
+		vp8xChunk(flagAnimation|flagAlpha, b.Dx()+2, b.Dy()+4),
+		chunk{"ANIM", make([]byte, 6)},
+		chunk{"ANMF", anmf.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := a.Frames[0].Image
+	if f.Bounds() != b.Add(image.Pt(2, 4)) {
+		t.Fatalf("got frame bounds %v, want %v", f.Bounds(), b.Add(image.Pt(2, 4)))
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if color.NRGBAModel.Convert(want.At(x, y)) != color.NRGBAModel.Convert(f.At(x+2, y+4)) {
+				t.Fatalf("pixel (%d, %d) mismatch", x, y)
+			}
+		}
+	}
+}
+
+func TestOpaqueImage(t *testing.T) {
+	for _, alpha := range []uint8{0xff, 0x40} {
+		want := color.Model(color.RGBAModel)
+		if alpha != 0xff {
+			want = color.NRGBAModel
+		}
+		m := testFrame(image.Rect(0, 0, 5, 5), color.NRGBA{0x10, 0x20, 0x30, alpha})
+
+		for _, md := range []*Metadata{nil, {XMP: []byte("<x/>")}} {
+			var buf bytes.Buffer
+			if err := (&Encoder{}).EncodeWithOptions(&buf, m, &EncodeOptions{Metadata: md}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameImage(m, got) {
+				t.Fatal("image mismatch")
+			}
+			cfg, n, err := DecodeFrameCount(bytes.NewReader(buf.Bytes()), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("got %d frames, want 1", n)
+			}
+			if got.ColorModel() != want || cfg.ColorModel != want {
+				t.Errorf("alpha %#x, metadata %v: got color models %v and %v", alpha, md != nil, got.ColorModel(), cfg.ColorModel)
+			}
+		}
+	}
+}
+
+func TestVP8LAlphaHint(t *testing.T) {
+	m := testFrame(image.Rect(0, 0, 5, 5), color.NRGBA{0x10, 0x20, 0x30, 0x40})
+	var buf bytes.Buffer
+	if err := (&Encoder{}).Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if string(data[12:16]) != "VP8L" {
+		t.Fatal("expected simple lossless file format")
+	}
+
+	// Clear the hint that the image uses alpha.
+	data[24] &^= 0x10
+	got, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.(*image.NRGBA); !ok {
+		t.Fatalf("got %T, want *image.NRGBA", got)
+	}
+	if !sameImage(m, got) {
+		t.Fatal("image mismatch")
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+// Package webp implements a WebP image decoder and lossless encoder.
+//
+// The decoder supports the extended file format, including animation and
+// metadata. Still images and individual frames are decoded using
+// golang.org/x/image/webp. Images are encoded losslessly, using the VP8L
+// bitstream format.
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+)
+
+const (
+	// MinEffort is the fastest encoding effort.
+	MinEffort = 1
+	// MaxEffort is the encoding effort producing the smallest files.
+	MaxEffort = 9
+	// DefaultEffort is the encoding effort used if none is specified.
+	DefaultEffort = 6
+
+	// maxDimension is the largest width or height VP8L can represent.
+	maxDimension = 1 << 14
+)
+
+// Encoder configures encoding WebP images.
+type Encoder struct {
+	// Effort trades encoding speed for file size, from MinEffort to
+	// MaxEffort. Zero means DefaultEffort.
+	Effort int
+}
+
+// EncodeOptions specifies options for encoding.
+type EncodeOptions struct {
+	// Metadata is the metadata to store in the image, if any.
+	Metadata *Metadata
+}
+
+// Encode writes the image m to w in lossless WebP format.
+func Encode(w io.Writer, m image.Image) error {
+	var e Encoder
+	return e.Encode(w, m)
+}
+
+// Encode writes the image m to w in lossless WebP format.
+func (enc *Encoder) Encode(w io.Writer, m image.Image) error {
+	return enc.EncodeWithOptions(w, m, nil)
+}
+
+// EncodeWithOptions writes the image m to w in lossless WebP format,
+// according to the options specified.
+func (enc *Encoder) EncodeWithOptions(w io.Writer, m image.Image, o *EncodeOptions) error {
+	b := m.Bounds()
+	return enc.EncodeAllWithOptions(w, &Animation{
+		Frames: []*Frame{{Image: m}},
+		Width:  b.Dx(),
+		Height: b.Dy(),
+	}, o)
+}
+
+// EncodeAll writes the frames in a to w in lossless WebP format.
+func EncodeAll(w io.Writer, a *Animation) error {
+	var e Encoder
+	return e.EncodeAll(w, a)
+}
+
+// EncodeAll writes the frames in a to w in lossless WebP format.
+func (enc *Encoder) EncodeAll(w io.Writer, a *Animation) error {
+	return enc.EncodeAllWithOptions(w, a, nil)
+}
+
+// EncodeAllWithOptions writes the frames in a to w in lossless WebP
+// format, according to the options specified. A single frame that
+// covers the whole canvas is written as a still image. The frames of
+// an animation must be placed at even offsets.
+func (enc *Encoder) EncodeAllWithOptions(w io.Writer, a *Animation, o *EncodeOptions) error {
+	if o == nil {
+		o = &EncodeOptions{}
+	}
+	if len(a.Frames) == 0 {
+		return errors.New("webp: no frames to encode")
+	}
+	if a.Width <= 0 || a.Height <= 0 || a.Width > 1<<24 || a.Height > 1<<24 {
+		return errors.New("webp: invalid canvas size")
+	}
+	if a.LoopCount < 0 || a.LoopCount > 0xffff {
+		return errors.New("webp: invalid loop count")
+	}
+
+	effort := enc.Effort
+	switch {
+	case effort == 0:
+		effort = DefaultEffort
+	case effort < MinEffort:
+		effort = MinEffort
+	case effort > MaxEffort:
+		effort = MaxEffort
+	}
+	lo := losslessOptionsForEffort(effort)
+
+	// Images are placed at the origin of the canvas, whatever their
+	// bounds, unless they are part of an animation.
+	animated := len(a.Frames) > 1 || a.Frames[0].Image.Bounds().Size() != a.Bounds().Size()
+	if animated {
+		for _, f := range a.Frames {
+			b := f.Image.Bounds()
+			if !b.In(a.Bounds()) {
+				return errors.New("webp: frame outside of canvas")
+			}
+			if b.Min.X&1 != 0 || b.Min.Y&1 != 0 {
+				return errors.New("webp: frame offset must be even")
+			}
+			if f.Duration < 0 || f.Duration >= 1<<24 {
+				return errors.New("webp: invalid frame duration")
+			}
+		}
+	}
+
+	var flags byte
+	var frames []chunk
+	for _, f := range a.Frames {
+		b := f.Image.Bounds()
+		if b.Dx() <= 0 || b.Dy() <= 0 || b.Dx() > maxDimension || b.Dy() > maxDimension {
+			return errors.New("webp: invalid image size: " + b.String())
+		}
+
+		pix, hasAlpha := argbPixels(f.Image)
+		if hasAlpha {
+			flags |= flagAlpha
+		}
+		bitstream := chunk{"VP8L", encodeLossless(pix, b.Dx(), b.Dy(), hasAlpha, lo)}
+		if !animated {
+			frames = append(frames, bitstream)
+			break
+		}
+
+		var buf bytes.Buffer
+		hdr := make([]byte, 16)
+		putUint24(hdr[0:], b.Min.X/2)
+		putUint24(hdr[3:], b.Min.Y/2)
+		putUint24(hdr[6:], b.Dx()-1)
+		putUint24(hdr[9:], b.Dy()-1)
+		putUint24(hdr[12:], f.Duration)
+		if f.Dispose {
+			hdr[15] |= anmfDispose
+		}
+		if !f.Blend {
+			hdr[15] |= anmfNoBlend
+		}
+		buf.Write(hdr)
+		writeChunk(&buf, bitstream)
+		frames = append(frames, chunk{"ANMF", buf.Bytes()})
+	}
+
+	// Use the simple file format if possible.
+	md := o.Metadata
+	if !animated && md.IsEmpty() {
+		return writeRIFF(w, frames...)
+	}
+
+	chunks := []chunk{{}}
+	if md != nil && md.ICCProfile != nil {
+		flags |= flagICCP
+		chunks = append(chunks, chunk{"ICCP", md.ICCProfile})
+	}
+	if animated {
+		flags |= flagAnimation
+		bg := a.Background
+		anim := []byte{bg.B, bg.G, bg.R, bg.A, 0, 0}
+		binary.LittleEndian.PutUint16(anim[4:], uint16(a.LoopCount))
+		chunks = append(chunks, chunk{"ANIM", anim})
+	}
+	chunks = append(chunks, frames...)
+	if md != nil && md.EXIF != nil {
+		flags |= flagEXIF
+		chunks = append(chunks, chunk{"EXIF", md.EXIF})
+	}
+	if md != nil && md.XMP != nil {
+		flags |= flagXMP
+		chunks = append(chunks, chunk{"XMP ", md.XMP})
+	}
+	chunks[0] = vp8xChunk(flags, a.Width, a.Height)
+
+	return writeRIFF(w, chunks...)
+}
+
+// argbPixels returns the non-premultiplied pixels of m as ARGB values,
+// and whether any of them are not fully opaque.
+func argbPixels(m image.Image) ([]uint32, bool) {
+	b := m.Bounds()
+	nrgba, ok := m.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(b)
+		draw.Draw(nrgba, b, m, b.Min, draw.Src)
+	}
+
+	pix := make([]uint32, 0, b.Dx()*b.Dy())
+	hasAlpha := false
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := nrgba.Pix[nrgba.PixOffset(b.Min.X, y):]
+		for x := 0; x < b.Dx(); x++ {
+			c := color.NRGBA{row[4*x], row[4*x+1], row[4*x+2], row[4*x+3]}
+			if c.A != 0xff {
+				hasAlpha = true
+			}
+			pix = append(pix, uint32(c.A)<<24|uint32(c.R)<<16|uint32(c.G)<<8|uint32(c.B))
+		}
+	}
+	return pix, hasAlpha
+}
+
+// putUint24 writes a little-endian 24-bit integer.
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// writeChunk writes a RIFF chunk, including any padding.
+func writeChunk(buf *bytes.Buffer, c chunk) {
+	var hdr [8]byte
+	copy(hdr[:4], c.fourCC)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(c.data)))
+	buf.Write(hdr[:])
+	buf.Write(c.data)
+	if len(c.data)&1 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+// writeRIFF writes a WebP file consisting of the given chunks.
+func writeRIFF(w io.Writer, chunks ...chunk) error {
+	var buf bytes.Buffer
+	buf.WriteString("RIFF\x00\x00\x00\x00WEBP")
+	for _, c := range chunks {
+		writeChunk(&buf, c)
+	}
+
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	_, err := w.Write(data)
+	return err
+}
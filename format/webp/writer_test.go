@@ -0,0 +1,85 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func testImages() map[string]image.Image {
+	rng := rand.New(rand.NewSource(1))
+
+	gradient := image.NewNRGBA(image.Rect(0, 0, 67, 45))
+	noise := image.NewNRGBA(image.Rect(0, 0, 33, 17))
+	for y := 0; y < 45; y++ {
+		for x := 0; x < 67; x++ {
+			gradient.SetNRGBA(x, y, color.NRGBA{uint8(x * 3), uint8(y * 5), uint8(x + y), uint8(255 - x)})
+		}
+	}
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(rng.Intn(256))
+	}
+
+	pal := color.Palette{color.Black, color.White, color.NRGBA{0xff, 0, 0, 0x80}}
+	paletted := image.NewPaletted(image.Rect(0, 0, 29, 13), pal)
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(rng.Intn(len(pal)))
+	}
+
+	many := image.NewPaletted(image.Rect(0, 0, 40, 40), nil)
+	for i := 0; i < 200; i++ {
+		many.Palette = append(many.Palette, color.RGBA{uint8(i), uint8(i * 7), uint8(i * 13), 0xff})
+	}
+	for i := range many.Pix {
+		many.Pix[i] = uint8(rng.Intn(len(many.Palette)))
+	}
+
+	solid := image.NewRGBA(image.Rect(5, 5, 6, 6))
+	solid.SetRGBA(5, 5, color.RGBA{1, 2, 3, 4})
+
+	return map[string]image.Image{
+		"gradient": gradient,
+		"noise":    noise,
+		"paletted": paletted,
+		"many":     many,
+		"solid":    solid,
+		"gray":     image.NewGray16(image.Rect(0, 0, 300, 2)),
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for name, m := range testImages() {
+		for effort := MinEffort; effort <= MaxEffort; effort++ {
+			var buf bytes.Buffer
+			enc := &Encoder{Effort: effort}
+			if err := enc.Encode(&buf, m); err != nil {
+				t.Fatalf("%s, effort %d: %v", name, effort, err)
+			}
+
+			got, err := webp.Decode(&buf)
+			if err != nil {
+				t.Fatalf("%s, effort %d: decode: %v", name, effort, err)
+			}
+
+			b := m.Bounds()
+			if got.Bounds().Dx() != b.Dx() || got.Bounds().Dy() != b.Dy() {
+				t.Fatalf("%s, effort %d: got size %v, want %v", name, effort, got.Bounds(), b)
+			}
+			for y := 0; y < b.Dy(); y++ {
+				for x := 0; x < b.Dx(); x++ {
+					want := color.NRGBAModel.Convert(m.At(b.Min.X+x, b.Min.Y+y))
+					have := color.NRGBAModel.Convert(got.At(x, y))
+					if want != have {
+						t.Fatalf("%s, effort %d: pixel (%d, %d): got %v, want %v", name, effort, x, y, have, want)
+					}
+				}
+			}
+		}
+	}
+}
@@ -7,6 +7,5 @@ require (
 	github.com/pborman/getopt/v2 v2.1.0
 	github.com/spakin/netpbm v1.3.0
 	github.com/xfmoulet/qoi v0.2.0
-	golang.org/x/exp v0.0.0-20221230185412-738e83a70c30
 	golang.org/x/image v0.2.0
 )
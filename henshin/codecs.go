@@ -4,15 +4,20 @@ package henshin
 
 import (
 	"bufio"
+	"fmt"
 	"image"
 	"io"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 type ErrNoSuchCodec string
 func (e ErrNoSuchCodec) Error() string { return "no such codec: " + string(e) }
 
+type ErrNoCodecParams string
+func (e ErrNoCodecParams) Error() string { return "codec takes no parameters: " + string(e) }
+
 var (
 	knownCodecs = map[string]Codec{}
 	knownCodecAliases = map[string]string{}
@@ -39,6 +44,29 @@ type CodecWithParamParser interface {
 	ParseParams(opt string) (any, error)
 }
 
+// eachCodecParam calls fn with the key and value of each parameter in a
+// comma-separated list of "key=value" parameters, as passed to ParseParams.
+// hasVal is false for parameters without a value, such as "progressive".
+func eachCodecParam(opt string, fn func(key, val string, hasVal bool) error) error {
+	for _, param := range strings.Split(opt, ",") {
+		param = strings.TrimSpace(param)
+		if param == "" { continue }
+
+		key, val, hasVal := strings.Cut(param, "=")
+		if err := fn(key, val, hasVal); err != nil { return err }
+	}
+	return nil
+}
+
+// parseBoolParam parses the value of a boolean codec parameter, which is
+// true if it has no value.
+func parseBoolParam(codec, key, val string, hasVal bool) (bool, error) {
+	if !hasVal { return true, nil }
+	b, err := strconv.ParseBool(val)
+	if err != nil { return false, fmt.Errorf("%s: invalid value for %s: %q", codec, key, val) }
+	return b, nil
+}
+
 // Decoder is an image codec that can decode.
 type Decoder interface {
 	Codec
@@ -53,6 +81,29 @@ type Encoder interface {
 	Encode(io.Writer, image.Image, *EncodeOptions) error
 }
 
+// DecoderWithFrames is an image decoder that can decode every frame
+// of a multi-frame image.
+type DecoderWithFrames interface {
+	Decoder
+	DecodeFrames(io.Reader, *DecodeOptions) (*Animation, error)
+}
+
+// DecoderWithFrameCount is an image decoder that can count the frames
+// of a multi-frame image without decoding them. DecodeFrameCount returns
+// the same configuration as DecodeConfig, along with the number of frames
+// that DecodeFrames would return.
+type DecoderWithFrameCount interface {
+	DecoderWithFrames
+	DecodeFrameCount(io.Reader, *DecodeOptions) (image.Config, int, error)
+}
+
+// EncoderWithFrames is an image encoder that can encode multi-frame
+// images.
+type EncoderWithFrames interface {
+	Encoder
+	EncodeFrames(io.Writer, *Animation, *EncodeOptions) error
+}
+
 // RegisterCodec registers a new image processing codec.
 func RegisterCodec(c Codec) {
 	knownCodecs[c.Name()] = c
@@ -102,28 +153,59 @@ func match(a []byte, b string) bool {
 	return true
 }
 
-// Decode decodes an image that has been encoded in a format understood
-// by a registered codec.
-func Decode(r io.Reader, o *DecodeOptions) (image.Image, error) {
-	pkr, ok := r.(peekableReader)
-	if !ok {
-		pkr = bufio.NewReader(r)
-	}
-
-	for _, v := range knownCodecs {
+// detect returns the registered decoder whose magic strings match the
+// data available from pkr. Codecs are tried in order of name, so that
+// the result is the same for codecs sharing magic strings, such as PNG
+// and ZNG.
+func detect(pkr peekableReader) (Decoder, error) {
+	for _, v := range Codecs() {
 		d, ok := v.(Decoder)
 		if !ok { continue }
 
 		for _, m := range d.Magic() {
 			toPeek, err := pkr.Peek(len(m))
 			if err == nil && match(toPeek, m) {
-				return d.New().(Decoder).Decode(pkr, o)
+				return d.New().(Decoder), nil
 			}
 		}
 	}
 	return nil, ErrNoSuchCodec("unknown")
 }
 
+// Decode decodes an image that has been encoded in a format understood
+// by a registered codec.
+func Decode(r io.Reader, o *DecodeOptions) (image.Image, error) {
+	pkr, ok := r.(peekableReader)
+	if !ok {
+		pkr = bufio.NewReader(r)
+	}
+
+	d, err := detect(pkr)
+	if err != nil { return nil, err }
+	return d.Decode(pkr, o)
+}
+
+// DecodeFrames decodes every frame of an image that has been encoded
+// in a format understood by a registered codec. Images in formats
+// without multi-frame support are returned as a single frame.
+func DecodeFrames(r io.Reader, o *DecodeOptions) (*Animation, error) {
+	pkr, ok := r.(peekableReader)
+	if !ok {
+		pkr = bufio.NewReader(r)
+	}
+
+	d, err := detect(pkr)
+	if err != nil { return nil, err }
+
+	if fd, ok := d.(DecoderWithFrames); ok {
+		return fd.DecodeFrames(pkr, o)
+	}
+
+	im, err := d.Decode(pkr, o)
+	if err != nil { return nil, err }
+	return NewAnimation(im), nil
+}
+
 // Encode encodes an image into the registered codec corresponding to
 // the specified name.
 func Encode(name string, w io.Writer, i image.Image, o *EncodeOptions) error {
@@ -134,3 +216,19 @@ func Encode(name string, w io.Writer, i image.Image, o *EncodeOptions) error {
 
 	return encoder.Encode(w, i, o)
 }
+
+// EncodeFrames encodes a multi-frame image into the registered codec
+// corresponding to the specified name. If the codec does not support
+// multiple frames, only the first frame is encoded.
+func EncodeFrames(name string, w io.Writer, a *Animation, o *EncodeOptions) error {
+	codec, err := NewCodec(name)
+	if err != nil { return err }
+	encoder, ok := codec.(Encoder)
+	if !ok { return ErrNoSuchCodec(name) }
+
+	if fe, ok := encoder.(EncoderWithFrames); ok {
+		return fe.EncodeFrames(w, a, o)
+	}
+
+	return encoder.Encode(w, a.First(), o)
+}
@@ -0,0 +1,52 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"errors"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidColor is returned when parsing an invalid color.
+var ErrInvalidColor = errors.New("invalid color")
+
+var colorNames = map[string]color.Color{
+	"none": color.Transparent,
+	"transparent": color.Transparent,
+	"black": color.Black,
+	"white": color.White,
+	"gray": color.Gray{0x80},
+	"grey": color.Gray{0x80},
+	"red": color.RGBA{0xff, 0, 0, 0xff},
+	"green": color.RGBA{0, 0x80, 0, 0xff},
+	"lime": color.RGBA{0, 0xff, 0, 0xff},
+	"blue": color.RGBA{0, 0, 0xff, 0xff},
+	"yellow": color.RGBA{0xff, 0xff, 0, 0xff},
+	"cyan": color.RGBA{0, 0xff, 0xff, 0xff},
+	"magenta": color.RGBA{0xff, 0, 0xff, 0xff},
+}
+
+// ParseColor parses a color name, such as "white" or "none", or a
+// hexadecimal color in the form #rgb, #rgba, #rrggbb or #rrggbbaa.
+func ParseColor(s string) (color.Color, error) {
+	if c, ok := colorNames[strings.ToLower(s)]; ok { return c, nil }
+
+	if len(s) == 0 || s[0] != '#' { return nil, ErrInvalidColor }
+	hex := s[1:]
+	if len(hex) == 3 || len(hex) == 4 {
+		var expanded []byte
+		for i := range hex {
+			expanded = append(expanded, hex[i], hex[i])
+		}
+		hex = string(expanded)
+	}
+	if len(hex) == 6 { hex += "ff" }
+	if len(hex) != 8 { return nil, ErrInvalidColor }
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil { return nil, ErrInvalidColor }
+
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
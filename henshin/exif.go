@@ -0,0 +1,649 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// ExifIFD identifies an image file directory (IFD) within EXIF data.
+type ExifIFD int
+
+const (
+	// ExifIFD0 contains tags describing the main image.
+	ExifIFD0 ExifIFD = iota
+	// ExifIFDExif contains tags describing the camera and exposure.
+	ExifIFDExif
+	// ExifIFDGPS contains GPS tags.
+	ExifIFDGPS
+	// ExifIFDInterop contains interoperability tags.
+	ExifIFDInterop
+	// ExifIFD1 contains tags describing the thumbnail image.
+	ExifIFD1
+
+	numExifIFDs
+)
+
+// String returns the name of the IFD.
+func (ifd ExifIFD) String() string {
+	switch ifd {
+		case ExifIFD0: return "IFD0"
+		case ExifIFDExif: return "Exif"
+		case ExifIFDGPS: return "GPS"
+		case ExifIFDInterop: return "Interop"
+		case ExifIFD1: return "IFD1"
+	}
+	return fmt.Sprintf("ExifIFD(%d)", int(ifd))
+}
+
+// ExifType is the data type of an EXIF tag's value.
+type ExifType uint16
+
+const (
+	ExifTypeByte ExifType = 1 + iota
+	ExifTypeASCII
+	ExifTypeShort
+	ExifTypeLong
+	ExifTypeRational
+	ExifTypeSByte
+	ExifTypeUndefined
+	ExifTypeSShort
+	ExifTypeSLong
+	ExifTypeSRational
+	ExifTypeFloat
+	ExifTypeDouble
+)
+
+// exifTypeSizes contains the size of a single value of each type.
+var exifTypeSizes = [...]int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+// Common EXIF tags.
+const (
+	ExifTagImageDescription = 0x010e
+	ExifTagMake = 0x010f
+	ExifTagModel = 0x0110
+	ExifTagOrientation = 0x0112
+	ExifTagXResolution = 0x011a
+	ExifTagYResolution = 0x011b
+	ExifTagResolutionUnit = 0x0128
+	ExifTagSoftware = 0x0131
+	ExifTagDateTime = 0x0132
+	ExifTagArtist = 0x013b
+	ExifTagJPEGInterchangeFormat = 0x0201
+	ExifTagJPEGInterchangeFormatLength = 0x0202
+	ExifTagCopyright = 0x8298
+	ExifTagExifIFDPointer = 0x8769
+	ExifTagGPSIFDPointer = 0x8825
+	ExifTagDateTimeOriginal = 0x9003
+	ExifTagPixelXDimension = 0xa002
+	ExifTagPixelYDimension = 0xa003
+	ExifTagInteropIFDPointer = 0xa005
+)
+
+// ExifRational is an unsigned rational number.
+type ExifRational struct {
+	Num, Den uint32
+}
+
+// ExifSRational is a signed rational number.
+type ExifSRational struct {
+	Num, Den int32
+}
+
+// ExifTag is a single EXIF tag.
+type ExifTag struct {
+	// ID is the tag's numeric identifier.
+	ID uint16
+
+	// Type is the tag's data type.
+	Type ExifType
+
+	// Value is the tag's value. Its Go type depends on Type:
+	//
+	//	ExifTypeByte, ExifTypeUndefined: []byte
+	//	ExifTypeASCII: string
+	//	ExifTypeShort: []uint16
+	//	ExifTypeLong: []uint32
+	//	ExifTypeRational: []ExifRational
+	//	ExifTypeSByte: []int8
+	//	ExifTypeSShort: []int16
+	//	ExifTypeSLong: []int32
+	//	ExifTypeSRational: []ExifSRational
+	//	ExifTypeFloat: []float32
+	//	ExifTypeDouble: []float64
+	Value any
+}
+
+// Count returns the number of values in the tag. For ASCII tags, this
+// is the length of the string.
+func (t *ExifTag) Count() int {
+	switch v := t.Value.(type) {
+		case []byte: return len(v)
+		case string: return len(v)
+		case []uint16: return len(v)
+		case []uint32: return len(v)
+		case []ExifRational: return len(v)
+		case []int8: return len(v)
+		case []int16: return len(v)
+		case []int32: return len(v)
+		case []ExifSRational: return len(v)
+		case []float32: return len(v)
+		case []float64: return len(v)
+	}
+	return 0
+}
+
+// Int returns the i-th value of an integer tag.
+func (t *ExifTag) Int(i int) (int64, bool) {
+	if i < 0 || i >= t.Count() { return 0, false }
+
+	switch v := t.Value.(type) {
+		case []byte: return int64(v[i]), true
+		case []uint16: return int64(v[i]), true
+		case []uint32: return int64(v[i]), true
+		case []int8: return int64(v[i]), true
+		case []int16: return int64(v[i]), true
+		case []int32: return int64(v[i]), true
+	}
+	return 0, false
+}
+
+// Float returns the i-th value of a numeric tag.
+func (t *ExifTag) Float(i int) (float64, bool) {
+	if i < 0 || i >= t.Count() { return 0, false }
+
+	switch v := t.Value.(type) {
+		case []ExifRational:
+			if v[i].Den == 0 { return 0, false }
+			return float64(v[i].Num) / float64(v[i].Den), true
+		case []ExifSRational:
+			if v[i].Den == 0 { return 0, false }
+			return float64(v[i].Num) / float64(v[i].Den), true
+		case []float32: return float64(v[i]), true
+		case []float64: return v[i], true
+	}
+
+	n, ok := t.Int(i)
+	return float64(n), ok
+}
+
+// String returns a human-readable representation of the tag's value.
+func (t *ExifTag) String() string {
+	if s, ok := t.Value.(string); ok { return s }
+
+	if b, ok := t.Value.([]byte); ok && t.Type == ExifTypeUndefined {
+		printable := len(b) > 0
+		for _, c := range b {
+			if c < 0x20 || c > 0x7e { printable = false; break }
+		}
+		if printable { return string(b) }
+		return fmt.Sprintf("(%d bytes)", len(b))
+	}
+
+	var sb strings.Builder
+	for i := 0; i < t.Count(); i++ {
+		if i > 0 { sb.WriteString(", ") }
+
+		switch v := t.Value.(type) {
+			case []ExifRational: fmt.Fprintf(&sb, "%d/%d", v[i].Num, v[i].Den)
+			case []ExifSRational: fmt.Fprintf(&sb, "%d/%d", v[i].Num, v[i].Den)
+			case []float32, []float64:
+				f, _ := t.Float(i)
+				fmt.Fprint(&sb, f)
+			default:
+				n, _ := t.Int(i)
+				fmt.Fprint(&sb, n)
+		}
+	}
+	return sb.String()
+}
+
+// clone returns a deep copy of the tag.
+func (t *ExifTag) clone() *ExifTag {
+	newT := *t
+	switch v := t.Value.(type) {
+		case []byte: newT.Value = append([]byte(nil), v...)
+		case []uint16: newT.Value = append([]uint16(nil), v...)
+		case []uint32: newT.Value = append([]uint32(nil), v...)
+		case []ExifRational: newT.Value = append([]ExifRational(nil), v...)
+		case []int8: newT.Value = append([]int8(nil), v...)
+		case []int16: newT.Value = append([]int16(nil), v...)
+		case []int32: newT.Value = append([]int32(nil), v...)
+		case []ExifSRational: newT.Value = append([]ExifSRational(nil), v...)
+		case []float32: newT.Value = append([]float32(nil), v...)
+		case []float64: newT.Value = append([]float64(nil), v...)
+	}
+	return &newT
+}
+
+// Exif is structured EXIF data.
+type Exif struct {
+	// ByteOrder is the byte order used when encoding the data.
+	ByteOrder binary.ByteOrder
+
+	// Thumbnail is the JPEG thumbnail image, if any.
+	Thumbnail []byte
+
+	ifds [numExifIFDs][]*ExifTag
+}
+
+// NewExif returns empty EXIF data.
+func NewExif() *Exif {
+	return &Exif{ByteOrder: binary.LittleEndian}
+}
+
+// Tags returns the tags in an IFD, sorted by ID.
+func (e *Exif) Tags(ifd ExifIFD) []*ExifTag {
+	return e.ifds[ifd]
+}
+
+// Get returns the tag with the given ID in an IFD.
+func (e *Exif) Get(ifd ExifIFD, id uint16) (tag *ExifTag, ok bool) {
+	for _, t := range e.ifds[ifd] {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return
+}
+
+// Set adds a tag to an IFD, replacing any tag with the same ID.
+func (e *Exif) Set(ifd ExifIFD, tag *ExifTag) (replaced bool) {
+	tags := e.ifds[ifd]
+	i := sort.Search(len(tags), func(i int) bool { return tags[i].ID >= tag.ID })
+	if i < len(tags) && tags[i].ID == tag.ID {
+		tags[i] = tag
+		return true
+	}
+
+	tags = append(tags, nil)
+	copy(tags[i+1:], tags[i:])
+	tags[i] = tag
+	e.ifds[ifd] = tags
+	return false
+}
+
+// Delete removes the tag with the given ID from an IFD.
+func (e *Exif) Delete(ifd ExifIFD, id uint16) (deleted bool) {
+	tags := e.ifds[ifd]
+	for i, t := range tags {
+		if t.ID == id {
+			e.ifds[ifd] = append(tags[:i:i], tags[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// IsEmpty returns true if there are no tags and no thumbnail.
+func (e *Exif) IsEmpty() bool {
+	for _, tags := range e.ifds {
+		if len(tags) != 0 { return false }
+	}
+	return e.Thumbnail == nil
+}
+
+// Clone returns a deep copy of the EXIF data.
+func (e *Exif) Clone() *Exif {
+	newE := &Exif{
+		ByteOrder: e.ByteOrder,
+		Thumbnail: append([]byte(nil), e.Thumbnail...),
+	}
+
+	for ifd, tags := range e.ifds {
+		for _, t := range tags {
+			newE.ifds[ifd] = append(newE.ifds[ifd], t.clone())
+		}
+	}
+	return newE
+}
+
+// Orientation returns the value of the orientation tag, from 1 to 8.
+// If the tag is missing or invalid, 1 (normal orientation) is returned.
+func (e *Exif) Orientation() int {
+	t, ok := e.Get(ExifIFD0, ExifTagOrientation)
+	if !ok { return 1 }
+
+	v, ok := t.Int(0)
+	if !ok || v < 1 || v > 8 { return 1 }
+	return int(v)
+}
+
+// SetOrientation sets the value of the orientation tag.
+func (e *Exif) SetOrientation(v int) {
+	e.Set(ExifIFD0, &ExifTag{ID: ExifTagOrientation, Type: ExifTypeShort, Value: []uint16{uint16(v)}})
+}
+
+// ErrInvalidExif is returned when EXIF data cannot be parsed.
+var ErrInvalidExif = errors.New("invalid EXIF data")
+
+// exifHeader is the header preceding EXIF data in JPEG APP1 segments.
+const exifHeader = "Exif\x00\x00"
+
+// ParseExif parses EXIF data, which must be in TIFF format, optionally
+// preceded by the "Exif\x00\x00" header used in JPEG files.
+func ParseExif(data []byte) (*Exif, error) {
+	return parseExif(bytes.TrimPrefix(data, []byte(exifHeader)), true)
+}
+
+// parseExif parses EXIF data in TIFF format. If hasIFD1 is false, the
+// IFD following IFD0 is not parsed as the thumbnail IFD.
+func parseExif(data []byte, hasIFD1 bool) (*Exif, error) {
+	if len(data) < 8 { return nil, ErrInvalidExif }
+
+	e := &Exif{}
+	switch string(data[:4]) {
+		case "II\x2a\x00": e.ByteOrder = binary.LittleEndian
+		case "MM\x00\x2a": e.ByteOrder = binary.BigEndian
+		default: return nil, ErrInvalidExif
+	}
+
+	p := &exifParser{data: data, order: e.ByteOrder, seen: map[uint32]bool{}}
+
+	var next uint32
+	var err error
+	e.ifds[ExifIFD0], next, err = p.readIFD(e.ByteOrder.Uint32(data[4:]))
+	if err != nil { return nil, err }
+
+	subIFDs := []struct{ parent ExifIFD; pointer uint16; ifd ExifIFD }{
+		{ExifIFD0, ExifTagExifIFDPointer, ExifIFDExif},
+		{ExifIFD0, ExifTagGPSIFDPointer, ExifIFDGPS},
+		{ExifIFDExif, ExifTagInteropIFDPointer, ExifIFDInterop},
+	}
+	for _, sub := range subIFDs {
+		t, ok := e.Get(sub.parent, sub.pointer)
+		if !ok { continue }
+		e.Delete(sub.parent, sub.pointer)
+
+		off, ok := t.Int(0)
+		if !ok { return nil, ErrInvalidExif }
+
+		e.ifds[sub.ifd], _, err = p.readIFD(uint32(off))
+		if err != nil { return nil, err }
+	}
+
+	// Thumbnails are often broken, so ignore any errors.
+	if hasIFD1 && next != 0 {
+		if tags, _, err := p.readIFD(next); err == nil {
+			e.ifds[ExifIFD1] = tags
+
+			t1, ok1 := e.Get(ExifIFD1, ExifTagJPEGInterchangeFormat)
+			t2, ok2 := e.Get(ExifIFD1, ExifTagJPEGInterchangeFormatLength)
+			if ok1 && ok2 {
+				e.Delete(ExifIFD1, ExifTagJPEGInterchangeFormat)
+				e.Delete(ExifIFD1, ExifTagJPEGInterchangeFormatLength)
+
+				off, _ := t1.Int(0)
+				n, _ := t2.Int(0)
+				if off > 0 && n > 0 && off + n <= int64(len(data)) {
+					e.Thumbnail = append([]byte(nil), data[off:off+n]...)
+				}
+			}
+		}
+	}
+
+	return e, nil
+}
+
+// exifParser reads IFDs from EXIF data.
+type exifParser struct {
+	data []byte
+	order binary.ByteOrder
+	seen map[uint32]bool
+}
+
+// readIFD reads the IFD at the given offset, returning its tags sorted
+// by ID and the offset of the next IFD.
+func (p *exifParser) readIFD(off uint32) ([]*ExifTag, uint32, error) {
+	if p.seen[off] { return nil, 0, ErrInvalidExif }
+	p.seen[off] = true
+
+	data, order := p.data, p.order
+	if uint64(off) + 2 > uint64(len(data)) { return nil, 0, ErrInvalidExif }
+
+	n := int(order.Uint16(data[off:]))
+	start := int(off) + 2
+	if start + 12 * n + 4 > len(data) { return nil, 0, ErrInvalidExif }
+
+	tags := make([]*ExifTag, 0, n)
+	for i := 0; i < n; i++ {
+		entry := data[start + 12 * i:]
+		typ := ExifType(order.Uint16(entry[2:]))
+		count := uint64(order.Uint32(entry[4:]))
+
+		// Skip tags with unknown types, since their size is unknown.
+		if typ < ExifTypeByte || typ > ExifTypeDouble { continue }
+
+		size := count * uint64(exifTypeSizes[typ])
+		var value []byte
+		if size <= 4 {
+			value = entry[8:8+size]
+		} else {
+			valueOff := uint64(order.Uint32(entry[8:]))
+			if valueOff + size > uint64(len(data)) { return nil, 0, ErrInvalidExif }
+			value = data[valueOff:valueOff+size]
+		}
+
+		tags = append(tags, &ExifTag{
+			ID: order.Uint16(entry),
+			Type: typ,
+			Value: decodeExifValue(order, typ, value),
+		})
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].ID < tags[j].ID })
+	return tags, order.Uint32(data[start + 12 * n:]), nil
+}
+
+// decodeExifValue decodes the raw value of a tag.
+func decodeExifValue(order binary.ByteOrder, typ ExifType, b []byte) any {
+	n := len(b) / exifTypeSizes[typ]
+	switch typ {
+		case ExifTypeByte, ExifTypeUndefined:
+			return append([]byte(nil), b...)
+		case ExifTypeASCII:
+			if i := bytes.IndexByte(b, 0); i != -1 { b = b[:i] }
+			return string(b)
+		case ExifTypeShort:
+			v := make([]uint16, n)
+			for i := range v { v[i] = order.Uint16(b[2*i:]) }
+			return v
+		case ExifTypeLong:
+			v := make([]uint32, n)
+			for i := range v { v[i] = order.Uint32(b[4*i:]) }
+			return v
+		case ExifTypeRational:
+			v := make([]ExifRational, n)
+			for i := range v { v[i] = ExifRational{order.Uint32(b[8*i:]), order.Uint32(b[8*i+4:])} }
+			return v
+		case ExifTypeSByte:
+			v := make([]int8, n)
+			for i := range v { v[i] = int8(b[i]) }
+			return v
+		case ExifTypeSShort:
+			v := make([]int16, n)
+			for i := range v { v[i] = int16(order.Uint16(b[2*i:])) }
+			return v
+		case ExifTypeSLong:
+			v := make([]int32, n)
+			for i := range v { v[i] = int32(order.Uint32(b[4*i:])) }
+			return v
+		case ExifTypeSRational:
+			v := make([]ExifSRational, n)
+			for i := range v { v[i] = ExifSRational{int32(order.Uint32(b[8*i:])), int32(order.Uint32(b[8*i+4:]))} }
+			return v
+		case ExifTypeFloat:
+			v := make([]float32, n)
+			for i := range v { v[i] = math.Float32frombits(order.Uint32(b[4*i:])) }
+			return v
+		case ExifTypeDouble:
+			v := make([]float64, n)
+			for i := range v { v[i] = math.Float64frombits(order.Uint64(b[8*i:])) }
+			return v
+	}
+	return nil
+}
+
+// exifByteOrder is a byte order that can be used to encode EXIF data.
+type exifByteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// encodeExifValue encodes the value of a tag, returning the raw value
+// and the number of values.
+func encodeExifValue(order exifByteOrder, t *ExifTag) ([]byte, uint32, error) {
+	var b []byte
+	switch v := t.Value.(type) {
+		case []byte:
+			if t.Type != ExifTypeByte && t.Type != ExifTypeUndefined { break }
+			return v, uint32(len(v)), nil
+		case string:
+			if t.Type != ExifTypeASCII { break }
+			return append([]byte(v), 0), uint32(len(v) + 1), nil
+		case []uint16:
+			if t.Type != ExifTypeShort { break }
+			for _, x := range v { b = order.AppendUint16(b, x) }
+			return b, uint32(len(v)), nil
+		case []uint32:
+			if t.Type != ExifTypeLong { break }
+			for _, x := range v { b = order.AppendUint32(b, x) }
+			return b, uint32(len(v)), nil
+		case []ExifRational:
+			if t.Type != ExifTypeRational { break }
+			for _, x := range v { b = order.AppendUint32(order.AppendUint32(b, x.Num), x.Den) }
+			return b, uint32(len(v)), nil
+		case []int8:
+			if t.Type != ExifTypeSByte { break }
+			for _, x := range v { b = append(b, byte(x)) }
+			return b, uint32(len(v)), nil
+		case []int16:
+			if t.Type != ExifTypeSShort { break }
+			for _, x := range v { b = order.AppendUint16(b, uint16(x)) }
+			return b, uint32(len(v)), nil
+		case []int32:
+			if t.Type != ExifTypeSLong { break }
+			for _, x := range v { b = order.AppendUint32(b, uint32(x)) }
+			return b, uint32(len(v)), nil
+		case []ExifSRational:
+			if t.Type != ExifTypeSRational { break }
+			for _, x := range v { b = order.AppendUint32(order.AppendUint32(b, uint32(x.Num)), uint32(x.Den)) }
+			return b, uint32(len(v)), nil
+		case []float32:
+			if t.Type != ExifTypeFloat { break }
+			for _, x := range v { b = order.AppendUint32(b, math.Float32bits(x)) }
+			return b, uint32(len(v)), nil
+		case []float64:
+			if t.Type != ExifTypeDouble { break }
+			for _, x := range v { b = order.AppendUint64(b, math.Float64bits(x)) }
+			return b, uint32(len(v)), nil
+	}
+	return nil, 0, fmt.Errorf("EXIF tag 0x%04x: value %T does not match type %d", t.ID, t.Value, t.Type)
+}
+
+// exifLayout is the order in which IFDs are written.
+var exifLayout = []ExifIFD{ExifIFD0, ExifIFDExif, ExifIFDInterop, ExifIFDGPS, ExifIFD1}
+
+// Bytes encodes the EXIF data in TIFF format, without the
+// "Exif\x00\x00" header used in JPEG files.
+func (e *Exif) Bytes() ([]byte, error) {
+	var order exifByteOrder = binary.LittleEndian
+	if e.ByteOrder == binary.BigEndian { order = binary.BigEndian }
+
+	// Add pointers to the sub-IFDs and thumbnail, which are filled in
+	// once the layout is known.
+	var ifds [numExifIFDs][]*ExifTag
+	for ifd := range ifds {
+		ifds[ifd] = append([]*ExifTag(nil), e.ifds[ifd]...)
+	}
+	pointer := func(parent ExifIFD, id uint16, v uint32) *ExifTag {
+		t := &ExifTag{ID: id, Type: ExifTypeLong, Value: []uint32{v}}
+		ifds[parent] = append(ifds[parent], t)
+		return t
+	}
+
+	var pointers [numExifIFDs]*ExifTag
+	if len(ifds[ExifIFDInterop]) != 0 {
+		pointers[ExifIFDInterop] = pointer(ExifIFDExif, ExifTagInteropIFDPointer, 0)
+	}
+	if len(ifds[ExifIFDExif]) != 0 {
+		pointers[ExifIFDExif] = pointer(ExifIFD0, ExifTagExifIFDPointer, 0)
+	}
+	if len(ifds[ExifIFDGPS]) != 0 {
+		pointers[ExifIFDGPS] = pointer(ExifIFD0, ExifTagGPSIFDPointer, 0)
+	}
+	var thumbnailPointer *ExifTag
+	if e.Thumbnail != nil {
+		thumbnailPointer = pointer(ExifIFD1, ExifTagJPEGInterchangeFormat, 0)
+		pointer(ExifIFD1, ExifTagJPEGInterchangeFormatLength, uint32(len(e.Thumbnail)))
+	}
+
+	// Work out where each IFD goes.
+	var offsets [numExifIFDs]uint32
+	off := uint32(8)
+	for _, ifd := range exifLayout {
+		if len(ifds[ifd]) == 0 && ifd != ExifIFD0 { continue }
+
+		sort.SliceStable(ifds[ifd], func(i, j int) bool { return ifds[ifd][i].ID < ifds[ifd][j].ID })
+		offsets[ifd] = off
+		off += 2 + 12 * uint32(len(ifds[ifd])) + 4
+		for _, t := range ifds[ifd] {
+			value, _, err := encodeExifValue(order, t)
+			if err != nil { return nil, err }
+			if len(value) > 4 { off += uint32(len(value) + len(value) & 1) }
+		}
+	}
+
+	for ifd, t := range pointers {
+		if t != nil { t.Value = []uint32{offsets[ifd]} }
+	}
+	if thumbnailPointer != nil { thumbnailPointer.Value = []uint32{off} }
+
+	// Now, write everything out.
+	buf := make([]byte, 8, int(off) + len(e.Thumbnail))
+	if order == binary.BigEndian {
+		copy(buf, "MM\x00\x2a")
+	} else {
+		copy(buf, "II\x2a\x00")
+	}
+	order.PutUint32(buf[4:], 8)
+
+	for _, ifd := range exifLayout {
+		if offsets[ifd] == 0 { continue }
+
+		dataOff := offsets[ifd] + 2 + 12 * uint32(len(ifds[ifd])) + 4
+		var data []byte
+
+		buf = order.AppendUint16(buf, uint16(len(ifds[ifd])))
+		for _, t := range ifds[ifd] {
+			value, count, _ := encodeExifValue(order, t)
+
+			buf = order.AppendUint16(buf, t.ID)
+			buf = order.AppendUint16(buf, uint16(t.Type))
+			buf = order.AppendUint32(buf, count)
+			if len(value) <= 4 {
+				var inline [4]byte
+				copy(inline[:], value)
+				buf = append(buf, inline[:]...)
+			} else {
+				buf = order.AppendUint32(buf, dataOff + uint32(len(data)))
+				data = append(data, value...)
+				if len(value) & 1 != 0 { data = append(data, 0) }
+			}
+		}
+
+		// IFD0 links to IFD1, if present.
+		next := uint32(0)
+		if ifd == ExifIFD0 { next = offsets[ExifIFD1] }
+		buf = order.AppendUint32(buf, next)
+		buf = append(buf, data...)
+	}
+
+	return append(buf, e.Thumbnail...), nil
+}
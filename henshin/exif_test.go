@@ -0,0 +1,87 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"reflect"
+
+	"testing"
+)
+
+// testExif returns EXIF data with tags in every IFD.
+func testExif() *Exif {
+	e := NewExif()
+	e.ByteOrder = binary.BigEndian
+	e.Set(ExifIFD0, &ExifTag{ID: ExifTagModel, Type: ExifTypeASCII, Value: "Test Camera"})
+	e.Set(ExifIFD0, &ExifTag{ID: ExifTagMake, Type: ExifTypeASCII, Value: "Ronsor Labs"})
+	e.Set(ExifIFD0, &ExifTag{ID: ExifTagXResolution, Type: ExifTypeRational, Value: []ExifRational{{72, 1}}})
+	e.SetOrientation(6)
+	e.Set(ExifIFDExif, &ExifTag{ID: 0x9000, Type: ExifTypeUndefined, Value: []byte("0232")})
+	e.Set(ExifIFDExif, &ExifTag{ID: 0x9204, Type: ExifTypeSRational, Value: []ExifSRational{{-1, 3}}})
+	e.Set(ExifIFDGPS, &ExifTag{ID: 0x0002, Type: ExifTypeRational, Value: []ExifRational{{51, 1}, {30, 1}, {1234, 100}}})
+	e.Set(ExifIFDGPS, &ExifTag{ID: 0x0001, Type: ExifTypeASCII, Value: "N"})
+	e.Set(ExifIFDInterop, &ExifTag{ID: 0x0001, Type: ExifTypeASCII, Value: "R98"})
+	e.Set(ExifIFD1, &ExifTag{ID: 0x0103, Type: ExifTypeShort, Value: []uint16{6}})
+	e.Thumbnail = []byte("\xff\xd8 not really a thumbnail \xff\xd9")
+	return e
+}
+
+// TestExifRoundTrip tests the encoding and decoding of EXIF data.
+func TestExifRoundTrip(t *testing.T) {
+	e := testExif()
+
+	data, err := e.Bytes()
+	if err != nil { t.Fatal(err) }
+
+	e2, err := ParseExif(data)
+	if err != nil { t.Fatal(err) }
+
+	if e2.ByteOrder != e.ByteOrder {
+		t.Fatalf("expected byte order %v, got %v", e.ByteOrder, e2.ByteOrder)
+	}
+	if !bytes.Equal(e2.Thumbnail, e.Thumbnail) {
+		t.Fatalf("expected thumbnail %q, got %q", e.Thumbnail, e2.Thumbnail)
+	}
+	for ifd := ExifIFD0; ifd < numExifIFDs; ifd++ {
+		if !reflect.DeepEqual(e.Tags(ifd), e2.Tags(ifd)) {
+			t.Fatalf("%v: expected %v, got %v", ifd, e.Tags(ifd), e2.Tags(ifd))
+		}
+	}
+	if e2.Orientation() != 6 {
+		t.Fatalf("expected orientation 6, got %d", e2.Orientation())
+	}
+
+	tag, _ := e2.Get(ExifIFDGPS, 0x0002)
+	if s := tag.String(); s != "51/1, 30/1, 1234/100" {
+		t.Fatalf("unexpected GPS latitude: %q", s)
+	}
+}
+
+// TestExifCodecs tests that EXIF data survives encoding and decoding
+// in every codec that supports it.
+func TestExifCodecs(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+
+	for _, codec := range []string{"jpeg", "png", "webp"} {
+		var buf bytes.Buffer
+		err := Encode(codec, &buf, img, &EncodeOptions{CompressionLevel: -1, Metadata: &Metadata{EXIF: testExif()}})
+		if err != nil { t.Fatalf("%s: %v", codec, err) }
+
+		md := &Metadata{}
+		if _, err := Decode(&buf, &DecodeOptions{Metadata: md}); err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		if md.EXIF == nil {
+			t.Fatalf("%s: EXIF data was lost", codec)
+		}
+		if tag, ok := md.EXIF.Get(ExifIFDInterop, 0x0001); !ok || tag.String() != "R98" {
+			t.Fatalf("%s: expected interop index %q, got %v", codec, "R98", tag)
+		}
+		if md.EXIF.Orientation() != 6 {
+			t.Fatalf("%s: expected orientation 6, got %d", codec, md.EXIF.Orientation())
+		}
+	}
+}
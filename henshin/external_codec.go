@@ -0,0 +1,219 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ExternalCodec is a codec that runs an external program to encode or
+// decode images. Images are passed to and from the program in an
+// intermediate format understood by a built-in codec, such as PNG.
+//
+// In command templates, the argument "%i" is replaced by the path of a
+// temporary input file and "%o" by the path of a temporary output file.
+// Without "%i", the input is written to the program's standard input;
+// without "%o", the output is read from its standard output.
+type ExternalCodec struct {
+	// CodecName is the name of the codec, which is also used as the file
+	// extension of temporary files in its format.
+	CodecName string
+
+	// CodecAliases contains alternate names for the codec.
+	CodecAliases []string
+
+	// MagicStrings contains magic strings that identify data in the
+	// codec's format. Images are only detected if DecodeCommand is set.
+	MagicStrings []string
+
+	// DecodeCommand is the command that converts from the codec's format
+	// to the intermediate format.
+	DecodeCommand []string
+
+	// EncodeCommand is the command that converts from the intermediate
+	// format to the codec's format.
+	EncodeCommand []string
+
+	// Intermediate is the name of the codec used for the intermediate
+	// format.
+	Intermediate string
+
+	// EncodeArgs, if not nil, returns extra arguments for EncodeCommand
+	// according to the options specified.
+	EncodeArgs func(o *EncodeOptions) []string
+
+	// ParamParser, if not nil, parses codec parameters instead of the
+	// default parser, which passes them to EncodeCommand as arguments.
+	ParamParser func(opt string) (any, error)
+}
+
+// ExternalCodecParams are extra arguments for an external encoder,
+// returned by ExternalCodec.ParseParams.
+type ExternalCodecParams []string
+
+// ErrNoExternalCommand is returned when an external codec can't perform
+// an operation because it has no command for it.
+var ErrNoExternalCommand = errors.New("external codec has no command for this operation")
+
+// New returns a new instance of the external codec.
+func (c *ExternalCodec) New() Codec {
+	nc := *c
+	return &nc
+}
+
+// Name returns the name of the external codec.
+func (c *ExternalCodec) Name() string { return c.CodecName }
+
+// Aliases returns alternate names for the external codec.
+func (c *ExternalCodec) Aliases() []string { return c.CodecAliases }
+
+// Magic returns magic strings that identify data in the codec's format,
+// if it can be decoded.
+func (c *ExternalCodec) Magic() []string {
+	if len(c.DecodeCommand) == 0 { return nil }
+	return c.MagicStrings
+}
+
+// ParseParams parses a comma-separated list of parameters. By default,
+// they become extra arguments for the encoder: each "key=value" parameter
+// becomes the argument "--key=value", and each "key" parameter becomes
+// "--key".
+func (c *ExternalCodec) ParseParams(opt string) (any, error) {
+	if c.ParamParser != nil { return c.ParamParser(opt) }
+
+	var params ExternalCodecParams
+	err := eachCodecParam(opt, func(key, val string, hasVal bool) error {
+		if key == "" || strings.HasPrefix(key, "-") {
+			return fmt.Errorf("%s: invalid parameter %q", c.CodecName, key)
+		}
+		if hasVal {
+			params = append(params, "--" + key + "=" + val)
+		} else {
+			params = append(params, "--" + key)
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+	return params, nil
+}
+
+// run runs an external command template on data, whose file extension
+// is inExt, and returns the output, whose file extension is outExt.
+func (c *ExternalCodec) run(command []string, data []byte, inExt, outExt string) ([]byte, error) {
+	if len(command) == 0 { return nil, ErrNoExternalCommand }
+
+	dir, err := os.MkdirTemp("", "majokko-")
+	if err != nil { return nil, err }
+	defer os.RemoveAll(dir)
+
+	inPath := filepath.Join(dir, "in." + inExt)
+	outPath := filepath.Join(dir, "out." + outExt)
+
+	var usesIn, usesOut bool
+	args := make([]string, len(command))
+	for i, arg := range command {
+		switch arg {
+			case "%i": arg, usesIn = inPath, true
+			case "%o": arg, usesOut = outPath, true
+		}
+		args[i] = arg
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	if usesIn {
+		if err := os.WriteFile(inPath, data, 0600); err != nil { return nil, err }
+	} else {
+		cmd.Stdin = bytes.NewReader(data)
+	}
+	if !usesOut { cmd.Stdout = &stdout }
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s: %v: %s", c.CodecName, args[0], err, msg)
+		}
+		return nil, fmt.Errorf("%s: %s: %v", c.CodecName, args[0], err)
+	}
+
+	if !usesOut { return stdout.Bytes(), nil }
+	return os.ReadFile(outPath)
+}
+
+// intermediateCodec returns the name of the intermediate codec.
+func (c *ExternalCodec) intermediateCodec() string {
+	if c.Intermediate == "" { return "png" }
+	return c.Intermediate
+}
+
+// Decode decodes an image by running DecodeCommand and decoding its
+// output with the intermediate codec.
+func (c *ExternalCodec) Decode(r io.Reader, o *DecodeOptions) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil { return nil, err }
+
+	out, err := c.run(c.DecodeCommand, data, c.CodecName, c.intermediateCodec())
+	if err != nil { return nil, err }
+
+	codec, err := NewCodec(c.intermediateCodec())
+	if err != nil { return nil, err }
+	dec, ok := codec.(Decoder)
+	if !ok { return nil, ErrNoSuchCodec(c.intermediateCodec()) }
+
+	return dec.Decode(bytes.NewReader(out), o)
+}
+
+// DecodeConfig returns the color model and dimensions of an image. The
+// external program has to decode the entire image to determine them.
+func (c *ExternalCodec) DecodeConfig(r io.Reader, o *DecodeOptions) (image.Config, error) {
+	im, err := c.Decode(r, o)
+	if err != nil { return image.Config{}, err }
+
+	b := im.Bounds()
+	return image.Config{ColorModel: im.ColorModel(), Width: b.Dx(), Height: b.Dy()}, nil
+}
+
+// Encode encodes an image with the intermediate codec and converts it by
+// running EncodeCommand. Metadata is passed to the intermediate codec,
+// so the external program may preserve it.
+func (c *ExternalCodec) Encode(w io.Writer, i image.Image, o *EncodeOptions) error {
+	if o == nil { o = DefaultEncodeOptions() }
+	if len(c.EncodeCommand) == 0 { return ErrNoExternalCommand }
+
+	// The intermediate image is only written once, so favor speed.
+	var buf bytes.Buffer
+	err := Encode(c.intermediateCodec(), &buf, i, &EncodeOptions{
+		CompressionLevel: 0,
+		Metadata: o.Metadata,
+	})
+	if err != nil { return err }
+
+	command := c.EncodeCommand
+	var extra []string
+	if c.EncodeArgs != nil { extra = append(extra, c.EncodeArgs(o)...) }
+	if params, ok := o.EncoderSpecific.(ExternalCodecParams); ok { extra = append(extra, params...) }
+	if len(extra) > 0 {
+		command = append(append([]string{command[0]}, extra...), command[1:]...)
+	}
+
+	out, err := c.run(command, buf.Bytes(), c.intermediateCodec(), c.CodecName)
+	if err != nil { return err }
+
+	_, err = w.Write(out)
+	return err
+}
+
+var (
+	_ Decoder = &ExternalCodec{}
+	_ Encoder = &ExternalCodec{}
+	_ CodecWithAliases = &ExternalCodec{}
+	_ CodecWithParamParser = &ExternalCodec{}
+)
@@ -0,0 +1,81 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"os/exec"
+	"reflect"
+
+	"testing"
+)
+
+// TestExternalCodec tests encoding and decoding images with external
+// programs, passing data through both files and pipes.
+func TestExternalCodec(t *testing.T) {
+	for _, tool := range []string{"cp", "cat", "false"} {
+		if _, err := exec.LookPath(tool); err != nil { t.Skipf("%s not available", tool) }
+	}
+
+	im := image.NewNRGBA(image.Rect(0, 0, 8, 4))
+	im.Set(3, 2, color.NRGBA{R: 255, G: 128, A: 255})
+
+	codecs := []*ExternalCodec{
+		{CodecName: "ext", DecodeCommand: []string{"cp", "%i", "%o"}, EncodeCommand: []string{"cp", "%i", "%o"}},
+		{CodecName: "ext", DecodeCommand: []string{"cat"}, EncodeCommand: []string{"cat"}, Intermediate: "qoi"},
+	}
+	for _, c := range codecs {
+		var buf bytes.Buffer
+		if err := c.Encode(&buf, im, nil); err != nil { t.Fatal(err) }
+
+		cfg, err := c.DecodeConfig(bytes.NewReader(buf.Bytes()), nil)
+		if err != nil { t.Fatal(err) }
+		if cfg.Width != 8 || cfg.Height != 4 { t.Fatalf("expected 8x4 image, got %dx%d", cfg.Width, cfg.Height) }
+
+		got, err := c.Decode(bytes.NewReader(buf.Bytes()), nil)
+		if err != nil { t.Fatal(err) }
+		if r, g, _, _ := got.At(3, 2).RGBA(); r >> 8 != 255 || g >> 8 != 128 {
+			t.Fatalf("%v: pixel differs after round trip", c.DecodeCommand)
+		}
+	}
+
+	c := &ExternalCodec{CodecName: "ext", EncodeCommand: []string{"false"}}
+	if err := c.Encode(&bytes.Buffer{}, im, nil); err == nil { t.Fatal("expected error from failing command") }
+	if _, err := c.Decode(&bytes.Buffer{}, nil); err != ErrNoExternalCommand { t.Fatalf("expected ErrNoExternalCommand, got %v", err) }
+	if c.Magic() != nil { t.Fatal("expected no magic strings without a decoder") }
+}
+
+// TestJXLEncodeArgs tests that encoding options are converted to cjxl
+// arguments.
+func TestJXLEncodeArgs(t *testing.T) {
+	c := NewJXLCodec()
+	tests := []struct {
+		level int
+		params string
+		want []string
+	}{
+		{-1, "", nil},
+		{0, "", []string{"-d", "0"}},
+		{10, "", []string{"-d", "1.000"}},
+		{-1, "effort=7", []string{"-e", "7"}},
+		{20, "distance=0.5,effort=3", []string{"-d", "0.5", "-e", "3"}},
+		{20, "lossless", []string{"-d", "0"}},
+	}
+	for _, tt := range tests {
+		o := &EncodeOptions{CompressionLevel: tt.level}
+		if tt.params != "" {
+			p, err := c.ParseParams(tt.params)
+			if err != nil { t.Fatal(err) }
+			o.EncoderSpecific = p
+		}
+		if got := jxlEncodeArgs(o); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("level %d, %q: expected %q, got %q", tt.level, tt.params, tt.want, got)
+		}
+	}
+
+	for _, params := range []string{"effort=10", "distance=-1", "speed=3"} {
+		if _, err := c.ParseParams(params); err == nil { t.Errorf("%q: expected error", params) }
+	}
+}
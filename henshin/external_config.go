@@ -0,0 +1,167 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ExternalCodecConfig describes an external codec in a configuration
+// file. Configuration files are JSON documents of the form:
+//
+//	{
+//		"codecs": [
+//			{
+//				"name": "foo",
+//				"extensions": ["foo", "fooimg"],
+//				"magic": ["464f4f21", "464f4f??"],
+//				"decode": ["foo2png", "%i", "%o"],
+//				"encode": ["png2foo", "--quiet"],
+//				"intermediate": "png"
+//			}
+//		]
+//	}
+//
+// Magic strings are given in hexadecimal, where "??" matches any byte.
+// The byte 3f is rejected, since it is the ASCII code of the wildcard
+// and can't be matched exactly. Commands use the same "%i" and "%o"
+// placeholders as ExternalCodec.
+type ExternalCodecConfig struct {
+	// Name is the name of the codec.
+	Name string `json:"name"`
+
+	// Aliases and Extensions are alternate names for the codec. Output
+	// files with one of these extensions are written with the codec.
+	Aliases []string `json:"aliases,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+
+	// Magic contains hexadecimal magic strings that identify data in the
+	// codec's format. At least one is required to decode images.
+	Magic []string `json:"magic,omitempty"`
+
+	// Decode and Encode are command templates for decoding and encoding
+	// images. At least one of them is required.
+	Decode []string `json:"decode,omitempty"`
+	Encode []string `json:"encode,omitempty"`
+
+	// Intermediate is the name of the built-in codec used to exchange
+	// images with the commands. It defaults to "png".
+	Intermediate string `json:"intermediate,omitempty"`
+}
+
+// externalCodecFile is the structure of an external codec configuration
+// file.
+type externalCodecFile struct {
+	Codecs []ExternalCodecConfig `json:"codecs"`
+}
+
+// Codec returns the external codec described by the configuration, or
+// an error if the configuration is invalid.
+func (cfg *ExternalCodecConfig) Codec() (*ExternalCodec, error) {
+	if cfg.Name == "" { return nil, errors.New("external codec has no name") }
+	if len(cfg.Decode) == 0 && len(cfg.Encode) == 0 {
+		return nil, fmt.Errorf("%s: external codec has no decode or encode command", cfg.Name)
+	}
+	if len(cfg.Decode) != 0 && len(cfg.Magic) == 0 {
+		return nil, fmt.Errorf("%s: external decoder has no magic strings", cfg.Name)
+	}
+
+	c := &ExternalCodec{
+		CodecName: cfg.Name,
+		DecodeCommand: cfg.Decode,
+		EncodeCommand: cfg.Encode,
+		Intermediate: cfg.Intermediate,
+	}
+
+	for _, alias := range append(append([]string{}, cfg.Aliases...), cfg.Extensions...) {
+		alias = strings.TrimPrefix(alias, ".")
+		if alias != "" && alias != cfg.Name { c.CodecAliases = append(c.CodecAliases, alias) }
+	}
+
+	for _, m := range cfg.Magic {
+		magic, err := parseHexMagic(m)
+		if err != nil { return nil, fmt.Errorf("%s: invalid magic string %q: %v", cfg.Name, m, err) }
+		c.MagicStrings = append(c.MagicStrings, magic)
+	}
+
+	ic, err := NewCodec(c.intermediateCodec())
+	if err != nil { return nil, fmt.Errorf("%s: intermediate codec: %v", cfg.Name, err) }
+	if _, ok := ic.(*ExternalCodec); ok {
+		return nil, fmt.Errorf("%s: intermediate codec %s is external", cfg.Name, ic.Name())
+	}
+	if _, ok := ic.(Decoder); !ok && len(c.DecodeCommand) != 0 {
+		return nil, fmt.Errorf("%s: intermediate codec %s can't decode images", cfg.Name, ic.Name())
+	}
+	if _, ok := ic.(Encoder); !ok && len(c.EncodeCommand) != 0 {
+		return nil, fmt.Errorf("%s: intermediate codec %s can't encode images", cfg.Name, ic.Name())
+	}
+	return c, nil
+}
+
+// parseHexMagic converts a hexadecimal magic string to the form expected
+// by Decoder.Magic, where "??" becomes the wildcard "?". The byte 3f is
+// rejected, since it would become the wildcard too.
+func parseHexMagic(s string) (string, error) {
+	s = strings.ReplaceAll(s, " ", "")
+	if s == "" || len(s) % 2 != 0 { return "", errors.New("odd or zero length") }
+
+	var b strings.Builder
+	for i := 0; i < len(s); i += 2 {
+		if s[i:i+2] == "??" { b.WriteByte('?'); continue }
+		v, err := hex.DecodeString(s[i:i+2])
+		if err != nil { return "", err }
+		if v[0] == '?' { return "", errors.New("byte 3f is the wildcard; use ?? instead") }
+		b.Write(v)
+	}
+	return b.String(), nil
+}
+
+// LoadExternalCodecs reads an external codec configuration file from r
+// and returns the codecs it describes.
+func LoadExternalCodecs(r io.Reader) ([]*ExternalCodec, error) {
+	var f externalCodecFile
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil { return nil, err }
+
+	seen := map[string]bool{}
+	codecs := make([]*ExternalCodec, 0, len(f.Codecs))
+	for i := range f.Codecs {
+		c, err := f.Codecs[i].Codec()
+		if err != nil { return nil, err }
+		for _, name := range append([]string{c.CodecName}, c.CodecAliases...) {
+			if seen[name] { return nil, fmt.Errorf("%s: duplicate codec name %q", c.CodecName, name) }
+			seen[name] = true
+		}
+		codecs = append(codecs, c)
+	}
+	return codecs, nil
+}
+
+// RegisterExternalCodecFile loads the external codec configuration file
+// at path and registers its codecs. Codecs may not replace codecs that
+// are already registered. Nothing is registered if there is an error.
+func RegisterExternalCodecFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil { return err }
+	defer f.Close()
+
+	codecs, err := LoadExternalCodecs(f)
+	if err != nil { return fmt.Errorf("%s: %v", path, err) }
+
+	for _, c := range codecs {
+		for _, name := range append([]string{c.CodecName}, c.CodecAliases...) {
+			if _, err := NewCodec(name); err == nil {
+				return fmt.Errorf("%s: %s: codec %q is already registered", path, c.CodecName, name)
+			}
+		}
+	}
+	for _, c := range codecs { RegisterCodec(c) }
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"testing"
+)
+
+// TestExternalCodecConfig tests registering external codecs from a
+// configuration file, using shell scripts as stand-in codecs that store
+// a PNG image after a 4-byte header.
+func TestExternalCodecConfig(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil { t.Skip("sh not available") }
+
+	dir := t.TempDir()
+	writeScript := func(name, script string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n" + script + "\n"), 0755); err != nil { t.Fatal(err) }
+		return path
+	}
+	enc := writeScript("png2test", `printf 'TST!'; cat`)
+	dec := writeScript("test2png", `tail -c +5 "$1" > "$2"`)
+
+	config := filepath.Join(dir, "codecs.json")
+	err := os.WriteFile(config, []byte(`{
+		"codecs": [{
+			"name": "testext",
+			"extensions": [".tstx"],
+			"magic": ["545354??"],
+			"decode": ["` + dec + `", "%i", "%o"],
+			"encode": ["` + enc + `"]
+		}]
+	}`), 0644)
+	if err != nil { t.Fatal(err) }
+	if err := RegisterExternalCodecFile(config); err != nil { t.Fatal(err) }
+	if err := RegisterExternalCodecFile(config); err == nil { t.Fatal("expected error registering codecs twice") }
+
+	w := NewWand()
+	im := image.NewNRGBA(image.Rect(0, 0, 5, 3))
+	im.Set(1, 1, color.NRGBA{B: 200, A: 255})
+	w.SetImage(im)
+
+	out := filepath.Join(dir, "out.tstx")
+	if err := w.WriteImage(out); err != nil { t.Fatal(err) }
+	data, err := os.ReadFile(out)
+	if err != nil { t.Fatal(err) }
+	if !strings.HasPrefix(string(data), "TST!\x89PNG") { t.Fatalf("unexpected output %q", data[:8]) }
+
+	w2 := NewWand()
+	if err := w2.ReadImage(out); err != nil { t.Fatal(err) }
+	if _, _, b, _ := w2.Image().At(1, 1).RGBA(); b >> 8 != 200 { t.Fatal("pixel differs after round trip") }
+}
+
+// TestLoadExternalCodecsErrors tests that invalid configuration files
+// are rejected.
+func TestLoadExternalCodecsErrors(t *testing.T) {
+	for _, config := range []string{
+		`{"codecs": [{"encode": ["cat"]}]}`,
+		`{"codecs": [{"name": "x"}]}`,
+		`{"codecs": [{"name": "x", "decode": ["cat"]}]}`,
+		`{"codecs": [{"name": "x", "decode": ["cat"], "magic": ["abc"]}]}`,
+		`{"codecs": [{"name": "x", "decode": ["cat"], "magic": ["zz"]}]}`,
+		`{"codecs": [{"name": "x", "decode": ["cat"], "magic": ["ff3f"]}]}`,
+		`{"codecs": [{"name": "x", "encode": ["cat"], "intermediate": "nonexistent"}]}`,
+		`{"codecs": [{"name": "x", "encode": ["cat"]}, {"name": "y", "aliases": ["x"], "encode": ["cat"]}]}`,
+		`{"codecs": [{"name": "x", "encode": ["cat"], "unknown": true}]}`,
+	} {
+		if _, err := LoadExternalCodecs(strings.NewReader(config)); err == nil {
+			t.Errorf("%s: expected error", config)
+		}
+	}
+
+	codecs, err := LoadExternalCodecs(strings.NewReader(`{"codecs": [{"name": "x", "magic": ["ff 0a ??"], "decode": ["cat"], "extensions": ["x", "xx"]}]}`))
+	if err != nil { t.Fatal(err) }
+	if c := codecs[0]; len(c.MagicStrings) != 1 || c.MagicStrings[0] != "\xff\x0a?" || len(c.CodecAliases) != 1 || c.CodecAliases[0] != "xx" {
+		t.Fatalf("unexpected codec %+v", c)
+	}
+}
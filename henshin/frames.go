@@ -0,0 +1,216 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"image"
+	"image/color"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// Disposal specifies what happens to the area covered by a frame
+// before the next frame is rendered.
+type Disposal int
+
+const (
+	// DisposeNone leaves the frame in place.
+	DisposeNone Disposal = iota
+	// DisposeBackground clears the frame's area to transparent black.
+	DisposeBackground
+	// DisposePrevious restores the frame's area to what it was before
+	// the frame was rendered.
+	DisposePrevious
+)
+
+// Blend specifies how a frame is drawn onto the canvas.
+type Blend int
+
+const (
+	// BlendOver composites the frame over the canvas.
+	BlendOver Blend = iota
+	// BlendSource replaces the frame's area of the canvas.
+	BlendSource
+)
+
+// Frame is a single frame of a multi-frame image.
+type Frame struct {
+	// Image is the frame's image data. Its bounds specify where on
+	// the canvas the frame is placed.
+	Image image.Image
+
+	// Delay is how long the frame is displayed.
+	Delay time.Duration
+
+	// Disposal specifies how the frame is disposed of before the
+	// next frame is rendered.
+	Disposal Disposal
+
+	// Blend specifies how the frame is drawn onto the canvas.
+	Blend Blend
+}
+
+// Animation is an ordered list of frames sharing a single canvas.
+type Animation struct {
+	// Frames contains each frame, in display order.
+	Frames []*Frame
+
+	// Width and Height are the dimensions of the canvas.
+	Width, Height int
+
+	// LoopCount is the number of times the animation is played. A
+	// value of 0 means the animation loops forever.
+	LoopCount int
+}
+
+// NewAnimation returns an Animation containing a single still image.
+func NewAnimation(im image.Image) *Animation {
+	b := im.Bounds()
+	return &Animation{
+		Frames: []*Frame{&Frame{Image: im}},
+		Width: b.Dx(),
+		Height: b.Dy(),
+	}
+}
+
+// Bounds returns the bounds of the canvas.
+func (a *Animation) Bounds() image.Rectangle {
+	return image.Rect(0, 0, a.Width, a.Height)
+}
+
+// IsCoalesced returns true if every frame covers the full canvas
+// and does not depend on the contents of any previous frame. A
+// single still image is always coalesced.
+func (a *Animation) IsCoalesced() bool {
+	if len(a.Frames) == 1 { return true }
+	for _, f := range a.Frames {
+		if f.Image.Bounds() != a.Bounds() || f.Disposal != DisposeBackground {
+			return false
+		}
+	}
+	return true
+}
+
+// Coalesce renders each frame onto the canvas, replacing the frames
+// with full-canvas images that can be processed independently of one
+// another. The frames keep their pixel format if they share one that
+// can hold transparent pixels.
+func (a *Animation) Coalesce() {
+	if a.IsCoalesced() { return }
+
+	canvas := newCanvasLike(a.canvasFormat(), a.Bounds(), nil)
+	var saved draw.Image
+
+	for _, f := range a.Frames {
+		b := f.Image.Bounds().Intersect(canvas.Bounds())
+		if f.Disposal == DisposePrevious {
+			saved = newImageLike(canvas, b).(draw.Image)
+			draw.Copy(saved, b.Min, canvas, b, draw.Src, nil)
+		}
+
+		if f.Blend == BlendSource {
+			draw.Copy(canvas, b.Min, f.Image, b, draw.Src, nil)
+		} else {
+			draw.Copy(canvas, b.Min, f.Image, b, draw.Over, nil)
+		}
+
+		newIm := copyImage(canvas)
+
+		switch f.Disposal {
+			case DisposeBackground:
+				draw.Draw(canvas, b, image.Transparent, image.Point{}, draw.Src)
+			case DisposePrevious:
+				draw.Copy(canvas, b.Min, saved, b, draw.Src, nil)
+		}
+
+		f.Image = newIm
+		f.Disposal = DisposeBackground
+		f.Blend = BlendSource
+	}
+}
+
+// canvasFormat returns the first frame if every frame has the same color
+// model, and an empty *image.RGBA otherwise.
+func (a *Animation) canvasFormat() image.Image {
+	im := a.Frames[0].Image
+	for _, f := range a.Frames[1:] {
+		if !sameColorModel(f.Image.ColorModel(), im.ColorModel()) { return emptyImage }
+	}
+	return im
+}
+
+// sameColorModel reports whether two color models are the same. Palettes
+// are the same if they have the same colors.
+func sameColorModel(m1, m2 color.Model) bool {
+	p1, ok1 := m1.(color.Palette)
+	p2, ok2 := m2.(color.Palette)
+	if !ok1 && !ok2 { return m1 == m2 }
+	if !ok1 || !ok2 || len(p1) != len(p2) { return false }
+
+	for i := range p1 {
+		if p1[i] != p2[i] { return false }
+	}
+	return true
+}
+
+// coalesced returns a coalesced copy of the animation, leaving the
+// original untouched. Frames are not copied if they are already
+// coalesced.
+func (a *Animation) coalesced() *Animation {
+	if a.IsCoalesced() { return a }
+
+	newAnim := *a
+	newAnim.Frames = make([]*Frame, len(a.Frames))
+	for i, f := range a.Frames {
+		newF := *f
+		newAnim.Frames[i] = &newF
+	}
+	newAnim.Coalesce()
+	return &newAnim
+}
+
+// First returns the first frame as it appears on the canvas.
+func (a *Animation) First() image.Image {
+	im := a.Frames[0].Image
+	if a.IsCoalesced() || im.Bounds() == a.Bounds() { return im }
+
+	canvas := newCanvasLike(im, a.Bounds(), nil)
+	draw.Copy(canvas, im.Bounds().Min, im, im.Bounds(), draw.Over, nil)
+	return canvas
+}
+
+// Clone returns a deep copy of the animation.
+func (a *Animation) Clone() *Animation {
+	newAnim := *a
+	newAnim.Frames = make([]*Frame, len(a.Frames))
+	for i, f := range a.Frames {
+		newF := *f
+		newF.Image = copyImage(f.Image)
+		newAnim.Frames[i] = &newF
+	}
+	return &newAnim
+}
+
+// copyImage returns a copy of im with the same bounds, keeping its pixel
+// format where possible.
+func copyImage(im image.Image) image.Image {
+	pix, stride, _, ok := rawPixels(im)
+	if !ok { return cloneImage(im) }
+
+	b := im.Bounds()
+	newIm := newImageLike(im, b)
+	newPix, newStride, _, _ := rawPixels(newIm)
+	for y := 0; y < b.Dy(); y++ {
+		copy(newPix[y * newStride:(y + 1) * newStride], pix[y * stride:])
+	}
+	return newIm
+}
+
+// cloneImage returns a copy of im as an *image.RGBA with the same
+// bounds.
+func cloneImage(im image.Image) *image.RGBA {
+	newIm := image.NewRGBA(im.Bounds())
+	draw.Copy(newIm, newIm.Bounds().Min, im, im.Bounds(), draw.Src, nil)
+	return newIm
+}
@@ -3,9 +3,15 @@
 package henshin
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"image"
+	"image/color"
 	"image/gif"
 	"io"
+	"strconv"
+	"time"
 )
 
 func init() {
@@ -31,17 +37,271 @@ func (c *GIFCodec) Decode(r io.Reader, d *DecodeOptions) (image.Image, error) {
 	return gif.Decode(r)
 }
 
+// DecodeFrames decodes every frame of a GIF image according to the
+// options specified.
+func (c *GIFCodec) DecodeFrames(r io.Reader, d *DecodeOptions) (*Animation, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil { return nil, err }
+
+	if len(g.Image) == 1 {
+		return NewAnimation(g.Image[0]), nil
+	}
+
+	a := &Animation{
+		Frames: make([]*Frame, len(g.Image)),
+		Width: g.Config.Width,
+		Height: g.Config.Height,
+	}
+
+	switch g.LoopCount {
+		case 0: a.LoopCount = 0
+		case -1: a.LoopCount = 1
+		default: a.LoopCount = g.LoopCount + 1
+	}
+
+	for i, im := range g.Image {
+		f := &Frame{
+			Image: im,
+			Delay: time.Duration(g.Delay[i]) * 10 * time.Millisecond,
+		}
+
+		switch g.Disposal[i] {
+			case gif.DisposalBackground: f.Disposal = DisposeBackground
+			case gif.DisposalPrevious: f.Disposal = DisposePrevious
+			default: f.Disposal = DisposeNone
+		}
+
+		a.Frames[i] = f
+	}
+
+	return a, nil
+}
+
 // DecodeConfig returns the color model and dimensions of a GIF image
 // without decoding the image.
 func (c *GIFCodec) DecodeConfig(r io.Reader, d *DecodeOptions) (image.Config, error) {
 	return gif.DecodeConfig(r)
 }
 
+// DecodeFrameCount returns the color model and dimensions of a GIF image
+// and its number of frames, without decoding them.
+func (c *GIFCodec) DecodeFrameCount(r io.Reader, d *DecodeOptions) (image.Config, int, error) {
+	br, ok := r.(interface { io.Reader; io.ByteReader })
+	if !ok { br = bufio.NewReader(r) }
+
+	// The configuration comes from the header, the logical screen
+	// descriptor and the global color table.
+	var header bytes.Buffer
+	if _, err := io.CopyN(&header, br, 13); err != nil { return image.Config{}, 0, io.ErrUnexpectedEOF }
+	if flags := header.Bytes()[10]; flags & 0x80 != 0 {
+		if _, err := io.CopyN(&header, br, 3 << (flags & 7 + 1)); err != nil { return image.Config{}, 0, io.ErrUnexpectedEOF }
+	}
+	cfg, err := gif.DecodeConfig(bytes.NewReader(header.Bytes()))
+	if err != nil { return image.Config{}, 0, err }
+
+	n := 0
+	for {
+		b, err := br.ReadByte()
+		if err != nil { return image.Config{}, 0, io.ErrUnexpectedEOF }
+
+		switch b {
+			case 0x21:
+				// Extensions have a label followed by data sub-blocks.
+				if _, err := br.ReadByte(); err != nil { return image.Config{}, 0, io.ErrUnexpectedEOF }
+			case 0x2c:
+				// Image descriptors are followed by an optional local
+				// color table, the LZW code size and data sub-blocks.
+				var desc [9]byte
+				if _, err := io.ReadFull(br, desc[:]); err != nil { return image.Config{}, 0, io.ErrUnexpectedEOF }
+				if flags := desc[8]; flags & 0x80 != 0 {
+					if _, err := io.CopyN(io.Discard, br, 3 << (flags & 7 + 1)); err != nil { return image.Config{}, 0, io.ErrUnexpectedEOF }
+				}
+				if _, err := br.ReadByte(); err != nil { return image.Config{}, 0, io.ErrUnexpectedEOF }
+				n++
+			case 0x3b:
+				return cfg, n, nil
+			default:
+				return image.Config{}, 0, fmt.Errorf("gif: unknown block type: 0x%.2x", b)
+		}
+
+		// Skip the data sub-blocks.
+		for {
+			size, err := br.ReadByte()
+			if err != nil { return image.Config{}, 0, io.ErrUnexpectedEOF }
+			if size == 0 { break }
+			if _, err := io.CopyN(io.Discard, br, int64(size)); err != nil { return image.Config{}, 0, io.ErrUnexpectedEOF }
+		}
+	}
+}
+
+// GIFEncodeOptions specifies GIF-specific encoding options. Pass it in
+// EncodeOptions.EncoderSpecific.
+type GIFEncodeOptions struct {
+	// Colors is the maximum number of colors in the palette, from 2 to
+	// 256. A value of 0 means 256.
+	Colors int
+
+	// Dither is the dithering method used to map images to the palette.
+	Dither Dither
+}
+
+// ParseParams parses GIF encoding options from a comma-separated list
+// of parameters. The parameters are:
+//
+//	colors=N                            maximum number of colors (2-256)
+//	dither=none|floydsteinberg|ordered  dithering method
+//
+// Images are dithered with Floyd-Steinberg dithering by default.
+func (c *GIFCodec) ParseParams(opt string) (any, error) {
+	gifOpt := &GIFEncodeOptions{Dither: DitherFloydSteinberg}
+	err := eachCodecParam(opt, func(key, val string, hasVal bool) error {
+		var err error
+		switch key {
+			case "colors":
+				gifOpt.Colors, err = strconv.Atoi(val)
+				if err != nil || gifOpt.Colors < 2 || gifOpt.Colors > 256 {
+					return fmt.Errorf("gif: invalid number of colors %q", val)
+				}
+			case "dither":
+				gifOpt.Dither, err = ParseDither(val)
+				if err != nil { return fmt.Errorf("gif: %w %q", err, val) }
+			default: return fmt.Errorf("gif: unknown parameter %q", key)
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+	return gifOpt, nil
+}
+
+// gifPalettizer returns a function that maps images to a palette of the
+// colors in frames, as specified by the GIF-specific options in o.
+// Paletted images with few enough colors are kept. Since GIF has no
+// partial transparency, pixels less than half opaque become transparent
+// and the rest become opaque.
+func gifPalettizer(o *EncodeOptions, frames ...image.Image) func(image.Image) *image.Paletted {
+	gifOpt, ok := o.EncoderSpecific.(*GIFEncodeOptions)
+	if !ok || gifOpt == nil { gifOpt = &GIFEncodeOptions{Dither: DitherFloydSteinberg} }
+
+	n := gifOpt.Colors
+	if n < 2 || n > 256 { n = 256 }
+	keep := func(im image.Image) bool {
+		p, ok := im.(*image.Paletted)
+		return ok && len(p.Palette) <= n
+	}
+
+	var hist map[[4]uint8]int
+	for _, im := range frames {
+		if !keep(im) { hist = colorHistogram(hist, gifAlpha(im)) }
+	}
+	// The transparent entry is reserved so that it is never averaged
+	// with other colors.
+	_, transparent := hist[[4]uint8{}]
+	if transparent {
+		delete(hist, [4]uint8{})
+		n--
+	}
+	pal := medianCut(hist, n)
+	if transparent { pal = append(pal, color.Transparent) }
+
+	return func(im image.Image) *image.Paletted {
+		if keep(im) { return im.(*image.Paletted) }
+
+		im = gifAlpha(im)
+		p := palettize(im, pal, gifOpt.Dither)
+		if transparent {
+			b := p.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if _, _, _, a := im.At(x, y).RGBA(); a == 0 {
+						p.SetColorIndex(x, y, uint8(len(pal) - 1))
+					}
+				}
+			}
+		}
+		return p
+	}
+}
+
+// gifAlpha returns im with pixels less than half opaque made transparent
+// and the rest made opaque.
+func gifAlpha(im image.Image) image.Image {
+	if isOpaque(im) { return im }
+
+	b := im.Bounds()
+	m := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(im.At(x, y)).(color.NRGBA)
+			if c.A < 0x80 {
+				c = color.NRGBA{}
+			} else {
+				c.A = 0xff
+			}
+			m.SetNRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
 // Encode encodes a GIF image according to the options specified.
+// GIF-specific options may be given as a *GIFEncodeOptions.
 func (c *GIFCodec) Encode(w io.Writer, i image.Image, o *EncodeOptions) error {
 	if o == nil { o = DefaultEncodeOptions() }
 
-	var gifOpt gif.Options
+	return gif.Encode(w, gifPalettizer(o, i)(i), nil)
+}
+
+// EncodeFrames encodes a multi-frame GIF image according to the
+// options specified.
+func (c *GIFCodec) EncodeFrames(w io.Writer, a *Animation, o *EncodeOptions) error {
+	if o == nil { o = DefaultEncodeOptions() }
+
+	// GIF frames are always composited over the canvas.
+	for _, f := range a.Frames {
+		if f.Blend == BlendSource {
+			a = a.coalesced()
+			break
+		}
+	}
+
+	g := &gif.GIF{
+		Image: make([]*image.Paletted, len(a.Frames)),
+		Delay: make([]int, len(a.Frames)),
+		Disposal: make([]byte, len(a.Frames)),
+		Config: image.Config{Width: a.Width, Height: a.Height},
+	}
+
+	switch a.LoopCount {
+		case 0: g.LoopCount = 0
+		case 1: g.LoopCount = -1
+		default: g.LoopCount = a.LoopCount - 1
+	}
 
-	return gif.Encode(w, i, &gifOpt)
+	// Every frame shares the same palette.
+	images := make([]image.Image, len(a.Frames))
+	for i, f := range a.Frames {
+		images[i] = f.Image
+	}
+	palettize := gifPalettizer(o, images...)
+
+	for i, f := range a.Frames {
+		g.Image[i] = palettize(f.Image)
+		g.Delay[i] = int(f.Delay / (10 * time.Millisecond))
+
+		switch f.Disposal {
+			case DisposeBackground: g.Disposal[i] = gif.DisposalBackground
+			case DisposePrevious: g.Disposal[i] = gif.DisposalPrevious
+			default: g.Disposal[i] = gif.DisposalNone
+		}
+	}
+
+	return gif.EncodeAll(w, g)
 }
+
+var (
+	_ Decoder = &GIFCodec{}
+	_ Encoder = &GIFCodec{}
+	_ DecoderWithFrames = &GIFCodec{}
+	_ EncoderWithFrames = &GIFCodec{}
+	_ CodecWithParamParser = &GIFCodec{}
+)
@@ -0,0 +1,147 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+
+	"testing"
+)
+
+// TestAnimatedGIFRoundTrip tests that every frame of an animated GIF
+// survives decoding, resizing and encoding.
+func TestAnimatedGIFRoundTrip(t *testing.T) {
+	pal := color.Palette{color.Transparent, color.Black, color.White}
+
+	g := &gif.GIF{LoopCount: 2}
+	for i := 0; i < 3; i++ {
+		im := image.NewPaletted(image.Rect(i * 4, i * 4, i * 4 + 8, i * 4 + 8), pal)
+		for j := range im.Pix { im.Pix[j] = uint8(1 + i % 2) }
+		g.Image = append(g.Image, im)
+		g.Delay = append(g.Delay, 10 * (i + 1))
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	g.Config = image.Config{Width: 16, Height: 16}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil { t.Fatal(err) }
+
+	w := NewWand()
+	if err := w.DecodeImage(&buf); err != nil { t.Fatal(err) }
+
+	if w.FrameCount() != 3 {
+		t.Fatalf("expected 3 frames, got %d", w.FrameCount())
+	}
+	if w.Width() != 16 || w.Height() != 16 {
+		t.Fatalf("expected 16x16 canvas, got %dx%d", w.Width(), w.Height())
+	}
+	if w.Frames().LoopCount != 3 {
+		t.Fatalf("expected loop count 3, got %d", w.Frames().LoopCount)
+	}
+
+	w.Resize(8, 8, NearestStrategy)
+
+	buf.Reset()
+	if err := w.EncodeImage(&buf, "gif"); err != nil { t.Fatal(err) }
+
+	g2, err := gif.DecodeAll(&buf)
+	if err != nil { t.Fatal(err) }
+
+	if len(g2.Image) != 3 {
+		t.Fatalf("expected 3 encoded frames, got %d", len(g2.Image))
+	}
+	if g2.Config.Width != 8 || g2.Config.Height != 8 {
+		t.Fatalf("expected 8x8 encoded canvas, got %dx%d", g2.Config.Width, g2.Config.Height)
+	}
+	if g2.LoopCount != g.LoopCount {
+		t.Fatalf("expected loop count %d, got %d", g.LoopCount, g2.LoopCount)
+	}
+	for i, d := range g2.Delay {
+		if d != g.Delay[i] {
+			t.Fatalf("frame %d: expected delay %d, got %d", i, g.Delay[i], d)
+		}
+	}
+}
+
+// TestGIFFramesKeepWhite tests that encoding the frames of an animation
+// keeps pure white, in both opaque frames and frames with transparency.
+func TestGIFFramesKeepWhite(t *testing.T) {
+	a := &Animation{Width: 4, Height: 4}
+	for i := 0; i < 2; i++ {
+		im := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 4; x++ {
+				if (x + y) % 2 == 0 {
+					im.Set(x, y, color.White)
+				} else {
+					im.Set(x, y, color.Black)
+				}
+			}
+		}
+		if i == 1 { im.Set(3, 3, color.Transparent) }
+		a.Frames = append(a.Frames, &Frame{Image: im})
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeFrames("gif", &buf, a, nil); err != nil { t.Fatal(err) }
+	g, err := gif.DecodeAll(&buf)
+	if err != nil { t.Fatal(err) }
+
+	for i, im := range g.Image {
+		if r, g, b, a := im.At(0, 0).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff || a != 0xffff {
+			t.Errorf("frame %d: expected white, got %v", i, im.At(0, 0))
+		}
+		if r, g, b, _ := im.At(1, 0).RGBA(); r != 0 || g != 0 || b != 0 {
+			t.Errorf("frame %d: expected black, got %v", i, im.At(1, 0))
+		}
+	}
+	if _, _, _, a := g.Image[1].At(3, 3).RGBA(); a != 0 {
+		t.Errorf("expected a transparent pixel, got %v", g.Image[1].At(3, 3))
+	}
+}
+
+// TestGIFQuantizeFrames tests that single images and animations are
+// mapped to a palette the same way.
+func TestGIFQuantizeFrames(t *testing.T) {
+	im := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			im.Set(x, y, color.NRGBA{uint8(x * 16), uint8(y * 16), 0x80, 0xff})
+		}
+	}
+	im.Set(0, 0, color.NRGBA{0xff, 0, 0, 0x40})
+
+	for _, params := range []string{"", "colors=4,dither=none"} {
+		o := DefaultEncodeOptions()
+		gifOpt, err := (&GIFCodec{}).ParseParams(params)
+		if err != nil { t.Fatal(err) }
+		o.EncoderSpecific = gifOpt
+
+		var single, multi bytes.Buffer
+		if err := Encode("gif", &single, im, o); err != nil { t.Fatal(err) }
+		if err := EncodeFrames("gif", &multi, NewAnimation(im), o); err != nil { t.Fatal(err) }
+
+		g1, err := gif.Decode(&single)
+		if err != nil { t.Fatal(err) }
+		g2, err := gif.DecodeAll(&multi)
+		if err != nil { t.Fatal(err) }
+
+		p1, p2 := g1.(*image.Paletted), g2.Image[0]
+		if params != "" && len(p1.Palette) > 4 {
+			t.Errorf("%q: expected at most 4 colors, got %d", params, len(p1.Palette))
+		}
+		if _, _, _, a := p1.At(0, 0).RGBA(); a != 0 {
+			t.Errorf("%q: expected a transparent pixel, got %v", params, p1.At(0, 0))
+		}
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 16; x++ {
+				if c1, c2 := p1.At(x, y), p2.At(x, y); c1 != c2 {
+					t.Fatalf("%q: pixel (%d, %d) differs: %v and %v", params, x, y, c1, c2)
+				}
+			}
+		}
+	}
+}
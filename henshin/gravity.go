@@ -0,0 +1,71 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"errors"
+	"strings"
+)
+
+// Gravity specifies where a region is placed relative to an image, like
+// ImageMagick's -gravity option.
+type Gravity int
+
+const (
+	GravityNorthWest Gravity = iota
+	GravityNorth
+	GravityNorthEast
+	GravityWest
+	GravityCenter
+	GravityEast
+	GravitySouthWest
+	GravitySouth
+	GravitySouthEast
+)
+
+var gravityNames = [...]string{
+	GravityNorthWest: "NorthWest",
+	GravityNorth: "North",
+	GravityNorthEast: "NorthEast",
+	GravityWest: "West",
+	GravityCenter: "Center",
+	GravityEast: "East",
+	GravitySouthWest: "SouthWest",
+	GravitySouth: "South",
+	GravitySouthEast: "SouthEast",
+}
+
+// ErrInvalidGravity is returned when parsing an unknown gravity.
+var ErrInvalidGravity = errors.New("invalid gravity")
+
+// ParseGravity parses a gravity name, such as "Center" or "SouthEast".
+// Names are case insensitive.
+func ParseGravity(s string) (Gravity, error) {
+	for g, name := range gravityNames {
+		if strings.EqualFold(s, name) { return Gravity(g), nil }
+	}
+	return GravityNorthWest, ErrInvalidGravity
+}
+
+func (g Gravity) String() string {
+	if g < 0 || int(g) >= len(gravityNames) { return "Gravity(?)" }
+	return gravityNames[g]
+}
+
+// offset returns the position of an inner region of size iw x ih within
+// an outer region of size w x h. The offsets xoff and yoff move the inner
+// region away from the edge the gravity refers to.
+func (g Gravity) offset(w, h, iw, ih, xoff, yoff int) (x, y int) {
+	switch g {
+		case GravityNorthWest, GravityWest, GravitySouthWest: x = xoff
+		case GravityNorth, GravityCenter, GravitySouth: x = (w - iw) / 2 + xoff
+		default: x = w - iw - xoff
+	}
+
+	switch g {
+		case GravityNorthWest, GravityNorth, GravityNorthEast: y = yoff
+		case GravityWest, GravityCenter, GravityEast: y = (h - ih) / 2 + yoff
+		default: y = h - ih - yoff
+	}
+	return
+}
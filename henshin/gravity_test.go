@@ -0,0 +1,139 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+
+	"testing"
+)
+
+// TestParseGravity tests parsing gravity names.
+func TestParseGravity(t *testing.T) {
+	for _, name := range []string{"center", "Center", "CENTER"} {
+		g, err := ParseGravity(name)
+		if err != nil || g != GravityCenter {
+			t.Errorf("%q: expected Center but got %v (%v)", name, g, err)
+		}
+	}
+
+	if _, err := ParseGravity("middle"); err != ErrInvalidGravity {
+		t.Errorf("expected ErrInvalidGravity but got %v", err)
+	}
+}
+
+// TestCropAnchor tests cropping relative to each gravity.
+func TestCropAnchor(t *testing.T) {
+	im := image.NewGray(image.Rect(0, 0, 5, 3))
+	for i := range im.Pix {
+		im.Pix[i] = uint8(i)
+	}
+
+	tests := []struct {
+		g Gravity
+		xoff, yoff int
+		x, y int
+	}{
+		{GravityNorthWest, 0, 0, 0, 0},
+		{GravityNorthWest, 1, 1, 1, 1},
+		{GravityCenter, 0, 0, 2, 1},
+		{GravitySouthEast, 0, 0, 4, 2},
+		{GravitySouthEast, 1, 0, 3, 2},
+		{GravityNorth, 0, 0, 2, 0},
+		{GravityWest, 0, 0, 0, 1},
+	}
+
+	for _, tt := range tests {
+		w := NewWand()
+		w.SetImage(im)
+		w.CropAnchor(1, 1, tt.xoff, tt.yoff, tt.g)
+
+		expected := im.GrayAt(tt.x, tt.y)
+		got := color.GrayModel.Convert(w.Image().At(0, 0))
+		if w.Width() != 1 || w.Height() != 1 || got != expected {
+			t.Errorf("%v%+d%+d: expected pixel %v but got %v", tt.g, tt.xoff, tt.yoff, expected, got)
+		}
+	}
+}
+
+// TestExtent tests extending an image with a background color.
+func TestExtent(t *testing.T) {
+	im := image.NewGray(image.Rect(0, 0, 2, 2))
+	w := NewWand()
+	w.SetImage(im)
+	w.Extent(4, 6, color.White, GravityCenter)
+
+	if w.Width() != 4 || w.Height() != 6 {
+		t.Fatalf("expected 4x6 but got %dx%d", w.Width(), w.Height())
+	}
+
+	white := color.RGBAModel.Convert(color.White)
+	black := color.RGBAModel.Convert(color.Black)
+	if c := color.RGBAModel.Convert(w.Image().At(0, 0)); c != white {
+		t.Errorf("expected background at corner but got %v", c)
+	}
+	if c := color.RGBAModel.Convert(w.Image().At(1, 2)); c != black {
+		t.Errorf("expected image at center but got %v", c)
+	}
+	if _, ok := w.Image().(*image.Gray); !ok {
+		t.Errorf("expected a gray image but got %T", w.Image())
+	}
+
+	// A transparent background doesn't fit in a gray image.
+	for _, im := range []image.Image{image.NewGray(im.Rect), image.NewGray16(im.Rect)} {
+		w.SetImage(im)
+		w.Extent(4, 6, nil, GravityCenter)
+		if _, _, _, a := w.Image().At(0, 0).RGBA(); a != 0 {
+			t.Errorf("%T: expected a transparent corner but got alpha %d", im, a)
+		}
+		switch w.Image().(type) {
+			case *image.RGBA: if _, ok := im.(*image.Gray); !ok { t.Errorf("%T: got an RGBA image", im) }
+			case *image.RGBA64: if _, ok := im.(*image.Gray16); !ok { t.Errorf("%T: got an RGBA64 image", im) }
+			default: t.Errorf("%T: got a %T image", im, w.Image())
+		}
+	}
+}
+
+// TestPalettedCanvas tests that areas outside a paletted image are
+// transparent after cropping or extending it.
+func TestPalettedCanvas(t *testing.T) {
+	newIm := func(pal color.Palette) *image.Paletted {
+		im := image.NewPaletted(image.Rect(0, 0, 2, 2), pal)
+		for i := range im.Pix { im.Pix[i] = 1 }
+		return im
+	}
+
+	tests := []struct {
+		pal color.Palette
+		want image.Image
+	}{
+		{color.Palette{color.Black, color.White}, &image.Paletted{}},
+		{color.Palette{color.White, color.Black, color.Transparent}, &image.Paletted{}},
+		{make(color.Palette, 256), &image.RGBA{}},
+	}
+	for i := range tests[2].pal { tests[2].pal[i] = color.Gray{uint8(i)} }
+
+	for _, tt := range tests {
+		for _, op := range []string{"crop", "extent"} {
+			w := NewWand()
+			w.SetImage(newIm(tt.pal))
+			if op == "crop" {
+				w.Crop(3, 3, -1, -1)
+			} else {
+				w.Extent(3, 3, nil, GravitySouthEast)
+			}
+
+			if gt, wt := reflect.TypeOf(w.Image()), reflect.TypeOf(tt.want); gt != wt {
+				t.Errorf("%s with %d colors: got %v, want %v", op, len(tt.pal), gt, wt)
+			}
+			if _, _, _, a := w.Image().At(0, 0).RGBA(); a != 0 {
+				t.Errorf("%s with %d colors: expected a transparent corner but got alpha %d", op, len(tt.pal), a)
+			}
+			if gt, wt := color.RGBAModel.Convert(w.Image().At(2, 2)), color.RGBAModel.Convert(tt.pal[1]); gt != wt {
+				t.Errorf("%s with %d colors: got %v, want %v", op, len(tt.pal), gt, wt)
+			}
+		}
+	}
+}
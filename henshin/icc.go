@@ -0,0 +1,251 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	// ErrInvalidICCProfile is returned when parsing a malformed ICC
+	// profile.
+	ErrInvalidICCProfile = errors.New("invalid ICC profile")
+	// ErrUnsupportedICCProfile is returned when converting pixels using
+	// an ICC profile that isn't a matrix/TRC profile.
+	ErrUnsupportedICCProfile = errors.New("unsupported ICC profile")
+)
+
+// iccCurve is a tone reproduction curve, mapping encoded values to linear
+// values in the range [0, 1].
+type iccCurve func(v float64) float64
+
+// iccProfile is the part of an ICC profile needed to convert pixels to
+// sRGB: a gray TRC, or RGB TRCs and colorants relative to D50.
+type iccProfile struct {
+	gray bool
+	trc [3]iccCurve
+	matrix [3][3]float64
+}
+
+// srgbD50 contains the colorants of sRGB adapted to D50, as columns.
+var srgbD50 = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseICCCurve parses a curveType or parametricCurveType element.
+func parseICCCurve(data []byte) (iccCurve, error) {
+	if len(data) < 12 { return nil, ErrInvalidICCProfile }
+
+	switch string(data[:4]) {
+		case "curv":
+			n := int(binary.BigEndian.Uint32(data[8:]))
+			if len(data) < 12 + n * 2 { return nil, ErrInvalidICCProfile }
+
+			switch n {
+				case 0: return func(v float64) float64 { return v }, nil
+				case 1:
+					gamma := float64(binary.BigEndian.Uint16(data[12:])) / 256
+					return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+			}
+
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(data[12 + i * 2:])) / 0xffff
+			}
+			return func(v float64) float64 {
+				pos := v * float64(n - 1)
+				i := int(pos)
+				if i >= n - 1 { return table[n - 1] }
+				if i < 0 { return table[0] }
+				frac := pos - float64(i)
+				return table[i] + (table[i + 1] - table[i]) * frac
+			}, nil
+		case "para":
+			fn := binary.BigEndian.Uint16(data[8:])
+			counts := []int{1, 3, 4, 5, 7}
+			if int(fn) >= len(counts) { return nil, ErrUnsupportedICCProfile }
+			if len(data) < 12 + counts[fn] * 4 { return nil, ErrInvalidICCProfile }
+
+			var p [7]float64
+			for i := 0; i < counts[fn]; i++ {
+				p[i] = s15Fixed16(data[12 + i * 4:])
+			}
+			g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+
+			switch fn {
+				case 0: return func(v float64) float64 { return math.Pow(v, g) }, nil
+				case 1: d, c = -b / a, 0
+				case 2: d, e, f, c = -b / a, c, c, 0
+				case 3: // already Y = (aX+b)^g for X >= d, else cX
+			}
+			return func(v float64) float64 {
+				if v >= d { return math.Pow(math.Max(a * v + b, 0), g) + e }
+				return c * v + f
+			}, nil
+	}
+	return nil, ErrUnsupportedICCProfile
+}
+
+// parseICCProfile parses a matrix/TRC ICC profile.
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" { return nil, ErrInvalidICCProfile }
+
+	p := &iccProfile{}
+	switch string(data[16:20]) {
+		case "RGB ":
+		case "GRAY": p.gray = true
+		default: return nil, ErrUnsupportedICCProfile
+	}
+	if string(data[20:24]) != "XYZ " { return nil, ErrUnsupportedICCProfile }
+
+	tags := map[string][]byte{}
+	n := int(binary.BigEndian.Uint32(data[128:]))
+	if n > (len(data) - 132) / 12 { return nil, ErrInvalidICCProfile }
+	for i := 0; i < n; i++ {
+		entry := data[132 + i * 12:]
+		offset := int(binary.BigEndian.Uint32(entry[4:]))
+		size := int(binary.BigEndian.Uint32(entry[8:]))
+		if offset < 0 || size < 0 || offset > len(data) || size > len(data) - offset {
+			return nil, ErrInvalidICCProfile
+		}
+		tags[string(entry[:4])] = data[offset:offset + size]
+	}
+
+	trcTags, xyzTags := []string{"rTRC", "gTRC", "bTRC"}, []string{"rXYZ", "gXYZ", "bXYZ"}
+	if p.gray { trcTags = []string{"kTRC"} }
+
+	for i, sig := range trcTags {
+		tag, ok := tags[sig]
+		if !ok { return nil, ErrUnsupportedICCProfile }
+
+		curve, err := parseICCCurve(tag)
+		if err != nil { return nil, err }
+		p.trc[i] = curve
+	}
+	if p.gray { return p, nil }
+
+	for i, sig := range xyzTags {
+		tag, ok := tags[sig]
+		if !ok { return nil, ErrUnsupportedICCProfile }
+		if len(tag) < 20 || string(tag[:4]) != "XYZ " { return nil, ErrInvalidICCProfile }
+
+		for j := 0; j < 3; j++ {
+			p.matrix[j][i] = s15Fixed16(tag[8 + j * 4:])
+		}
+	}
+	return p, nil
+}
+
+func mul3x3(a, b [3][3]float64) (c [3][3]float64) {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				c[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return
+}
+
+func invert3x3(m [3][3]float64) (inv [3][3]float64) {
+	det := m[0][0] * (m[1][1] * m[2][2] - m[1][2] * m[2][1]) -
+		m[0][1] * (m[1][0] * m[2][2] - m[1][2] * m[2][0]) +
+		m[0][2] * (m[1][0] * m[2][1] - m[1][1] * m[2][0])
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			a, b := m[(j + 1) % 3], m[(j + 2) % 3]
+			inv[i][j] = (a[(i + 1) % 3] * b[(i + 2) % 3] - a[(i + 2) % 3] * b[(i + 1) % 3]) / det
+		}
+	}
+	return
+}
+
+// srgbConverter converts colors from an ICC profile to sRGB.
+type srgbConverter struct {
+	gray bool
+	// luts map 16-bit encoded values to linear values.
+	luts [3][]float64
+	// matrix maps linear values to linear sRGB.
+	matrix [3][3]float64
+}
+
+func newSRGBConverter(p *iccProfile) *srgbConverter {
+	linearTablesOnce.Do(initLinearTables)
+
+	sc := &srgbConverter{gray: p.gray}
+	channels := 3
+	if p.gray { channels = 1 }
+	for i := 0; i < channels; i++ {
+		sc.luts[i] = make([]float64, 1 << 16)
+		for v := range sc.luts[i] {
+			sc.luts[i][v] = p.trc[i](float64(v) / 0xffff)
+		}
+	}
+	if p.gray { sc.luts[1], sc.luts[2] = sc.luts[0], sc.luts[0] }
+
+	if !p.gray {
+		sc.matrix = mul3x3(invert3x3(srgbD50), p.matrix)
+	}
+	return sc
+}
+
+// encode converts a linear sRGB value to a 16-bit sRGB value.
+func (sc *srgbConverter) encode(v float64) uint16 {
+	if v <= 0 { return 0 }
+	if v >= 1 { return 0xffff }
+	return linearToSRGB[int(v * 0xffff + 0.5)]
+}
+
+// convert returns the sRGB equivalent of c.
+func (sc *srgbConverter) convert(c color.Color) color.NRGBA64 {
+	nc := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	r, g, b := sc.luts[0][nc.R], sc.luts[1][nc.G], sc.luts[2][nc.B]
+	if !sc.gray {
+		m := &sc.matrix
+		r, g, b = m[0][0] * r + m[0][1] * g + m[0][2] * b,
+			m[1][0] * r + m[1][1] * g + m[1][2] * b,
+			m[2][0] * r + m[2][1] * g + m[2][2] * b
+	}
+	return color.NRGBA64{sc.encode(r), sc.encode(g), sc.encode(b), nc.A}
+}
+
+// apply returns im converted to sRGB, keeping its pixel format where
+// possible. Paletted images have their palette converted instead.
+func (sc *srgbConverter) apply(im image.Image) image.Image {
+	if p, ok := im.(*image.Paletted); ok {
+		pal := make(color.Palette, len(p.Palette))
+		for i, c := range p.Palette {
+			pal[i] = sc.convert(c)
+		}
+		return &image.Paletted{Pix: append([]uint8(nil), p.Pix...), Stride: p.Stride, Rect: p.Rect, Palette: pal}
+	}
+
+	b := im.Bounds()
+	var newIm draw.Image
+	switch im.(type) {
+		case *image.Gray, *image.Gray16, *image.NRGBA, *image.NRGBA64, *image.RGBA64:
+			newIm = newImageLike(im, b).(draw.Image)
+		default:
+			newIm = image.NewNRGBA(b)
+	}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			newIm.Set(x, y, sc.convert(im.At(x, y)))
+		}
+	}
+	return newIm
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+
+	"testing"
+)
+
+// testICCProfile returns an RGB matrix/TRC profile with sRGB colorants
+// and the given curve element for each channel, padded to size bytes.
+func testICCProfile(curve []byte, size int) []byte {
+	fixed := func(v float64) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(int32(v * 65536)))
+	}
+
+	type tag struct {
+		sig string
+		data []byte
+	}
+	var tags []tag
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		data := []byte("XYZ \x00\x00\x00\x00")
+		for j := 0; j < 3; j++ {
+			data = append(data, fixed(srgbD50[j][i])...)
+		}
+		tags = append(tags, tag{sig, data})
+	}
+	for _, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		tags = append(tags, tag{sig, curve})
+	}
+
+	profile := make([]byte, 128)
+	copy(profile[12:], "mntr")
+	copy(profile[16:], "RGB XYZ ")
+	copy(profile[36:], "acsp")
+	profile = binary.BigEndian.AppendUint32(profile, uint32(len(tags)))
+
+	offset := len(profile) + len(tags) * 12
+	var data []byte
+	for _, t := range tags {
+		profile = append(profile, t.sig...)
+		profile = binary.BigEndian.AppendUint32(profile, uint32(offset + len(data)))
+		profile = binary.BigEndian.AppendUint32(profile, uint32(len(t.data)))
+		data = append(data, t.data...)
+		for len(data) % 4 != 0 { data = append(data, 0) }
+	}
+	profile = append(profile, data...)
+	if len(profile) < size { profile = append(profile, make([]byte, size - len(profile))...) }
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+// TestConvertToSRGB tests converting images from matrix/TRC profiles.
+func TestConvertToSRGB(t *testing.T) {
+	// The sRGB curve, as a parametric curve.
+	srgbCurve := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, v := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		srgbCurve = binary.BigEndian.AppendUint32(srgbCurve, uint32(int32(v * 65536)))
+	}
+	linearCurve := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x00")
+
+	tests := []struct {
+		name string
+		curve []byte
+		in, out uint8
+	}{
+		{"sRGB", srgbCurve, 0x80, 0x80},
+		{"linear", linearCurve, 0x80, 188},
+	}
+
+	for _, tt := range tests {
+		im := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+		for i := range im.Pix {
+			im.Pix[i] = tt.in
+			if i % 4 == 3 { im.Pix[i] = 0xff }
+		}
+
+		w := NewWand()
+		w.SetImage(im)
+		w.Metadata().ICCProfile = testICCProfile(tt.curve, 0)
+		if err := w.ConvertToSRGB(); err != nil { t.Fatal(err) }
+
+		if w.Metadata().ICCProfile != nil {
+			t.Errorf("%s: profile was not removed", tt.name)
+		}
+		c := color.NRGBAModel.Convert(w.Image().At(1, 1)).(color.NRGBA)
+		for _, v := range []uint8{c.R, c.G, c.B} {
+			if v < tt.out - 1 || v > tt.out + 1 {
+				t.Errorf("%s: expected %d but got %v", tt.name, tt.out, c)
+				break
+			}
+		}
+	}
+
+	w := NewWand()
+	w.NewImage(1, 1)
+	w.Metadata().ICCProfile = []byte("not a profile")
+	if err := w.ConvertToSRGB(); err != ErrInvalidICCProfile {
+		t.Errorf("expected ErrInvalidICCProfile but got %v", err)
+	}
+}
+
+// TestICCProfileCodecs tests embedding ICC profiles in each codec that
+// supports them, including profiles that span several JPEG segments.
+func TestICCProfileCodecs(t *testing.T) {
+	profile := testICCProfile([]byte("curv\x00\x00\x00\x00\x00\x00\x00\x00"), 150000)
+
+	for _, codec := range []string{"png", "jpeg", "webp", "tiff"} {
+		w := NewWand()
+		w.NewImage(4, 4)
+		w.Metadata().ICCProfile = profile
+
+		var buf bytes.Buffer
+		if err := w.EncodeImage(&buf, codec); err != nil { t.Fatal(err) }
+
+		w = NewWand()
+		if err := w.DecodeImage(&buf); err != nil { t.Fatal(err) }
+		if !bytes.Equal(w.Metadata().ICCProfile, profile) {
+			t.Errorf("%s: ICC profile was not preserved (%d bytes)", codec, len(w.Metadata().ICCProfile))
+		}
+	}
+}
@@ -3,9 +3,18 @@
 package henshin
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"image"
-	"image/jpeg"
 	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ronsor/majokko/format/jpeg"
 )
 
 func init() {
@@ -31,33 +40,445 @@ func (c *JPEGCodec) Magic() []string {
 	return []string{"\xff\xd8"}
 }
 
+// jpegSegment is a marker segment in a JPEG file.
+type jpegSegment struct {
+	marker byte
+	data []byte
+}
+
+// JPEG markers.
+const (
+	jpegMarkerSOI = 0xd8
+	jpegMarkerEOI = 0xd9
+	jpegMarkerSOS = 0xda
+	jpegMarkerAPP0 = 0xe0
+	jpegMarkerAPP1 = 0xe1
+	jpegMarkerAPP2 = 0xe2
+	jpegMarkerCOM = 0xfe
+)
+
+// jpegJFIFHeader prefixes the APP0 segment of a JFIF file.
+const jpegJFIFHeader = "JFIF\x00"
+
+// jpegICCHeader prefixes each APP2 segment containing part of an ICC
+// profile.
+const jpegICCHeader = "ICC_PROFILE\x00"
+
+// jpegXMPHeader prefixes the APP1 segment containing an XMP packet.
+const jpegXMPHeader = "http://ns.adobe.com/xap/1.0/\x00"
+
+// jpegMaxICCChunk is the largest part of an ICC profile that fits in a
+// single APP2 segment, after the header, sequence number and count.
+const jpegMaxICCChunk = 0xffff - 2 - len(jpegICCHeader) - 2
+
+// readJPEGSegments returns the marker segments that precede the image
+// data of a JPEG file.
+func readJPEGSegments(data []byte) (segs []jpegSegment, err error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != jpegMarkerSOI {
+		return nil, jpeg.FormatError("missing SOI marker")
+	}
+
+	for i := 2; ; {
+		if i + 1 >= len(data) || data[i] != 0xff {
+			return nil, jpeg.FormatError("invalid marker")
+		}
+
+		// Markers may be preceded by fill bytes.
+		marker := data[i + 1]
+		if marker == 0xff { i++; continue }
+		i += 2
+
+		switch {
+			case marker == jpegMarkerSOS || marker == jpegMarkerEOI:
+				return
+			case marker >= 0xd0 && marker <= 0xd7 || marker == 0x01:
+				// These markers have no parameters.
+				continue
+		}
+
+		if i + 2 > len(data) { return nil, jpeg.FormatError("truncated segment") }
+		n := int(binary.BigEndian.Uint16(data[i:]))
+		if n < 2 || i + n > len(data) { return nil, jpeg.FormatError("truncated segment") }
+
+		segs = append(segs, jpegSegment{marker, data[i+2:i+n]})
+		i += n
+	}
+}
+
+// readJPEGHeader reads the start of a JPEG file from r, up to and
+// including the SOS segment that begins the image data. The rest of the file
+// is not read.
+func readJPEGHeader(r io.Reader) ([]byte, error) {
+	br, ok := r.(interface { io.Reader; io.ByteReader })
+	if !ok { br = bufio.NewReader(r) }
+
+	var buf bytes.Buffer
+	readByte := func() (byte, error) {
+		b, err := br.ReadByte()
+		if err == io.EOF { err = io.ErrUnexpectedEOF }
+		buf.WriteByte(b)
+		return b, err
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := readByte(); err != nil { return nil, err }
+	}
+
+	for {
+		b, err := readByte()
+		if err != nil { return nil, err }
+		if b != 0xff { return nil, jpeg.FormatError("invalid marker") }
+
+		// Markers may be preceded by fill bytes.
+		marker := byte(0xff)
+		for marker == 0xff {
+			if marker, err = readByte(); err != nil { return nil, err }
+		}
+
+		switch {
+			case marker == jpegMarkerEOI:
+				return buf.Bytes(), nil
+			case marker >= 0xd0 && marker <= 0xd7 || marker == 0x01:
+				// These markers have no parameters.
+				continue
+		}
+
+		var length [2]byte
+		for i := range length {
+			if length[i], err = readByte(); err != nil { return nil, err }
+		}
+		n := int64(binary.BigEndian.Uint16(length[:]))
+		if n < 2 { return nil, jpeg.FormatError("truncated segment") }
+		if m, _ := io.CopyN(&buf, br, n - 2); m < n - 2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		// The image data follows the SOS segment.
+		if marker == jpegMarkerSOS { return buf.Bytes(), nil }
+	}
+}
+
+// writeJPEGWithSegments writes a JPEG file with the given marker
+// segments inserted after the SOI marker.
+func writeJPEGWithSegments(w io.Writer, data []byte, segs []jpegSegment) error {
+	var buf bytes.Buffer
+	buf.Write(data[:2])
+	for _, seg := range segs {
+		if len(seg.data) > 0xffff - 2 { return errors.New("jpeg: segment too large") }
+
+		buf.Write([]byte{0xff, seg.marker})
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(seg.data) + 2)))
+		buf.Write(seg.data)
+	}
+	buf.Write(data[2:])
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
 // Decode decodes a JPEG image according to the options specified.
-func (c *JPEGCodec) Decode(r io.Reader, d *DecodeOptions) (image.Image, error) {
-	return jpeg.Decode(r)
+func (c *JPEGCodec) Decode(r io.Reader, o *DecodeOptions) (image.Image, error) {
+	if o == nil || o.Metadata == nil { return jpeg.Decode(r) }
+
+	data, err := io.ReadAll(r)
+	if err != nil { return nil, err }
+
+	segs, err := readJPEGSegments(data)
+	if err != nil { return nil, err }
+
+	if err := jpegSegmentsToMetadata(segs, o); err != nil { return nil, err }
+
+	return jpeg.Decode(bytes.NewReader(data))
+}
+
+// jpegSegmentsToMetadata reads metadata from marker segments into
+// o.Metadata. Malformed metadata is ignored unless o.Strict is set.
+func jpegSegmentsToMetadata(segs []jpegSegment, o *DecodeOptions) error {
+	for _, seg := range segs {
+		switch {
+			case seg.marker == jpegMarkerCOM:
+				o.Metadata.Comments = append(o.Metadata.Comments, string(seg.data))
+			case seg.marker == jpegMarkerAPP0 && bytes.HasPrefix(seg.data, []byte(jpegJFIFHeader)):
+				density, err := jpegJFIFDensity(seg.data)
+				if err != nil && o.Strict { return err }
+				if err == nil && density != nil {
+					o.Metadata.Density = density
+				}
+			case seg.marker == jpegMarkerAPP1 && bytes.HasPrefix(seg.data, []byte(exifHeader)):
+				exif, err := ParseExif(seg.data)
+				if err != nil && o.Strict { return err }
+				if err == nil {
+					o.Metadata.EXIF = exif
+				}
+			case seg.marker == jpegMarkerAPP1 && bytes.HasPrefix(seg.data, []byte(jpegXMPHeader)):
+				o.Metadata.XMP = append([]byte(nil), seg.data[len(jpegXMPHeader):]...)
+		}
+	}
+
+	profile, err := jpegICCProfile(segs)
+	if err != nil && o.Strict { return err }
+	if err == nil && profile != nil {
+		o.Metadata.ICCProfile = profile
+	}
+	return nil
+}
+
+// jpegJFIFDensity returns the pixel density from a JFIF APP0 segment, or
+// nil if the segment only specifies square pixels.
+func jpegJFIFDensity(data []byte) (*Density, error) {
+	if len(data) < 12 { return nil, jpeg.FormatError("truncated JFIF segment") }
+
+	d := &Density{
+		X: float64(binary.BigEndian.Uint16(data[8:])),
+		Y: float64(binary.BigEndian.Uint16(data[10:])),
+	}
+	switch data[7] {
+		case 0: d.Unit = DensityUnitNone
+		case 1: d.Unit = DensityUnitInch
+		case 2: d.Unit = DensityUnitCentimeter
+		default: return nil, jpeg.FormatError("invalid JFIF density unit")
+	}
+	if d.X == 0 || d.Y == 0 { return nil, jpeg.FormatError("invalid JFIF density") }
+
+	if d.Unit == DensityUnitNone && d.X == d.Y { return nil, nil }
+	return d, nil
+}
+
+// jpegJFIFSegment returns a JFIF APP0 segment specifying a pixel
+// density. Densities too large for JFIF are scaled down, keeping their
+// aspect ratio.
+func jpegJFIFSegment(d *Density) jpegSegment {
+	x, y := d.X, d.Y
+	if m := math.Max(x, y); m > math.MaxUint16 {
+		x, y = x * math.MaxUint16 / m, y * math.MaxUint16 / m
+	}
+
+	data := append([]byte(jpegJFIFHeader), 1, 2, byte(d.Unit))
+	data = binary.BigEndian.AppendUint16(data, uint16(math.Max(1, math.Round(x))))
+	data = binary.BigEndian.AppendUint16(data, uint16(math.Max(1, math.Round(y))))
+	// No thumbnail.
+	data = append(data, 0, 0)
+	return jpegSegment{jpegMarkerAPP0, data}
 }
 
 // DecodeConfig returns the color model and dimensions of a JPEG image
-// without decoding the image.
-func (c *JPEGCodec) DecodeConfig(r io.Reader, d *DecodeOptions) (image.Config, error) {
-	return jpeg.DecodeConfig(r)
+// without decoding the image, reading metadata according to the options
+// specified.
+func (c *JPEGCodec) DecodeConfig(r io.Reader, o *DecodeOptions) (image.Config, error) {
+	if o == nil || o.Metadata == nil { return jpeg.DecodeConfig(r) }
+
+	data, err := readJPEGHeader(r)
+	if err != nil { return image.Config{}, err }
+
+	segs, err := readJPEGSegments(data)
+	if err != nil { return image.Config{}, err }
+
+	if err := jpegSegmentsToMetadata(segs, o); err != nil { return image.Config{}, err }
+
+	return jpeg.DecodeConfig(bytes.NewReader(data))
+}
+
+// jpegICCProfile reassembles an ICC profile split across APP2 segments.
+func jpegICCProfile(segs []jpegSegment) ([]byte, error) {
+	var chunks [][]byte
+	for _, seg := range segs {
+		if seg.marker != jpegMarkerAPP2 || !bytes.HasPrefix(seg.data, []byte(jpegICCHeader)) { continue }
+
+		data := seg.data[len(jpegICCHeader):]
+		if len(data) < 2 { return nil, jpeg.FormatError("truncated ICC profile segment") }
+		seq, count := int(data[0]), int(data[1])
+		if chunks == nil { chunks = make([][]byte, count) }
+		if seq < 1 || seq > len(chunks) || count != len(chunks) {
+			return nil, jpeg.FormatError("invalid ICC profile segment")
+		}
+		chunks[seq - 1] = data[2:]
+	}
+
+	var profile []byte
+	for _, chunk := range chunks {
+		if chunk == nil { return nil, jpeg.FormatError("missing ICC profile segment") }
+		profile = append(profile, chunk...)
+	}
+	return profile, nil
+}
+
+// jpegICCSegments splits an ICC profile into APP2 segments.
+func jpegICCSegments(profile []byte) ([]jpegSegment, error) {
+	count := (len(profile) + jpegMaxICCChunk - 1) / jpegMaxICCChunk
+	if count > 255 { return nil, errors.New("jpeg: ICC profile too large") }
+
+	segs := make([]jpegSegment, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := profile[i * jpegMaxICCChunk:]
+		if len(chunk) > jpegMaxICCChunk { chunk = chunk[:jpegMaxICCChunk] }
+
+		data := append([]byte(jpegICCHeader), byte(i + 1), byte(count))
+		segs = append(segs, jpegSegment{jpegMarkerAPP2, append(data, chunk...)})
+	}
+	return segs, nil
+}
+
+// jpegExifSegment returns an APP1 segment containing EXIF data. The
+// thumbnail is dropped if the data doesn't fit in a single segment.
+func jpegExifSegment(exif *Exif) (jpegSegment, error) {
+	data, err := exif.Bytes()
+	if err != nil { return jpegSegment{}, err }
+
+	if len(exifHeader) + len(data) > 0xffff - 2 && exif.Thumbnail != nil {
+		exif = exif.Clone()
+		exif.Thumbnail = nil
+		return jpegExifSegment(exif)
+	}
+
+	return jpegSegment{jpegMarkerAPP1, append([]byte(exifHeader), data...)}, nil
+}
+
+// jpegMetadataSegments returns the marker segments that store md.
+func jpegMetadataSegments(md *Metadata) (segs []jpegSegment, err error) {
+	// The JFIF segment must come first.
+	if md.Density != nil && md.Density.X > 0 && md.Density.Y > 0 {
+		segs = append(segs, jpegJFIFSegment(md.Density))
+	}
+
+	if md.EXIF != nil && !md.EXIF.IsEmpty() {
+		seg, err := jpegExifSegment(md.EXIF)
+		if err != nil { return nil, err }
+		segs = append(segs, seg)
+	}
+
+	if md.XMP != nil {
+		if len(jpegXMPHeader) + len(md.XMP) > 0xffff - 2 {
+			return nil, errors.New("jpeg: XMP packet too large")
+		}
+		segs = append(segs, jpegSegment{jpegMarkerAPP1, append([]byte(jpegXMPHeader), md.XMP...)})
+	}
+
+	if md.ICCProfile != nil {
+		iccSegs, err := jpegICCSegments(md.ICCProfile)
+		if err != nil { return nil, err }
+		segs = append(segs, iccSegs...)
+	}
+
+	for _, comment := range md.Comments {
+		// Long comments are split across several segments.
+		for len(comment) > 0xffff - 2 {
+			segs = append(segs, jpegSegment{jpegMarkerCOM, []byte(comment[:0xffff - 2])})
+			comment = comment[0xffff - 2:]
+		}
+		segs = append(segs, jpegSegment{jpegMarkerCOM, []byte(comment)})
+	}
+	return segs, nil
+}
+
+// JPEGSubsampling is a chroma subsampling mode for JPEG images.
+type JPEGSubsampling int
+
+const (
+	JPEGSubsampling420 JPEGSubsampling = iota
+	JPEGSubsampling422
+	JPEGSubsampling444
+	JPEGSubsampling440
+)
+
+// JPEGEncodeOptions specifies JPEG-specific encoding options. Pass it in
+// EncodeOptions.EncoderSpecific.
+type JPEGEncodeOptions struct {
+	// Subsampling is the chroma subsampling mode.
+	Subsampling JPEGSubsampling
+
+	// Progressive writes a progressive JPEG image.
+	Progressive bool
+
+	// OptimizeHuffman builds Huffman tables for each image, which makes
+	// it smaller but slower to encode.
+	OptimizeHuffman bool
+
+	// RestartInterval is the number of MCUs between restart markers, or
+	// 0 for none.
+	RestartInterval int
+}
+
+// ParseParams parses JPEG encoding options from a comma-separated list
+// of parameters, such as "subsampling=4:4:4,progressive,restart=8". The
+// parameters are:
+//
+//	subsampling=4:2:0|4:2:2|4:4:4|4:4:0  chroma subsampling
+//	progressive[=true|false]             write a progressive image
+//	optimize[=true|false]                optimize Huffman tables
+//	restart=N                            MCUs between restart markers
+func (c *JPEGCodec) ParseParams(opt string) (any, error) {
+	jo := &JPEGEncodeOptions{}
+	err := eachCodecParam(opt, func(key, val string, hasVal bool) error {
+		var err error
+		switch key {
+			case "subsampling", "sampling-factor":
+				switch strings.ReplaceAll(val, ":", "") {
+					case "420": jo.Subsampling = JPEGSubsampling420
+					case "422": jo.Subsampling = JPEGSubsampling422
+					case "444": jo.Subsampling = JPEGSubsampling444
+					case "440": jo.Subsampling = JPEGSubsampling440
+					default: return fmt.Errorf("jpeg: invalid subsampling %q", val)
+				}
+			case "progressive": jo.Progressive, err = parseBoolParam("jpeg", key, val, hasVal)
+			case "optimize": jo.OptimizeHuffman, err = parseBoolParam("jpeg", key, val, hasVal)
+			case "restart":
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 || n > 0xffff { return fmt.Errorf("jpeg: invalid restart interval %q", val) }
+				jo.RestartInterval = n
+			default:
+				return fmt.Errorf("jpeg: unknown parameter %q", key)
+		}
+		return err
+	})
+	if err != nil { return nil, err }
+	return jo, nil
+}
+
+// jpegOptions returns the options to pass to the JPEG encoder.
+func jpegOptions(o *EncodeOptions) *jpeg.Options {
+	jpegOpt := &jpeg.Options{Quality: jpeg.DefaultQuality}
+	if o.CompressionLevel < 100 {
+		jpegOpt.Quality = 100 - o.CompressionLevel
+	}
+
+	if jo, ok := o.EncoderSpecific.(*JPEGEncodeOptions); ok && jo != nil {
+		switch jo.Subsampling {
+			case JPEGSubsampling422: jpegOpt.Subsampling = jpeg.Subsampling422
+			case JPEGSubsampling444: jpegOpt.Subsampling = jpeg.Subsampling444
+			case JPEGSubsampling440: jpegOpt.Subsampling = jpeg.Subsampling440
+		}
+		jpegOpt.Progressive = jo.Progressive
+		jpegOpt.OptimizeHuffman = jo.OptimizeHuffman
+		jpegOpt.RestartInterval = jo.RestartInterval
+	}
+	return jpegOpt
 }
 
 // Encode encodes a JPEG image according to the options specified.
+// JPEG-specific options may be given as a *JPEGEncodeOptions.
 func (c *JPEGCodec) Encode(w io.Writer, i image.Image, o *EncodeOptions) error {
 	if o == nil { o = DefaultEncodeOptions() }
 
-	var jpegOpt jpeg.Options
-	if o.CompressionLevel < 100 {
-		jpegOpt.Quality = 100 - o.CompressionLevel
-	} else {
-		jpegOpt.Quality = jpeg.DefaultQuality
+	jpegOpt := jpegOptions(o)
+
+	var segs []jpegSegment
+	if o.Metadata != nil {
+		var err error
+		segs, err = jpegMetadataSegments(o.Metadata)
+		if err != nil { return err }
 	}
 
-	return jpeg.Encode(w, i, &jpegOpt)
+	if len(segs) == 0 { return jpeg.Encode(w, i, jpegOpt) }
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, i, jpegOpt); err != nil { return err }
+
+	return writeJPEGWithSegments(w, buf.Bytes(), segs)
 }
 
 var (
 	_ Decoder = &JPEGCodec{}
 	_ Encoder = &JPEGCodec{}
 	_ CodecWithAliases = &JPEGCodec{}
+	_ CodecWithParamParser = &JPEGCodec{}
 )
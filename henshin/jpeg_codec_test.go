@@ -0,0 +1,186 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"reflect"
+	"strings"
+
+	"github.com/ronsor/majokko/format/jpeg"
+
+	"testing"
+)
+
+// TestJPEGMetadataRoundTrip tests that comments, density, EXIF, ICC and
+// XMP metadata survive encoding and decoding a JPEG image.
+func TestJPEGMetadataRoundTrip(t *testing.T) {
+	w := NewWand()
+	w.SetImage(image.NewRGBA(image.Rect(0, 0, 16, 16)))
+	w.AddComment("first comment")
+	w.AddComment("second comment")
+	w.SetDensity(300, 150, DensityUnitInch)
+	md := w.Metadata()
+	md.EXIF = NewExif()
+	md.EXIF.Set(ExifIFD0, &ExifTag{ID: ExifTagMake, Type: ExifTypeASCII, Value: "Majokko"})
+	md.ICCProfile = []byte(strings.Repeat("icc", 30000))
+	md.XMP = []byte(testXMPPacket)
+
+	var buf bytes.Buffer
+	if err := w.EncodeImage(&buf, "jpeg"); err != nil { t.Fatal(err) }
+	data := buf.Bytes()
+
+	w2 := NewWand()
+	if err := w2.DecodeImage(bytes.NewReader(data)); err != nil { t.Fatal(err) }
+	got := w2.Metadata()
+
+	if len(got.Comments) != 2 || got.Comments[0] != "first comment" || got.Comments[1] != "second comment" {
+		t.Fatalf("expected comments %q, got %q", md.Comments, got.Comments)
+	}
+	if got.Density == nil || *got.Density != *md.Density {
+		t.Fatalf("expected density %v, got %v", md.Density, got.Density)
+	}
+	if tag, _ := got.EXIF.Get(ExifIFD0, ExifTagMake); tag == nil || tag.String() != "Majokko" {
+		t.Fatalf("expected EXIF make %q, got %v", "Majokko", tag)
+	}
+	if !bytes.Equal(got.ICCProfile, md.ICCProfile) {
+		t.Fatalf("expected an ICC profile of %d bytes, got %d bytes", len(md.ICCProfile), len(got.ICCProfile))
+	}
+	if !bytes.Equal(got.XMP, md.XMP) {
+		t.Fatalf("expected XMP %q, got %q", md.XMP, got.XMP)
+	}
+
+	w2.Strip()
+	buf.Reset()
+	if err := w2.EncodeImage(&buf, "jpeg"); err != nil { t.Fatal(err) }
+
+	segs, err := readJPEGSegments(buf.Bytes())
+	if err != nil { t.Fatal(err) }
+	for _, seg := range segs {
+		if seg.marker == jpegMarkerCOM || seg.marker >= jpegMarkerAPP0 && seg.marker <= 0xef {
+			t.Fatalf("expected no metadata segments after stripping, got marker 0x%02x", seg.marker)
+		}
+	}
+}
+
+// TestLosslessJPEG tests that JPEG images are transformed without
+// recompressing them, and that other operations fall back to normal
+// processing.
+func TestLosslessJPEG(t *testing.T) {
+	im := image.NewRGBA(image.Rect(0, 0, 48, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 48; x++ {
+			im.Set(x, y, color.RGBA{uint8(x * 5), uint8(y * 7), uint8(x * y), 255})
+		}
+	}
+	w := NewWand()
+	w.SetImage(im)
+	var buf bytes.Buffer
+	if err := w.EncodeImage(&buf, "jpeg"); err != nil { t.Fatal(err) }
+	data := buf.Bytes()
+
+	process := func(fn func(w *Wand)) (*Wand, *jpeg.Coefficients) {
+		w := NewWand()
+		w.SetLosslessJPEG(true)
+		if err := w.DecodeImage(bytes.NewReader(data)); err != nil { t.Fatal(err) }
+		fn(w)
+
+		var buf bytes.Buffer
+		if err := w.EncodeImage(&buf, "jpg"); err != nil { t.Fatal(err) }
+		c, err := jpeg.DecodeCoefficients(&buf)
+		if err != nil { t.Fatal(err) }
+		return w, c
+	}
+	expect := func(fn func(c *jpeg.Coefficients)) *jpeg.Coefficients {
+		c, err := jpeg.DecodeCoefficients(bytes.NewReader(data))
+		if err != nil { t.Fatal(err) }
+		fn(c)
+		return c
+	}
+
+	w, got := process(func(w *Wand) { w.AddComment("lossless") })
+	if want := expect(func(c *jpeg.Coefficients) {}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected unchanged coefficients after adding a comment")
+	}
+
+	w, got = process(func(w *Wand) { w.Rotate(90, nil, nil) })
+	want := expect(func(c *jpeg.Coefficients) { c.Transpose(); c.FlipHorizontal() })
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected rotated coefficients")
+	}
+	if w.Width() != 32 || w.Height() != 48 {
+		t.Fatalf("expected 32x48 image, got %dx%d", w.Width(), w.Height())
+	}
+
+	_, got = process(func(w *Wand) { w.Crop(16, 16, 16, 16) })
+	want = expect(func(c *jpeg.Coefficients) { c.Crop(image.Rect(16, 16, 32, 32)) })
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected cropped coefficients")
+	}
+
+	// Clones keep their own coefficients.
+	_, got = process(func(w *Wand) {
+		w.Clone().Rotate(180, nil, nil)
+		w.Clone().AddComment("clone")
+	})
+	if want := expect(func(c *jpeg.Coefficients) {}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected unchanged coefficients after transforming a clone")
+	}
+	w, _ = process(func(w *Wand) {})
+	if c := w.Clone(); c.losslessJPEG() == nil {
+		t.Fatalf("expected a clone to keep the coefficients")
+	}
+
+	// Unaligned crops are recompressed.
+	w, got = process(func(w *Wand) { w.Crop(20, 20, 4, 4) })
+	if got.Width != 20 || got.Height != 20 || w.losslessJPEG() != nil {
+		t.Fatalf("expected a recompressed 20x20 image, got %dx%d", got.Width, got.Height)
+	}
+}
+
+// TestJPEGParseParams tests that JPEG encoding options are parsed and
+// applied by the encoder.
+func TestJPEGParseParams(t *testing.T) {
+	c := &JPEGCodec{}
+	for _, bad := range []string{"subsampling=4:1:1", "progressive=maybe", "restart=-1", "quality=5"} {
+		if _, err := c.ParseParams(bad); err == nil {
+			t.Fatalf("expected an error parsing %q", bad)
+		}
+	}
+
+	opt, err := c.ParseParams("subsampling=4:4:4, progressive,optimize=false,restart=4")
+	if err != nil { t.Fatal(err) }
+	want := &JPEGEncodeOptions{Subsampling: JPEGSubsampling444, Progressive: true, RestartInterval: 4}
+	if !reflect.DeepEqual(opt, want) {
+		t.Fatalf("expected %+v, got %+v", want, opt)
+	}
+
+	var buf bytes.Buffer
+	im := image.NewRGBA(image.Rect(0, 0, 40, 24))
+	if err := c.Encode(&buf, im, &EncodeOptions{CompressionLevel: -1, EncoderSpecific: opt}); err != nil { t.Fatal(err) }
+
+	segs, err := readJPEGSegments(buf.Bytes())
+	if err != nil { t.Fatal(err) }
+	var sof, dri *jpegSegment
+	for i := range segs {
+		switch segs[i].marker {
+			case 0xc0, 0xc1, 0xc2: sof = &segs[i]
+			case 0xdd: dri = &segs[i]
+		}
+	}
+	if sof == nil || sof.marker != 0xc2 {
+		t.Fatalf("expected a progressive frame header")
+	}
+	// The luma sampling factors follow the precision, size, component
+	// count and component ID.
+	if sof.data[7] != 0x11 {
+		t.Fatalf("expected luma sampling factors 0x11, got 0x%02x", sof.data[7])
+	}
+	if dri == nil || dri.data[1] != 4 {
+		t.Fatalf("expected a restart interval of 4")
+	}
+
+	if _, err := Decode(bytes.NewReader(buf.Bytes()), nil); err != nil { t.Fatal(err) }
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"image"
+	"io"
+
+	"github.com/ronsor/majokko/format/jpeg"
+)
+
+// jpegLossless holds the DCT coefficients of a JPEG image, so that it can
+// be transformed and written again without recompressing it.
+type jpegLossless struct {
+	coeffs *jpeg.Coefficients
+
+	// im is the decoded image the coefficients correspond to. Once a
+	// frame is replaced by anything else, the coefficients are stale.
+	im image.Image
+}
+
+// SetLosslessJPEG enables or disables lossless processing of JPEG images.
+// It must be called before the image is read. When enabled, rotations
+// by multiples of 90 degrees, flips, MCU-aligned crops and metadata edits
+// are applied to the DCT coefficients, and the image is written without
+// recompressing it if it's saved as JPEG with the default compression
+// level. Any other operation falls back to normal processing.
+func (w *Wand) SetLosslessJPEG(enable bool) {
+	w.keepJPEG = enable
+	if !enable { w.jpeg = nil }
+}
+
+// readLosslessJPEG decodes the DCT coefficients of data, if it's a JPEG
+// image, for the frames in w.anim. Images that can't be decoded this way
+// are simply processed normally.
+func (w *Wand) readLosslessJPEG(data []byte) {
+	w.jpeg = nil
+	if !bytes.HasPrefix(data, []byte("\xff\xd8")) || w.FrameCount() != 1 { return }
+
+	coeffs, err := jpeg.DecodeCoefficients(bytes.NewReader(data))
+	if err != nil { return }
+	w.jpeg = &jpegLossless{coeffs: coeffs, im: w.Image()}
+}
+
+// losslessJPEG returns the coefficients of the image, or nil if the image
+// has been modified in a way they don't reflect.
+func (w *Wand) losslessJPEG() *jpeg.Coefficients {
+	if w.jpeg == nil || w.FrameCount() != 1 || w.Image() != w.jpeg.im { return nil }
+	return w.jpeg.coeffs
+}
+
+// cloneLosslessJPEG returns a copy of the coefficients of the image for
+// anim, a clone of w.anim, or nil if they are stale.
+func (w *Wand) cloneLosslessJPEG(anim *Animation) *jpegLossless {
+	coeffs := w.losslessJPEG()
+	if coeffs == nil { return nil }
+	return &jpegLossless{coeffs: coeffs.Clone(), im: anim.Frames[0].Image}
+}
+
+// setLosslessJPEG replaces the image with one decoded from coeffs, so
+// that later operations see the same pixels that will be written.
+func (w *Wand) setLosslessJPEG(coeffs *jpeg.Coefficients) error {
+	var buf bytes.Buffer
+	if err := jpeg.EncodeCoefficients(&buf, coeffs, nil); err != nil { return err }
+
+	im, err := jpeg.Decode(&buf)
+	if err != nil { return err }
+
+	w.anim.Frames[0].Image = im
+	w.anim.Width, w.anim.Height = coeffs.Width, coeffs.Height
+	w.jpeg = &jpegLossless{coeffs: coeffs, im: im}
+	return nil
+}
+
+// transformLosslessJPEG applies t to the coefficients of the image and
+// reports whether it succeeded. Flips are only lossless if the flipped
+// edge ends on an MCU boundary, since a partial MCU can't be moved to the
+// opposite edge.
+func (w *Wand) transformLosslessJPEG(t imageTransform) bool {
+	coeffs := w.losslessJPEG()
+	if coeffs == nil { return false }
+
+	mcu, width, height := coeffs.MCUSize(), coeffs.Width, coeffs.Height
+	if t.transpose {
+		mcu.X, mcu.Y = mcu.Y, mcu.X
+		width, height = height, width
+	}
+	if (t.flipX && width % mcu.X != 0) || (t.flipY && height % mcu.Y != 0) { return false }
+
+	if t.transpose { coeffs.Transpose() }
+	if t.flipX && coeffs.FlipHorizontal() != nil { return false }
+	if t.flipY && coeffs.FlipVertical() != nil { return false }
+	return w.setLosslessJPEG(coeffs) == nil
+}
+
+// cropLosslessJPEG crops the coefficients of the image to r and reports
+// whether it succeeded. The crop must lie within the image, and its top
+// left corner must be on an MCU boundary.
+func (w *Wand) cropLosslessJPEG(r image.Rectangle) bool {
+	coeffs := w.losslessJPEG()
+	if coeffs == nil || r.Empty() || !r.In(image.Rect(0, 0, coeffs.Width, coeffs.Height)) { return false }
+
+	mcu := coeffs.MCUSize()
+	if r.Min.X % mcu.X != 0 || r.Min.Y % mcu.Y != 0 { return false }
+
+	coeffs.Crop(r)
+	return w.setLosslessJPEG(coeffs) == nil
+}
+
+// encodeLosslessJPEG writes the coefficients of the image to wr with the
+// current metadata, and reports whether it did so. Progressive, Huffman
+// and restart options still apply, but subsampling can't be changed.
+func (w *Wand) encodeLosslessJPEG(wr io.Writer, codec string) (bool, error) {
+	coeffs := w.losslessJPEG()
+	if coeffs == nil || w.encOpt.CompressionLevel >= 0 { return false, nil }
+	if c, err := NewCodec(codec); err != nil || c.Name() != "jpeg" { return false, nil }
+
+	segs, err := jpegMetadataSegments(w.md)
+	if err != nil { return true, err }
+
+	var buf bytes.Buffer
+	if err := jpeg.EncodeCoefficients(&buf, coeffs, jpegOptions(w.encOpt)); err != nil { return true, err }
+	return true, writeJPEGWithSegments(wr, buf.Bytes(), segs)
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// RegisterExternalCodecs registers codecs that depend on external
+// programs, which are not registered by default.
+func RegisterExternalCodecs() {
+	RegisterCodec(NewJXLCodec())
+}
+
+// JXLEncodeOptions specifies options for the JPEG XL encoder.
+type JXLEncodeOptions struct {
+	// Effort is the encoder effort, from 1 (fastest) to 9 (slowest). If
+	// it is 0, the encoder's default is used. Unlike WEBP, the effort is
+	// not derived from the compression level, which selects the distance.
+	Effort int
+
+	// Distance is the maximum Butteraugli distance. If it is 0, it is
+	// derived from the compression level.
+	Distance float64
+
+	// Lossless requests lossless encoding.
+	Lossless bool
+}
+
+// NewJXLCodec returns a codec for JPEG XL images, which uses the
+// external cjxl and djxl programs from libjxl.
+//
+// The compression level is converted to a distance like the quality
+// option of cjxl, where a level of 0 is lossless. The encoder effort is
+// only set by the effort parameter.
+func NewJXLCodec() *ExternalCodec {
+	return &ExternalCodec{
+		CodecName: "jxl",
+		CodecAliases: []string{"jpegxl"},
+		MagicStrings: []string{"\xff\x0a", "\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a"},
+		DecodeCommand: []string{"djxl", "%i", "%o"},
+		EncodeCommand: []string{"cjxl", "%i", "%o"},
+		Intermediate: "png",
+		EncodeArgs: jxlEncodeArgs,
+		ParamParser: parseJXLParams,
+	}
+}
+
+// parseJXLParams parses JPEG XL codec parameters.
+func parseJXLParams(opt string) (any, error) {
+	jo := &JXLEncodeOptions{}
+	err := eachCodecParam(opt, func(key, val string, hasVal bool) (err error) {
+		switch key {
+			case "effort":
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 1 || n > 9 { return fmt.Errorf("jxl: invalid effort %q", val) }
+				jo.Effort = n
+			case "distance":
+				d, err := strconv.ParseFloat(val, 64)
+				if err != nil || d < 0 || d > 25 { return fmt.Errorf("jxl: invalid distance %q", val) }
+				jo.Distance, jo.Lossless = d, d == 0
+			case "lossless":
+				jo.Lossless, err = parseBoolParam("jxl", key, val, hasVal)
+			default:
+				return fmt.Errorf("jxl: unknown parameter %q", key)
+		}
+		return err
+	})
+	if err != nil { return nil, err }
+	return jo, nil
+}
+
+// jxlDistance converts a compression level to a distance, using the same
+// mapping as the quality option of cjxl. The distance is limited to 25,
+// the maximum cjxl accepts.
+func jxlDistance(level int) float64 {
+	q := float64(100 - level)
+	if q >= 30 { return 0.1 + (100 - q) * 0.09 }
+	return math.Min(25, 6.4 + math.Pow(2.5, (30 - q) / 5) / 6.25)
+}
+
+// jxlEncodeArgs returns the arguments to pass to cjxl.
+func jxlEncodeArgs(o *EncodeOptions) (args []string) {
+	jo, _ := o.EncoderSpecific.(*JXLEncodeOptions)
+	if jo == nil { jo = &JXLEncodeOptions{} }
+
+	switch {
+		case jo.Lossless || o.CompressionLevel == 0 && jo.Distance == 0:
+			args = append(args, "-d", "0")
+		case jo.Distance > 0:
+			args = append(args, "-d", strconv.FormatFloat(jo.Distance, 'f', -1, 64))
+		case o.CompressionLevel > 0:
+			args = append(args, "-d", strconv.FormatFloat(jxlDistance(o.CompressionLevel), 'f', 3, 64))
+	}
+	if jo.Effort > 0 { args = append(args, "-e", strconv.Itoa(jo.Effort)) }
+	return
+}
@@ -2,6 +2,11 @@
 
 package henshin
 
+import (
+	"image/color"
+	"time"
+)
+
 type TextEntry struct {
 	Key, Value string
 
@@ -75,6 +80,75 @@ func (td TextData) ToStringMap() (ret map[string]string) {
 	return
 }
 
+// XMPTextKey is the key of the PNG text chunk containing an image's XMP
+// packet, if any. Codecs store the packet in Metadata.XMP instead of a
+// TextEntry.
+const XMPTextKey = "XML:com.adobe.xmp"
+
+// DensityUnit is the unit of a pixel density.
+type DensityUnit int
+
+const (
+	// DensityUnitNone means that the density only specifies the aspect
+	// ratio of pixels.
+	DensityUnitNone DensityUnit = iota
+	// DensityUnitInch specifies pixels per inch.
+	DensityUnitInch
+	// DensityUnitCentimeter specifies pixels per centimeter.
+	DensityUnitCentimeter
+)
+
+func (u DensityUnit) String() string {
+	switch u {
+		case DensityUnitInch: return "PixelsPerInch"
+		case DensityUnitCentimeter: return "PixelsPerCentimeter"
+	}
+	return "Undefined"
+}
+
+// Density is the physical size of pixels.
+type Density struct {
+	X, Y float64
+	Unit DensityUnit
+}
+
+// PerInch returns the density in pixels per inch.
+func (d *Density) PerInch() (x, y float64) {
+	if d.Unit == DensityUnitCentimeter { return d.X * 2.54, d.Y * 2.54 }
+	return d.X, d.Y
+}
+
+// Chromaticities are the CIE 1931 xy chromaticities of the white point
+// and primaries of an image's color space.
+type Chromaticities struct {
+	WhiteX, WhiteY float64
+	RedX, RedY float64
+	GreenX, GreenY float64
+	BlueX, BlueY float64
+}
+
+// RenderingIntent is an ICC rendering intent.
+type RenderingIntent int
+
+const (
+	// RenderingIntentNone means that the image is not known to be sRGB.
+	RenderingIntentNone RenderingIntent = iota
+	RenderingIntentPerceptual
+	RenderingIntentRelative
+	RenderingIntentSaturation
+	RenderingIntentAbsolute
+)
+
+func (ri RenderingIntent) String() string {
+	switch ri {
+		case RenderingIntentPerceptual: return "Perceptual"
+		case RenderingIntentRelative: return "Relative"
+		case RenderingIntentSaturation: return "Saturation"
+		case RenderingIntentAbsolute: return "Absolute"
+	}
+	return "Undefined"
+}
+
 // Metadata is additional image metadata.
 type Metadata struct {
 	// Text contains key-value pairs of text data.
@@ -83,6 +157,40 @@ type Metadata struct {
 	// Comments contains a list of comments for the image.
 	Comments []string
 
+	// ICCProfile contains the image's ICC color profile, if any.
+	ICCProfile []byte
+
+	// EXIF contains the image's EXIF data, if any.
+	EXIF *Exif
+
+	// XMP contains the image's XMP packet, if any. Use ParseXMP to read
+	// its properties.
+	XMP []byte
+
+	// Density is the physical pixel density of the image, if known.
+	Density *Density
+
+	// Gamma is the exponent relating stored values to the intensity of
+	// the original scene, such as 1/2.2, or 0 if unknown.
+	Gamma float64
+
+	// Chromaticities describes the image's color space, if known.
+	Chromaticities *Chromaticities
+
+	// RenderingIntent is the rendering intent of sRGB images.
+	RenderingIntent RenderingIntent
+
+	// ModTime is when the image was last modified, if known.
+	ModTime time.Time
+
+	// SignificantBits is the number of significant bits in the red,
+	// green, blue and alpha channels of the original image. A value of
+	// zero means that the number of significant bits is unknown.
+	SignificantBits [4]uint8
+
+	// Background is the image's suggested background color, if any.
+	Background color.Color
+
 	// Specific contains encoder/decoder specific data.
 	Specific any
 }
@@ -97,9 +205,31 @@ func (md *Metadata) Clone() *Metadata {
 		comments = append(comments, v)
 	}
 
-	return &Metadata{
+	exif := (*Exif)(nil)
+	if md.EXIF != nil {
+		exif = md.EXIF.Clone()
+	}
+
+	newMd := &Metadata{
 		Text: text,
 		Comments: comments,
+		ICCProfile: append([]byte(nil), md.ICCProfile...),
+		EXIF: exif,
+		XMP: append([]byte(nil), md.XMP...),
+		Gamma: md.Gamma,
+		RenderingIntent: md.RenderingIntent,
+		ModTime: md.ModTime,
+		SignificantBits: md.SignificantBits,
+		Background: md.Background,
 		Specific: md.Specific,
 	}
+	if md.Density != nil {
+		density := *md.Density
+		newMd.Density = &density
+	}
+	if md.Chromaticities != nil {
+		chrm := *md.Chromaticities
+		newMd.Chromaticities = &chrm
+	}
+	return newMd
 }
@@ -4,8 +4,14 @@ package henshin
 
 import (
 	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
 	"image"
 	"io"
+	"math"
+	"strconv"
+	"time"
 
 	"github.com/ronsor/majokko/format/png"
 )
@@ -15,7 +21,7 @@ func init() {
 	RegisterCodec(&PNGCodec{isZNGCodec: true})
 }
 
-// PNGCodec is the still PNG codec.
+// PNGCodec is the PNG codec, including APNG animation support.
 type PNGCodec struct {
 	isZNGCodec bool
 }
@@ -39,20 +45,67 @@ func (c *PNGCodec) Magic() []string {
 	return []string{"\x89PNG\r\n\x1a\n"}
 }
 
+// compressPNGText compresses text for a `zTXt` or `iTXt` chunk.
+func compressPNGText(buf *bytes.Buffer, text string) {
+	// Writes to a bytes.Buffer cannot fail.
+	zw := zlib.NewWriter(buf)
+	zw.Write([]byte(text))
+	zw.Close()
+}
+
+// pngMaxInflatedSize is the largest size that compressed text and ICC
+// profiles in PNG chunks may decompress to, which is the default limit
+// of libpng.
+const pngMaxInflatedSize = 8 << 20
+
+// inflatePNGData decompresses the zlib-compressed data of a chunk, up to
+// pngMaxInflatedSize bytes.
+func inflatePNGData(data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil { return nil, err }
+	defer zr.Close()
+
+	inflated, err := io.ReadAll(io.LimitReader(zr, pngMaxInflatedSize + 1))
+	if err != nil { return nil, err }
+	if len(inflated) > pngMaxInflatedSize { return nil, png.FormatError("decompressed chunk too large") }
+	return inflated, nil
+}
+
+// decompressPNGText decompresses the text of a `zTXt` or `iTXt` chunk.
+func decompressPNGText(method byte, data []byte) (string, error) {
+	if method != 0 { return "", png.UnsupportedError("text compression method") }
+
+	text, err := inflatePNGData(data)
+	if _, ok := err.(png.FormatError); err != nil && !ok {
+		err = png.FormatError("invalid compressed text: " + err.Error())
+	}
+	return string(text), err
+}
+
 // textEntryToPNGChunk converts a TextEntry to a PNG
-// `tEXt` or `iTXt` chunk.
-// TODO: support compression
+// `tEXt`, `zTXt` or `iTXt` chunk.
 func textEntryToPNGChunk(te *TextEntry) (chunk png.Chunk) {
 	var buf bytes.Buffer
 	buf.WriteString(te.Key)
 	buf.WriteByte(0)
 
 	if te.Language == "" && te.Utf8Key == "" && !te.IsUtf8 {
-		buf.WriteString(te.Value)
+		if te.Compress {
+			buf.WriteByte(0)
+			compressPNGText(&buf, te.Value)
+
+			chunk.Name = "zTXt"
+		} else {
+			buf.WriteString(te.Value)
 
-		chunk.Name = "tEXt"
+			chunk.Name = "tEXt"
+		}
 	} else {
-		buf.WriteByte(0)
+		if te.Compress {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
 		buf.WriteByte(0)
 
 		buf.WriteString(te.Language)
@@ -61,7 +114,11 @@ func textEntryToPNGChunk(te *TextEntry) (chunk png.Chunk) {
 		buf.WriteString(te.Utf8Key)
 		buf.WriteByte(0)
 
-		buf.WriteString(te.Value)
+		if te.Compress {
+			compressPNGText(&buf, te.Value)
+		} else {
+			buf.WriteString(te.Value)
+		}
 
 		chunk.Name = "iTXt"
 	}
@@ -70,9 +127,8 @@ func textEntryToPNGChunk(te *TextEntry) (chunk png.Chunk) {
 	return
 }
 
-// pngChunkToTextEntry converts a PNG `tEXt` or `iTXt`
+// pngChunkToTextEntry converts a PNG `tEXt`, `zTXt` or `iTXt`
 // chunk to a TextEntry.
-// TODO: support compression
 func pngChunkToTextEntry(chunk png.Chunk) (te *TextEntry, err error) {
 	te = &TextEntry{}
 
@@ -90,20 +146,22 @@ func pngChunkToTextEntry(chunk png.Chunk) (te *TextEntry, err error) {
 		case "tEXt":
 			te.Value = string(chunk.Data[keyNul+1:])
 			return
+		case "zTXt":
+			te.Compress = true
+
+			rest := chunk.Data[keyNul+1:]
+			te.Value, err = decompressPNGText(rest[0], rest[1:])
+			return
 		case "iTXt":
 			te.IsUtf8 = true
 
 			rest := chunk.Data[keyNul+1:]
-			if rest[0] != 0 {
-				err = png.UnsupportedError("compressed iTXt chunks")
-				return
-			}
-
 			if len(rest) < 4 {
 				err = png.FormatError("truncated iTXt chunk")
 				return
 			}
 
+			compressed, method := rest[0] != 0, rest[1]
 			rest = rest[2:]
 			nul := bytes.IndexByte(rest, 0)
 			if nul == -1 {
@@ -128,7 +186,12 @@ func pngChunkToTextEntry(chunk png.Chunk) (te *TextEntry, err error) {
 			te.Utf8Key = string(rest[:nul])
 
 			rest = rest[nul+1:]
-			te.Value = string(rest)
+			if compressed {
+				te.Compress = true
+				te.Value, err = decompressPNGText(method, rest)
+			} else {
+				te.Value = string(rest)
+			}
 			return
 	}
 
@@ -136,40 +199,306 @@ func pngChunkToTextEntry(chunk png.Chunk) (te *TextEntry, err error) {
 	return
 }
 
-// Decode decodes a PNG according to the options specified.
-func (c *PNGCodec) Decode(r io.Reader, o *DecodeOptions) (image.Image, error) {
-	if o == nil { o = DefaultDecodeOptions() }
+// pngICCProfileName is the profile name written to iCCP chunks.
+const pngICCProfileName = "ICC Profile"
+
+// pngChunkToICCProfile extracts the ICC profile from a PNG `iCCP` chunk.
+func pngChunkToICCProfile(chunk png.Chunk) ([]byte, error) {
+	nul := bytes.IndexByte(chunk.Data, 0)
+	if nul == -1 || nul + 1 >= len(chunk.Data) {
+		return nil, png.FormatError("truncated iCCP chunk")
+	}
+	if chunk.Data[nul + 1] != 0 {
+		return nil, png.UnsupportedError("iCCP compression method")
+	}
+
+	return inflatePNGData(chunk.Data[nul + 2:])
+}
+
+// iccProfileToPNGChunk converts an ICC profile to a PNG `iCCP` chunk.
+func iccProfileToPNGChunk(profile []byte) (chunk png.Chunk, err error) {
+	var buf bytes.Buffer
+	buf.WriteString(pngICCProfileName)
+	buf.Write([]byte{0, 0})
+
+	zw := zlib.NewWriter(&buf)
+	if _, err = zw.Write(profile); err != nil { return }
+	if err = zw.Close(); err != nil { return }
+
+	chunk.Name = "iCCP"
+	chunk.Data = buf.Bytes()
+	return
+}
+
+// pngChunkToMetadata parses a pHYs, gAMA, cHRM, sRGB or tIME chunk into
+// the corresponding metadata field.
+func pngChunkToMetadata(chunk png.Chunk, md *Metadata) error {
+	data := chunk.Data
+	switch chunk.Name {
+		case "pHYs":
+			if len(data) != 9 { return png.FormatError("bad pHYs length") }
+			d := &Density{
+				X: float64(binary.BigEndian.Uint32(data[0:])),
+				Y: float64(binary.BigEndian.Uint32(data[4:])),
+			}
+			if data[8] == 1 {
+				d.X, d.Y, d.Unit = d.X / 100, d.Y / 100, DensityUnitCentimeter
+			}
+			md.Density = d
+		case "gAMA":
+			if len(data) != 4 { return png.FormatError("bad gAMA length") }
+			md.Gamma = float64(binary.BigEndian.Uint32(data)) / 100000
+		case "cHRM":
+			if len(data) != 32 { return png.FormatError("bad cHRM length") }
+			var v [8]float64
+			for i := range v {
+				v[i] = float64(binary.BigEndian.Uint32(data[i * 4:])) / 100000
+			}
+			md.Chromaticities = &Chromaticities{v[0], v[1], v[2], v[3], v[4], v[5], v[6], v[7]}
+		case "sRGB":
+			if len(data) != 1 || data[0] > 3 { return png.FormatError("bad sRGB chunk") }
+			md.RenderingIntent = RenderingIntent(data[0]) + RenderingIntentPerceptual
+		case "tIME":
+			if len(data) != 7 { return png.FormatError("bad tIME length") }
+			md.ModTime = time.Date(int(binary.BigEndian.Uint16(data)), time.Month(data[2]), int(data[3]),
+				int(data[4]), int(data[5]), int(data[6]), 0, time.UTC)
+	}
+	return nil
+}
+
+// metadataToPNGChunks converts typed metadata to pHYs, gAMA, cHRM, sRGB
+// and tIME chunks.
+func metadataToPNGChunks(md *Metadata) (chunks []png.Chunk) {
+	u32 := func(b []byte, v float64) []byte {
+		return binary.BigEndian.AppendUint32(b, uint32(math.Round(math.Max(v, 0))))
+	}
+
+	if md.Gamma > 0 {
+		chunks = append(chunks, png.Chunk{Name: "gAMA", Data: u32(nil, md.Gamma * 100000)})
+	}
 
+	if c := md.Chromaticities; c != nil {
+		var data []byte
+		for _, v := range []float64{c.WhiteX, c.WhiteY, c.RedX, c.RedY, c.GreenX, c.GreenY, c.BlueX, c.BlueY} {
+			data = u32(data, v * 100000)
+		}
+		chunks = append(chunks, png.Chunk{Name: "cHRM", Data: data})
+	}
+
+	// The sRGB chunk should not be present if there is an ICC profile.
+	if md.RenderingIntent != RenderingIntentNone && md.ICCProfile == nil {
+		intent := byte(md.RenderingIntent - RenderingIntentPerceptual)
+		chunks = append(chunks, png.Chunk{Name: "sRGB", Data: []byte{intent}})
+	}
+
+	if d := md.Density; d != nil {
+		var data []byte
+		switch d.Unit {
+			case DensityUnitInch: data = append(u32(u32(nil, d.X / 0.0254), d.Y / 0.0254), 1)
+			case DensityUnitCentimeter: data = append(u32(u32(nil, d.X * 100), d.Y * 100), 1)
+			default: data = append(u32(u32(nil, d.X), d.Y), 0)
+		}
+		chunks = append(chunks, png.Chunk{Name: "pHYs", Data: data})
+	}
+
+	if !md.ModTime.IsZero() {
+		t := md.ModTime.UTC()
+		data := binary.BigEndian.AppendUint16(nil, uint16(t.Year()))
+		data = append(data, byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()))
+		chunks = append(chunks, png.Chunk{Name: "tIME", Data: data})
+	}
+	return
+}
+
+// pngDecodeOptions returns the options to pass to the PNG decoder in
+// order to read metadata according to the options specified.
+func pngDecodeOptions(o *DecodeOptions) *png.DecodeOptions {
 	pngOpt := &png.DecodeOptions{
 		ParseUnknownChunk: func (c png.Chunk) error {
 			if o.Metadata == nil { return nil }
 
-			if c.Name == "tEXt" || c.Name == "iTXt" {
-				entry, err := pngChunkToTextEntry(c)
-				if err != nil && o.Strict { return err }
-				if err == nil {
-					if entry.Key != "__COMMENT__" {
-						o.Metadata.Text.Add(entry)
-					} else {
-						o.Metadata.Comments = append(o.Metadata.Comments, entry.Value)
+			switch c.Name {
+				case "tEXt", "zTXt", "iTXt":
+					entry, err := pngChunkToTextEntry(c)
+					if err != nil && o.Strict { return err }
+					if err == nil {
+						switch entry.Key {
+							case "__COMMENT__": o.Metadata.Comments = append(o.Metadata.Comments, entry.Value)
+							case XMPTextKey: o.Metadata.XMP = []byte(entry.Value)
+							default: o.Metadata.Text.Add(entry)
+						}
 					}
-				}
+				case "iCCP":
+					profile, err := pngChunkToICCProfile(c)
+					if err != nil && o.Strict { return err }
+					if err == nil {
+						o.Metadata.ICCProfile = profile
+					}
+				case "eXIf":
+					exif, err := ParseExif(c.Data)
+					if err != nil && o.Strict { return err }
+					if err == nil {
+						o.Metadata.EXIF = exif
+					}
+				case "pHYs", "gAMA", "cHRM", "sRGB", "tIME":
+					err := pngChunkToMetadata(c, o.Metadata)
+					if err != nil && o.Strict { return err }
 			}
 			return nil
 		},
 	}
 
-	return png.DecodeWithOptions(r, pngOpt)
+	if o.Metadata != nil {
+		pngOpt.Metadata = &png.Metadata{}
+	}
+	return pngOpt
+}
+
+// pngDecodedMetadata copies the metadata read by the PNG decoder.
+func pngDecodedMetadata(o *DecodeOptions, pngOpt *png.DecodeOptions) {
+	if pngOpt.Metadata == nil { return }
+
+	o.Metadata.Background = pngOpt.Metadata.Background
+	o.Metadata.SignificantBits = pngOpt.Metadata.SignificantBits
+}
+
+// Decode decodes a PNG according to the options specified.
+func (c *PNGCodec) Decode(r io.Reader, o *DecodeOptions) (image.Image, error) {
+	if o == nil { o = DefaultDecodeOptions() }
+
+	pngOpt := pngDecodeOptions(o)
+	im, err := png.DecodeWithOptions(r, pngOpt)
+	if err != nil { return nil, err }
+
+	pngDecodedMetadata(o, pngOpt)
+	return im, nil
+}
+
+// DecodeFrames decodes every frame of an animated PNG according to the
+// options specified.
+func (c *PNGCodec) DecodeFrames(r io.Reader, o *DecodeOptions) (*Animation, error) {
+	if o == nil { o = DefaultDecodeOptions() }
+
+	pngOpt := pngDecodeOptions(o)
+	pa, err := png.DecodeAllWithOptions(r, pngOpt)
+	if err != nil { return nil, err }
+
+	pngDecodedMetadata(o, pngOpt)
+
+	if len(pa.Frames) == 1 && pa.Default == nil {
+		return NewAnimation(pa.Frames[0].Image), nil
+	}
+
+	a := &Animation{
+		Frames: make([]*Frame, len(pa.Frames)),
+		Width: pa.Width,
+		Height: pa.Height,
+		LoopCount: pa.NumPlays,
+	}
+
+	for i, pf := range pa.Frames {
+		den := time.Duration(pf.DelayDen)
+		if den == 0 { den = 100 }
+
+		f := &Frame{
+			Image: pf.Image,
+			Delay: time.Duration(pf.DelayNum) * time.Second / den,
+		}
+
+		switch pf.DisposeOp {
+			case png.DisposeOpBackground: f.Disposal = DisposeBackground
+			case png.DisposeOpPrevious: f.Disposal = DisposePrevious
+			default: f.Disposal = DisposeNone
+		}
+
+		if pf.BlendOp == png.BlendOpSource {
+			f.Blend = BlendSource
+		}
+
+		a.Frames[i] = f
+	}
+
+	return a, nil
 }
 
 // DecodeConfig returns the color model and dimensions of a PNG image
-// without decoding the image.
+// without decoding the image. Metadata is read according to the options
+// specified, skipping over the image data to reach any that follows it.
 func (c *PNGCodec) DecodeConfig(r io.Reader, o *DecodeOptions) (image.Config, error) {
-	return png.DecodeConfig(r)
+	if o == nil || o.Metadata == nil {
+		return png.DecodeConfigWithOptions(r, &png.DecodeOptions{})
+	}
+
+	pngOpt := pngDecodeOptions(o)
+	cfg, err := png.DecodeConfigWithOptions(r, pngOpt)
+	if err != nil { return image.Config{}, err }
+
+	pngDecodedMetadata(o, pngOpt)
+	return cfg, nil
 }
 
-// Encode encodes a PNG according to the options specified.
-func (c *PNGCodec) Encode(w io.Writer, i image.Image, o *EncodeOptions) error {
+// DecodeFrameCount returns the color model and dimensions of a PNG image
+// and its number of frames, which APNG images give in their acTL chunk,
+// without decoding the image. Metadata is read according to the options
+// specified.
+func (c *PNGCodec) DecodeFrameCount(r io.Reader, o *DecodeOptions) (image.Config, int, error) {
+	if o == nil { o = &DecodeOptions{} }
+
+	pngOpt := pngDecodeOptions(o)
+	frames := 1
+	parse := pngOpt.ParseUnknownChunk
+	pngOpt.ParseUnknownChunk = func (c png.Chunk) error {
+		// APNG chunks are unknown chunks unless the frames are decoded.
+		if c.Name == "acTL" && len(c.Data) >= 4 {
+			frames = int(binary.BigEndian.Uint32(c.Data))
+		}
+		return parse(c)
+	}
+
+	cfg, err := png.DecodeConfigWithOptions(r, pngOpt)
+	if err != nil { return image.Config{}, 0, err }
+
+	pngDecodedMetadata(o, pngOpt)
+	return cfg, frames, nil
+}
+
+// PNGEncodeOptions specifies PNG-specific encoding options. Pass it in
+// EncodeOptions.EncoderSpecific.
+type PNGEncodeOptions struct {
+	// Level is the zlib compression level, from 1 to 9, or for ZNG
+	// images the zstd compression level, from 1 to 22. It overrides
+	// EncodeOptions.CompressionLevel unless it is 0.
+	Level int
+}
+
+// ParseParams parses PNG encoding options from a comma-separated list
+// of parameters. The only parameter is "zlib_level=N", or "zstd_level=N"
+// for ZNG images, which sets the compression level.
+func (c *PNGCodec) ParseParams(opt string) (any, error) {
+	po := &PNGEncodeOptions{}
+	maxLevel := 9
+	if c.isZNGCodec { maxLevel = 22 }
+
+	err := eachCodecParam(opt, func(key, val string, hasVal bool) error {
+		switch {
+			case key == "zlib_level" && !c.isZNGCodec, key == "zstd_level" && c.isZNGCodec:
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 1 || n > maxLevel {
+					return fmt.Errorf("%s: invalid %s %q", c.Name(), key, val)
+				}
+				po.Level = n
+			default:
+				return fmt.Errorf("%s: unknown parameter %q", c.Name(), key)
+		}
+		return nil
+	})
+	if err != nil { return nil, err }
+	return po, nil
+}
+
+// pngEncoder returns a PNG encoder and its options according to the
+// options specified.
+func (c *PNGCodec) pngEncoder(o *EncodeOptions) (*png.Encoder, *png.EncodeOptions, error) {
 	convertCompressionLevel := func (i int) png.CompressionLevel {
 		if i == -1 {
 			return png.DefaultCompression
@@ -184,19 +513,29 @@ func (c *PNGCodec) Encode(w io.Writer, i image.Image, o *EncodeOptions) error {
 		}
 	}
 
-	if o == nil { o = DefaultEncodeOptions() }
-
 	enc := &png.Encoder{
 		CompressionLevel: convertCompressionLevel(o.CompressionLevel),
 		UseZstd: c.isZNGCodec,
 	}
+	if po, ok := o.EncoderSpecific.(*PNGEncodeOptions); ok && po != nil && po.Level > 0 {
+		enc.CompressionLevel = png.CompressionLevel(po.Level)
+	}
 
 	pngOpt := &png.EncodeOptions{}
 	if o.Metadata != nil {
 		for _, entry := range o.Metadata.Text {
+			if entry.Key == XMPTextKey && o.Metadata.XMP != nil { continue }
 			pngOpt.CustomChunks = append(pngOpt.CustomChunks, textEntryToPNGChunk(entry))
 		}
 
+		if o.Metadata.XMP != nil {
+			pngOpt.CustomChunks = append(pngOpt.CustomChunks, textEntryToPNGChunk(&TextEntry{
+				Key: XMPTextKey,
+				Value: string(o.Metadata.XMP),
+				IsUtf8: true,
+			}))
+		}
+
 		for _, comment := range o.Metadata.Comments {
 			pngOpt.CustomChunks = append(pngOpt.CustomChunks, textEntryToPNGChunk(&TextEntry{
 				Key: "__COMMENT__",
@@ -204,12 +543,98 @@ func (c *PNGCodec) Encode(w io.Writer, i image.Image, o *EncodeOptions) error {
 				IsUtf8: true,
 			}))
 		}
+
+		if o.Metadata.ICCProfile != nil {
+			chunk, err := iccProfileToPNGChunk(o.Metadata.ICCProfile)
+			if err != nil { return nil, nil, err }
+			pngOpt.CustomChunks = append(pngOpt.CustomChunks, chunk)
+		}
+
+		if o.Metadata.EXIF != nil && !o.Metadata.EXIF.IsEmpty() {
+			exif, err := o.Metadata.EXIF.Bytes()
+			if err != nil { return nil, nil, err }
+			pngOpt.CustomChunks = append(pngOpt.CustomChunks, png.Chunk{Name: "eXIf", Data: exif})
+		}
+
+		pngOpt.CustomChunks = append(pngOpt.CustomChunks, metadataToPNGChunks(o.Metadata)...)
+		pngOpt.Metadata = &png.Metadata{
+			Background: o.Metadata.Background,
+			SignificantBits: o.Metadata.SignificantBits,
+		}
 	}
 
+	return enc, pngOpt, nil
+}
+
+// Encode encodes a PNG according to the options specified.
+func (c *PNGCodec) Encode(w io.Writer, i image.Image, o *EncodeOptions) error {
+	if o == nil { o = DefaultEncodeOptions() }
+
+	enc, pngOpt, err := c.pngEncoder(o)
+	if err != nil { return err }
+
 	return enc.EncodeWithOptions(w, i, pngOpt)
 }
 
+// EncodeFrames encodes an animated PNG according to the options
+// specified. Animations cannot be stored in ZNG images, so only the
+// first frame is encoded in that case.
+func (c *PNGCodec) EncodeFrames(w io.Writer, a *Animation, o *EncodeOptions) error {
+	if len(a.Frames) == 1 || c.isZNGCodec {
+		return c.Encode(w, a.First(), o)
+	}
+
+	if o == nil { o = DefaultEncodeOptions() }
+
+	// The first frame of an APNG must cover the entire canvas.
+	if a.Frames[0].Image.Bounds() != a.Bounds() {
+		a = a.coalesced()
+	}
+
+	pa := &png.Animation{
+		Frames: make([]*png.Frame, len(a.Frames)),
+		Width: a.Width,
+		Height: a.Height,
+		NumPlays: a.LoopCount,
+	}
+
+	for i, f := range a.Frames {
+		pf := &png.Frame{Image: f.Image}
+
+		ms := f.Delay.Milliseconds()
+		if ms <= math.MaxUint16 {
+			pf.DelayNum, pf.DelayDen = uint16(ms), 1000
+		} else if ms / 10 <= math.MaxUint16 {
+			pf.DelayNum, pf.DelayDen = uint16(ms / 10), 100
+		} else {
+			pf.DelayNum, pf.DelayDen = math.MaxUint16, 100
+		}
+
+		switch f.Disposal {
+			case DisposeBackground: pf.DisposeOp = png.DisposeOpBackground
+			case DisposePrevious: pf.DisposeOp = png.DisposeOpPrevious
+			default: pf.DisposeOp = png.DisposeOpNone
+		}
+
+		if f.Blend == BlendSource {
+			pf.BlendOp = png.BlendOpSource
+		} else {
+			pf.BlendOp = png.BlendOpOver
+		}
+
+		pa.Frames[i] = pf
+	}
+
+	enc, pngOpt, err := c.pngEncoder(o)
+	if err != nil { return err }
+
+	return enc.EncodeAllWithOptions(w, pa, pngOpt)
+}
+
 var (
 	_ Decoder = &PNGCodec{}
 	_ Encoder = &PNGCodec{}
+	_ DecoderWithFrames = &PNGCodec{}
+	_ EncoderWithFrames = &PNGCodec{}
+	_ CodecWithParamParser = &PNGCodec{}
 )
@@ -4,7 +4,15 @@ package henshin
 
 import (
 	"bytes"
+	"encoding/binary"
+	"hash/crc32"
 	"image"
+	"image/color"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ronsor/majokko/format/png"
 
 	"testing"
 )
@@ -37,6 +45,20 @@ func TestTextChunksRoundTrip(t *testing.T) {
 			Value: "test123",
 			
 		},
+		&TextEntry{Key: "compressed", Value: strings.Repeat("zTXt ", 100), Compress: true},
+		&TextEntry{
+			Key: XMPTextKey,
+			Value: strings.Repeat("<x:xmpmeta/>", 100),
+			IsUtf8: true,
+			Compress: true,
+		},
+		&TextEntry{
+			Key: "compressed kitchen sink",
+			Utf8Key: "utf8-y kitchen sink",
+			Value: "\x00here",
+			Language: "en_US",
+			Compress: true,
+		},
 	}
 
 	for _, original := range cases {
@@ -132,3 +154,157 @@ func TestFullRoundTrip(t *testing.T) {
 		}
 	}
 }
+
+// TestAnimatedPNGRoundTrip tests the encoding and decoding of
+// animated PNG images through a Wand.
+func TestAnimatedPNGRoundTrip(t *testing.T) {
+	a := &Animation{
+		Width: 32,
+		Height: 32,
+		LoopCount: 2,
+	}
+	for i := 0; i < 4; i++ {
+		a.Frames = append(a.Frames, &Frame{
+			Image: image.NewNRGBA(image.Rect(i * 4, 0, 32, 32 - i * 4)),
+			Delay: time.Duration(i + 1) * 50 * time.Millisecond,
+			Disposal: Disposal(i % 3),
+			Blend: Blend(i % 2),
+		})
+	}
+
+	w := NewWand()
+	w.SetFrames(a)
+
+	var buf bytes.Buffer
+	if err := w.EncodeImage(&buf, "png"); err != nil { t.Fatal(err) }
+
+	w2 := NewWand()
+	if err := w2.DecodeImage(&buf); err != nil { t.Fatal(err) }
+
+	b := w2.Frames()
+	if len(b.Frames) != len(a.Frames) {
+		t.Fatalf("expected %d frames, got %d", len(a.Frames), len(b.Frames))
+	}
+	if b.Width != a.Width || b.Height != a.Height || b.LoopCount != a.LoopCount {
+		t.Fatalf("expected %dx%d (loop %d), got %dx%d (loop %d)",
+			a.Width, a.Height, a.LoopCount, b.Width, b.Height, b.LoopCount)
+	}
+	for i, f := range b.Frames {
+		g := a.Frames[i]
+		if f.Delay != g.Delay || f.Disposal != g.Disposal || f.Blend != g.Blend {
+			t.Fatalf("frame %d: expected %v/%v/%v, got %v/%v/%v",
+				i, g.Delay, g.Disposal, g.Blend, f.Delay, f.Disposal, f.Blend)
+		}
+		if f.Image.Bounds() != g.Image.Bounds() {
+			t.Fatalf("frame %d: expected bounds %v, got %v", i, g.Image.Bounds(), f.Image.Bounds())
+		}
+	}
+}
+
+// TestAncillaryChunksRoundTrip tests the encoding and decoding of typed
+// PNG ancillary chunk metadata.
+func TestAncillaryChunksRoundTrip(t *testing.T) {
+	images := []image.Image{
+		image.NewNRGBA(image.Rect(0, 0, 8, 8)),
+		image.NewGray16(image.Rect(0, 0, 8, 8)),
+		image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{color.Black, color.White}),
+	}
+
+	near := func(a, b float64) bool { return math.Abs(a - b) < 1e-4 }
+
+	for _, img := range images {
+		md := &Metadata{
+			Density: &Density{X: 300, Y: 150, Unit: DensityUnitInch},
+			Gamma: 1 / 2.2,
+			Chromaticities: &Chromaticities{0.3127, 0.329, 0.64, 0.33, 0.3, 0.6, 0.15, 0.06},
+			RenderingIntent: RenderingIntentRelative,
+			ModTime: time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC),
+			SignificantBits: [4]uint8{6, 6, 6, 0},
+			Background: color.White,
+		}
+
+		var codec PNGCodec
+		var buf bytes.Buffer
+		if err := codec.Encode(&buf, img, &EncodeOptions{Metadata: md}); err != nil { t.Fatal(err) }
+
+		decOpt := &DecodeOptions{Metadata: &Metadata{}}
+		if _, err := codec.Decode(&buf, decOpt); err != nil { t.Fatal(err) }
+		got := decOpt.Metadata
+
+		if got.Density == nil || got.Density.Unit != DensityUnitCentimeter {
+			t.Fatalf("%T: expected density in pixels per centimeter, got %v", img, got.Density)
+		}
+		if x, y := got.Density.PerInch(); math.Abs(x - 300) > 0.05 || math.Abs(y - 150) > 0.05 {
+			t.Fatalf("%T: expected 300x150 ppi, got %gx%g", img, x, y)
+		}
+		if !near(got.Gamma, md.Gamma) {
+			t.Fatalf("%T: expected gamma %g, got %g", img, md.Gamma, got.Gamma)
+		}
+		if got.Chromaticities == nil || !near(got.Chromaticities.RedX, 0.64) || !near(got.Chromaticities.BlueY, 0.06) {
+			t.Fatalf("%T: expected chromaticities %v, got %v", img, md.Chromaticities, got.Chromaticities)
+		}
+		if got.RenderingIntent != md.RenderingIntent {
+			t.Fatalf("%T: expected rendering intent %v, got %v", img, md.RenderingIntent, got.RenderingIntent)
+		}
+		if !got.ModTime.Equal(md.ModTime) {
+			t.Fatalf("%T: expected modification time %v, got %v", img, md.ModTime, got.ModTime)
+		}
+		// Unknown channels are written at the full bit depth.
+		if got.SignificantBits[0] != 6 || got.SignificantBits[1] != 6 || got.SignificantBits[2] != 6 {
+			t.Fatalf("%T: expected significant bits %v, got %v", img, md.SignificantBits, got.SignificantBits)
+		}
+		if got.Background == nil {
+			t.Fatalf("%T: expected a background color", img)
+		}
+		if r, g, b, _ := got.Background.RGBA(); r != 0xffff || g != 0xffff || b != 0xffff {
+			t.Fatalf("%T: expected a white background, got %v", img, got.Background)
+		}
+	}
+}
+
+// TestPNGTextAfterImageData tests that text chunks after the image data
+// are read when only the header of a PNG image is decoded.
+func TestPNGTextAfterImageData(t *testing.T) {
+	w := NewWand()
+	w.SetImage(image.NewGray(image.Rect(0, 0, 3, 3)))
+	var buf bytes.Buffer
+	if err := w.EncodeImage(&buf, "png"); err != nil { t.Fatal(err) }
+
+	// Insert a tEXt chunk before IEND.
+	data := buf.Bytes()
+	iend := data[len(data) - 12:]
+	chunk := []byte("\x00\x00\x00\x00tEXtAuthor\x00Someone")
+	binary.BigEndian.PutUint32(chunk, uint32(len(chunk) - 8))
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	data = append(append(append([]byte(nil), data[:len(data) - 12]...), chunk...), iend...)
+
+	full, header := NewWand(), NewWand()
+	if err := full.DecodeImage(bytes.NewReader(data)); err != nil { t.Fatal(err) }
+	if err := header.DecodeImageConfig(bytes.NewReader(data)); err != nil { t.Fatal(err) }
+	for _, w := range []*Wand{full, header} {
+		if got := w.FormatString("%[text:Author]"); got != "Someone" {
+			t.Errorf("got author %q, want %q", got, "Someone")
+		}
+	}
+}
+
+// TestPNGInflateLimit tests that compressed text and ICC profiles that
+// decompress to more than pngMaxInflatedSize bytes are rejected.
+func TestPNGInflateLimit(t *testing.T) {
+	for _, size := range []int{pngMaxInflatedSize, pngMaxInflatedSize + 1} {
+		var buf bytes.Buffer
+		compressPNGText(&buf, strings.Repeat("a", size))
+		data := buf.Bytes()
+
+		_, textErr := decompressPNGText(0, data)
+		_, iccErr := pngChunkToICCProfile(png.Chunk{Name: "iCCP", Data: append([]byte("icc\x00\x00"), data...)})
+		for _, err := range []error{textErr, iccErr} {
+			_, isFormatErr := err.(png.FormatError)
+			if size > pngMaxInflatedSize && !isFormatErr {
+				t.Errorf("%d bytes: got error %v, want a format error", size, err)
+			} else if size <= pngMaxInflatedSize && err != nil {
+				t.Errorf("%d bytes: %v", size, err)
+			}
+		}
+	}
+}
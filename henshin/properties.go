@@ -0,0 +1,170 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"strconv"
+)
+
+// colorModelInfo describes the pixels of a color model.
+type colorModelInfo struct {
+	// Depth is the number of bits per channel.
+	Depth int
+	// Gray is set if the color model only has gray levels.
+	Gray bool
+	// Alpha is set if the color model has an alpha channel. Images with
+	// such a color model may still be opaque; see Wand.hasAlpha.
+	Alpha bool
+}
+
+// modelInfo returns information about a color model. Models outside
+// the standard library are examined by converting colors with them.
+func modelInfo(m color.Model) colorModelInfo {
+	if p, ok := m.(color.Palette); ok {
+		info := colorModelInfo{Depth: 8, Gray: true}
+		for _, c := range p {
+			r, g, b, a := c.RGBA()
+			if a != 0xffff { info.Alpha = true }
+			if r != g || g != b { info.Gray = false }
+		}
+		return info
+	}
+
+	switch m {
+		case color.GrayModel: return colorModelInfo{Depth: 8, Gray: true}
+		case color.Gray16Model: return colorModelInfo{Depth: 16, Gray: true}
+		case color.AlphaModel: return colorModelInfo{Depth: 8, Gray: true, Alpha: true}
+		case color.Alpha16Model: return colorModelInfo{Depth: 16, Gray: true, Alpha: true}
+		case color.YCbCrModel, color.CMYKModel: return colorModelInfo{Depth: 8}
+		case color.RGBAModel, color.NRGBAModel, color.NYCbCrAModel: return colorModelInfo{Depth: 8, Alpha: true}
+		case color.RGBA64Model, color.NRGBA64Model: return colorModelInfo{Depth: 16, Alpha: true}
+	}
+
+	info := colorModelInfo{Depth: 8}
+	// An 8-bit model loses the low byte of each channel.
+	if r, _, _, _ := m.Convert(color.RGBA64{0x1234, 0x1234, 0x1234, 0xffff}).RGBA(); r & 0xff != r >> 8 {
+		info.Depth = 16
+	}
+	if r, g, b, _ := m.Convert(color.RGBA64{0xffff, 0, 0, 0xffff}).RGBA(); r == g && g == b {
+		info.Gray = true
+	}
+	if _, _, _, a := m.Convert(color.NRGBA64{0x8000, 0x8000, 0x8000, 0x8000}).RGBA(); a != 0xffff {
+		info.Alpha = true
+	}
+	return info
+}
+
+// hasAlpha reports whether the image has an alpha channel that is used:
+// its color model must have one, and a frame must have pixels that are
+// not fully opaque. Without decoded frames, only the color model is
+// considered.
+func (w *Wand) hasAlpha() bool {
+	m := w.ColorModel()
+	if m == nil || !modelInfo(m).Alpha { return false }
+	if w.anim == nil { return true }
+
+	for _, f := range w.anim.Frames {
+		im, ok := f.Image.(interface{ Opaque() bool })
+		if !ok || !im.Opaque() { return true }
+	}
+	return false
+}
+
+// Colorspace returns the name of the colorspace of pixels in the color
+// model: "Gray", "CMYK" or "sRGB".
+func (info colorModelInfo) Colorspace(m color.Model) string {
+	switch {
+		case m == color.CMYKModel: return "CMYK"
+		case info.Gray: return "Gray"
+	}
+	return "sRGB"
+}
+
+// Type returns the image type of the color model, using the same names
+// as ImageMagick, such as "Grayscale" or "TrueColorAlpha".
+func (info colorModelInfo) Type(m color.Model) (typ string) {
+	_, paletted := m.(color.Palette)
+	switch {
+		case paletted: typ = "Palette"
+		case m == color.CMYKModel: typ = "ColorSeparation"
+		case info.Gray: typ = "Grayscale"
+		default: typ = "TrueColor"
+	}
+	if info.Alpha { typ += "Alpha" }
+	return
+}
+
+// wandProperties is the JSON representation of the properties of an
+// image, as returned by the "json" property. The names of the fields
+// are those of the corresponding properties.
+type wandProperties struct {
+	Filename string `json:"filename,omitempty"`
+	Size int64 `json:"size,omitempty"`
+	Format string `json:"format,omitempty"`
+	Width int `json:"width"`
+	Height int `json:"height"`
+	Frames int `json:"frames"`
+	Depth int `json:"depth,omitempty"`
+	Colorspace string `json:"colorspace,omitempty"`
+	Type string `json:"type,omitempty"`
+	HasAlpha bool `json:"has-alpha"`
+	Hash int64 `json:"hash"`
+
+	Comments []string `json:"comments,omitempty"`
+	Density string `json:"density,omitempty"`
+	Units string `json:"units,omitempty"`
+	Gamma string `json:"gamma,omitempty"`
+	Chromaticity string `json:"chromaticity,omitempty"`
+	RenderingIntent string `json:"rendering-intent,omitempty"`
+	Modified string `json:"modified,omitempty"`
+	SignificantBits string `json:"significant-bits,omitempty"`
+	Background string `json:"background,omitempty"`
+	Text map[string]string `json:"text,omitempty"`
+	XMP string `json:"xmp,omitempty"`
+}
+
+// propertiesJSON returns the properties of the image as a JSON object.
+func (w *Wand) propertiesJSON() string {
+	atoi := func(key string) int {
+		n, _ := strconv.Atoi(w.property(key))
+		return n
+	}
+
+	p := &wandProperties{
+		Filename: w.property("filename"),
+		Size: w.fileSize,
+		Format: w.property("format"),
+		Width: w.Width(),
+		Height: w.Height(),
+		Frames: w.frames(),
+		Depth: atoi("depth"),
+		Colorspace: w.property("colorspace"),
+		Type: w.property("type"),
+		HasAlpha: w.property("has-alpha") == "true",
+		Hash: int64(w.Hash()),
+
+		Comments: w.md.Comments,
+		Density: w.property("density"),
+		Units: w.property("units"),
+		Gamma: w.property("gamma"),
+		Chromaticity: w.property("chromaticity"),
+		RenderingIntent: w.property("rendering-intent"),
+		Modified: w.property("modified"),
+		SignificantBits: w.property("significant-bits"),
+		Background: w.property("background"),
+		XMP: w.property("xmp"),
+	}
+	if len(w.md.Text) > 0 {
+		p.Text = w.md.Text.ToStringMap()
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// XMP packets are full of markup, which needs no escaping.
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(p); err != nil { return "" }
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
@@ -0,0 +1,220 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Dither is a dithering method used when reducing the number of colors
+// in an image.
+type Dither int
+
+const (
+	// DitherNone maps each pixel to the nearest color in the palette.
+	DitherNone Dither = iota
+	// DitherFloydSteinberg diffuses the error of each pixel to its
+	// neighbors.
+	DitherFloydSteinberg
+	// DitherOrdered adds a threshold pattern from a Bayer matrix before
+	// mapping each pixel to the palette.
+	DitherOrdered
+)
+
+var ditherNames = map[string]Dither{
+	"none": DitherNone,
+	"floydsteinberg": DitherFloydSteinberg,
+	"fs": DitherFloydSteinberg,
+	"ordered": DitherOrdered,
+	"bayer": DitherOrdered,
+}
+
+// ErrInvalidDither is returned when parsing an unknown dithering method.
+var ErrInvalidDither = errors.New("invalid dithering method")
+
+// ParseDither parses the name of a dithering method: "none",
+// "floyd-steinberg" or "ordered". Names are case insensitive.
+func ParseDither(s string) (Dither, error) {
+	d, ok := ditherNames[strings.ToLower(strings.ReplaceAll(s, "-", ""))]
+	if !ok { return DitherNone, ErrInvalidDither }
+	return d, nil
+}
+
+// MedianCutQuantizer is a draw.Quantizer that builds a palette using the
+// median cut algorithm.
+type MedianCutQuantizer struct{}
+
+// Quantize appends up to cap(p) - len(p) colors representing m to p.
+func (q MedianCutQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	return append(p, medianCut(colorHistogram(nil, m), cap(p) - len(p))...)
+}
+
+// colorCount is the number of pixels of a single color.
+type colorCount struct {
+	c [4]uint8
+	n int
+}
+
+// colorHistogram adds the colors of m, as premultiplied 8-bit values, to
+// the histogram hist.
+func colorHistogram(hist map[[4]uint8]int, m image.Image) map[[4]uint8]int {
+	if hist == nil { hist = map[[4]uint8]int{} }
+
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, a := m.At(x, y).RGBA()
+			hist[[4]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}]++
+		}
+	}
+	return hist
+}
+
+// medianCut returns a palette of at most n colors for the histogram.
+// Boxes of colors are repeatedly split at the median of their widest
+// channel, and each box contributes the average of its colors.
+func medianCut(hist map[[4]uint8]int, n int) color.Palette {
+	colors := make([]colorCount, 0, len(hist))
+	for c, count := range hist {
+		colors = append(colors, colorCount{c, count})
+	}
+	// Keep the result independent of map iteration order.
+	sort.Slice(colors, func(i, j int) bool {
+		a, b := colors[i].c, colors[j].c
+		for k := range a {
+			if a[k] != b[k] { return a[k] < b[k] }
+		}
+		return false
+	})
+
+	boxes := [][]colorCount{colors}
+	if len(colors) == 0 || n <= 0 { boxes = nil }
+
+	for len(boxes) < n {
+		best, bestChannel, bestRange := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 { continue }
+			for ch := 0; ch < 4; ch++ {
+				lo, hi := 255, 0
+				for _, cc := range box {
+					v := int(cc.c[ch])
+					if v < lo { lo = v }
+					if v > hi { hi = v }
+				}
+				if hi - lo > bestRange {
+					best, bestChannel, bestRange = i, ch, hi - lo
+				}
+			}
+		}
+		if best == -1 { break }
+
+		box := boxes[best]
+		sort.SliceStable(box, func(i, j int) bool { return box[i].c[bestChannel] < box[j].c[bestChannel] })
+
+		total := 0
+		for _, cc := range box {
+			total += cc.n
+		}
+		split, sum := 1, box[0].n
+		for split < len(box) - 1 && sum < total / 2 {
+			sum += box[split].n
+			split++
+		}
+
+		boxes[best] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	pal := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		var sum [4]int
+		total := 0
+		for _, cc := range box {
+			for k := range sum {
+				sum[k] += int(cc.c[k]) * cc.n
+			}
+			total += cc.n
+		}
+		pal[i] = color.RGBA{
+			uint8((sum[0] + total / 2) / total),
+			uint8((sum[1] + total / 2) / total),
+			uint8((sum[2] + total / 2) / total),
+			uint8((sum[3] + total / 2) / total),
+		}
+	}
+	return pal
+}
+
+// bayer8 is an 8x8 Bayer threshold matrix.
+var bayer8 = [8][8]uint8{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// paletteIndexer caches the nearest palette index of each color.
+type paletteIndexer struct {
+	pal color.Palette
+	cache map[color.NRGBA]uint8
+}
+
+func (pi *paletteIndexer) index(c color.NRGBA) uint8 {
+	i, ok := pi.cache[c]
+	if !ok {
+		i = uint8(pi.pal.Index(c))
+		pi.cache[c] = i
+	}
+	return i
+}
+
+// palettize returns im mapped to the palette pal using the specified
+// dithering method.
+func palettize(im image.Image, pal color.Palette, dither Dither) *image.Paletted {
+	b := im.Bounds()
+	p := image.NewPaletted(b, pal)
+
+	if dither == DitherFloydSteinberg {
+		draw.FloydSteinberg.Draw(p, b, im, b.Min)
+		return p
+	}
+
+	// The threshold pattern is scaled to the typical distance between
+	// palette colors.
+	spread := 0.0
+	if dither == DitherOrdered {
+		spread = math.Min(255, 255 / math.Max(1, math.Cbrt(float64(len(pal))) - 1))
+	}
+
+	pi := &paletteIndexer{pal: pal, cache: map[color.NRGBA]uint8{}}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(im.At(x, y)).(color.NRGBA)
+			if spread != 0 && c.A != 0 {
+				t := (float64(bayer8[y & 7][x & 7]) + 0.5) / 64 - 0.5
+				c.R = clampUint8(float64(c.R) + t * spread)
+				c.G = clampUint8(float64(c.G) + t * spread)
+				c.B = clampUint8(float64(c.B) + t * spread)
+			}
+			p.Pix[p.PixOffset(x, y)] = pi.index(c)
+		}
+	}
+	return p
+}
+
+func clampUint8(v float64) uint8 {
+	if v < 0 { return 0 }
+	if v > 255 { return 255 }
+	return uint8(v + 0.5)
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+
+	"testing"
+)
+
+// gradientImage returns an image with a smooth gradient.
+func gradientImage(w, h int) *image.NRGBA {
+	im := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			im.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / w), uint8(y * 255 / h), 0x80, 0xff})
+		}
+	}
+	return im
+}
+
+// TestMedianCutExact tests that images with few colors keep them exactly.
+func TestMedianCutExact(t *testing.T) {
+	im := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	im.SetNRGBA(0, 0, color.NRGBA{0xff, 0, 0, 0xff})
+	im.SetNRGBA(1, 0, color.NRGBA{0, 0xff, 0, 0xff})
+	im.SetNRGBA(2, 0, color.NRGBA{0, 0, 0xff, 0xff})
+
+	pal := medianCut(colorHistogram(nil, im), 16)
+	if len(pal) != 4 {
+		t.Fatalf("expected 4 colors but got %d", len(pal))
+	}
+
+	p := palettize(im, pal, DitherNone)
+	for x := 0; x < 4; x++ {
+		r1, g1, b1, a1 := im.At(x, 0).RGBA()
+		r2, g2, b2, a2 := p.At(x, 0).RGBA()
+		if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+			t.Errorf("pixel %d changed from %v to %v", x, im.At(x, 0), p.At(x, 0))
+		}
+	}
+}
+
+// TestQuantize tests reducing colors with each dithering method and
+// encoding the result as a paletted PNG.
+func TestQuantize(t *testing.T) {
+	for _, name := range []string{"none", "Floyd-Steinberg", "ordered"} {
+		dither, err := ParseDither(name)
+		if err != nil { t.Fatal(err) }
+
+		w := NewWand()
+		w.SetImage(gradientImage(64, 64))
+		w.Quantize(16, dither)
+
+		p, ok := w.Image().(*image.Paletted)
+		if !ok {
+			t.Fatalf("%s: expected *image.Paletted but got %T", name, w.Image())
+		}
+		if len(p.Palette) > 16 {
+			t.Errorf("%s: expected at most 16 colors but got %d", name, len(p.Palette))
+		}
+
+		var buf bytes.Buffer
+		if err := w.EncodeImage(&buf, "png"); err != nil { t.Fatal(err) }
+		w = NewWand()
+		if err := w.DecodeImage(&buf); err != nil { t.Fatal(err) }
+		if _, ok := w.Image().(*image.Paletted); !ok {
+			t.Errorf("%s: expected paletted PNG but decoded %T", name, w.Image())
+		}
+	}
+
+	if _, err := ParseDither("riemersma"); err != ErrInvalidDither {
+		t.Errorf("expected ErrInvalidDither but got %v", err)
+	}
+}
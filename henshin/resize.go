@@ -3,7 +3,10 @@
 package henshin
 
 import (
+	"errors"
 	"math"
+	"sort"
+	"strings"
 
 	"golang.org/x/image/draw"
 )
@@ -14,8 +17,93 @@ type ResizeStrategy = draw.Interpolator
 var (
 	BiLinearStrategy = draw.BiLinear
 	NearestStrategy = draw.NearestNeighbor
+	CatmullRomStrategy = draw.CatmullRom
+
+	// LanczosStrategy uses a three-lobed Lanczos kernel, which keeps
+	// photos sharp when downscaling.
+	LanczosStrategy = &draw.Kernel{Support: 3, At: lanczos3}
+	// MitchellStrategy uses the Mitchell-Netravali cubic filter with
+	// B = C = 1/3, a compromise between blurring and ringing.
+	MitchellStrategy = &draw.Kernel{Support: 2, At: mitchell}
+	// BoxStrategy averages the source pixels covered by each pixel. The
+	// support is slightly wider than the kernel so that pixels exactly
+	// halfway between two source pixels are not skipped.
+	BoxStrategy = &draw.Kernel{Support: 0.501, At: box}
+	// GaussianStrategy uses a Gaussian kernel with a standard deviation
+	// of 0.5, which produces soft results without ringing.
+	GaussianStrategy = &draw.Kernel{Support: 2, At: gaussian}
 )
 
+var resizeStrategies = map[string]ResizeStrategy{
+	"nearest": NearestStrategy,
+	"bilinear": BiLinearStrategy,
+	"catmullrom": CatmullRomStrategy,
+	"lanczos": LanczosStrategy,
+	"mitchell": MitchellStrategy,
+	"box": BoxStrategy,
+	"gaussian": GaussianStrategy,
+}
+
+// ErrUnknownResizeStrategy is returned when looking up a resize strategy
+// that does not exist.
+var ErrUnknownResizeStrategy = errors.New("unknown resize strategy")
+
+// ResizeStrategyByName returns the resize strategy with the specified
+// name, such as "lanczos" or "catmull-rom". Names are case insensitive
+// and may contain dashes.
+func ResizeStrategyByName(name string) (ResizeStrategy, error) {
+	name = strings.ToLower(strings.ReplaceAll(name, "-", ""))
+	if name == "lanczos3" { name = "lanczos" }
+
+	strategy, ok := resizeStrategies[name]
+	if !ok { return nil, ErrUnknownResizeStrategy }
+	return strategy, nil
+}
+
+// ResizeStrategyNames returns the names of every resize strategy, sorted.
+func ResizeStrategyNames() (ret []string) {
+	for name := range resizeStrategies {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return
+}
+
+func sinc(x float64) float64 {
+	if x == 0 { return 1 }
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+func lanczos3(t float64) float64 {
+	if t < 0 { t = -t }
+	if t >= 3 { return 0 }
+	return sinc(t) * sinc(t / 3)
+}
+
+func mitchell(t float64) float64 {
+	const b, c = 1.0 / 3, 1.0 / 3
+
+	if t < 0 { t = -t }
+	switch {
+		case t < 1:
+			return ((12 - 9 * b - 6 * c) * t * t * t + (-18 + 12 * b + 6 * c) * t * t + (6 - 2 * b)) / 6
+		case t < 2:
+			return ((-b - 6 * c) * t * t * t + (6 * b + 30 * c) * t * t + (-12 * b - 48 * c) * t + (8 * b + 24 * c)) / 6
+	}
+	return 0
+}
+
+func box(t float64) float64 {
+	if t > 0.5 || t < -0.5 { return 0 }
+	return 1
+}
+
+func gaussian(t float64) float64 {
+	const sigma = 0.5
+	return math.Exp(-t * t / (2 * sigma * sigma))
+}
+
 // areaFit returns a new width and height x2i and y2i given a
 // maximum area and the original width and height x and y.
 func areaFit(x, y, area int) (x2i int, y2i int) {
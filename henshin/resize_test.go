@@ -3,6 +3,9 @@
 package henshin
 
 import (
+	"image"
+	"image/color"
+
 	"testing"
 )
 
@@ -12,3 +15,80 @@ func TestAreaFit(t *testing.T) {
 		t.Errorf("Expected (1365, 768) but got (%d, %d)", w, h)
 	}
 }
+
+// TestResizeStrategies tests that every resize strategy keeps a solid
+// color unchanged when scaling up and down.
+func TestResizeStrategies(t *testing.T) {
+	gray := color.RGBA{0x80, 0x80, 0x80, 0xff}
+	im := image.NewRGBA(image.Rect(0, 0, 30, 20))
+	for i := 0; i < len(im.Pix); i += 4 {
+		im.Pix[i], im.Pix[i + 1], im.Pix[i + 2], im.Pix[i + 3] = gray.R, gray.G, gray.B, gray.A
+	}
+
+	for _, name := range ResizeStrategyNames() {
+		strategy, err := ResizeStrategyByName(name)
+		if err != nil { t.Fatal(err) }
+
+		for _, size := range [][2]int{{7, 5}, {61, 43}} {
+			w := NewWand()
+			w.SetImage(im)
+			w.Resize(size[0], size[1], strategy)
+			if w.Width() != size[0] || w.Height() != size[1] {
+				t.Fatalf("%s: expected %dx%d but got %dx%d", name, size[0], size[1], w.Width(), w.Height())
+			}
+			if c := w.Image().At(size[0] / 2, size[1] / 2); c != gray {
+				t.Errorf("%s: expected %v at %dx%d but got %v", name, gray, size[0], size[1], c)
+			}
+		}
+	}
+
+	if _, err := ResizeStrategyByName("Catmull-Rom"); err != nil {
+		t.Errorf("Catmull-Rom: %v", err)
+	}
+	if _, err := ResizeStrategyByName("bicubic-ish"); err != ErrUnknownResizeStrategy {
+		t.Errorf("expected ErrUnknownResizeStrategy but got %v", err)
+	}
+}
+
+// TestResizePaletted tests that resizing a paletted image interpolates
+// in true color instead of snapping to the palette.
+func TestResizePaletted(t *testing.T) {
+	im := image.NewPaletted(image.Rect(0, 0, 2, 1), color.Palette{color.Black, color.White})
+	im.Pix[1] = 1
+
+	w := NewWand()
+	w.SetImage(im)
+	w.Resize(4, 1, BiLinearStrategy)
+	if _, ok := w.Image().(*image.NRGBA); !ok {
+		t.Fatalf("expected an NRGBA image but got %T", w.Image())
+	}
+	if c := color.GrayModel.Convert(w.Image().At(1, 0)).(color.Gray); c.Y == 0 || c.Y == 0xff {
+		t.Errorf("expected an interpolated gray but got %v", c)
+	}
+
+	w.SetImage(im)
+	w.Resize(4, 1, NearestStrategy)
+	if _, ok := w.Image().(*image.Paletted); !ok {
+		t.Errorf("expected a paletted image but got %T", w.Image())
+	}
+}
+
+// TestLinearLight tests that downscaling in linear light keeps the
+// brightness of fine detail.
+func TestLinearLight(t *testing.T) {
+	// Alternating black and white columns.
+	im := image.NewGray(image.Rect(0, 0, 8, 8))
+	for i := range im.Pix {
+		if i % 2 == 0 { im.Pix[i] = 0xff }
+	}
+
+	w := NewWand()
+	w.SetImage(im)
+	w.Resize(1, 1, LinearLight(BoxStrategy))
+
+	// 50% linear intensity is about 188 in sRGB.
+	r, _, _, a := w.Image().At(0, 0).RGBA()
+	if r >> 8 < 186 || r >> 8 > 190 || a != 0xffff {
+		t.Errorf("expected sRGB value of about 188 but got %d (alpha %d)", r >> 8, a >> 8)
+	}
+}
@@ -3,10 +3,14 @@
 package henshin
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"image"
 	"io"
+	"sort"
 
-	"golang.org/x/image/tiff"
+	"github.com/ronsor/majokko/format/tiff"
 )
 
 func init() {
@@ -32,29 +36,484 @@ func (c *TIFFCodec) Magic() []string {
 	return []string{"II\x2A\x00", "MM\x00\x2A"}
 }
 
-// Decode decodes a TIFF image according to the options specified.
-func (c *TIFFCodec) Decode(r io.Reader, d *DecodeOptions) (image.Image, error) {
-	return tiff.Decode(r)
+// tiffStructureTags are TIFF tags that describe how image data is
+// stored, rather than the image itself.
+var tiffStructureTags = []uint16{
+	254, // NewSubfileType
+	256, // ImageWidth
+	257, // ImageLength
+	258, // BitsPerSample
+	259, // Compression
+	262, // PhotometricInterpretation
+	273, // StripOffsets
+	277, // SamplesPerPixel
+	278, // RowsPerStrip
+	279, // StripByteCounts
+	284, // PlanarConfiguration
+	297, // PageNumber
+	317, // Predictor
+	320, // ColorMap
+	322, // TileWidth
+	323, // TileLength
+	324, // TileOffsets
+	325, // TileByteCounts
+	338, // ExtraSamples
+	339, // SampleFormat
 }
 
-// DecodeConfig returns the color model and dimensions of a TIFF image
-// without decoding the image.
-func (c *TIFFCodec) DecodeConfig(r io.Reader, d *DecodeOptions) (image.Config, error) {
-	return tiff.DecodeConfig(r)
+// TIFF tags containing metadata other than EXIF.
+const (
+	tiffTagXMP = 700
+	tiffTagICCProfile = 34675
+)
+
+// tiffExif extracts EXIF data from the first IFD of a TIFF file.
+func tiffExif(data []byte) (*Exif, error) {
+	// The next IFD is the next page, not a thumbnail.
+	exif, err := parseExif(data, false)
+	if err != nil { return nil, err }
+
+	for _, id := range tiffStructureTags {
+		exif.Delete(ExifIFD0, id)
+	}
+	return exif, nil
+}
+
+// tiffMetadata extracts metadata from the first IFD of a TIFF file into
+// o.Metadata.
+func tiffMetadata(data []byte, o *DecodeOptions) error {
+	exif, err := tiffExif(data)
+	if err != nil {
+		if o.Strict { return err }
+		return nil
+	}
+
+	if t, ok := exif.Get(ExifIFD0, tiffTagICCProfile); ok {
+		if profile, ok := t.Value.([]byte); ok {
+			o.Metadata.ICCProfile = profile
+		}
+		exif.Delete(ExifIFD0, tiffTagICCProfile)
+	}
+	if t, ok := exif.Get(ExifIFD0, tiffTagXMP); ok {
+		switch v := t.Value.(type) {
+			case []byte: o.Metadata.XMP = v
+			case string: o.Metadata.XMP = []byte(v)
+		}
+		exif.Delete(ExifIFD0, tiffTagXMP)
+	}
+	if !exif.IsEmpty() {
+		o.Metadata.EXIF = exif
+	}
+	return nil
+}
+
+// tiffHeader reads the start of a TIFF file from r, up to the end of the
+// first IFD, the EXIF IFDs it refers to and the values of their tags.
+// The image data is only read if it comes before them.
+func tiffHeader(r io.Reader) ([]byte, error) {
+	var data []byte
+	fill := func(end uint64) error {
+		if end <= uint64(len(data)) { return nil }
+		buf := make([]byte, end - uint64(len(data)))
+		if _, err := io.ReadFull(r, buf); err != nil { return ErrInvalidExif }
+		data = append(data, buf...)
+		return nil
+	}
+
+	if err := fill(8); err != nil { return nil, err }
+	order, err := tiffByteOrder(data)
+	if err != nil { return nil, err }
+
+	ifds := []uint32{order.Uint32(data[4:])}
+	seen := map[uint32]bool{}
+	for len(ifds) > 0 {
+		off := ifds[0]
+		ifds = ifds[1:]
+		if seen[off] { continue }
+		seen[off] = true
+
+		if err := fill(uint64(off) + 2); err != nil { return nil, err }
+		n := uint64(order.Uint16(data[off:]))
+		if err := fill(uint64(off) + 2 + 12 * n + 4); err != nil { return nil, err }
+
+		for i := uint64(0); i < n; i++ {
+			entry := data[uint64(off) + 2 + 12 * i:]
+			id, typ, count := order.Uint16(entry), order.Uint16(entry[2:]), order.Uint32(entry[4:])
+			if typ == 0 || int(typ) >= len(exifTypeSizes) { continue }
+
+			valueOff := order.Uint32(entry[8:])
+			if size := uint64(count) * uint64(exifTypeSizes[typ]); size > 4 {
+				if err := fill(uint64(valueOff) + size); err != nil { return nil, err }
+			}
+			switch id {
+				case ExifTagExifIFDPointer, ExifTagGPSIFDPointer, ExifTagInteropIFDPointer:
+					ifds = append(ifds, valueOff)
+			}
+		}
+	}
+	return data, nil
+}
+
+// Decode decodes the first page of a TIFF image according to the options
+// specified.
+func (c *TIFFCodec) Decode(r io.Reader, o *DecodeOptions) (image.Image, error) {
+	if o == nil || o.Metadata == nil { return tiff.Decode(r) }
+
+	data, err := io.ReadAll(r)
+	if err != nil { return nil, err }
+
+	im, err := tiff.Decode(bytes.NewReader(data))
+	if err != nil { return nil, err }
+
+	if err := tiffMetadata(data, o); err != nil { return nil, err }
+	return im, nil
+}
+
+// DecodeFrames decodes every page of a multi-page TIFF image according to
+// the options specified. Each page becomes a frame placed at the top left
+// of the canvas, which is as large as the largest page. Metadata is read
+// from the first page.
+func (c *TIFFCodec) DecodeFrames(r io.Reader, o *DecodeOptions) (*Animation, error) {
+	data, err := io.ReadAll(r)
+	if err != nil { return nil, err }
+
+	pages, err := tiff.DecodeAll(bytes.NewReader(data))
+	if err != nil { return nil, err }
+
+	if o != nil && o.Metadata != nil {
+		if err := tiffMetadata(data, o); err != nil { return nil, err }
+	}
+
+	a := &Animation{Frames: make([]*Frame, len(pages))}
+	for i, im := range pages {
+		a.Frames[i] = &Frame{Image: im, Disposal: DisposeBackground, Blend: BlendSource}
+
+		b := im.Bounds()
+		if b.Dx() > a.Width { a.Width = b.Dx() }
+		if b.Dy() > a.Height { a.Height = b.Dy() }
+	}
+	return a, nil
+}
+
+// DecodeConfig returns the color model and dimensions of the first page
+// of a TIFF image without decoding the image, reading metadata according
+// to the options specified.
+func (c *TIFFCodec) DecodeConfig(r io.Reader, o *DecodeOptions) (image.Config, error) {
+	if o == nil || o.Metadata == nil { return tiff.DecodeConfig(r) }
+
+	data, err := tiffHeader(r)
+	if err != nil { return image.Config{}, err }
+
+	cfg, err := tiff.DecodeConfig(bytes.NewReader(data))
+	if err != nil { return image.Config{}, err }
+
+	if err := tiffMetadata(data, o); err != nil { return image.Config{}, err }
+	return cfg, nil
+}
+
+// DecodeFrameCount returns the color model and dimensions of the first
+// page of a TIFF image and its number of pages without decoding them,
+// reading metadata according to the options specified.
+func (c *TIFFCodec) DecodeFrameCount(r io.Reader, o *DecodeOptions) (image.Config, int, error) {
+	if o == nil || o.Metadata == nil { return tiff.DecodePageCount(r) }
+
+	data, err := tiffHeader(r)
+	if err != nil { return image.Config{}, 0, err }
+
+	// The other pages are found in the rest of the file.
+	cfg, n, err := tiff.DecodePageCount(io.MultiReader(bytes.NewReader(data), r))
+	if err != nil { return image.Config{}, 0, err }
+
+	if err := tiffMetadata(data, o); err != nil { return image.Config{}, 0, err }
+	return cfg, n, nil
+}
+
+// TIFFCompression is a TIFF compression scheme.
+type TIFFCompression int
+
+const (
+	// TIFFDefaultCompression selects the compression scheme from the
+	// compression level: images are uncompressed at the default level
+	// or level 0, and Deflate-compressed otherwise.
+	TIFFDefaultCompression TIFFCompression = iota
+	TIFFUncompressed
+	TIFFDeflate
+	TIFFLZW
+)
+
+// TIFFEncodeOptions specifies TIFF-specific encoding options. Pass it in
+// EncodeOptions.EncoderSpecific.
+type TIFFEncodeOptions struct {
+	// Compression is the compression scheme.
+	Compression TIFFCompression
+
+	// Predictor applies a horizontal differencing predictor before
+	// compression, which usually makes photographs smaller.
+	Predictor bool
+}
+
+// ParseParams parses TIFF encoding options from a comma-separated list
+// of parameters. The parameters are:
+//
+//	compression=none|deflate|lzw  compression scheme
+//	predictor[=true|false]        use a horizontal predictor
+func (c *TIFFCodec) ParseParams(opt string) (any, error) {
+	to := &TIFFEncodeOptions{}
+	err := eachCodecParam(opt, func(key, val string, hasVal bool) error {
+		var err error
+		switch key {
+			case "compression":
+				switch val {
+					case "none": to.Compression = TIFFUncompressed
+					case "deflate", "zip": to.Compression = TIFFDeflate
+					case "lzw": to.Compression = TIFFLZW
+					default: return fmt.Errorf("tiff: invalid compression %q", val)
+				}
+			case "predictor": to.Predictor, err = parseBoolParam("tiff", key, val, hasVal)
+			default: return fmt.Errorf("tiff: unknown parameter %q", key)
+		}
+		return err
+	})
+	if err != nil { return nil, err }
+	return to, nil
+}
+
+// tiffOptions returns the options to pass to the TIFF encoder. Positive
+// compression levels select a Deflate compression level from 1 to 9.
+func tiffOptions(o *EncodeOptions) *tiff.Options {
+	to, _ := o.EncoderSpecific.(*TIFFEncodeOptions)
+	if to == nil { to = &TIFFEncodeOptions{} }
+
+	tiffOpt := &tiff.Options{Predictor: to.Predictor}
+	switch to.Compression {
+		case TIFFDefaultCompression:
+			if o.CompressionLevel > 0 { tiffOpt.Compression = tiff.Deflate }
+		case TIFFDeflate: tiffOpt.Compression = tiff.Deflate
+		case TIFFLZW: tiffOpt.Compression = tiff.LZW
+	}
+
+	if tiffOpt.Compression == tiff.Deflate && o.CompressionLevel > 0 {
+		level := 1 + (o.CompressionLevel - 1) * 9 / 100
+		if level > 9 { level = 9 }
+		tiffOpt.DeflateLevel = level
+	}
+	return tiffOpt
 }
 
 // Encode encodes a TIFF image according to the options specified.
+// TIFF-specific options may be given as a *TIFFEncodeOptions.
 func (c *TIFFCodec) Encode(w io.Writer, i image.Image, o *EncodeOptions) error {
+	return c.encode(w, []image.Image{i}, o)
+}
+
+// EncodeFrames encodes every frame of an image as a page of a multi-page
+// TIFF image according to the options specified. Frames that depend on
+// earlier frames, as in animations, are coalesced first.
+func (c *TIFFCodec) EncodeFrames(w io.Writer, a *Animation, o *EncodeOptions) error {
+	if len(a.Frames) == 1 { return c.Encode(w, a.First(), o) }
+
+	for _, f := range a.Frames {
+		if f.Image.Bounds().Min != (image.Point{}) || f.Disposal != DisposeBackground || f.Blend != BlendSource {
+			a = a.coalesced()
+			break
+		}
+	}
+
+	pages := make([]image.Image, len(a.Frames))
+	for i, f := range a.Frames {
+		pages[i] = f.Image
+	}
+	return c.encode(w, pages, o)
+}
+
+// encode encodes images as the pages of a TIFF image. Metadata is stored
+// in the first page.
+func (c *TIFFCodec) encode(w io.Writer, pages []image.Image, o *EncodeOptions) error {
 	if o == nil { o = DefaultEncodeOptions() }
+	tiffOpt := tiffOptions(o)
+
+	md := o.Metadata
+	if md == nil || (md.XMP == nil && md.ICCProfile == nil && (md.EXIF == nil || md.EXIF.IsEmpty())) {
+		return tiff.EncodeAll(w, pages, tiffOpt)
+	}
+
+	var buf bytes.Buffer
+	if err := tiff.EncodeAll(&buf, pages, tiffOpt); err != nil { return err }
+
+	data, tags, err := tiffMetadataTags(buf.Bytes(), md)
+	if err != nil { return err }
+	data, err = tiffAddTags(data, tags)
+	if err != nil { return err }
+
+	_, err = w.Write(data)
+	return err
+}
+
+// tiffMetadataTags returns the tags storing metadata in the first IFD of
+// a TIFF file. The EXIF sub-IFDs the tags point to are appended to data.
+func tiffMetadataTags(data []byte, md *Metadata) ([]byte, []*ExifTag, error) {
+	order, err := tiffByteOrder(data)
+	if err != nil { return nil, nil, err }
+
+	var tags []*ExifTag
+	if md.XMP != nil {
+		tags = append(tags, &ExifTag{ID: tiffTagXMP, Type: ExifTypeByte, Value: md.XMP})
+	}
+	if md.ICCProfile != nil {
+		tags = append(tags, &ExifTag{ID: tiffTagICCProfile, Type: ExifTypeUndefined, Value: md.ICCProfile})
+	}
+	if md.EXIF == nil { return data, tags, nil }
+
+	// Tags describing the image data written by the encoder are kept.
+	structure := map[uint16]bool{}
+	for _, id := range tiffStructureTags {
+		structure[id] = true
+	}
+	for _, t := range md.EXIF.Tags(ExifIFD0) {
+		if !structure[t.ID] { tags = append(tags, t) }
+	}
+
+	// The Interop IFD is referenced from the Exif IFD, so it is written
+	// first.
+	exifTags := md.EXIF.Tags(ExifIFDExif)
+	if interop := md.EXIF.Tags(ExifIFDInterop); len(interop) > 0 && len(exifTags) > 0 {
+		var off uint32
+		data, off, err = tiffAppendIFD(data, order, interop)
+		if err != nil { return nil, nil, err }
+		exifTags = append(exifTags[:len(exifTags):len(exifTags)],
+			&ExifTag{ID: ExifTagInteropIFDPointer, Type: ExifTypeLong, Value: []uint32{off}})
+	}
+
+	for _, sub := range []struct{ pointer uint16; tags []*ExifTag }{
+		{ExifTagExifIFDPointer, exifTags},
+		{ExifTagGPSIFDPointer, md.EXIF.Tags(ExifIFDGPS)},
+	} {
+		if len(sub.tags) == 0 { continue }
+
+		var off uint32
+		data, off, err = tiffAppendIFD(data, order, sub.tags)
+		if err != nil { return nil, nil, err }
+		tags = append(tags, &ExifTag{ID: sub.pointer, Type: ExifTypeLong, Value: []uint32{off}})
+	}
+	return data, tags, nil
+}
+
+// tiffByteOrder returns the byte order of a TIFF file.
+func tiffByteOrder(data []byte) (exifByteOrder, error) {
+	if len(data) < 8 { return nil, ErrInvalidExif }
+
+	switch string(data[:4]) {
+		case "II\x2a\x00": return binary.LittleEndian, nil
+		case "MM\x00\x2a": return binary.BigEndian, nil
+	}
+	return nil, ErrInvalidExif
+}
+
+// tiffEntry encodes the IFD entry of a tag. Values too large to fit in
+// the entry are appended to values, which start at offset valueOff in the
+// file.
+func tiffEntry(order exifByteOrder, t *ExifTag, valueOff int, values []byte) (entry []byte, _ []byte, err error) {
+	value, count, err := encodeExifValue(order, t)
+	if err != nil { return nil, nil, err }
+
+	entry = order.AppendUint16(nil, t.ID)
+	entry = order.AppendUint16(entry, uint16(t.Type))
+	entry = order.AppendUint32(entry, count)
+	if len(value) > 4 {
+		entry = order.AppendUint32(entry, uint32(valueOff + len(values)))
+		values = append(values, value...)
+		if len(values) & 1 != 0 { values = append(values, 0) }
+	} else {
+		entry = append(entry, make([]byte, 4)...)
+		copy(entry[8:], value)
+	}
+	return entry, values, nil
+}
+
+// tiffAppendIFD appends an IFD containing tags, followed by their values,
+// to a TIFF file. It returns the new file and the offset of the IFD.
+func tiffAppendIFD(data []byte, order exifByteOrder, tags []*ExifTag) ([]byte, uint32, error) {
+	tags = append([]*ExifTag(nil), tags...)
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].ID < tags[j].ID })
+
+	out := data
+	if len(out) & 1 != 0 { out = append(out, 0) }
+	ifdOff := len(out)
+	valueOff := ifdOff + 2 + 12 * len(tags) + 4
+
+	var values []byte
+	out = order.AppendUint16(out, uint16(len(tags)))
+	for _, t := range tags {
+		var entry []byte
+		var err error
+		entry, values, err = tiffEntry(order, t, valueOff, values)
+		if err != nil { return nil, 0, err }
+		out = append(out, entry...)
+	}
+	out = order.AppendUint32(out, 0)
+	return append(out, values...), uint32(ifdOff), nil
+}
+
+// tiffAddTags adds tags to the first IFD of a TIFF file, replacing any
+// existing tags with the same IDs. The new IFD and the values of the
+// tags are appended to the file, and the old IFD is left unreferenced.
+func tiffAddTags(data []byte, tags []*ExifTag) ([]byte, error) {
+	order, err := tiffByteOrder(data)
+	if err != nil { return nil, err }
+
+	off := int(order.Uint32(data[4:]))
+	if off < 8 || off + 2 > len(data) { return nil, ErrInvalidExif }
+	n := int(order.Uint16(data[off:]))
+	if off + 2 + 12 * n + 4 > len(data) { return nil, ErrInvalidExif }
+	next := order.Uint32(data[off + 2 + 12 * n:])
+
+	// Existing entries are copied as-is, since their values stay where
+	// they are.
+	entries := map[uint16][]byte{}
+	for i := 0; i < n; i++ {
+		entry := data[off + 2 + 12 * i:][:12]
+		entries[order.Uint16(entry)] = entry
+	}
+
+	out := append([]byte(nil), data...)
+	if len(out) & 1 != 0 { out = append(out, 0) }
+	ifdOff := len(out)
+	valueOff := ifdOff + 2 + 12 * (n + len(tags)) + 4
+
+	var values []byte
+	for _, t := range tags {
+		var entry []byte
+		entry, values, err = tiffEntry(order, t, valueOff, values)
+		if err != nil { return nil, err }
+		entries[t.ID] = entry
+	}
+
+	ids := make([]int, 0, len(entries))
+	for id := range entries {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
 
-	var tiffOpt tiff.Options
-	// TODO: allow setting these options
+	out = order.AppendUint16(out, uint16(len(ids)))
+	for _, id := range ids {
+		out = append(out, entries[uint16(id)]...)
+	}
+	out = order.AppendUint32(out, next)
+	// Replaced tags leave unused space in the IFD.
+	for len(out) < valueOff {
+		out = append(out, 0)
+	}
+	out = append(out, values...)
 
-	return tiff.Encode(w, i, &tiffOpt)
+	order.PutUint32(out[4:], uint32(ifdOff))
+	return out, nil
 }
 
 var (
 	_ Decoder = &TIFFCodec{}
 	_ Encoder = &TIFFCodec{}
+	_ DecoderWithFrames = &TIFFCodec{}
+	_ EncoderWithFrames = &TIFFCodec{}
 	_ CodecWithAliases = &TIFFCodec{}
+	_ CodecWithParamParser = &TIFFCodec{}
 )
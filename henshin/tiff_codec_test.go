@@ -0,0 +1,164 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"strings"
+
+	"github.com/ronsor/majokko/format/tiff"
+
+	"testing"
+)
+
+// TestMultiPageTIFF tests that every page of a multi-page TIFF image
+// survives decoding, processing and encoding with each compression
+// scheme.
+func TestMultiPageTIFF(t *testing.T) {
+	a := &Animation{Width: 12, Height: 10}
+	for i := 0; i < 3; i++ {
+		im := image.NewGray(image.Rect(0, 0, 12, 10))
+		for j := range im.Pix { im.Pix[j] = uint8(j * (i + 1)) }
+		a.Frames = append(a.Frames, &Frame{Image: im, Disposal: DisposeBackground, Blend: BlendSource})
+	}
+
+	for _, params := range []string{"compression=none", "compression=lzw,predictor", "compression=deflate"} {
+		w := NewWand()
+		w.SetFrames(a)
+		if err := w.DefineCodecParams("tiff", params); err != nil { t.Fatal(err) }
+
+		var buf bytes.Buffer
+		if err := w.EncodeImage(&buf, "tiff"); err != nil { t.Fatalf("%s: %v", params, err) }
+
+		w2 := NewWand()
+		if err := w2.DecodeImage(&buf); err != nil { t.Fatalf("%s: %v", params, err) }
+		if w2.FrameCount() != 3 { t.Fatalf("%s: expected 3 pages, got %d", params, w2.FrameCount()) }
+
+		for i, f := range w2.Frames().Frames {
+			want := a.Frames[i].Image.(*image.Gray)
+			got, ok := f.Image.(*image.Gray)
+			if !ok || !bytes.Equal(got.Pix, want.Pix) { t.Fatalf("%s: page %d differs", params, i) }
+		}
+
+		w2.Resize(6, 5, NearestStrategy)
+		buf.Reset()
+		if err := w2.EncodeImage(&buf, "tiff"); err != nil { t.Fatal(err) }
+		pages, err := tiff.DecodeAll(&buf)
+		if err != nil { t.Fatal(err) }
+		if len(pages) != 3 || pages[2].Bounds() != image.Rect(0, 0, 6, 5) {
+			t.Fatalf("%s: expected 3 resized pages", params)
+		}
+	}
+}
+
+// TestTIFFPageSizes tests that pages of different sizes are kept as they
+// are.
+func TestTIFFPageSizes(t *testing.T) {
+	a := &Animation{Width: 8, Height: 8}
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 8, 4), image.Rect(0, 0, 3, 8)} {
+		im := image.NewNRGBA(r)
+		im.Set(1, 1, color.NRGBA{R: 255, A: 255})
+		a.Frames = append(a.Frames, &Frame{Image: im, Disposal: DisposeBackground, Blend: BlendSource})
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeFrames("tiff", &buf, a, nil); err != nil { t.Fatal(err) }
+	got, err := DecodeFrames(&buf, nil)
+	if err != nil { t.Fatal(err) }
+
+	if got.Width != 8 || got.Height != 8 || len(got.Frames) != 2 {
+		t.Fatalf("expected 2 pages on an 8x8 canvas, got %d on %dx%d", len(got.Frames), got.Width, got.Height)
+	}
+	for i, f := range got.Frames {
+		if f.Image.Bounds() != a.Frames[i].Image.Bounds() {
+			t.Fatalf("page %d: expected bounds %v, got %v", i, a.Frames[i].Image.Bounds(), f.Image.Bounds())
+		}
+	}
+}
+
+// TestTIFFOptions tests that the compression level and TIFF parameters
+// select the compression scheme.
+func TestTIFFOptions(t *testing.T) {
+	c := &TIFFCodec{}
+	tests := []struct {
+		level int
+		params string
+		want tiff.Options
+	}{
+		{-1, "", tiff.Options{}},
+		{0, "", tiff.Options{}},
+		{1, "", tiff.Options{Compression: tiff.Deflate, DeflateLevel: 1}},
+		{100, "predictor", tiff.Options{Compression: tiff.Deflate, DeflateLevel: 9, Predictor: true}},
+		{-1, "compression=deflate", tiff.Options{Compression: tiff.Deflate}},
+		{75, "compression=lzw", tiff.Options{Compression: tiff.LZW}},
+		{75, "compression=none", tiff.Options{}},
+	}
+	for _, tt := range tests {
+		o := &EncodeOptions{CompressionLevel: tt.level}
+		if tt.params != "" {
+			p, err := c.ParseParams(tt.params)
+			if err != nil { t.Fatal(err) }
+			o.EncoderSpecific = p
+		}
+		if got := tiffOptions(o); *got != tt.want {
+			t.Errorf("level %d, %q: expected %+v, got %+v", tt.level, tt.params, tt.want, *got)
+		}
+	}
+}
+
+// TestTIFFMetadataRoundTrip tests that EXIF, ICC and XMP metadata survive
+// encoding and decoding a TIFF image, including a multi-page one.
+func TestTIFFMetadataRoundTrip(t *testing.T) {
+	for _, pages := range []int{1, 2} {
+		w := NewWand()
+		a := &Animation{Width: 8, Height: 8}
+		for i := 0; i < pages; i++ {
+			a.Frames = append(a.Frames, &Frame{Image: image.NewGray(image.Rect(0, 0, 8, 8)), Disposal: DisposeBackground, Blend: BlendSource})
+		}
+		w.SetFrames(a)
+
+		md := w.Metadata()
+		md.EXIF = NewExif()
+		md.EXIF.Set(ExifIFD0, &ExifTag{ID: ExifTagArtist, Type: ExifTypeASCII, Value: "Majokko"})
+		md.EXIF.Set(ExifIFD0, &ExifTag{ID: ExifTagOrientation, Type: ExifTypeShort, Value: []uint16{6}})
+		md.EXIF.Set(ExifIFDExif, &ExifTag{ID: ExifTagDateTimeOriginal, Type: ExifTypeASCII, Value: "2023:01:02 03:04:05"})
+		md.EXIF.Set(ExifIFDInterop, &ExifTag{ID: 1, Type: ExifTypeASCII, Value: "R98"})
+		md.EXIF.Set(ExifIFDGPS, &ExifTag{ID: 0, Type: ExifTypeByte, Value: []byte{2, 3, 0, 0}})
+		md.ICCProfile = []byte(strings.Repeat("icc", 1000))
+		md.XMP = []byte(testXMPPacket)
+
+		var buf bytes.Buffer
+		if err := w.EncodeImage(&buf, "tiff"); err != nil { t.Fatal(err) }
+
+		w2 := NewWand()
+		if err := w2.DecodeImage(&buf); err != nil { t.Fatal(err) }
+		if w2.FrameCount() != pages { t.Fatalf("expected %d pages, got %d", pages, w2.FrameCount()) }
+		got := w2.Metadata()
+
+		if got.EXIF == nil { t.Fatalf("%d pages: EXIF was not preserved", pages) }
+		if tag, _ := got.EXIF.Get(ExifIFD0, ExifTagArtist); tag == nil || tag.String() != "Majokko" {
+			t.Errorf("%d pages: expected artist %q, got %v", pages, "Majokko", tag)
+		}
+		if w2.Orientation() != 6 {
+			t.Errorf("%d pages: expected orientation 6, got %d", pages, w2.Orientation())
+		}
+		for _, tt := range []struct{ ifd ExifIFD; id uint16 }{
+			{ExifIFDExif, ExifTagDateTimeOriginal},
+			{ExifIFDInterop, 1},
+			{ExifIFDGPS, 0},
+		} {
+			want, _ := md.EXIF.Get(tt.ifd, tt.id)
+			if tag, _ := got.EXIF.Get(tt.ifd, tt.id); tag == nil || tag.String() != want.String() {
+				t.Errorf("%d pages: %v tag %d: expected %v, got %v", pages, tt.ifd, tt.id, want, tag)
+			}
+		}
+		if !bytes.Equal(got.ICCProfile, md.ICCProfile) {
+			t.Errorf("%d pages: expected an ICC profile of %d bytes, got %d bytes", pages, len(md.ICCProfile), len(got.ICCProfile))
+		}
+		if !bytes.Equal(got.XMP, md.XMP) {
+			t.Errorf("%d pages: expected XMP %q, got %q", pages, md.XMP, got.XMP)
+		}
+	}
+}
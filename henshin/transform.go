@@ -0,0 +1,193 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// imageTransform is a lossless rotation or reflection of an image. The
+// image is first transposed, if requested, and then flipped.
+type imageTransform struct {
+	transpose, flipX, flipY bool
+}
+
+var (
+	transformFlop = imageTransform{flipX: true}
+	transformFlip = imageTransform{flipY: true}
+	transformRotate90 = imageTransform{transpose: true, flipX: true}
+	transformRotate180 = imageTransform{flipX: true, flipY: true}
+	transformRotate270 = imageTransform{transpose: true, flipY: true}
+	transformTranspose = imageTransform{transpose: true}
+	transformTransverse = imageTransform{transpose: true, flipX: true, flipY: true}
+)
+
+// orientationTransforms contains the transform that corrects each EXIF
+// orientation.
+var orientationTransforms = [9]imageTransform{
+	2: transformFlop,
+	3: transformRotate180,
+	4: transformFlip,
+	5: transformTranspose,
+	6: transformRotate90,
+	7: transformTransverse,
+	8: transformRotate270,
+}
+
+// rawPixels returns the pixel buffer of an image and the number of bytes
+// per pixel, if the image stores one pixel per fixed number of bytes.
+func rawPixels(im image.Image) (pix []byte, stride, bpp int, ok bool) {
+	switch im := im.(type) {
+		case *image.RGBA: return im.Pix, im.Stride, 4, true
+		case *image.NRGBA: return im.Pix, im.Stride, 4, true
+		case *image.RGBA64: return im.Pix, im.Stride, 8, true
+		case *image.NRGBA64: return im.Pix, im.Stride, 8, true
+		case *image.Gray: return im.Pix, im.Stride, 1, true
+		case *image.Gray16: return im.Pix, im.Stride, 2, true
+		case *image.Alpha: return im.Pix, im.Stride, 1, true
+		case *image.Alpha16: return im.Pix, im.Stride, 2, true
+		case *image.CMYK: return im.Pix, im.Stride, 4, true
+		case *image.Paletted: return im.Pix, im.Stride, 1, true
+	}
+	return
+}
+
+// newImageLike returns a new image with the same pixel format as im,
+// or an *image.RGBA if the format is not supported by rawPixels.
+func newImageLike(im image.Image, r image.Rectangle) image.Image {
+	switch im := im.(type) {
+		case *image.RGBA: return image.NewRGBA(r)
+		case *image.NRGBA: return image.NewNRGBA(r)
+		case *image.RGBA64: return image.NewRGBA64(r)
+		case *image.NRGBA64: return image.NewNRGBA64(r)
+		case *image.Gray: return image.NewGray(r)
+		case *image.Gray16: return image.NewGray16(r)
+		case *image.Alpha: return image.NewAlpha(r)
+		case *image.Alpha16: return image.NewAlpha16(r)
+		case *image.CMYK: return image.NewCMYK(r)
+		case *image.Paletted: return image.NewPaletted(r, append(color.Palette(nil), im.Palette...))
+	}
+	return image.NewRGBA(r)
+}
+
+// newCanvasLike returns a new image with bounds r filled with the color
+// bg (transparent if nil). The image has the same pixel format as im if
+// it can hold bg and colors drawn over it, and is otherwise an
+// *image.RGBA, or an *image.RGBA64 if im has 16 bits per channel.
+func newCanvasLike(im image.Image, r image.Rectangle, bg color.Color) draw.Image {
+	if bg == nil { bg = color.Transparent }
+
+	if p, ok := im.(*image.Paletted); ok {
+		if canvas := newPalettedCanvas(p, r, bg); canvas != nil { return canvas }
+	} else if _, _, _, ok := rawPixels(im); ok {
+		r1, g1, b1, a1 := bg.RGBA()
+		r2, g2, b2, a2 := im.ColorModel().Convert(bg).RGBA()
+		if r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2 {
+			canvas := newImageLike(im, r).(draw.Image)
+			draw.Draw(canvas, r, image.NewUniform(bg), image.Point{}, draw.Src)
+			return canvas
+		}
+	}
+
+	var canvas draw.Image
+	if modelInfo(im.ColorModel()).Depth == 16 {
+		canvas = image.NewRGBA64(r)
+	} else {
+		canvas = image.NewRGBA(r)
+	}
+	draw.Draw(canvas, r, image.NewUniform(bg), image.Point{}, draw.Src)
+	return canvas
+}
+
+// newPalettedCanvas returns a new paletted image with bounds r filled
+// with bg, which is added to a copy of the palette of p if it is not
+// already there. It returns nil if the palette is full, or if it has
+// translucent entries, since colors blended with them are not in the
+// palette.
+func newPalettedCanvas(p *image.Paletted, r image.Rectangle, bg color.Color) *image.Paletted {
+	pal := append(color.Palette(nil), p.Palette...)
+	r1, g1, b1, a1 := bg.RGBA()
+	idx := -1
+	for i, c := range pal {
+		r2, g2, b2, a2 := c.RGBA()
+		if a2 != 0 && a2 != 0xffff { return nil }
+		if idx == -1 && r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2 { idx = i }
+	}
+	if idx == -1 {
+		if len(pal) >= 256 { return nil }
+		idx = len(pal)
+		pal = append(pal, bg)
+	}
+
+	canvas := image.NewPaletted(r, pal)
+	for i := range canvas.Pix { canvas.Pix[i] = uint8(idx) }
+	return canvas
+}
+
+// apply returns a transformed copy of im, with its bounds starting at
+// the origin. The pixel format is preserved where possible.
+func (t imageTransform) apply(im image.Image) image.Image {
+	if _, _, _, ok := rawPixels(im); !ok {
+		im = cloneImage(im)
+	}
+
+	b := im.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if t.transpose { dw, dh = h, w }
+
+	dst := newImageLike(im, image.Rect(0, 0, dw, dh))
+	src, srcStride, bpp, _ := rawPixels(im)
+	pix, stride, _, _ := rawPixels(dst)
+
+	for y := 0; y < dh; y++ {
+		row := pix[y * stride:]
+		for x := 0; x < dw; x++ {
+			sx, sy := x, y
+			if t.transpose { sx, sy = y, x }
+			if t.flipX { sx = w - 1 - sx }
+			if t.flipY { sy = h - 1 - sy }
+
+			i := sy * srcStride + sx * bpp
+			copy(row[x * bpp:x * bpp + bpp], src[i:i + bpp])
+		}
+	}
+	return dst
+}
+
+// rotateImage returns a copy of im rotated clockwise by an arbitrary
+// angle in degrees. The image is enlarged to fit the rotated image, and
+// uncovered areas are filled with the background color bg. The pixel
+// format of im is kept if it can hold bg.
+func rotateImage(im image.Image, degrees float64, bg color.Color, strategy ResizeStrategy) image.Image {
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+
+	b := im.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	// Avoid growing the image due to rounding errors.
+	dw := int(math.Ceil(math.Abs(w * cos) + math.Abs(h * sin) - 1e-9))
+	dh := int(math.Ceil(math.Abs(w * sin) + math.Abs(h * cos) - 1e-9))
+
+	// Interpolated colors are not in the palette of paletted images.
+	like := im
+	if _, ok := im.(*image.Paletted); ok { like = emptyImage }
+	dst := newCanvasLike(like, image.Rect(0, 0, dw, dh), bg)
+
+	// Rotate around the center of the source image, then move it to the
+	// center of the destination image.
+	sx := float64(b.Min.X) + w / 2
+	sy := float64(b.Min.Y) + h / 2
+	dx, dy := float64(dw) / 2, float64(dh) / 2
+	s2d := f64.Aff3{
+		cos, -sin, dx - cos * sx + sin * sy,
+		sin, cos, dy - sin * sx - cos * sy,
+	}
+
+	strategy.Transform(dst, s2d, im, b, draw.Over, nil)
+	return dst
+}
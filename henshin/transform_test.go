@@ -0,0 +1,166 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+
+	"testing"
+)
+
+// TestAutoOrient tests that every EXIF orientation is corrected.
+func TestAutoOrient(t *testing.T) {
+	// An upright 3x2 image, with a distinct value in each pixel.
+	upright := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range upright.Pix {
+		upright.Pix[i] = uint8(i + 1)
+	}
+
+	for o := 1; o <= 8; o++ {
+		// Produce the stored image by undoing the correcting transform.
+		stored := image.Image(upright)
+		switch o {
+			case 6: stored = transformRotate270.apply(stored)
+			case 8: stored = transformRotate90.apply(stored)
+			default: stored = orientationTransforms[o].apply(stored)
+		}
+
+		w := NewWand()
+		w.SetImage(stored)
+		w.Metadata().EXIF = NewExif()
+		w.Metadata().EXIF.SetOrientation(o)
+		w.AutoOrient()
+
+		if w.Orientation() != 1 {
+			t.Errorf("orientation %d: expected orientation 1 but got %d", o, w.Orientation())
+		}
+
+		got, ok := w.Image().(*image.Gray)
+		if !ok {
+			t.Fatalf("orientation %d: expected *image.Gray but got %T", o, w.Image())
+		}
+		if got.Bounds() != upright.Bounds() {
+			t.Fatalf("orientation %d: expected bounds %v but got %v", o, upright.Bounds(), got.Bounds())
+		}
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 3; x++ {
+				if got.GrayAt(x, y) != upright.GrayAt(x, y) {
+					t.Errorf("orientation %d: pixel (%d, %d) is %v, expected %v", o, x, y, got.GrayAt(x, y), upright.GrayAt(x, y))
+				}
+			}
+		}
+	}
+}
+
+// TestTransformPalette tests that transforms keep the palette of an image.
+func TestTransformPalette(t *testing.T) {
+	pal := color.Palette{color.Black, color.White}
+	im := image.NewPaletted(image.Rect(0, 0, 2, 1), pal)
+	im.Pix[1] = 1
+
+	got, ok := transformFlop.apply(im).(*image.Paletted)
+	if !ok {
+		t.Fatalf("expected *image.Paletted")
+	}
+	if len(got.Palette) != 2 || got.Pix[0] != 1 || got.Pix[1] != 0 {
+		t.Errorf("unexpected result: %v %v", got.Palette, got.Pix)
+	}
+}
+
+// TestRotate tests rotating images by various angles.
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		degrees float64
+		w, h int
+	}{
+		{0, 40, 20},
+		{90, 20, 40},
+		{-90, 20, 40},
+		{180, 40, 20},
+		{450, 20, 40},
+		{45, 43, 43},
+	}
+
+	for _, tt := range tests {
+		w := NewWand()
+		w.NewImage(40, 20)
+		w.Rotate(tt.degrees, color.White, nil)
+		if w.Width() != tt.w || w.Height() != tt.h {
+			t.Errorf("rotate %v: expected %dx%d but got %dx%d", tt.degrees, tt.w, tt.h, w.Width(), w.Height())
+		}
+	}
+
+	// The corners of an image rotated by an arbitrary angle should be
+	// filled with the background color.
+	w := NewWand()
+	w.NewImage(40, 20)
+	w.Rotate(30, color.White, BiLinearStrategy)
+	if c := color.RGBAModel.Convert(w.Image().At(0, 0)); c != color.RGBAModel.Convert(color.White) {
+		t.Errorf("expected background at corner but got %v", c)
+	}
+}
+
+// TestRotateKeepsFormat tests that rotating an image by an arbitrary
+// angle keeps its pixel format when the background fits in it.
+func TestRotateKeepsFormat(t *testing.T) {
+	r := image.Rect(0, 0, 8, 6)
+	tests := []struct {
+		im image.Image
+		bg color.Color
+		want image.Image
+	}{
+		{image.NewGray(r), color.White, &image.Gray{}},
+		{image.NewGray16(r), color.Black, &image.Gray16{}},
+		{image.NewGray(r), nil, &image.RGBA{}},
+		{image.NewGray16(r), nil, &image.RGBA64{}},
+		{image.NewNRGBA64(r), nil, &image.NRGBA64{}},
+		{image.NewPaletted(r, color.Palette{color.Black, color.White}), color.White, &image.RGBA{}},
+	}
+
+	for _, tt := range tests {
+		got := rotateImage(tt.im, 30, tt.bg, BiLinearStrategy)
+		if gt, wt := reflect.TypeOf(got), reflect.TypeOf(tt.want); gt != wt {
+			t.Errorf("%T with background %v: got %v, want %v", tt.im, tt.bg, gt, wt)
+		}
+	}
+}
+
+// TestCoalesceKeepsFormat tests that coalescing frames keeps their pixel
+// format when they share one that can hold transparent pixels.
+func TestCoalesceKeepsFormat(t *testing.T) {
+	pal := color.Palette{color.Transparent, color.Black, color.White}
+	frames := func(newImage func(r image.Rectangle) image.Image) *Animation {
+		a := NewAnimation(newImage(image.Rect(0, 0, 4, 4)))
+		a.Frames = append(a.Frames, &Frame{Image: newImage(image.Rect(1, 1, 3, 3)), Disposal: DisposePrevious})
+		return a
+	}
+
+	tests := []struct {
+		a *Animation
+		want image.Image
+	}{
+		{frames(func(r image.Rectangle) image.Image { return image.NewPaletted(r, pal) }), &image.Paletted{}},
+		{frames(func(r image.Rectangle) image.Image { return image.NewNRGBA64(r) }), &image.NRGBA64{}},
+		{frames(func(r image.Rectangle) image.Image { return image.NewGray16(r) }), &image.RGBA64{}},
+		{frames(func(r image.Rectangle) image.Image { return image.NewGray(r) }), &image.RGBA{}},
+	}
+
+	for _, tt := range tests {
+		tt.a.Coalesce()
+		for i, f := range tt.a.Frames {
+			if gt, wt := reflect.TypeOf(f.Image), reflect.TypeOf(tt.want); gt != wt {
+				t.Errorf("frame %d: got %v, want %v", i, gt, wt)
+			}
+		}
+	}
+
+	// Frames with different palettes are promoted.
+	a := frames(func(r image.Rectangle) image.Image { return image.NewPaletted(r, pal) })
+	a.Frames[1].Image.(*image.Paletted).Palette = color.Palette{color.Transparent, color.White}
+	a.Coalesce()
+	if _, ok := a.Frames[1].Image.(*image.RGBA); !ok {
+		t.Errorf("got %T, want *image.RGBA", a.Frames[1].Image)
+	}
+}
@@ -2,6 +2,31 @@
 
 package henshin
 
+import (
+	"image"
+)
+
+type opaquer interface {
+	Opaque() bool
+}
+
+// isOpaque returns whether or not the image is fully opaque.
+func isOpaque(im image.Image) bool {
+	if o, ok := im.(opaquer); ok {
+		return o.Opaque()
+	}
+	b := im.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			_, _, _, a := im.At(x, y).RGBA()
+			if a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // fmtExpand replaces %[var] or %v in the string based on the mapping function.
 func fmtExpand(s string, mapping func(string) string) string {
 	var buf []byte
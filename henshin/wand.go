@@ -3,11 +3,17 @@
 package henshin
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
 	"image"
+	"image/color"
 	"io"
+	"math"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/image/draw"
 )
@@ -15,18 +21,41 @@ import (
 var emptyImage = image.NewRGBA(image.Rect(0, 0, 0, 0))
 
 type Wand struct {
-	im image.Image
+	anim *Animation
 	md *Metadata
 
+	// config is the configuration read by DecodeImageConfig, which is
+	// used while there is no decoded image. configFrames is the number
+	// of frames it counted, or 0 if they weren't counted.
+	config *image.Config
+	configFrames int
+	// format is the name of the codec the image was read with.
+	format string
+	// fileName and fileSize are the path and size in bytes of the file
+	// the image was read from. fileSize is 0 if it is not known.
+	fileName string
+	fileSize int64
+
 	decOpt *DecodeOptions
 	encOpt *EncodeOptions
+	// skipMetadata is set if images are read without their metadata.
+	skipMetadata bool
+	// countFrames is set if DecodeImageConfig counts frames.
+	countFrames bool
+
+	// codecParams contains the comma-separated parameters for each
+	// codec, by codec name.
+	codecParams map[string]string
+
+	keepJPEG bool
+	jpeg *jpegLossless
 }
 
 func NewWand() *Wand {
 	md := &Metadata{}
 
 	return &Wand{
-		im: nil,
+		anim: nil,
 		md: md,
 		decOpt: &DecodeOptions{
 			Metadata: md,
@@ -39,59 +68,235 @@ func NewWand() *Wand {
 }
 
 func (w *Wand) NewImage(iw, ih int) {
-	w.im = image.NewRGBA(image.Rect(0, 0, iw, ih))
+	w.anim = NewAnimation(image.NewRGBA(image.Rect(0, 0, iw, ih)))
 }
 
 func (w *Wand) SetImage(im image.Image) {
-	w.im = im
+	w.anim = NewAnimation(im)
 }
 
+// Image returns the first frame of the image.
 func (w *Wand) Image() image.Image {
-	return w.im
+	if w.anim == nil { return nil }
+	return w.anim.First()
+}
+
+func (w *Wand) SetFrames(a *Animation) {
+	w.anim = a
+}
+
+func (w *Wand) Frames() *Animation {
+	return w.anim
+}
+
+func (w *Wand) FrameCount() int {
+	if w.anim == nil { return 0 }
+	return len(w.anim.Frames)
+}
+
+// frames returns the number of frames in the image, which were counted by
+// DecodeImageConfig if the image wasn't decoded.
+func (w *Wand) frames() int {
+	if w.anim == nil && w.config != nil { return w.configFrames }
+	return w.FrameCount()
+}
+
+func (w *Wand) SetLoopCount(n int) {
+	if w.anim != nil {
+		w.anim.LoopCount = n
+	}
 }
 
 func (w *Wand) DecodeImage(r io.Reader) error {
-	im, err := Decode(r, w.decOpt)
+	var data []byte
+	if w.keepJPEG {
+		var err error
+		data, err = io.ReadAll(r)
+		if err != nil { return err }
+		r = bytes.NewReader(data)
+	}
+
+	pkr, ok := r.(peekableReader)
+	if !ok { pkr = bufio.NewReader(r) }
+
+	d, err := detect(pkr)
+	if err != nil { return err }
+
+	a, err := DecodeFrames(pkr, w.decodeOptions())
+	if err != nil { return err }
+	w.anim = a
+	w.config = nil
+	w.format = d.Name()
+
+	if w.keepJPEG { w.readLosslessJPEG(data) }
+	return nil
+}
+
+// DecodeImageConfig reads the format, dimensions, color model and
+// metadata of an image without decoding its pixels. The wand has no
+// frames afterwards, but Width, Height and ColorModel describe the image.
+func (w *Wand) DecodeImageConfig(r io.Reader) error {
+	pkr, ok := r.(peekableReader)
+	if !ok { pkr = bufio.NewReader(r) }
+
+	d, err := detect(pkr)
 	if err != nil { return err }
-	w.im = im
+
+	var cfg image.Config
+	frames := 1
+	fd, withFrames := d.(DecoderWithFrames)
+	switch fc, ok := d.(DecoderWithFrameCount); {
+		case withFrames && w.countFrames && ok:
+			cfg, frames, err = fc.DecodeFrameCount(pkr, w.decodeOptions())
+		case withFrames && w.countFrames:
+			// The frames can only be counted by decoding them.
+			var a *Animation
+			a, err = fd.DecodeFrames(pkr, w.decodeOptions())
+			if err == nil {
+				cfg = image.Config{ColorModel: a.First().ColorModel(), Width: a.Width, Height: a.Height}
+				frames = len(a.Frames)
+			}
+		default:
+			cfg, err = d.DecodeConfig(pkr, w.decodeOptions())
+			if withFrames { frames = 0 }
+	}
+	if err != nil { return err }
+	w.anim, w.jpeg = nil, nil
+	w.config = &cfg
+	w.configFrames = frames
+	w.format = d.Name()
 	return nil
 }
 
+// SetCountFrames sets whether DecodeImageConfig counts the frames of
+// multi-frame images, for the "frames" property. The frames aren't
+// decoded, but the whole image may have to be read to count them, so they
+// aren't counted by default.
+func (w *Wand) SetCountFrames(enable bool) {
+	w.countFrames = enable
+}
+
+// SetReadMetadata sets whether the metadata of images is read along with
+// them, which it is by default. Reading images is faster without it.
+func (w *Wand) SetReadMetadata(enable bool) {
+	w.skipMetadata = !enable
+}
+
+// decodeOptions returns the options images are decoded with.
+func (w *Wand) decodeOptions() *DecodeOptions {
+	if !w.skipMetadata { return w.decOpt }
+
+	o := *w.decOpt
+	o.Metadata = nil
+	return &o
+}
+
 func (w *Wand) EncodeImage(wr io.Writer, codec string) error {
-	if w.im == nil {
+	var err error
+	w.encOpt.EncoderSpecific, err = w.codecSpecific(codec)
+	if err != nil { return err }
+
+	if w.anim == nil {
 		return Encode(codec, wr, emptyImage, w.encOpt)
 	}
-	return Encode(codec, wr, w.im, w.encOpt) 
+	if ok, err := w.encodeLosslessJPEG(wr, codec); ok { return err }
+	return EncodeFrames(codec, wr, w.anim, w.encOpt)
 }
 
-func (w *Wand) ReadImage(path string) error {
-	if path == "-" {
-		return w.DecodeImage(os.Stdin)
+// eachFrame coalesces the image and replaces each frame with the
+// result of fn.
+func (w *Wand) eachFrame(fn func(im image.Image) image.Image) {
+	if w.anim == nil { return }
+
+	w.anim.Coalesce()
+	for _, f := range w.anim.Frames {
+		f.Image = fn(f.Image)
+	}
+
+	b := w.anim.Frames[0].Image.Bounds()
+	w.anim.Width = b.Dx()
+	w.anim.Height = b.Dy()
+}
+
+// openImage opens the image file at path, or standard input if path is
+// "-", and records its name and size.
+func (w *Wand) openImage(path string) (*os.File, error) {
+	f := os.Stdin
+	if path != "-" {
+		var err error
+		f, err = os.Open(path)
+		if err != nil { return nil, err }
 	}
 
-	f, err := os.Open(path)
+	w.fileName, w.fileSize = path, 0
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+		w.fileSize = fi.Size()
+	}
+	return f, nil
+}
+
+func (w *Wand) ReadImage(path string) error {
+	f, err := w.openImage(path)
 	if err != nil { return err }
+	if f != os.Stdin { defer f.Close() }
 	return w.DecodeImage(f)
 }
 
-func (w *Wand) WriteImage(path string) error {
-	codecName := "png"
+// ReadImageConfig reads the format, dimensions, color model and metadata
+// of the image at path without decoding its pixels. See
+// DecodeImageConfig.
+func (w *Wand) ReadImageConfig(path string) error {
+	f, err := w.openImage(path)
+	if err != nil { return err }
+	if f != os.Stdin { defer f.Close() }
+	return w.DecodeImageConfig(f)
+}
+
+// ParseOutputPath returns the name of the codec an image written to path
+// is encoded with, the path with any "codec:" prefix removed, and any
+// codec parameters. The codec is taken from the prefix or the file
+// extension, and defaults to PNG. Parameters are given as a query string
+// after the prefix or extension, as in "out.png?zlib_level=9&other=value",
+// and returned separated by commas, as CodecWithParamParser expects.
+// Otherwise, "?" is part of the file name.
+func ParseOutputPath(path string) (codecName string, file string, params string) {
+	if q := strings.LastIndexByte(path, '?'); q != -1 && strings.ContainsRune(path[q:], '=') && !strings.ContainsRune(path[q:], '/') {
+		if codecName, file, ok := parseOutputCodec(path[:q]); ok {
+			return codecName, file, strings.ReplaceAll(path[q+1:], "&", ",")
+		}
+	}
 
+	codecName, file, _ = parseOutputCodec(path)
+	return codecName, file, ""
+}
+
+// parseOutputCodec returns the name of the codec an image written to path
+// is encoded with and the path with any "codec:" prefix removed. If path
+// has no prefix or extension naming a codec, PNG is returned and ok is
+// false.
+func parseOutputCodec(path string) (codecName string, file string, ok bool) {
 	hasColon := strings.IndexByte(path, ':')
 	hasExt := strings.LastIndexByte(path, '.')
 	if hasColon != -1 {
 		_, err := NewCodec(path[:hasColon])
 		if err == nil {
-			codecName = path[:hasColon]
-			path = path[hasColon+1:]
+			return path[:hasColon], path[hasColon+1:], true
 		}
 	} else if hasExt != -1 {
 		ext := path[hasExt+1:]
 		_, err := NewCodec(ext)
 		if err == nil {
-			codecName = ext
+			return ext, path, true
 		}
 	}
+	return "png", path, false
+}
+
+func (w *Wand) WriteImage(path string) error {
+	codecName, path, params := ParseOutputPath(path)
+	if params != "" {
+		if err := w.DefineCodecParams(codecName, params); err != nil { return err }
+	}
 
 	if path == "-" {
 		return w.EncodeImage(os.Stdout, codecName)
@@ -102,6 +307,38 @@ func (w *Wand) WriteImage(path string) error {
 	return w.EncodeImage(f, codecName)
 }
 
+// DefineCodecParams adds comma-separated parameters, such as
+// "progressive,restart=8", for the named codec. They are parsed with the
+// codec's ParseParams method and passed to its encoder in
+// EncoderSpecific. An error is returned if the codec doesn't take
+// parameters or they are invalid.
+func (w *Wand) DefineCodecParams(codec string, params string) error {
+	c, err := NewCodec(codec)
+	if err != nil { return err }
+	pp, ok := c.(CodecWithParamParser)
+	if !ok { return ErrNoCodecParams(c.Name()) }
+
+	if prev := w.codecParams[c.Name()]; prev != "" {
+		params = prev + "," + params
+	}
+	if _, err := pp.ParseParams(params); err != nil { return err }
+
+	if w.codecParams == nil { w.codecParams = map[string]string{} }
+	w.codecParams[c.Name()] = params
+	return nil
+}
+
+// codecSpecific returns the parsed parameters for the named codec, or nil
+// if there are none.
+func (w *Wand) codecSpecific(codec string) (any, error) {
+	c, err := NewCodec(codec)
+	if err != nil { return nil, nil }
+
+	params, ok := w.codecParams[c.Name()]
+	if !ok { return nil, nil }
+	return c.(CodecWithParamParser).ParseParams(params)
+}
+
 func (w *Wand) AddComment(comment string) {
 	w.md.Comments = append(w.md.Comments, comment)
 }
@@ -122,21 +359,48 @@ func (w *Wand) Strip() {
 	*w.md = Metadata{}
 }
 
+// SetDensity sets the physical pixel density of the image.
+func (w *Wand) SetDensity(x, y float64, unit DensityUnit) {
+	w.md.Density = &Density{X: x, Y: y, Unit: unit}
+}
+
 func (w *Wand) Width() int {
-	if w.im == nil { return 0 }
-	return w.im.Bounds().Dx()
+	if w.anim == nil {
+		if w.config != nil { return w.config.Width }
+		return 0
+	}
+	return w.anim.Width
 }
 
 func (w *Wand) Height() int {
-	if w.im == nil { return 0 }
-	return w.im.Bounds().Dy()
+	if w.anim == nil {
+		if w.config != nil { return w.config.Height }
+		return 0
+	}
+	return w.anim.Height
+}
+
+// ColorModel returns the color model of the first frame of the image, or
+// nil if there is no image.
+func (w *Wand) ColorModel() color.Model {
+	if w.anim == nil {
+		if w.config != nil { return w.config.ColorModel }
+		return nil
+	}
+	return w.Image().ColorModel()
+}
+
+// Format returns the name of the codec the image was read with, or an
+// empty string if it was not read from a file.
+func (w *Wand) Format() string {
+	return w.format
 }
 
 func (w *Wand) Resize(iw, ih int, strategy ResizeStrategy) {
 	if w.Width() == iw && w.Height() == ih { return }
 
 	if (w.Width() == 0 && w.Height() == 0) || (iw == 0 && ih == 0) {
-		w.im = image.NewRGBA(image.Rect(0, 0, iw, ih))
+		w.NewImage(iw, ih)
 		return
 	}
 
@@ -148,12 +412,20 @@ func (w *Wand) Resize(iw, ih int, strategy ResizeStrategy) {
 		ih = int(float64(iw) * ratio)
 	}
 
-	newIm := image.NewRGBA(image.Rect(0, 0, iw, ih))
-
 	if iw < 0 || ih < 0 { return }
 
-	strategy.Scale(newIm, newIm.Bounds(), w.im, w.im.Bounds(), draw.Over, nil)
-	w.im = newIm
+	w.eachFrame(func(im image.Image) image.Image {
+		var newIm draw.Image
+		if _, ok := im.(*image.Paletted); ok && strategy != NearestStrategy {
+			// Interpolated colors are not in the palette, so leave
+			// palettizing them to the encoder.
+			newIm = image.NewNRGBA(image.Rect(0, 0, iw, ih))
+		} else {
+			newIm = newImageLike(im, image.Rect(0, 0, iw, ih)).(draw.Image)
+		}
+		strategy.Scale(newIm, newIm.Bounds(), im, im.Bounds(), draw.Src, nil)
+		return newIm
+	})
 }
 
 func (w *Wand) ResizeArea(area int, strategy ResizeStrategy) {
@@ -165,42 +437,205 @@ func (w *Wand) Crop(iw, ih, xoff, yoff int) {
 	if iw == -1 { iw = w.Width() }
 	if ih == -1 { ih = w.Height() }
 	if w.Width() == iw && w.Height() == ih && xoff == 0 && yoff == 0 { return }
+	if w.cropLosslessJPEG(image.Rect(xoff, yoff, xoff + iw, yoff + ih)) { return }
+
+	if (w.Width() == 0 && w.Height() == 0) || (iw == 0 && ih == 0) {
+		w.NewImage(iw, ih)
+		return
+	}
+
+	w.eachFrame(func(im image.Image) image.Image {
+		r := image.Rect(xoff, yoff, xoff + iw, yoff + ih)
+		var newIm draw.Image
+		if _, ok := im.(*image.Paletted); ok && !r.In(im.Bounds()) {
+			// The zero index is not necessarily transparent.
+			newIm = newCanvasLike(im, image.Rect(0, 0, iw, ih), nil)
+		} else {
+			newIm = newImageLike(im, image.Rect(0, 0, iw, ih)).(draw.Image)
+		}
+		draw.Copy(newIm, newIm.Bounds().Min, im, r, draw.Src, nil)
+		return newIm
+	})
+}
+
+// CropAnchor crops the image to iw x ih, with the region positioned
+// relative to the anchor. The offsets move the region away from the edge
+// the anchor refers to, so GravityCenter with zero offsets crops the center
+// of the image.
+func (w *Wand) CropAnchor(iw, ih, xoff, yoff int, anchor Gravity) {
+	if iw == -1 { iw = w.Width() }
+	if ih == -1 { ih = w.Height() }
+
+	x, y := anchor.offset(w.Width(), w.Height(), iw, ih, xoff, yoff)
+	w.Crop(iw, ih, x, y)
+}
+
+// Extent changes the size of the image to iw x ih without scaling it.
+// The image is positioned relative to the anchor, and uncovered areas are
+// filled with the background color bg (transparent if nil). The pixel
+// format of the image is kept if it can hold bg.
+func (w *Wand) Extent(iw, ih int, bg color.Color, anchor Gravity) {
+	if iw == -1 { iw = w.Width() }
+	if ih == -1 { ih = w.Height() }
+	if w.Width() == iw && w.Height() == ih { return }
 
-	newIm := image.NewRGBA(image.Rect(0, 0, iw, ih))
 	if (w.Width() == 0 && w.Height() == 0) || (iw == 0 && ih == 0) {
-		w.im = newIm
+		w.NewImage(iw, ih)
 		return
 	}
 
-	draw.Copy(newIm, newIm.Bounds().Min, w.im, image.Rect(xoff, yoff, xoff + iw, yoff + ih), draw.Over, nil)
-	w.im = newIm
+	x, y := anchor.offset(iw, ih, w.Width(), w.Height(), 0, 0)
+	w.eachFrame(func(im image.Image) image.Image {
+		newIm := newCanvasLike(im, image.Rect(0, 0, iw, ih), bg)
+		b := im.Bounds()
+		draw.Draw(newIm, b.Sub(b.Min).Add(image.Pt(x, y)), im, b.Min, draw.Over)
+		return newIm
+	})
+}
+
+// Orientation returns the EXIF orientation of the image, from 1 to 8.
+// Images without EXIF data have an orientation of 1.
+func (w *Wand) Orientation() int {
+	if w.md.EXIF == nil { return 1 }
+	return w.md.EXIF.Orientation()
 }
 
-func (w *Wand) CropAnchor(iw, ih int, anchor string) {
-	panic("TODO")
+// AutoOrient rotates and flips the image as specified by its EXIF
+// orientation, then resets the orientation to 1.
+func (w *Wand) AutoOrient() {
+	o := w.Orientation()
+	if o <= 1 { return }
+
+	w.transform(orientationTransforms[o])
+	w.md.EXIF.SetOrientation(1)
+}
+
+// transform applies a lossless rotation or reflection to every frame.
+func (w *Wand) transform(t imageTransform) {
+	if w.transformLosslessJPEG(t) { return }
+	w.eachFrame(t.apply)
+}
+
+// Flip mirrors the image vertically.
+func (w *Wand) Flip() {
+	w.transform(transformFlip)
+}
+
+// Flop mirrors the image horizontally.
+func (w *Wand) Flop() {
+	w.transform(transformFlop)
+}
+
+// Transpose mirrors the image along the diagonal from the top left to
+// the bottom right corner.
+func (w *Wand) Transpose() {
+	w.transform(transformTranspose)
+}
+
+// Transverse mirrors the image along the diagonal from the top right to
+// the bottom left corner.
+func (w *Wand) Transverse() {
+	w.transform(transformTransverse)
+}
+
+// Rotate rotates the image clockwise by the specified number of degrees.
+// Multiples of 90 degrees are rotated losslessly. Otherwise, the image is
+// enlarged to fit, uncovered areas are filled with the background color
+// bg (transparent if nil), and pixels are interpolated using strategy.
+func (w *Wand) Rotate(degrees float64, bg color.Color, strategy ResizeStrategy) {
+	degrees = math.Mod(degrees, 360)
+	if degrees < 0 { degrees += 360 }
+
+	switch degrees {
+		case 0: return
+		case 90: w.transform(transformRotate90)
+		case 180: w.transform(transformRotate180)
+		case 270: w.transform(transformRotate270)
+		default:
+			if strategy == nil { strategy = BiLinearStrategy }
+			w.eachFrame(func(im image.Image) image.Image {
+				return rotateImage(im, degrees, bg, strategy)
+			})
+	}
+}
+
+// Quantize reduces the image to at most n colors, from 1 to 256, using
+// the specified dithering method. Every frame shares the same palette.
+func (w *Wand) Quantize(n int, dither Dither) {
+	if w.anim == nil { return }
+	if n < 1 { n = 1 }
+	if n > 256 { n = 256 }
+
+	var hist map[[4]uint8]int
+	for _, f := range w.anim.Frames {
+		hist = colorHistogram(hist, f.Image)
+	}
+
+	pal := medianCut(hist, n)
+	for _, f := range w.anim.Frames {
+		f.Image = palettize(f.Image, pal, dither)
+	}
+}
+
+// ConvertToSRGB converts the image from its embedded ICC profile to sRGB
+// and removes the profile. Images without a profile are assumed to be
+// sRGB already. Only matrix/TRC profiles are supported.
+func (w *Wand) ConvertToSRGB() error {
+	if w.md.ICCProfile == nil || w.anim == nil { return nil }
+
+	p, err := parseICCProfile(w.md.ICCProfile)
+	if err != nil { return err }
+
+	sc := newSRGBConverter(p)
+	for _, f := range w.anim.Frames {
+		f.Image = sc.apply(f.Image)
+	}
+	w.md.ICCProfile = nil
+	w.md.Gamma = 0
+	w.md.Chromaticities = nil
+	return nil
 }
 
 func (w *Wand) ForceRGBA() {
-	if w.im != nil {
-		newIm := image.NewRGBA(w.im.Bounds())
-		draw.Copy(newIm, newIm.Bounds().Min, w.im, w.im.Bounds(), draw.Over, nil)
-		w.im = newIm
+	if w.anim != nil {
+		for _, f := range w.anim.Frames {
+			f.Image = cloneImage(f.Image)
+		}
 	}
 }
 
 func (w *Wand) Clone() *Wand {
-	var newIm draw.Image
+	var newAnim *Animation
 
-	if w.im != nil {
-		newIm = image.NewRGBA(w.im.Bounds())
-		draw.Copy(newIm, newIm.Bounds().Min, w.im, w.im.Bounds(), draw.Over, nil)
+	if w.anim != nil {
+		newAnim = w.anim.Clone()
 	}
 
 	newMd := w.md.Clone()
 
+	var newParams map[string]string
+	if w.codecParams != nil {
+		newParams = make(map[string]string, len(w.codecParams))
+		for k, v := range w.codecParams {
+			newParams[k] = v
+		}
+	}
+
+	var newConfig *image.Config
+	if w.config != nil {
+		cfg := *w.config
+		newConfig = &cfg
+	}
+
 	return &Wand{
-		im: newIm,
+		anim: newAnim,
 		md: newMd,
+		config: newConfig,
+		configFrames: w.configFrames,
+		format: w.format,
+		fileName: w.fileName,
+		fileSize: w.fileSize,
+		codecParams: newParams,
 
 		decOpt: &DecodeOptions{
 			Metadata: newMd,
@@ -209,14 +644,19 @@ func (w *Wand) Clone() *Wand {
 			Metadata: newMd,
 			CompressionLevel: w.encOpt.CompressionLevel,
 		},
+		skipMetadata: w.skipMetadata,
+		countFrames: w.countFrames,
+		keepJPEG: w.keepJPEG,
+		jpeg: w.cloneLosslessJPEG(newAnim),
 	}
 }
 
 func (w *Wand) Hash() uint64 {
-	if w.im == nil || (w.Width() == 0 && w.Height() == 0) { return 0 }
+	if w.anim == nil || (w.Width() == 0 && w.Height() == 0) { return 0 }
 
+	im := w.Image()
 	smallIm := image.NewGray(image.Rect(0, 0, 9, 8))
-	NearestStrategy.Scale(smallIm, smallIm.Bounds(), w.im, w.im.Bounds(), draw.Over, nil)
+	NearestStrategy.Scale(smallIm, smallIm.Bounds(), im, im.Bounds(), draw.Over, nil)
 	return diffHash(smallIm)
 }
 
@@ -233,12 +673,72 @@ func (w *Wand) property(key string) (val string) {
 		case "w", "width": val = strconv.Itoa(w.Width())
 		case "h", "height": val = strconv.Itoa(w.Height())
 		case "H", "hash": val = strconv.FormatInt(int64(w.Hash()), 10)
-		case "J", "json":
-			val = `{"width":` + strconv.Itoa(w.Width()) + `,"height":` + strconv.Itoa(w.Height()) + `,"hash":` + strconv.FormatInt(int64(w.Hash()), 10) + `}`
+		case "J", "json": val = w.propertiesJSON()
+		case "m", "format": val = w.format
+		case "n", "frames": val = strconv.Itoa(w.frames())
+		case "f", "filename": val = w.fileName
+		case "b", "size":
+			if w.fileSize > 0 {
+				val = strconv.FormatInt(w.fileSize, 10)
+			}
+		case "z", "depth", "colorspace", "type", "A", "has-alpha":
+			m := w.ColorModel()
+			if m == nil { break }
+			info := modelInfo(m)
+			info.Alpha = w.hasAlpha()
+			switch key {
+				case "z", "depth": val = strconv.Itoa(info.Depth)
+				case "colorspace": val = info.Colorspace(m)
+				case "type": val = info.Type(m)
+				default: val = strconv.FormatBool(info.Alpha)
+			}
 		case "c", "comment":
 			if len(w.md.Comments) > 0 {
 				val = w.md.Comments[0]
 			}
+		case "x", "y", "density":
+			if d := w.md.Density; d != nil {
+				x, y := strconv.FormatFloat(d.X, 'g', -1, 64), strconv.FormatFloat(d.Y, 'g', -1, 64)
+				switch key {
+					case "x": val = x
+					case "y": val = y
+					default: val = x + "x" + y
+				}
+			}
+		case "U", "units":
+			if w.md.Density != nil {
+				val = w.md.Density.Unit.String()
+			}
+		case "gamma":
+			if w.md.Gamma != 0 {
+				val = strconv.FormatFloat(w.md.Gamma, 'g', -1, 64)
+			}
+		case "chromaticity":
+			if c := w.md.Chromaticities; c != nil {
+				f := func(x, y float64) string {
+					return "(" + strconv.FormatFloat(x, 'g', -1, 64) + "," + strconv.FormatFloat(y, 'g', -1, 64) + ")"
+				}
+				val = "white" + f(c.WhiteX, c.WhiteY) + " red" + f(c.RedX, c.RedY) +
+					" green" + f(c.GreenX, c.GreenY) + " blue" + f(c.BlueX, c.BlueY)
+			}
+		case "rendering-intent":
+			if w.md.RenderingIntent != RenderingIntentNone {
+				val = w.md.RenderingIntent.String()
+			}
+		case "modified":
+			if !w.md.ModTime.IsZero() {
+				val = w.md.ModTime.Format(time.RFC3339)
+			}
+		case "significant-bits":
+			if sb := w.md.SignificantBits; sb != [4]uint8{} {
+				val = strconv.Itoa(int(sb[0])) + "," + strconv.Itoa(int(sb[1])) + "," + strconv.Itoa(int(sb[2])) + "," + strconv.Itoa(int(sb[3]))
+			}
+		case "background":
+			if w.md.Background != nil {
+				c := color.NRGBAModel.Convert(w.md.Background).(color.NRGBA)
+				val = "#" + hex.EncodeToString([]byte{c.R, c.G, c.B, c.A})
+			}
+		case "xmp": val = string(w.md.XMP)
 		case "%": val = "%"
 		case ";": val = ","
 	}
@@ -249,6 +749,13 @@ func (w *Wand) property(key string) (val string) {
 			if err == nil && int(idx) < len(w.md.Comments) {
 				val = w.md.Comments[idx]
 			}
+		} else if strings.HasPrefix(key, "xmp:") && w.md.XMP != nil {
+			props, err := ParseXMP(w.md.XMP)
+			if err == nil {
+				val = props[key[len("xmp:"):]]
+			}
+		} else if strings.HasPrefix(key, "text:") {
+			val, _ = w.md.Text.GetString(key[len("text:"):])
 		}
 	}
 	return
@@ -257,3 +764,68 @@ func (w *Wand) property(key string) (val string) {
 func (w *Wand) FormatString(fmt string) (ret string) {
 	return fmtExpand(fmt, w.property)
 }
+
+// pixelProperties are the properties that can only be determined from
+// the decoded image, rather than from the image header.
+var pixelProperties = map[string]bool{
+	"H": true, "hash": true,
+	"J": true, "json": true,
+	// Whether the alpha channel is used depends on the pixels.
+	"A": true, "has-alpha": true,
+	"type": true,
+}
+
+// metadataPrefixes are the prefixes of properties that are read from the
+// image metadata, such as "%[text:Author]". Properties read from the
+// metadata without a prefix are listed in metadataProperties.
+var metadataPrefixes = []string{"C:", "comment:", "xmp:", "text:"}
+
+// metadataProperties are the properties that are read from the image
+// metadata.
+var metadataProperties = map[string]bool{
+	"J": true, "json": true,
+	"c": true, "comment": true,
+	"x": true, "y": true, "density": true,
+	"U": true, "units": true,
+	"gamma": true, "chromaticity": true, "rendering-intent": true,
+	"modified": true, "significant-bits": true, "background": true,
+	"xmp": true,
+}
+
+// FormatStringNeedsMetadata reports whether any property in fmt is read
+// from the image metadata, so that it cannot be expanded if the image was
+// read without it. See SetReadMetadata.
+func FormatStringNeedsMetadata(fmt string) (ret bool) {
+	fmtExpand(fmt, func(key string) string {
+		if metadataProperties[key] { ret = true }
+		for _, prefix := range metadataPrefixes {
+			if strings.HasPrefix(key, prefix) { ret = true }
+		}
+		return ""
+	})
+	return
+}
+
+// FormatStringNeedsPixels reports whether any property in fmt needs the
+// image to be decoded, so that it cannot be expanded after only reading
+// the image header with ReadImageConfig.
+func FormatStringNeedsPixels(fmt string) (ret bool) {
+	fmtExpand(fmt, func(key string) string {
+		if pixelProperties[key] { ret = true }
+		return ""
+	})
+	return
+}
+
+// FormatStringNeedsFrameCount reports whether any property in fmt needs
+// the number of frames in the image, so that they have to be counted if
+// only the image header is read. See SetCountFrames.
+func FormatStringNeedsFrameCount(fmt string) (ret bool) {
+	fmtExpand(fmt, func(key string) string {
+		switch key {
+			case "n", "frames", "J", "json": ret = true
+		}
+		return ""
+	})
+	return
+}
@@ -0,0 +1,377 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+
+	"testing"
+)
+
+// TestNativeFormats tests that Wand operations keep the pixel format of
+// the image.
+func TestNativeFormats(t *testing.T) {
+	r := image.Rect(0, 0, 8, 6)
+	images := []image.Image{
+		image.NewGray(r),
+		image.NewGray16(r),
+		image.NewNRGBA64(r),
+		image.NewPaletted(r, color.Palette{color.Black, color.White}),
+	}
+
+	for _, im := range images {
+		name := fmt.Sprintf("%T", im)
+		pix, _, _, _ := rawPixels(im)
+		for i := range pix {
+			pix[i] = uint8(i * 37)
+		}
+		if p, ok := im.(*image.Paletted); ok {
+			for i := range p.Pix {
+				p.Pix[i] %= 2
+			}
+		}
+
+		ops := map[string]func(w *Wand){
+			"crop": func(w *Wand) { w.Crop(4, 4, 1, 1) },
+			"resize": func(w *Wand) { w.Resize(4, 3, NearestStrategy) },
+			"clone": func(w *Wand) { w.SetFrames(w.Clone().Frames()) },
+		}
+		for opName, op := range ops {
+			w := NewWand()
+			w.SetImage(im)
+			op(w)
+			if reflect.TypeOf(w.Image()) != reflect.TypeOf(im) {
+				t.Errorf("%s: %s returned %T", name, opName, w.Image())
+			}
+		}
+
+		// PNG supports each of these formats, so encoding should be
+		// lossless.
+		w := NewWand()
+		w.SetImage(im)
+		var buf bytes.Buffer
+		if err := w.EncodeImage(&buf, "png"); err != nil { t.Fatal(err) }
+
+		w = NewWand()
+		if err := w.DecodeImage(&buf); err != nil { t.Fatal(err) }
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				r1, g1, b1, a1 := im.At(x, y).RGBA()
+				r2, g2, b2, a2 := w.Image().At(x, y).RGBA()
+				if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+					t.Fatalf("%s: pixel (%d, %d) changed from %v to %v", name, x, y, im.At(x, y), w.Image().At(x, y))
+				}
+			}
+		}
+	}
+}
+
+// TestCodecParams tests that codec parameters are parsed and passed to
+// the codec when encoding.
+func TestCodecParams(t *testing.T) {
+	for path, want := range map[string][3]string{
+		"gif:out.img?colors=2&dither=none": {"gif", "out.img", "colors=2,dither=none"},
+		"out.png?zlib_level=9": {"png", "out.png", "zlib_level=9"},
+		"a?b=c.png": {"png", "a?b=c.png", ""},
+		"what?x=1": {"png", "what?x=1", ""},
+	} {
+		codec, file, params := ParseOutputPath(path)
+		if got := [3]string{codec, file, params}; got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "a?b=c.png")
+	w := NewWand()
+	w.SetImage(image.NewGray(image.Rect(0, 0, 2, 2)))
+	if err := w.WriteImage(path); err != nil { t.Fatal(err) }
+	if err := w.ReadImage(path); err != nil { t.Fatal(err) }
+
+	w = NewWand()
+	if err := w.DefineCodecParams("qoi", "x=1"); err == nil {
+		t.Fatalf("expected an error defining parameters for a codec without any")
+	}
+	if err := w.DefineCodecParams("png", "zstd_level=3"); err == nil {
+		t.Fatalf("expected an error defining a zstd level for PNG")
+	}
+	for codec, params := range map[string]string{
+		"gif": "colors=2,dither=none",
+		"tif": "compression=deflate,predictor",
+		"zng": "zstd_level=19",
+		"png": "zlib_level=1",
+	} {
+		if err := w.DefineCodecParams(codec, params); err != nil { t.Fatalf("%s: %v", codec, err) }
+	}
+	if err := w.DefineCodecParams("gif", "colors=1"); err == nil {
+		t.Fatalf("expected an error defining an invalid number of colors")
+	}
+
+	im := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := range im.Pix {
+		im.Pix[i] = uint8(i * 13)
+	}
+	w.SetImage(im)
+	for _, codec := range []string{"gif", "tiff", "zng", "png"} {
+		var buf bytes.Buffer
+		if err := w.EncodeImage(&buf, codec); err != nil { t.Fatalf("%s: %v", codec, err) }
+		m, err := Decode(&buf, nil)
+		if err != nil { t.Fatalf("%s: %v", codec, err) }
+		if p, ok := m.(*image.Paletted); codec == "gif" && (!ok || len(p.Palette) > 2) {
+			t.Fatalf("expected a GIF with at most 2 colors, got %T", m)
+		}
+	}
+
+	w2 := w.Clone()
+	if !reflect.DeepEqual(w2.codecParams, w.codecParams) {
+		t.Fatalf("expected codec parameters to be cloned")
+	}
+}
+
+// TestDecodeImageConfig tests that reading only the image header gives
+// the same properties as decoding the image.
+func TestDecodeImageConfig(t *testing.T) {
+	im := image.NewGray16(image.Rect(0, 0, 7, 5))
+	for _, codec := range []string{"png", "jpeg", "tiff", "webp"} {
+		w := NewWand()
+		w.SetImage(im)
+		w.AddComment("a comment")
+		w.SetDensity(300, 300, DensityUnitInch)
+		w.Metadata().XMP = []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`)
+
+		var buf bytes.Buffer
+		if err := w.EncodeImage(&buf, codec); err != nil { t.Fatal(err) }
+
+		full, header := NewWand(), NewWand()
+		if err := full.DecodeImage(bytes.NewReader(buf.Bytes())); err != nil { t.Fatal(err) }
+		if err := header.DecodeImageConfig(bytes.NewReader(buf.Bytes())); err != nil { t.Fatalf("%s: %v", codec, err) }
+
+		if header.FrameCount() != 0 {
+			t.Errorf("%s: expected no frames, got %d", codec, header.FrameCount())
+		}
+		if header.Format() != codec || full.Format() != codec {
+			t.Errorf("%s: got formats %q and %q", codec, header.Format(), full.Format())
+		}
+		if header.ColorModel() != full.ColorModel() {
+			t.Errorf("%s: color model differs from the decoded image", codec)
+		}
+
+		format := "%wx%h %c %[density] %[xmp]"
+		if got, want := header.FormatString(format), full.FormatString(format); got != want {
+			t.Errorf("%s: got %q, want %q", codec, got, want)
+		}
+	}
+
+	if FormatStringNeedsPixels("%wx%h %[comment]") || !FormatStringNeedsPixels("%w %[hash]") {
+		t.Error("wrong result from FormatStringNeedsPixels")
+	}
+}
+
+// TestDecodeImageConfigFrames tests that DecodeImageConfig counts the
+// frames of multi-frame images when asked to.
+func TestDecodeImageConfigFrames(t *testing.T) {
+	pal := color.Palette{color.Black, color.White}
+	a := &Animation{Width: 6, Height: 4}
+	for i := 0; i < 3; i++ {
+		im := image.NewPaletted(a.Bounds(), pal)
+		im.Pix[i] = 1
+		a.Frames = append(a.Frames, &Frame{Image: im, Delay: 100 * time.Millisecond})
+	}
+
+	for _, codec := range []string{"gif", "png", "webp", "tiff", "jpeg"} {
+		w := NewWand()
+		w.SetFrames(a)
+		w.AddComment("a comment")
+		var buf bytes.Buffer
+		if err := w.EncodeImage(&buf, codec); err != nil { t.Fatal(err) }
+
+		full := NewWand()
+		if err := full.DecodeImage(bytes.NewReader(buf.Bytes())); err != nil { t.Fatal(err) }
+
+		for _, metadata := range []bool{false, true} {
+			header := NewWand()
+			header.SetReadMetadata(metadata)
+			header.SetCountFrames(true)
+			if err := header.DecodeImageConfig(bytes.NewReader(buf.Bytes())); err != nil { t.Fatalf("%s: %v", codec, err) }
+
+			format := "%wx%h %n"
+			if got, want := header.FormatString(format), full.FormatString(format); got != want {
+				t.Errorf("%s: got %q, want %q", codec, got, want)
+			}
+		}
+	}
+
+	if !FormatStringNeedsFrameCount("%w %[frames]") || FormatStringNeedsFrameCount("%w %h") {
+		t.Error("wrong result from FormatStringNeedsFrameCount")
+	}
+}
+
+// countingReader counts the bytes read from a reader.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += n
+	return
+}
+
+// TestDecodeImageConfigStops tests that DecodeImageConfig stops reading
+// before the image data.
+func TestDecodeImageConfigStops(t *testing.T) {
+	im := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Read(im.Pix)
+	for i := 3; i < len(im.Pix); i += 4 {
+		im.Pix[i] = 0xff
+	}
+
+	for _, codec := range []string{"png", "jpeg", "webp"} {
+		w := NewWand()
+		w.SetImage(im)
+		w.AddComment("a comment")
+
+		var buf bytes.Buffer
+		if err := w.EncodeImage(&buf, codec); err != nil { t.Fatal(err) }
+
+		for _, metadata := range []bool{false, true} {
+			// PNG and WebP images can have metadata after the image data,
+			// so it has to be skipped over.
+			if metadata && codec != "jpeg" { continue }
+
+			w := NewWand()
+			w.SetReadMetadata(metadata)
+			r := &countingReader{r: bytes.NewReader(buf.Bytes())}
+			if err := w.DecodeImageConfig(r); err != nil { t.Fatalf("%s %v: %v", codec, metadata, err) }
+			if r.n > buf.Len() / 2 {
+				t.Errorf("%s: read %d of %d bytes", codec, r.n, buf.Len())
+			}
+			if got, want := w.FormatString("%c"), map[bool]string{true: "a comment"}[metadata]; got != want {
+				t.Errorf("%s: got comment %q, want %q", codec, got, want)
+			}
+		}
+	}
+}
+
+// TestProperties tests the image properties available to format strings,
+// and that the JSON property contains them.
+func TestProperties(t *testing.T) {
+	im := image.NewNRGBA64(image.Rect(0, 0, 6, 4))
+	w := NewWand()
+	w.SetImage(im)
+	w.AddComment("say \"hi\"\n<b>&</b>")
+	w.Metadata().Text.AddString("Author", "Ronsor")
+
+	path := filepath.Join(t.TempDir(), "test.png")
+	if err := w.WriteImage(path); err != nil { t.Fatal(err) }
+	fi, err := os.Stat(path)
+	if err != nil { t.Fatal(err) }
+
+	w = NewWand()
+	if err := w.ReadImage(path); err != nil { t.Fatal(err) }
+
+	tests := map[string]string{
+		"%m": "png",
+		"%f": path,
+		"%b": strconv.FormatInt(fi.Size(), 10),
+		"%n": "1",
+		"%z": "16",
+		"%[colorspace]": "sRGB",
+		"%[type]": "TrueColorAlpha",
+		"%A": "true",
+		"%[text:Author]": "Ronsor",
+		"%[text:Missing]": "",
+	}
+	for format, want := range tests {
+		if got := w.FormatString(format); got != want {
+			t.Errorf("%s: expected %q, got %q", format, want, got)
+		}
+	}
+
+	var props map[string]any
+	if err := json.Unmarshal([]byte(w.FormatString("%J")), &props); err != nil { t.Fatal(err) }
+	want := map[string]any{
+		"filename": path,
+		"size": float64(fi.Size()),
+		"format": "png",
+		"width": float64(6),
+		"height": float64(4),
+		"frames": float64(1),
+		"depth": float64(16),
+		"colorspace": "sRGB",
+		"type": "TrueColorAlpha",
+		"has-alpha": true,
+		"hash": float64(0),
+		"comments": []any{"say \"hi\"\n<b>&</b>"},
+		"text": map[string]any{"Author": "Ronsor"},
+	}
+	if !reflect.DeepEqual(props, want) {
+		t.Errorf("expected JSON %v, got %v", want, props)
+	}
+}
+
+// TestHasAlpha tests that only images with pixels that are not fully
+// opaque are reported as having alpha.
+func TestHasAlpha(t *testing.T) {
+	for alpha, want := range map[uint8]string{0xff: "false TrueColor", 0x80: "true TrueColorAlpha"} {
+		im := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+		for i := 3; i < len(im.Pix); i += 4 {
+			im.Pix[i] = alpha
+		}
+
+		for _, codec := range []string{"webp", "qoi", "png", "tiff"} {
+			w := NewWand()
+			w.SetImage(im)
+			var buf bytes.Buffer
+			if err := w.EncodeImage(&buf, codec); err != nil { t.Fatal(err) }
+
+			w = NewWand()
+			if err := w.DecodeImage(bytes.NewReader(buf.Bytes())); err != nil { t.Fatal(err) }
+			if got := w.FormatString("%A %[type]"); got != want {
+				t.Errorf("%s with alpha %#x: got %q, want %q", codec, alpha, got, want)
+			}
+		}
+	}
+
+	if !FormatStringNeedsPixels("%A") {
+		t.Error("expected alpha to need the pixels")
+	}
+}
+
+// TestModelInfo tests the depth, colorspace and type of color models.
+func TestModelInfo(t *testing.T) {
+	gray16 := color.ModelFunc(func(c color.Color) color.Color { return color.Gray16Model.Convert(c) })
+	tests := []struct {
+		model color.Model
+		depth int
+		colorspace, typ string
+	}{
+		{color.GrayModel, 8, "Gray", "Grayscale"},
+		{color.RGBAModel, 8, "sRGB", "TrueColorAlpha"},
+		{color.YCbCrModel, 8, "sRGB", "TrueColor"},
+		{color.NRGBA64Model, 16, "sRGB", "TrueColorAlpha"},
+		{color.CMYKModel, 8, "CMYK", "ColorSeparation"},
+		{color.Palette{color.Black, color.White}, 8, "Gray", "Palette"},
+		{color.Palette{color.Black, color.Transparent, color.RGBA{R: 255, A: 255}}, 8, "sRGB", "PaletteAlpha"},
+		{gray16, 16, "Gray", "Grayscale"},
+	}
+	for i, tt := range tests {
+		info := modelInfo(tt.model)
+		if info.Depth != tt.depth || info.Colorspace(tt.model) != tt.colorspace || info.Type(tt.model) != tt.typ {
+			t.Errorf("%d: expected %d %s %s, got %d %s %s", i, tt.depth, tt.colorspace, tt.typ,
+				info.Depth, info.Colorspace(tt.model), info.Type(tt.model))
+		}
+	}
+}
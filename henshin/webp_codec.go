@@ -5,15 +5,18 @@ package henshin
 import (
 	"image"
 	"io"
+	"math"
+	"time"
 
-	"golang.org/x/image/webp"
+	"github.com/ronsor/majokko/format/webp"
 )
 
 func init() {
 	RegisterCodec(&WEBPCodec{})
 }
 
-// WEBPCodec is the WEBP codec.
+// WEBPCodec is the WEBP codec, including animation support. Images are
+// always encoded losslessly.
 type WEBPCodec struct{}
 
 // New returns a new instance of WEBPCodec.
@@ -28,16 +31,192 @@ func (c *WEBPCodec) Magic() []string {
 }
 
 // Decode decodes a WEBP image according to the options specified.
-func (c *WEBPCodec) Decode(r io.Reader, d *DecodeOptions) (image.Image, error) {
-	return webp.Decode(r)
+func (c *WEBPCodec) Decode(r io.Reader, o *DecodeOptions) (image.Image, error) {
+	a, err := c.DecodeFrames(r, o)
+	if err != nil { return nil, err }
+
+	return a.First(), nil
+}
+
+// webpDecodeOptions returns the options to pass to the WEBP decoder in
+// order to read metadata according to the options specified.
+func webpDecodeOptions(o *DecodeOptions) *webp.DecodeOptions {
+	webpOpt := &webp.DecodeOptions{}
+	if o.Metadata != nil {
+		webpOpt.Metadata = &webp.Metadata{}
+	}
+	return webpOpt
+}
+
+// webpDecodedMetadata copies the metadata read by the WEBP decoder.
+func webpDecodedMetadata(o *DecodeOptions, webpOpt *webp.DecodeOptions) error {
+	md := webpOpt.Metadata
+	if md == nil { return nil }
+
+	o.Metadata.ICCProfile = md.ICCProfile
+	if md.EXIF != nil {
+		exif, err := ParseExif(md.EXIF)
+		if err != nil && o.Strict { return err }
+		o.Metadata.EXIF = exif
+	}
+	if md.XMP != nil {
+		o.Metadata.XMP = md.XMP
+	}
+	return nil
+}
+
+// DecodeFrames decodes every frame of a WEBP image according to the
+// options specified.
+func (c *WEBPCodec) DecodeFrames(r io.Reader, o *DecodeOptions) (*Animation, error) {
+	if o == nil { o = DefaultDecodeOptions() }
+
+	webpOpt := webpDecodeOptions(o)
+	wa, err := webp.DecodeAllWithOptions(r, webpOpt)
+	if err != nil { return nil, err }
+
+	if err := webpDecodedMetadata(o, webpOpt); err != nil { return nil, err }
+
+	a := &Animation{
+		Frames: make([]*Frame, len(wa.Frames)),
+		Width: wa.Width,
+		Height: wa.Height,
+		LoopCount: wa.LoopCount,
+	}
+
+	for i, wf := range wa.Frames {
+		f := &Frame{
+			Image: wf.Image,
+			Delay: time.Duration(wf.Duration) * time.Millisecond,
+		}
+
+		if wf.Dispose {
+			f.Disposal = DisposeBackground
+		}
+
+		if !wf.Blend {
+			f.Blend = BlendSource
+		}
+
+		a.Frames[i] = f
+	}
+
+	return a, nil
 }
 
 // DecodeConfig returns the color model and dimensions of a WEBP image
-// without decoding the image.
-func (c *WEBPCodec) DecodeConfig(r io.Reader, d *DecodeOptions) (image.Config, error) {
-	return webp.DecodeConfig(r)
+// without decoding the image, reading metadata according to the options
+// specified.
+func (c *WEBPCodec) DecodeConfig(r io.Reader, o *DecodeOptions) (image.Config, error) {
+	if o == nil { o = DefaultDecodeOptions() }
+
+	webpOpt := webpDecodeOptions(o)
+	cfg, err := webp.DecodeConfigWithOptions(r, webpOpt)
+	if err != nil { return image.Config{}, err }
+
+	if err := webpDecodedMetadata(o, webpOpt); err != nil { return image.Config{}, err }
+	return cfg, nil
+}
+
+// DecodeFrameCount returns the color model and dimensions of a WEBP image
+// and its number of frames without decoding them, reading metadata
+// according to the options specified.
+func (c *WEBPCodec) DecodeFrameCount(r io.Reader, o *DecodeOptions) (image.Config, int, error) {
+	if o == nil { o = DefaultDecodeOptions() }
+
+	webpOpt := webpDecodeOptions(o)
+	cfg, n, err := webp.DecodeFrameCount(r, webpOpt)
+	if err != nil { return image.Config{}, 0, err }
+
+	if err := webpDecodedMetadata(o, webpOpt); err != nil { return image.Config{}, 0, err }
+	return cfg, n, nil
+}
+
+// webpEncoder returns a WEBP encoder and its options according to the
+// options specified. The compression level selects the encoder effort,
+// where higher levels produce smaller files more slowly.
+func (c *WEBPCodec) webpEncoder(o *EncodeOptions) (*webp.Encoder, *webp.EncodeOptions, error) {
+	enc := &webp.Encoder{}
+	if o.CompressionLevel == 0 {
+		enc.Effort = webp.MinEffort
+	} else if o.CompressionLevel > 0 {
+		enc.Effort = webp.MinEffort + o.CompressionLevel * (webp.MaxEffort - webp.MinEffort) / 100
+	}
+
+	webpOpt := &webp.EncodeOptions{}
+	if o.Metadata != nil {
+		webpOpt.Metadata = &webp.Metadata{
+			ICCProfile: o.Metadata.ICCProfile,
+			XMP: o.Metadata.XMP,
+		}
+
+		if o.Metadata.EXIF != nil && !o.Metadata.EXIF.IsEmpty() {
+			exif, err := o.Metadata.EXIF.Bytes()
+			if err != nil { return nil, nil, err }
+			webpOpt.Metadata.EXIF = exif
+		}
+	}
+
+	return enc, webpOpt, nil
+}
+
+// Encode encodes a WEBP image according to the options specified.
+func (c *WEBPCodec) Encode(w io.Writer, i image.Image, o *EncodeOptions) error {
+	if o == nil { o = DefaultEncodeOptions() }
+
+	enc, webpOpt, err := c.webpEncoder(o)
+	if err != nil { return err }
+
+	return enc.EncodeWithOptions(w, i, webpOpt)
+}
+
+// EncodeFrames encodes every frame of an animated WEBP image according
+// to the options specified.
+func (c *WEBPCodec) EncodeFrames(w io.Writer, a *Animation, o *EncodeOptions) error {
+	if len(a.Frames) == 1 {
+		return c.Encode(w, a.First(), o)
+	}
+
+	if o == nil { o = DefaultEncodeOptions() }
+
+	// WEBP frames must be placed at even offsets, and can't be disposed
+	// of by restoring the previous frame.
+	for _, f := range a.Frames {
+		min := f.Image.Bounds().Min
+		if min.X % 2 != 0 || min.Y % 2 != 0 || f.Disposal == DisposePrevious {
+			a = a.coalesced()
+			break
+		}
+	}
+
+	wa := &webp.Animation{
+		Frames: make([]*webp.Frame, len(a.Frames)),
+		Width: a.Width,
+		Height: a.Height,
+		LoopCount: a.LoopCount,
+	}
+	if wa.LoopCount > math.MaxUint16 { wa.LoopCount = math.MaxUint16 }
+
+	for i, f := range a.Frames {
+		ms := f.Delay.Milliseconds()
+		if ms >= 1 << 24 { ms = 1 << 24 - 1 }
+
+		wa.Frames[i] = &webp.Frame{
+			Image: f.Image,
+			Duration: int(ms),
+			Dispose: f.Disposal == DisposeBackground,
+			Blend: f.Blend == BlendOver,
+		}
+	}
+
+	enc, webpOpt, err := c.webpEncoder(o)
+	if err != nil { return err }
+
+	return enc.EncodeAllWithOptions(w, wa, webpOpt)
 }
 
 var (
 	_ Decoder = &WEBPCodec{}
+	_ DecoderWithFrames = &WEBPCodec{}
+	_ Encoder = &WEBPCodec{}
+	_ EncoderWithFrames = &WEBPCodec{}
 )
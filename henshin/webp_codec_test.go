@@ -0,0 +1,77 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"time"
+
+	"testing"
+)
+
+// TestAnimatedWEBPRoundTrip tests that the frames and metadata of an
+// animated WEBP image survive decoding and encoding.
+func TestAnimatedWEBPRoundTrip(t *testing.T) {
+	a := &Animation{Width: 10, Height: 10, LoopCount: 2}
+	for i := 0; i < 3; i++ {
+		// Odd offsets require the frames to be coalesced.
+		im := image.NewNRGBA(image.Rect(i, i, i + 5, i + 5))
+		for j := range im.Pix { im.Pix[j] = uint8(0x40 * (i + 1)) }
+		a.Frames = append(a.Frames, &Frame{Image: im, Delay: time.Duration(i + 1) * 50 * time.Millisecond})
+	}
+
+	md := &Metadata{ICCProfile: []byte("icc"), EXIF: NewExif()}
+	md.EXIF.Set(ExifIFD0, &ExifTag{ID: ExifTagMake, Type: ExifTypeASCII, Value: "Majokko"})
+	md.XMP = []byte("<x:xmpmeta xmlns:x='adobe:ns:meta/'/>")
+
+	var buf bytes.Buffer
+	if err := EncodeFrames("webp", &buf, a, &EncodeOptions{CompressionLevel: -1, Metadata: md}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewWand()
+	if err := w.DecodeImage(&buf); err != nil { t.Fatal(err) }
+
+	if w.FrameCount() != 3 {
+		t.Fatalf("expected 3 frames, got %d", w.FrameCount())
+	}
+	if w.Width() != 10 || w.Height() != 10 {
+		t.Fatalf("expected 10x10 canvas, got %dx%d", w.Width(), w.Height())
+	}
+	if w.Frames().LoopCount != 2 {
+		t.Fatalf("expected loop count 2, got %d", w.Frames().LoopCount)
+	}
+
+	want := a.coalesced()
+	got := w.Frames().coalesced()
+	for i, f := range got.Frames {
+		if f.Delay != a.Frames[i].Delay {
+			t.Fatalf("frame %d: expected delay %v, got %v", i, a.Frames[i].Delay, f.Delay)
+		}
+		for y := 0; y < 10; y++ {
+			for x := 0; x < 10; x++ {
+				c1 := color.NRGBAModel.Convert(want.Frames[i].Image.At(x, y))
+				c2 := color.NRGBAModel.Convert(f.Image.At(x, y))
+				if c1 != c2 {
+					t.Fatalf("frame %d: pixel (%d, %d): expected %v, got %v", i, x, y, c1, c2)
+				}
+			}
+		}
+	}
+
+	gotMd := w.Metadata()
+	if !bytes.Equal(gotMd.ICCProfile, md.ICCProfile) {
+		t.Fatalf("expected ICC profile %q, got %q", md.ICCProfile, gotMd.ICCProfile)
+	}
+	if gotMd.EXIF == nil {
+		t.Fatal("expected EXIF data")
+	}
+	if tag, _ := gotMd.EXIF.Get(ExifIFD0, ExifTagMake); tag == nil || tag.String() != "Majokko" {
+		t.Fatalf("expected EXIF make %q, got %v", "Majokko", tag)
+	}
+	if !bytes.Equal(gotMd.XMP, md.XMP) {
+		t.Fatalf("expected XMP %q, got %q", md.XMP, gotMd.XMP)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// XML namespaces used by XMP packets.
+const (
+	xmpNamespaceRDF = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmpNamespaceXML = "http://www.w3.org/XML/1998/namespace"
+)
+
+// ParseXMP parses the properties of an XMP packet into a map. Keys are
+// qualified with the namespace prefix declared in the packet, such as
+// "dc:title". Fields of structures are named after the structure and
+// the field, separated by a slash, as in "xmpMM:DerivedFrom/stRef:documentID".
+//
+// Language alternatives are reduced to their default value, and the
+// items of other arrays are joined with "; ".
+func ParseXMP(packet []byte) (map[string]string, error) {
+	p := &xmpParser{
+		d: xml.NewDecoder(bytes.NewReader(packet)),
+		prefixes: map[string]string{},
+		props: map[string]string{},
+	}
+	if err := p.parse(); err != nil { return nil, err }
+	return p.props, nil
+}
+
+// xmpParser reads the properties of an XMP packet.
+type xmpParser struct {
+	d *xml.Decoder
+	// prefixes maps namespaces to the prefixes declared for them.
+	prefixes map[string]string
+	props map[string]string
+}
+
+// declare records the namespace prefixes declared by an element.
+func (p *xmpParser) declare(se xml.StartElement) {
+	for _, a := range se.Attr {
+		if a.Name.Space == "xmlns" {
+			p.prefixes[a.Value] = a.Name.Local
+		}
+	}
+}
+
+// name returns the qualified name of an element or attribute.
+func (p *xmpParser) name(n xml.Name) string {
+	if prefix, ok := p.prefixes[n.Space]; ok { return prefix + ":" + n.Local }
+	return n.Local
+}
+
+// isRDF reports whether n is the RDF element or attribute named local.
+func isRDF(n xml.Name, local string) bool {
+	return n.Space == xmpNamespaceRDF && n.Local == local
+}
+
+// parse reads every rdf:Description element in the packet.
+func (p *xmpParser) parse() error {
+	for {
+		tok, err := p.d.Token()
+		if err == io.EOF { return nil }
+		if err != nil { return err }
+
+		if se, ok := tok.(xml.StartElement); ok {
+			p.declare(se)
+			if isRDF(se.Name, "Description") {
+				if err := p.description(se, ""); err != nil { return err }
+			}
+		}
+	}
+}
+
+// attributes records the properties written as attributes of se.
+func (p *xmpParser) attributes(se xml.StartElement, prefix string) {
+	for _, a := range se.Attr {
+		switch a.Name.Space {
+			case "xmlns", xmpNamespaceRDF, xmpNamespaceXML, "xml": continue
+			case "": if a.Name.Local == "xmlns" { continue }
+		}
+		p.props[prefix + p.name(a.Name)] = a.Value
+	}
+}
+
+// description reads the properties of an rdf:Description element, whose
+// start element has already been read.
+func (p *xmpParser) description(se xml.StartElement, prefix string) error {
+	p.attributes(se, prefix)
+	for {
+		tok, err := p.d.Token()
+		if err != nil { return err }
+
+		switch t := tok.(type) {
+			case xml.StartElement:
+				p.declare(t)
+				if err := p.property(t, prefix + p.name(t.Name)); err != nil { return err }
+			case xml.EndElement:
+				return nil
+		}
+	}
+}
+
+// property reads the value of the property element se, named key.
+func (p *xmpParser) property(se xml.StartElement, key string) error {
+	isStruct := false
+	for _, a := range se.Attr {
+		switch {
+			case isRDF(a.Name, "parseType") && a.Value == "Resource": isStruct = true
+			case isRDF(a.Name, "resource"): p.props[key] = a.Value
+		}
+	}
+	p.attributes(se, key + "/")
+
+	var text []byte
+	hasChildren := false
+	for {
+		tok, err := p.d.Token()
+		if err != nil { return err }
+
+		switch t := tok.(type) {
+			case xml.CharData:
+				text = append(text, t...)
+			case xml.StartElement:
+				p.declare(t)
+				hasChildren = true
+
+				var err error
+				switch {
+					case isRDF(t.Name, "Alt"), isRDF(t.Name, "Seq"), isRDF(t.Name, "Bag"):
+						var items []string
+						items, err = p.container()
+						if len(items) > 0 && isRDF(t.Name, "Alt") { items = items[:1] }
+						if len(items) > 0 { p.props[key] = strings.Join(items, "; ") }
+					case isRDF(t.Name, "Description"):
+						err = p.description(t, key + "/")
+					case isStruct:
+						err = p.property(t, key + "/" + p.name(t.Name))
+					default:
+						err = p.d.Skip()
+				}
+				if err != nil { return err }
+			case xml.EndElement:
+				if !hasChildren && !isStruct && len(text) > 0 {
+					p.props[key] = string(text)
+				}
+				return nil
+		}
+	}
+}
+
+// container reads the items of an rdf:Alt, rdf:Seq or rdf:Bag element.
+// An item with the language "x-default" is moved to the front.
+func (p *xmpParser) container() (items []string, err error) {
+	for {
+		tok, err := p.d.Token()
+		if err != nil { return nil, err }
+
+		switch t := tok.(type) {
+			case xml.StartElement:
+				p.declare(t)
+				if !isRDF(t.Name, "li") {
+					if err := p.d.Skip(); err != nil { return nil, err }
+					continue
+				}
+
+				isDefault := false
+				for _, a := range t.Attr {
+					if a.Name.Local == "lang" && a.Value == "x-default" { isDefault = true }
+				}
+
+				text, err := p.text()
+				if err != nil { return nil, err }
+				if isDefault {
+					items = append([]string{text}, items...)
+				} else {
+					items = append(items, text)
+				}
+			case xml.EndElement:
+				return items, nil
+		}
+	}
+}
+
+// text returns the character data of the current element, ignoring any
+// child elements.
+func (p *xmpParser) text() (string, error) {
+	var text []byte
+	for depth := 1; depth > 0; {
+		tok, err := p.d.Token()
+		if err != nil { return "", err }
+
+		switch t := tok.(type) {
+			case xml.CharData:
+				if depth == 1 { text = append(text, t...) }
+			case xml.StartElement:
+				depth++
+			case xml.EndElement:
+				depth--
+		}
+	}
+	return string(text), nil
+}
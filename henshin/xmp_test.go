@@ -0,0 +1,92 @@
+// Copyright 2023 Ronsor Labs. All rights reserved.
+
+package henshin
+
+import (
+	"bytes"
+	"image"
+
+	"testing"
+)
+
+const testXMPPacket = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:xmpMM="http://ns.adobe.com/xap/1.0/mm/"
+    xmlns:stRef="http://ns.adobe.com/xap/1.0/sType/ResourceRef#"
+    xmp:CreatorTool="majokko">
+   <dc:title>
+    <rdf:Alt>
+     <rdf:li xml:lang="fr">Titre</rdf:li>
+     <rdf:li xml:lang="x-default">Title</rdf:li>
+    </rdf:Alt>
+   </dc:title>
+   <dc:subject>
+    <rdf:Bag>
+     <rdf:li>cats</rdf:li>
+     <rdf:li>dogs</rdf:li>
+    </rdf:Bag>
+   </dc:subject>
+   <xmp:Rating>4</xmp:Rating>
+   <xmpMM:DerivedFrom rdf:parseType="Resource">
+    <stRef:documentID>doc-1</stRef:documentID>
+   </xmpMM:DerivedFrom>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+// TestParseXMP tests the parsing of XMP properties.
+func TestParseXMP(t *testing.T) {
+	props, err := ParseXMP([]byte(testXMPPacket))
+	if err != nil { t.Fatal(err) }
+
+	expected := map[string]string{
+		"xmp:CreatorTool": "majokko",
+		"dc:title": "Title",
+		"dc:subject": "cats; dogs",
+		"xmp:Rating": "4",
+		"xmpMM:DerivedFrom/stRef:documentID": "doc-1",
+	}
+	for k, v := range expected {
+		if props[k] != v {
+			t.Errorf("expected %s = %q, got %q", k, v, props[k])
+		}
+	}
+	if len(props) != len(expected) {
+		t.Errorf("expected %d properties, got %v", len(expected), props)
+	}
+
+	if _, err := ParseXMP([]byte("<x:xmpmeta>")); err == nil {
+		t.Error("expected an error for a truncated packet")
+	}
+}
+
+// TestXMPCodecs tests that XMP packets survive encoding and decoding in
+// each codec that supports them.
+func TestXMPCodecs(t *testing.T) {
+	for _, codec := range []string{"png", "jpeg", "webp", "tiff"} {
+		w := NewWand()
+		w.SetImage(image.NewNRGBA(image.Rect(0, 0, 8, 8)))
+		w.Metadata().XMP = []byte(testXMPPacket)
+
+		var buf bytes.Buffer
+		if err := w.EncodeImage(&buf, codec); err != nil { t.Fatalf("%s: %v", codec, err) }
+
+		w2 := NewWand()
+		if err := w2.DecodeImage(&buf); err != nil { t.Fatalf("%s: %v", codec, err) }
+
+		if xmp := w2.Metadata().XMP; !bytes.Equal(xmp, []byte(testXMPPacket)) {
+			t.Fatalf("%s: expected XMP %q, got %q", codec, testXMPPacket, xmp)
+		}
+		if title := w2.FormatString("%[xmp:dc:title]"); title != "Title" {
+			t.Fatalf("%s: expected title %q, got %q", codec, "Title", title)
+		}
+		if len(w2.Metadata().Text) != 0 {
+			t.Fatalf("%s: expected no text entries, got %v", codec, w2.Metadata().Text)
+		}
+	}
+}
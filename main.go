@@ -4,6 +4,7 @@ package main
 
 import (
 	"fmt"
+	"image/color"
 	"os"
 	"path/filepath"
 	"strings"
@@ -23,9 +24,13 @@ var (
 	doListFormats = false
 	maxWorkers int = 1
 	noOutputFileNames = false
+	enableExternalCodecs = false
+	codecConfigFile = ""
 
 	identifyFormatString = "%wx%h, hash: %H, comment: %c"
 
+	codecDefines []string
+
 	filterArgs FilterArgs
 
 	groupParamOpen, groupParamClose *int
@@ -34,11 +39,24 @@ var (
 // FilterArgs is a set of filtering arguments.
 // They are listed in the order they will be applied.
 type FilterArgs struct {
+	AutoOrient bool
+	ToSRGB bool
 	Strip bool
 	AddComments []string
 	SetComments []string
+	Density string
+	Gravity string
+	Background string
+	Filter string
+	Linear bool
 	Crop string
 	Resize string
+	Extent string
+	Rotate float64
+	Flip bool
+	Flop bool
+	Colors int
+	Dither string
 	CompressionLevel int
 }
 
@@ -50,8 +68,11 @@ func init() {
 	getopt.FlagLong(&doListFormats, "list-formats", 0, "List supported image formats").SetGroup("action")
 	getopt.FlagLong(&maxWorkers, "workers", 'W', "Maximum concurrent workers")
 	getopt.FlagLong(&noOutputFileNames, "no-names", 'N', "Don't include file names in output messages")
+	getopt.FlagLong(&enableExternalCodecs, "enable-external-codecs", 0, "Enable codecs that use external programs (e.g. JPEG XL)")
+	getopt.FlagLong(&codecConfigFile, "codec-config", 0, "Load external codecs from a configuration file")
 
 	getopt.FlagLong(&identifyFormatString, "identify-format", 0, "Format string for --identify output")
+	getopt.FlagLong(&codecDefines, "define", 'D', "Set codec parameter (e.g. jpeg:progressive or png:zlib_level=9)")
 
 	groupParamOpen = getopt.CounterLong("group", '(', "Open filter parameter group")
 	groupParamClose = getopt.CounterLong("end-group", ')', "Close filter parameter group")
@@ -62,11 +83,24 @@ func init() {
 }
 
 func initFilterArgs(filterArgs *FilterArgs, optSet *getopt.Set) {
+	optSet.FlagLong(&filterArgs.AutoOrient, "auto-orient", 0, "Rotate image according to its EXIF orientation")
+	optSet.FlagLong(&filterArgs.ToSRGB, "to-srgb", 0, "Convert image to sRGB using its ICC profile")
 	optSet.FlagLong(&filterArgs.Strip, "strip", 'S', "Strip metadata from image")
 	optSet.FlagLong(&filterArgs.AddComments, "comment", 'C', "Add comment to image metadata")
 	optSet.FlagLong(&filterArgs.SetComments, "set-comment", 0, "Set comments for image metadata")
+	optSet.FlagLong(&filterArgs.Density, "density", 0, "Set pixel density in pixels per inch (e.g. 300 or 300x200)")
+	optSet.FlagLong(&filterArgs.Gravity, "gravity", 0, "Anchor for crop and extent (e.g. Center, NorthWest)")
+	optSet.FlagLong(&filterArgs.Background, "background", 0, "Background color for rotate and extent")
+	optSet.FlagLong(&filterArgs.Filter, "filter", 0, "Resize filter ("+strings.Join(henshin.ResizeStrategyNames(), ", ")+")")
+	optSet.FlagLong(&filterArgs.Linear, "linear", 0, "Resize and rotate in linear light")
 	optSet.FlagLong(&filterArgs.Crop, "crop", 'c', "Crop image")
 	optSet.FlagLong(&filterArgs.Resize, "resize", 'r', "Resize image")
+	optSet.FlagLong(&filterArgs.Extent, "extent", 0, "Set image size without scaling")
+	optSet.FlagLong(&filterArgs.Rotate, "rotate", 0, "Rotate image clockwise by degrees")
+	optSet.FlagLong(&filterArgs.Flip, "flip", 0, "Mirror image vertically")
+	optSet.FlagLong(&filterArgs.Flop, "flop", 0, "Mirror image horizontally")
+	optSet.FlagLong(&filterArgs.Colors, "colors", 0, "Reduce image to a palette of N colors (1-256)")
+	optSet.FlagLong(&filterArgs.Dither, "dither", 0, "Dithering method for --colors (none, floyd-steinberg, ordered)")
 	optSet.FlagLong(&filterArgs.CompressionLevel, "compress", 0, "Compression level, if applicable (0-100)")
 	filterArgs.CompressionLevel = -1 // Set to default
 }
@@ -116,6 +150,17 @@ func parseFilterArgs(args []string) (ret []*FilterArgs) {
 }
 
 func processFilterArgs(wand *henshin.Wand, fa *FilterArgs) {
+	if fa.AutoOrient {
+		wand.AutoOrient()
+	}
+
+	if fa.ToSRGB {
+		if err := wand.ConvertToSRGB(); err != nil {
+			fmt.Fprintf(os.Stderr, "ConvertToSRGB: %v\n", err)
+			hasError = true
+		}
+	}
+
 	if fa.Strip {
 		wand.Strip()
 	}
@@ -130,6 +175,53 @@ func processFilterArgs(wand *henshin.Wand, fa *FilterArgs) {
 		wand.SetComments(fa.SetComments)
 	}
 
+	if fa.Density != "" {
+		var x, y float64
+		n, _ := fmt.Sscanf(fa.Density, "%gx%g", &x, &y)
+		if n == 1 { y = x }
+		if n > 0 {
+			wand.SetDensity(x, y, henshin.DensityUnitInch)
+		} else {
+			fmt.Fprintf(os.Stderr, "Density %q: invalid density\n", fa.Density)
+			hasError = true
+		}
+	}
+
+	gravity := henshin.GravityNorthWest
+	if fa.Gravity != "" {
+		var err error
+		gravity, err = henshin.ParseGravity(fa.Gravity)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Gravity %q: %v\n", fa.Gravity, err)
+			hasError = true
+		}
+	}
+
+	var background color.Color
+	if fa.Background != "" {
+		var err error
+		background, err = henshin.ParseColor(fa.Background)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Background %q: %v\n", fa.Background, err)
+			hasError = true
+		}
+	}
+
+	var strategy henshin.ResizeStrategy = henshin.BiLinearStrategy
+	if fa.Filter != "" {
+		var err error
+		strategy, err = henshin.ResizeStrategyByName(fa.Filter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Filter %q: %v\n", fa.Filter, err)
+			strategy = henshin.BiLinearStrategy
+			hasError = true
+		}
+	}
+
+	if fa.Linear {
+		strategy = henshin.LinearLight(strategy)
+	}
+
 	if fa.Crop != "" {
 		var (
 			w = -1
@@ -139,7 +231,7 @@ func processFilterArgs(wand *henshin.Wand, fa *FilterArgs) {
 		)
 		n, _ := fmt.Sscanf(fa.Crop, "%dx%d+%d+%d", &w, &h, &xoff, &yoff)
 		if n > 0 {
-			wand.Crop(w, h, xoff, yoff)
+			wand.CropAnchor(w, h, xoff, yoff, gravity)
 		}
 	}
 
@@ -172,7 +264,7 @@ func processFilterArgs(wand *henshin.Wand, fa *FilterArgs) {
 					goto SKIP
 				}
 
-				wand.ResizeArea(int(area), henshin.BiLinearStrategy)
+				wand.ResizeArea(int(area), strategy)
 			}
 		} else if resizeOpt[0] == 'x' {
 			var h int
@@ -189,7 +281,7 @@ func processFilterArgs(wand *henshin.Wand, fa *FilterArgs) {
 					goto SKIP
 				}
 
-				wand.Resize(-1, h, henshin.BiLinearStrategy)
+				wand.Resize(-1, h, strategy)
 			}
 		} else if resizeOpt[len(resizeOpt)-1] == 'x' {
 			var w int
@@ -206,7 +298,7 @@ func processFilterArgs(wand *henshin.Wand, fa *FilterArgs) {
 					goto SKIP
 				}
 
-				wand.Resize(w, -1, henshin.BiLinearStrategy)
+				wand.Resize(w, -1, strategy)
 			}			
 		} else {
 			var w, h int
@@ -227,29 +319,94 @@ func processFilterArgs(wand *henshin.Wand, fa *FilterArgs) {
 					goto SKIP
 				}
 
-				wand.Resize(w, h, henshin.BiLinearStrategy)
+				wand.Resize(w, h, strategy)
 			}
 		}
 
 		SKIP:
 	}
 
+	if fa.Extent != "" {
+		var w, h = -1, -1
+		n, _ := fmt.Sscanf(fa.Extent, "%dx%d", &w, &h)
+		if n > 0 {
+			wand.Extent(w, h, background, gravity)
+		}
+	}
+
+	if fa.Rotate != 0 {
+		wand.Rotate(fa.Rotate, background, strategy)
+	}
+
+	if fa.Flip {
+		wand.Flip()
+	}
+
+	if fa.Flop {
+		wand.Flop()
+	}
+
+	if fa.Colors > 0 {
+		dither := henshin.DitherFloydSteinberg
+		if fa.Dither != "" {
+			var err error
+			dither, err = henshin.ParseDither(fa.Dither)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Dither %q: %v\n", fa.Dither, err)
+				hasError = true
+			}
+		}
+		wand.Quantize(fa.Colors, dither)
+	}
+
 	if fa.CompressionLevel != -1 {
 		wand.SetCompressionLevel(fa.CompressionLevel)
 	}
 }
 
+// defineCodecParams applies the --define options to wand. The option
+// parser splits values at commas, so parameters without a codec belong
+// to the codec of the previous one, as in "jpeg:progressive,restart=8".
+func defineCodecParams(wand *henshin.Wand) error {
+	prevCodec := ""
+	for _, def := range codecDefines {
+		codec, param, ok := strings.Cut(def, ":")
+		if !ok || strings.ContainsRune(codec, '=') {
+			codec, param = prevCodec, def
+		}
+		if codec == "" {
+			return fmt.Errorf("define %q: expected codec:key=value", def)
+		}
+		prevCodec = codec
+		if err := wand.DefineCodecParams(codec, param); err != nil {
+			return fmt.Errorf("define %q: %v", def, err)
+		}
+	}
+	return nil
+}
+
 func actionIdentify(wand *henshin.Wand, logPrefix string, inFile string) {
 	fmt.Printf("%s%s\n", logPrefix, wand.FormatString(identifyFormatString))
 }
 
-func actionConvert(wand *henshin.Wand, logPrefix string, maxArg int, args []string, inFile string) {
+// outputFile returns the path inFile is converted to.
+func outputFile(maxArg int, args []string, inFile string) string {
 	outFile := args[maxArg]
 	if maxArg > 1 {
 		outFile = filepath.Join(outFile, filepath.Base(inFile))
 	}
+	return outFile
+}
+
+// isJPEGOutput reports whether outFile will be written as a JPEG image.
+func isJPEGOutput(outFile string) bool {
+	codecName, _, _ := henshin.ParseOutputPath(outFile)
+	codec, err := henshin.NewCodec(codecName)
+	return err == nil && codec.Name() == "jpeg"
+}
 
-	wand.ForceRGBA()
+func actionConvert(wand *henshin.Wand, logPrefix string, maxArg int, args []string, inFile string) {
+	outFile := outputFile(maxArg, args, inFile)
 
 	faGroups := parseFilterArgs(os.Args)
 	if faGroups == nil {
@@ -278,10 +435,29 @@ func actionVersion(full bool) {
 	fmt.Printf("\nFor more information, use the --list-formats option.\n")
 }
 
+// loadCodecConfig registers the external codecs in the file given by
+// --codec-config, or else in majokko/codecs.json in the user's
+// configuration directory, if it exists.
+func loadCodecConfig() error {
+	if codecConfigFile != "" { return henshin.RegisterExternalCodecFile(codecConfigFile) }
+
+	dir, err := os.UserConfigDir()
+	if err != nil { return nil }
+	path := filepath.Join(dir, "majokko", "codecs.json")
+	if _, err := os.Stat(path); err != nil { return nil }
+	return henshin.RegisterExternalCodecFile(path)
+}
+
 func main() {
 	getopt.Parse()
 	args := getopt.Args()
 
+	if enableExternalCodecs { henshin.RegisterExternalCodecs() }
+	if err := loadCodecConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
 	if doHelp {
 		actionVersion(false)
 		fmt.Println("")
@@ -323,9 +499,22 @@ func main() {
 		doConvert = !doIdentify
 	}
 
+	// Check the codec parameters once, rather than for every image.
+	if err := defineCodecParams(henshin.NewWand()); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
 	maxArg := len(args)
 	if doConvert { maxArg = maxArg - 1 }
 
+	// Images are not decoded when identifying them only needs the
+	// information in their headers, and their metadata is not read
+	// unless it is printed. Their frames are only counted if needed.
+	headerOnly := doIdentify && !henshin.FormatStringNeedsPixels(identifyFormatString)
+	skipMetadata := doIdentify && !henshin.FormatStringNeedsMetadata(identifyFormatString)
+	countFrames := headerOnly && henshin.FormatStringNeedsFrameCount(identifyFormatString)
+
 	var wg sync.WaitGroup
 
 	n := 0
@@ -342,7 +531,20 @@ func main() {
 			}
 
 			wand := henshin.NewWand()
-			err := wand.ReadImage(args[i])
+			defineCodecParams(wand)
+			wand.SetReadMetadata(!skipMetadata)
+			wand.SetCountFrames(countFrames)
+			// JPEG images that are only rotated, flipped, cropped or
+			// have their metadata changed are not recompressed.
+			if doConvert && isJPEGOutput(outputFile(maxArg, args, inFile)) {
+				wand.SetLosslessJPEG(true)
+			}
+			var err error
+			if headerOnly {
+				err = wand.ReadImageConfig(args[i])
+			} else {
+				err = wand.ReadImage(args[i])
+			}
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%sReadImage: %v\n", logPrefix, err)
 				hasError = true